@@ -1,43 +1,195 @@
 package api
 
 import (
+	"context"
+	"fmt"
+	"net/http"
 	"os"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
+	"github.com/luizbafilho/fusis/config"
 	"github.com/luizbafilho/fusis/fusis"
+	"github.com/luizbafilho/fusis/metrics"
 )
 
 // ApiService ...
 type ApiService struct {
 	balancer *fusis.Balancer
 	router   *gin.Engine
-	env      string
+	server   *http.Server
+	// socket serves the API in plain HTTP on the Unix socket, nil when
+	// there is none.
+	socket *http.Server
+	env    string
+	// events is the audit log of the API writes, nil when disabled.
+	events *eventLog
 }
 
 //NewAPI ...
-func NewAPI(balancer *fusis.Balancer) ApiService {
+// The handlers are wrapped with DefaultMiddleware then with middleware.
+func NewAPI(balancer *fusis.Balancer, middleware ...Middleware) ApiService {
 	gin.SetMode(gin.ReleaseMode)
 
-	return ApiService{
+	router := gin.New()
+	// Clients could set their IP with forwarding headers, which the rate
+	// limit must not trust
+	router.ForwardedByClientIP = false
+	use(router, DefaultMiddleware)
+	use(router, middleware)
+
+	var events *eventLog
+	if config.Balancer.AuditLogSize > 0 || config.Balancer.AuditLogPath != "" {
+		var err error
+		events, err = newEventLog(config.Balancer.AuditLogSize, config.Balancer.AuditLogPath, config.Balancer.AuditLogMaxSize)
+		if err != nil {
+			log.Fatalf("Opening the audit log failed: %v", err)
+		}
+		router.Use(events.audit)
+	}
+
+	as := ApiService{
 		balancer: balancer,
-		router:   gin.Default(),
+		router:   router,
+		server:   &http.Server{Addr: fmt.Sprintf("0.0.0.0:%d", config.Balancer.ApiPort), Handler: router},
 		env:      getEnv(),
+		events:   events,
 	}
+	if config.Balancer.ApiSocket != "" {
+		as.socket = &http.Server{Handler: router}
+	}
+	return as
 }
 
 func (as ApiService) Serve() {
-	as.router.GET("/services", as.serviceList)
-	as.router.GET("/services/:service_id", as.serviceGet)
-	as.router.POST("/services", as.serviceCreate)
-	as.router.DELETE("/services/:service_id", as.serviceDelete)
-
-	as.router.POST("/services/:service_id/destinations", as.destinationCreate)
-	as.router.DELETE("/services/:service_id/destinations/:destination_id", as.destinationDelete)
+	as.routes(as.router)
+	for v := MinAPIVersion; v <= APIVersion; v++ {
+		as.routes(as.router.Group(fmt.Sprintf("/v%d", v)))
+	}
 
 	if as.env == "test" {
 		as.router.POST("/flush", as.flush)
 	}
-	as.router.Run("0.0.0.0:8000")
+	if as.socket != nil {
+		ln, err := listenUnix(config.Balancer.ApiSocket, config.Balancer.ApiSocketMode)
+		if err != nil {
+			log.Fatalf("Listening on the API socket failed: %v", err)
+		}
+		// The socket is local, access is controlled by its permissions
+		// rather than TLS, so it has a server of its own
+		go func() {
+			if err := as.socket.Serve(ln); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	var err error
+	if config.Balancer.TLSCert == "" {
+		err = as.server.ListenAndServe()
+	} else {
+		as.server.TLSConfig, err = serverTLSConfig(config.Balancer.TLSClientCA)
+		if err != nil {
+			log.Fatalf("Loading API TLS configuration failed: %v", err)
+		}
+		err = as.server.ListenAndServeTLS(config.Balancer.TLSCert, config.Balancer.TLSKey)
+	}
+
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// routes registers the API handlers on r. They are served unprefixed, in the
+// version negotiated from the X-Fusis-API-Version header, and under a /v<N>
+// prefix for each version served.
+func (as ApiService) routes(r gin.IRoutes) {
+	r.GET("/services", as.serviceList)
+	r.GET("/services/:service_id", as.serviceGet)
+	r.GET("/services/:service_id/stats", as.serviceStats)
+	r.GET("/services/:service_id/persistence", as.servicePersistence)
+	r.POST("/services", as.leaderOnly, as.serviceCreate)
+	r.PUT("/services/:service_id", as.leaderOnly, as.serviceUpdate)
+	r.PATCH("/services/:service_id", as.leaderOnly, as.servicePatch)
+	r.DELETE("/services", as.leaderOnly, as.serviceFlush)
+	r.DELETE("/services/:service_id", as.leaderOnly, as.serviceDelete)
+	r.GET("/watch/services", as.serviceWatch)
+	r.POST("/batch/services", as.leaderOnly, as.serviceBatchCreate)
+	r.POST("/batch/destinations", as.leaderOnly, as.destinationBatchCreate)
+	r.POST("/batch", as.leaderOnly, as.batch)
+
+	r.GET("/services/:service_id/destinations", as.destinationList)
+	r.GET("/services/:service_id/destinations/:destination_id", as.destinationGet)
+	r.GET("/services/:service_id/destinations/:destination_id/stats", as.destinationStats)
+	r.GET("/services/:service_id/destinations/:destination_id/health", as.destinationHealth)
+	r.POST("/services/:service_id/destinations", as.leaderOnly, as.destinationCreate)
+	r.PUT("/services/:service_id/destinations/:destination_id", as.leaderOnly, as.destinationUpdate)
+	r.PUT("/services/:service_id/destinations/:destination_id/heartbeat", as.leaderOnly, as.destinationHeartbeat)
+	r.DELETE("/services/:service_id/destinations/:destination_id", as.leaderOnly, as.destinationDelete)
+
+	r.POST("/reconcile", as.reconcile)
+	r.GET("/dump", as.dump)
+	r.GET("/health", as.health)
+	r.GET("/health/destinations", as.destinationHealthList)
+	r.GET("/live", as.live)
+	r.GET("/ready", as.ready)
+	r.GET("/log-level", as.logLevelGet)
+	r.PUT("/log-level", as.logLevelSet)
+	r.GET("/metrics", gin.WrapH(metrics.Handler(as.balancer)))
+	r.GET("/cluster/leader", as.clusterLeader)
+	r.GET("/cluster/members", as.memberList)
+	r.DELETE("/cluster/members/:name", as.leaderOnly, as.memberRemove)
+	r.GET("/cluster/state", as.clusterState)
+	r.GET("/cluster/peers", as.peerList)
+	r.POST("/cluster/peers", as.leaderOnly, as.peerAdd)
+	r.DELETE("/cluster/peers/:peer", as.leaderOnly, as.peerRemove)
+	r.GET("/version", as.version)
+	r.GET("/events", as.eventList)
+	r.GET("/sync", as.syncList)
+	r.POST("/sync", as.syncStart)
+	r.DELETE("/sync/:state", as.syncStop)
+	r.GET("/config/timeouts", as.timeoutsGet)
+	r.PUT("/config/timeouts", as.timeoutsSet)
+	r.GET("/bgp", as.bgpState)
+	r.GET("/bgp/routes", as.bgpRoutes)
+}
+
+// Shutdown stops the API gracefully then the balancer. The balancer is first
+// reported not ready for the configured DrainDelay, or until ctx is done.
+// Then new connections are refused while the requests being served are given
+// until ctx is done to complete. The balancer then closes its local store and
+// leaves the cluster.
+func (as ApiService) Shutdown(ctx context.Context) error {
+	as.balancer.Drain()
+	if config.Balancer.DrainDelay > 0 {
+		timer := time.NewTimer(config.Balancer.DrainDelay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	err := as.server.Shutdown(ctx)
+	if as.socket != nil {
+		if socketErr := as.socket.Shutdown(ctx); err == nil {
+			err = socketErr
+		}
+	}
+	as.balancer.Shutdown()
+	return err
+}
+
+// leaderOnly rejects writes on nodes that aren't the raft leader, telling the
+// client where the leader is.
+func (as ApiService) leaderOnly(c *gin.Context) {
+	if as.balancer.IsLeader() {
+		c.Next()
+		return
+	}
+
+	c.JSON(StatusNotLeader, gin.H{"error": "not the cluster leader", "leader": as.balancer.LeaderApiAddr()})
+	c.Abort()
 }
 
 func getEnv() string {
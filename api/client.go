@@ -2,6 +2,9 @@ package api
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,132 +12,2057 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/luizbafilho/fusis/bgp"
+	"github.com/luizbafilho/fusis/engine"
+	"github.com/luizbafilho/fusis/health"
 	"github.com/luizbafilho/fusis/ipvs"
 )
 
+// Version is the fusis version this package belongs to. It can be set at
+// build time with -ldflags "-X github.com/luizbafilho/fusis/api.Version=...".
+var Version = "0.1.0-dev"
+
+// Commit is the git commit fusis was built from, set at build time like
+// Version.
+var Commit = ""
+
+// APIVersion is the latest version of the API the client speaks and the
+// server serves. MinAPIVersion is the oldest one the server still serves.
+const (
+	APIVersion    = 1
+	MinAPIVersion = 1
+)
+
+// RequestIDHeader carries the correlation ID of a request.
+const RequestIDHeader = "X-Request-Id"
+
+// NextCursorHeader carries the cursor of the page following the services
+// listed in a response.
+const NextCursorHeader = "X-Next-Cursor"
+
 type Client struct {
 	Addr       string
 	HttpClient *http.Client
+
+	// UserAgent is sent on every request. When empty it defaults to
+	// fusis-client/<Version>.
+	UserAgent string
+	// RequestID, when set, is called once per request and its result sent
+	// in the X-Request-Id header so requests can be traced in server logs.
+	RequestID func() string
+
+	// RetryPolicy, when set, makes GET and DELETE requests retry on
+	// connection errors and 5xx responses.
+	RetryPolicy *RetryPolicy
+
+	// Token, when set, is sent as a bearer token on every request.
+	Token string
+	// BasicAuth, when set and Token is empty, is sent as HTTP basic
+	// credentials on every request.
+	BasicAuth *BasicAuth
+
+	// Compression, when set, asks for gzipped responses. Servers without
+	// compression enabled answer uncompressed.
+	Compression bool
+	// RequestCompression, when set, gzips the request bodies. Unlike
+	// responses they can't be negotiated: the server must have compression
+	// enabled or it fails to decode them.
+	RequestCompression bool
+
+	// APIVersion pins the API version asked for in the X-Fusis-API-Version
+	// header. When zero it defaults to the latest one the client speaks.
+	APIVersion int
+
+	// DryRun, when set, makes the server validate the writes and answer as
+	// if they were applied, without changing anything.
+	DryRun bool
+
+	// FollowRedirects, when set, resends writes rejected by a node that
+	// isn't the cluster leader to the leader it points to, and keeps
+	// sending writes there.
+	FollowRedirects bool
+	leader          *leaderCache
+
+	// limiter bounds the requests in flight, see
+	// ClientOptions.MaxConcurrentRequests.
+	limiter limiter
+}
+
+// StatusNotLeader is answered to writes sent to a node that isn't the
+// cluster leader. The body carries the leader API address.
+const StatusNotLeader = http.StatusMisdirectedRequest
+
+// ErrNotLeader is returned when a write reached a node that isn't the cluster
+// leader. Leader is the leader API address, empty during an election.
+type ErrNotLeader struct {
+	Leader string
+}
+
+func (e *ErrNotLeader) Error() string {
+	if e.Leader == "" {
+		return "not the cluster leader, no leader elected"
+	}
+	return fmt.Sprintf("not the cluster leader, leader is %s", e.Leader)
+}
+
+// ErrRateLimited is returned when the server rejected a request because the
+// client sent too many. RetryAfter is how long the server asked to wait.
+type ErrRateLimited struct {
+	RetryAfter time.Duration
+}
+
+func (e *ErrRateLimited) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.RetryAfter)
+}
+
+// Node states reported in NodeInfo.
+const (
+	NodeLeader   = "leader"
+	NodeFollower = "follower"
+)
+
+// NodeInfo describes a fusis node of the cluster.
+type NodeInfo struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+	State   string `json:"state"`
+	// LastSeen is when the node was last known to be alive. It is only
+	// reported by GetClusterMembers.
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// Peer is a balancer taking part in the raft consensus.
+type Peer struct {
+	Address string `json:"address"`
+}
+
+// BatchError reports the item of a batch that failed. Every item before
+// Index was created by a batch create, none by ApplyBatch.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch item %d failed: %s", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// The operations of a batch applied by ApplyBatch
+const (
+	OpCreateService     = "create_service"
+	OpDeleteService     = "delete_service"
+	OpAddDestination    = "add_destination"
+	OpDeleteDestination = "delete_destination"
+)
+
+// Operation is a step of a batch applied by ApplyBatch. Service is set for
+// the service operations and Destination for the destination ones; deleting
+// only needs their name.
+type Operation struct {
+	Op          string            `json:"op"`
+	Service     *ipvs.Service     `json:"service,omitempty"`
+	Destination *ipvs.Destination `json:"destination,omitempty"`
+}
+
+// HealthStatus is the outcome of the health checks of a destination: its
+// state, how many checks in a row passed or failed, and when it was last
+// checked. Destinations without a health check are always unknown.
+type HealthStatus = health.Status
+
+// ReconcileReport lists the corrections made to the IPVS table of a node by
+// Reconcile.
+type ReconcileReport = ipvs.ReconcileReport
+
+// PersistenceEntry is a client pinned to a destination of a service.
+type PersistenceEntry = ipvs.PersistenceEntry
+
+// VersionInfo is the build of a fusis node and the API versions it serves.
+type VersionInfo struct {
+	Version       string `json:"version"`
+	Commit        string `json:"commit,omitempty"`
+	GoVersion     string `json:"go_version"`
+	APIVersion    int    `json:"api_version"`
+	MinAPIVersion int    `json:"min_api_version"`
+}
+
+// Supports tells if the node serves the given API version.
+func (v VersionInfo) Supports(apiVersion int) bool {
+	return apiVersion >= v.MinAPIVersion && apiVersion <= v.APIVersion
+}
+
+// CurrentVersion describes the build of this fusis.
+func CurrentVersion() VersionInfo {
+	return VersionInfo{
+		Version:       Version,
+		Commit:        Commit,
+		GoVersion:     runtime.Version(),
+		APIVersion:    APIVersion,
+		MinAPIVersion: MinAPIVersion,
+	}
+}
+
+// SyncDaemon is an IPVS connection synchronization daemon of a node.
+type SyncDaemon = ipvs.SyncDaemon
+
+// SyncState is the role of a SyncDaemon, master or backup.
+type SyncState = ipvs.SyncState
+
+// States of a SyncDaemon.
+const (
+	SyncMaster = ipvs.SyncMaster
+	SyncBackup = ipvs.SyncBackup
+)
+
+// IPVSTimeouts are the IPVS connection timeouts of a node, in seconds.
+type IPVSTimeouts = ipvs.Timeouts
+
+// BGPRoute is a VIP announced to the BGP peers of a node.
+type BGPRoute = bgp.Route
+
+// BGPState tells whether a node announces its VIPs, why not when it doesn't,
+// and the state of its BGP sessions.
+type BGPState = bgp.State
+
+// BGPPeerStatus is the state of the session of a node with a BGP peer.
+type BGPPeerStatus = bgp.PeerStatus
+
+// HealthChange is a destination becoming healthy or unhealthy, as seen by
+// the health checks of the balancer streaming it.
+type HealthChange = health.Change
+
+// Ejection is a destination ejected by the outlier detection of its service,
+// or readmitted, as seen by the balancer streaming it.
+type Ejection = engine.Ejection
+
+// Reasons of an Ejection.
+const (
+	EjectedForLatency = engine.EjectedForLatency
+	EjectedForErrors  = engine.EjectedForErrors
+)
+
+// Reasons of a HealthChange.
+const (
+	HealthPassed            = health.ReasonPassed
+	HealthTimeout           = health.ReasonTimeout
+	HealthBadStatus         = health.ReasonBadStatus
+	HealthConnectionRefused = health.ReasonConnectionRefused
+	HealthPassive           = health.ReasonPassive
+	HealthFailed            = health.ReasonFailed
+)
+
+// Health states of a destination.
+const (
+	HealthUnknown   = health.Unknown
+	HealthHealthy   = health.Healthy
+	HealthUnhealthy = health.Unhealthy
+)
+
+// ServiceEventType tells what happened to the service of a ServiceEvent.
+type ServiceEventType string
+
+const (
+	ServiceAdded   ServiceEventType = "added"
+	ServiceUpdated ServiceEventType = "updated"
+	ServiceDeleted ServiceEventType = "deleted"
+	// HealthChanged events carry a HealthChange instead of a service.
+	HealthChanged ServiceEventType = "health"
+	// DestinationEjected events carry an Ejection instead of a service.
+	DestinationEjected ServiceEventType = "ejection"
+)
+
+// ServiceEvent is a change to a service streamed by WatchServices. Changes to
+// destinations are reported as ServiceUpdated with the whole service, and
+// changes to their health as HealthChanged, and their ejections by outlier
+// detection as DestinationEjected.
+type ServiceEvent struct {
+	Type     ServiceEventType `json:"type"`
+	Service  *ipvs.Service    `json:"service,omitempty"`
+	Health   *HealthChange    `json:"health,omitempty"`
+	Ejection *Ejection        `json:"ejection,omitempty"`
+	// Err is only set on the last event of a watch that broke before its
+	// context was done, so the consumer knows it must reconnect.
+	Err error `json:"-"`
+}
+
+// BasicAuth holds HTTP basic authentication credentials.
+type BasicAuth struct {
+	User     string
+	Password string
 }
 
 var (
-	ErrNoSuchService = errors.New("no such service")
+	ErrNoSuchService     = errors.New("no such service")
+	ErrNoSuchDestination = errors.New("no such destination")
+	ErrMissingIdentifier = errors.New("destination ServiceId and Name are required")
+	ErrInvalidLocation   = errors.New("no resource id in Location header")
+	ErrWatchClosed       = errors.New("watch stream closed by server")
+	ErrDrainTimeout      = errors.New("active connections didn't drain in time")
+	ErrServiceNotReady   = errors.New("service has no healthy destination")
+	ErrInvalidAddr       = errors.New("invalid fusis address")
+	ErrNoSuchPeer        = errors.New("no such peer")
+	ErrNoSuchMember      = errors.New("no such cluster member")
+	ErrNotReady          = errors.New("node not ready")
+	ErrNoSyncDaemon      = errors.New("no sync daemon running")
+	ErrIncompatibleAPI   = errors.New("server doesn't serve the client API version")
+
+	ErrServiceConflict     = errors.New("service conflict")
+	ErrDestinationConflict = errors.New("destination conflict")
+	ErrConflict            = errors.New("resource modified since it was read")
+	ErrInvalidRequest      = errors.New("invalid request")
+	ErrServerError         = errors.New("server error")
+	ErrUnauthorized        = errors.New("unauthorized")
 )
 
+// RequestError is returned when the API answers with an unexpected status.
+// It unwraps to one of the sentinel errors above when the status belongs to
+// a known class, so callers can use errors.Is on it.
+type RequestError struct {
+	StatusCode int
+	// Body holds the first maxErrorBody bytes of the response.
+	Body string
+	Err  error
+}
+
+// maxErrorBody caps how much of the body of a failed response is read, so a
+// misbehaving server or proxy can't make the client hold any amount of it.
+const maxErrorBody = 64 << 10
+
+// readErrorBody reads the body of the failed response resp, up to
+// maxErrorBody bytes.
+func readErrorBody(resp *http.Response) []byte {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return body
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Request failed. Status Code: %v. Body: %q", e.StatusCode, e.Body)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
 func NewClient(addr string) *Client {
-	baseTimeout := 30 * time.Second
-	fullTimeout := time.Minute
+	return NewClientWithHTTPClient(addr, nil)
+}
+
+// NewClientWithHTTPClient returns a client that sends its requests through
+// hc, allowing callers to provide their own transport, TLS configuration and
+// timeouts. A nil hc falls back to the same defaults used by NewClient.
+func NewClientWithHTTPClient(addr string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = newHTTPClient(ClientOptions{})
+	}
+	if socket, ok := unixSocket(addr); ok {
+		hc = overSocket(hc, socket)
+	}
 	return &Client{
-		Addr: addr,
-		HttpClient: &http.Client{
-			Transport: &http.Transport{
-				Dial: (&net.Dialer{
-					Timeout:   baseTimeout,
-					KeepAlive: baseTimeout,
-				}).Dial,
-				TLSHandshakeTimeout: baseTimeout,
-				// Disabled http keep alive for more reliable dial timeouts.
-				MaxIdleConnsPerHost: -1,
-				DisableKeepAlives:   true,
-			},
-			Timeout: fullTimeout,
-		},
+		Addr:       addr,
+		HttpClient: hc,
+		leader:     &leaderCache{},
+	}
+}
+
+// WithTimeout returns a shallow copy of the client whose requests time out
+// after d instead, 0 meaning no timeout. The copy shares the transport, and
+// so the connections, of the client.
+func (c *Client) WithTimeout(d time.Duration) *Client {
+	hc := http.Client{}
+	if c.HttpClient != nil {
+		hc = *c.HttpClient
+	}
+	hc.Timeout = d
+
+	clone := *c
+	clone.HttpClient = &hc
+	return &clone
+}
+
+// SetAddr points the client to addr after normalizing it with NormalizeAddr.
+// Addr is left untouched when addr is malformed.
+func (c *Client) SetAddr(addr string) error {
+	normalized, err := NormalizeAddr(addr)
+	if err != nil {
+		return err
+	}
+	if socket, ok := unixSocket(normalized); ok {
+		if c.HttpClient == nil {
+			c.HttpClient = newHTTPClient(ClientOptions{})
+		}
+		c.HttpClient = overSocket(c.HttpClient, socket)
+	}
+	c.Addr = normalized
+	return nil
+}
+
+// NormalizeAddr turns addr into the base URL of a fusis API. Addresses
+// without a scheme, like "fusis.example.com:8000", default to http, and
+// trailing slashes are removed. Only http and https URLs with a host and
+// without query or fragment are accepted, or the absolute path of a Unix
+// socket like "unix:///var/run/fusis.sock".
+func NormalizeAddr(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return "", fmt.Errorf("%w: empty address", ErrInvalidAddr)
+	}
+	if socket, ok := unixSocket(addr); ok {
+		if !filepath.IsAbs(socket) {
+			return "", fmt.Errorf("%w: %q must be the absolute path of a socket", ErrInvalidAddr, addr)
+		}
+		return unixScheme + filepath.Clean(socket), nil
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAddr, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%w: unsupported scheme %q", ErrInvalidAddr, u.Scheme)
+	}
+	if u.Host == "" || u.Hostname() == "" {
+		return "", fmt.Errorf("%w: %q has no host", ErrInvalidAddr, addr)
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("%w: %q must not have credentials, query or fragment", ErrInvalidAddr, addr)
+	}
+	return u.Scheme + "://" + u.Host + strings.TrimRight(u.EscapedPath(), "/"), nil
+}
+
+// Default timeouts used by NewClient and by NewClientWithOptions for any
+// option left at its zero value.
+const (
+	DefaultDialTimeout    = 30 * time.Second
+	DefaultKeepAlive      = 30 * time.Second
+	DefaultRequestTimeout = time.Minute
+	// DefaultIdleConnTimeout is how long the connections kept alive with
+	// ClientOptions.MaxConnsPerHost stay open while idle.
+	DefaultIdleConnTimeout = 90 * time.Second
+)
+
+// ClientOptions tunes the timeouts and the connections of the HTTP client
+// built by NewClientWithOptions.
+type ClientOptions struct {
+	// DialTimeout bounds connecting and the TLS handshake.
+	DialTimeout time.Duration
+	// RequestTimeout bounds a whole request, including reading the body.
+	RequestTimeout time.Duration
+	// KeepAlive is the TCP keep-alive period of the connections.
+	KeepAlive time.Duration
+	// TLSConfig, when set, is used for https addresses, for instance to
+	// present a client certificate.
+	TLSConfig *tls.Config
+
+	// MaxConnsPerHost, when positive, enables keep-alives: up to that many
+	// connections are opened to each node and reused once idle. Otherwise
+	// every request opens its own connection.
+	MaxConnsPerHost int
+	// MaxConcurrentRequests, when positive, bounds the requests the client
+	// and its copies have in flight. A request over the bound waits for
+	// another one to complete, or for its context to be done. Requests are
+	// in flight until their response body is closed, watches until they
+	// are stopped.
+	MaxConcurrentRequests int
+}
+
+// NewClientWithOptions returns a client whose HTTP client uses the timeouts
+// and connection limits in opts.
+func NewClientWithOptions(addr string, opts ClientOptions) *Client {
+	c := NewClientWithHTTPClient(addr, newHTTPClient(opts))
+	c.limiter = newLimiter(opts.MaxConcurrentRequests)
+	return c
+}
+
+func newHTTPClient(opts ClientOptions) *http.Client {
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = DefaultKeepAlive
+	}
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = DefaultRequestTimeout
+	}
+	transport := &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout:   opts.DialTimeout,
+			KeepAlive: opts.KeepAlive,
+		}).Dial,
+		TLSHandshakeTimeout: opts.DialTimeout,
+		TLSClientConfig:     opts.TLSConfig,
+		// Disabled http keep alive for more reliable dial timeouts.
+		MaxIdleConnsPerHost: -1,
+		DisableKeepAlives:   true,
+	}
+	if opts.MaxConnsPerHost > 0 {
+		transport.DisableKeepAlives = false
+		transport.MaxConnsPerHost = opts.MaxConnsPerHost
+		transport.MaxIdleConnsPerHost = opts.MaxConnsPerHost
+		transport.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   opts.RequestTimeout,
+	}
+}
+
+// Ping checks that the node at Addr is up and serving the API.
+func (c *Client) Ping() error {
+	return c.PingContext(context.Background())
+}
+
+// PingContext is like Ping but aborts the request when ctx is done.
+func (c *Client) PingContext(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "GET", c.path("health"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// Live checks that the process of the node at Addr runs.
+func (c *Client) Live() error {
+	return c.LiveContext(context.Background())
+}
+
+// LiveContext is like Live but aborts the request when ctx is done.
+func (c *Client) LiveContext(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "GET", c.path("live"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// Ready checks that the node at Addr can balance. When it can't, the error
+// returned wraps ErrNotReady with the reason given by the node.
+func (c *Client) Ready() error {
+	return c.ReadyContext(context.Background())
+}
+
+// ReadyContext is like Ready but aborts the request when ctx is done.
+func (c *Client) ReadyContext(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "GET", c.path("ready"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusServiceUnavailable:
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return fmt.Errorf("%w: %s", ErrNotReady, body.Error)
+	default:
+		return formatError(resp)
+	}
+}
+
+// Reconcile makes the node at Addr correct the drift of its IPVS table from
+// the services it balances, returning the corrections made.
+func (c *Client) Reconcile() (*ReconcileReport, error) {
+	return c.ReconcileContext(context.Background())
+}
+
+// ReconcileContext is like Reconcile but aborts the request when ctx is done.
+func (c *Client) ReconcileContext(ctx context.Context) (*ReconcileReport, error) {
+	req, err := c.newRequest(ctx, "POST", c.path("reconcile"), nil)
+	if err != nil {
+		return nil, err
+	}
+	// The IPVS table of the node at Addr is reconciled, not the leader one
+	resp, err := c.doWith(c.HttpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var report *ReconcileReport
+	err = decode(resp.Body, &report)
+	return report, err
+}
+
+// DumpTable returns the IPVS table of the node at Addr, formatted like the
+// output of `ipvsadm -L -n`.
+func (c *Client) DumpTable() (string, error) {
+	return c.DumpTableContext(context.Background())
+}
+
+// DumpTableContext is like DumpTable but aborts the request when ctx is done.
+func (c *Client) DumpTableContext(ctx context.Context) (string, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("dump"), nil)
+	if err != nil {
+		return "", err
+	}
+	// Every balancer programs its own table, the leader one isn't wanted
+	resp, err := c.doWith(c.HttpClient, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", formatError(resp)
+	}
+	table, err := ioutil.ReadAll(resp.Body)
+	return string(table), err
+}
+
+// Version returns the build of the node at Addr and the API versions it
+// serves, to check its compatibility with the client or find the nodes left
+// to upgrade.
+func (c *Client) Version() (*VersionInfo, error) {
+	return c.VersionContext(context.Background())
+}
+
+// VersionContext is like Version but aborts the request when ctx is done.
+func (c *Client) VersionContext(ctx context.Context) (*VersionInfo, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("version"), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Nodes are upgraded one at a time, the leader version isn't wanted
+	resp, err := c.doWith(c.HttpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var info *VersionInfo
+	err = decode(resp.Body, &info)
+	return info, err
+}
+
+// CheckVersion is like Version but fails with ErrIncompatibleAPI, along with
+// the version of the node, when the node doesn't serve the API version the
+// client asks for.
+func (c *Client) CheckVersion() (*VersionInfo, error) {
+	return c.CheckVersionContext(context.Background())
+}
+
+// CheckVersionContext is like CheckVersion but aborts the request when ctx
+// is done.
+func (c *Client) CheckVersionContext(ctx context.Context) (*VersionInfo, error) {
+	info, err := c.VersionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Supports(c.apiVersion()) {
+		return info, ErrIncompatibleAPI
+	}
+	return info, nil
+}
+
+// GetEvents returns the audit events of the writes served by the leader from
+// from up to to, oldest first. A zero from or to leaves that end of the range
+// open.
+func (c *Client) GetEvents(from, to time.Time) ([]Event, error) {
+	return c.GetEventsContext(context.Background(), from, to)
+}
+
+// GetEventsContext is like GetEvents but aborts the request when ctx is done.
+func (c *Client) GetEventsContext(ctx context.Context, from, to time.Time) ([]Event, error) {
+	q := url.Values{}
+	if !from.IsZero() {
+		q.Set("from", from.Format(time.RFC3339Nano))
+	}
+	if !to.IsZero() {
+		q.Set("to", to.Format(time.RFC3339Nano))
+	}
+	path := c.path("events")
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	req, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var events []Event
+	err = decode(resp.Body, &events)
+	return events, err
+}
+
+// GetSyncDaemons returns the IPVS sync daemons running on the node at Addr.
+func (c *Client) GetSyncDaemons() ([]SyncDaemon, error) {
+	return c.GetSyncDaemonsContext(context.Background())
+}
+
+// GetSyncDaemonsContext is like GetSyncDaemons but aborts the request when
+// ctx is done.
+func (c *Client) GetSyncDaemonsContext(ctx context.Context) ([]SyncDaemon, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("sync"), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Every balancer runs its own daemons, the leader ones aren't wanted
+	resp, err := c.doWith(c.HttpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var daemons []SyncDaemon
+	err = decode(resp.Body, &daemons)
+	return daemons, err
+}
+
+// StartSyncDaemon starts an IPVS sync daemon on the node at Addr, replacing
+// the one of the same state. Masters send the connections they balance to
+// the backups sharing their sync ID, which keep them when taking over.
+func (c *Client) StartSyncDaemon(d SyncDaemon) error {
+	return c.StartSyncDaemonContext(context.Background(), d)
+}
+
+// StartSyncDaemonContext is like StartSyncDaemon but aborts the request when
+// ctx is done.
+func (c *Client) StartSyncDaemonContext(ctx context.Context, d SyncDaemon) error {
+	if err := d.Validate(); err != nil {
+		return err
 	}
+	json, err := encode(d)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, "POST", c.path("sync"), json)
+	if err != nil {
+		return err
+	}
+	resp, err := c.doWith(c.HttpClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// GetTimeouts returns the IPVS connection timeouts of the node at Addr.
+func (c *Client) GetTimeouts() (*IPVSTimeouts, error) {
+	return c.GetTimeoutsContext(context.Background())
+}
+
+// GetTimeoutsContext is like GetTimeouts but aborts the request when ctx is
+// done.
+func (c *Client) GetTimeoutsContext(ctx context.Context) (*IPVSTimeouts, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("config", "timeouts"), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Every balancer has its own timeouts, the leader ones aren't wanted
+	resp, err := c.doWith(c.HttpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var timeouts *IPVSTimeouts
+	err = decode(resp.Body, &timeouts)
+	return timeouts, err
+}
+
+// SetTimeouts sets the IPVS connection timeouts of the node at Addr. The
+// timeouts that are 0 are left unchanged, so a single one can be set.
+func (c *Client) SetTimeouts(t IPVSTimeouts) error {
+	return c.SetTimeoutsContext(context.Background(), t)
+}
+
+// SetTimeoutsContext is like SetTimeouts but aborts the request when ctx is
+// done.
+func (c *Client) SetTimeoutsContext(ctx context.Context, t IPVSTimeouts) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	json, err := encode(t)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, "PUT", c.path("config", "timeouts"), json)
+	if err != nil {
+		return err
+	}
+	resp, err := c.doWith(c.HttpClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// StopSyncDaemon stops the IPVS sync daemon of the given state on the node
+// at Addr. It fails with ErrNoSyncDaemon when none is running.
+func (c *Client) StopSyncDaemon(state SyncState) error {
+	return c.StopSyncDaemonContext(context.Background(), state)
+}
+
+// StopSyncDaemonContext is like StopSyncDaemon but aborts the request when
+// ctx is done.
+func (c *Client) StopSyncDaemonContext(ctx context.Context, state SyncState) error {
+	req, err := c.newRequest(ctx, "DELETE", c.path("sync", url.PathEscape(string(state))), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.doWith(c.HttpClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNoSyncDaemon
+	}
+	if resp.StatusCode != http.StatusOK {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// GetBGPState returns the advertise state of the node at Addr. A node
+// withdraws every route while it isn't ready, has lost quorum or leadership,
+// or its health hook fails.
+func (c *Client) GetBGPState() (*BGPState, error) {
+	return c.GetBGPStateContext(context.Background())
+}
+
+// GetBGPStateContext is like GetBGPState but aborts the request when ctx is
+// done.
+func (c *Client) GetBGPStateContext(ctx context.Context) (*BGPState, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("bgp"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.doWith(c.HttpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var state *BGPState
+	err = decode(resp.Body, &state)
+	return state, err
+}
+
+// GetBGPRoutes returns the routes the node at Addr announces to its BGP
+// peers: the VIPs of the services having a healthy destination.
+func (c *Client) GetBGPRoutes() ([]BGPRoute, error) {
+	return c.GetBGPRoutesContext(context.Background())
+}
+
+// GetBGPRoutesContext is like GetBGPRoutes but aborts the request when ctx
+// is done.
+func (c *Client) GetBGPRoutesContext(ctx context.Context) ([]BGPRoute, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("bgp", "routes"), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Every balancer has its own BGP sessions, the leader ones aren't wanted
+	resp, err := c.doWith(c.HttpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var routes []BGPRoute
+	err = decode(resp.Body, &routes)
+	return routes, err
+}
+
+// LogLevel returns the level of the logs of the node at Addr.
+func (c *Client) LogLevel() (string, error) {
+	return c.LogLevelContext(context.Background())
+}
+
+// LogLevelContext is like LogLevel but aborts the request when ctx is done.
+func (c *Client) LogLevelContext(ctx context.Context) (string, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("log-level"), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", formatError(resp)
+	}
+	var level LogLevel
+	err = decode(resp.Body, &level)
+	return level.Level, err
+}
+
+// SetLogLevel changes the level of the logs of the node at Addr, which must
+// be one of debug, info, warning, error, fatal or panic.
+func (c *Client) SetLogLevel(level string) error {
+	return c.SetLogLevelContext(context.Background(), level)
+}
+
+// SetLogLevelContext is like SetLogLevel but aborts the request when ctx is
+// done.
+func (c *Client) SetLogLevelContext(ctx context.Context, level string) error {
+	json, err := encode(LogLevel{Level: level})
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, "PUT", c.path("log-level"), json)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// LeaderInfo returns the cluster leader as seen by the node at Addr.
+func (c *Client) LeaderInfo() (*NodeInfo, error) {
+	return c.LeaderInfoContext(context.Background())
+}
+
+// LeaderInfoContext is like LeaderInfo but aborts the request when ctx is
+// done.
+func (c *Client) LeaderInfoContext(ctx context.Context) (*NodeInfo, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("cluster", "leader"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var node *NodeInfo
+	err = decode(resp.Body, &node)
+	return node, err
+}
+
+// GetClusterMembers returns the balancers of the cluster, as seen by the node
+// at Addr.
+func (c *Client) GetClusterMembers() ([]*NodeInfo, error) {
+	return c.GetClusterMembersContext(context.Background())
+}
+
+// GetClusterMembersContext is like GetClusterMembers but aborts the request
+// when ctx is done.
+func (c *Client) GetClusterMembersContext(ctx context.Context) ([]*NodeInfo, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("cluster", "members"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var nodes []*NodeInfo
+	err = decode(resp.Body, &nodes)
+	return nodes, err
+}
+
+// LeaveCluster gracefully removes the node named nodeID from the cluster.
+// Other nodes than the one leaving must have already stopped.
+func (c *Client) LeaveCluster(nodeID string) error {
+	return c.LeaveClusterContext(context.Background(), nodeID)
+}
+
+// LeaveClusterContext is like LeaveCluster but aborts the request when ctx is
+// done.
+func (c *Client) LeaveClusterContext(ctx context.Context, nodeID string) error {
+	req, err := c.newRequest(ctx, "DELETE", c.path("cluster", "members", url.PathEscape(nodeID)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNoSuchMember
+	}
+	if resp.StatusCode != http.StatusOK {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// Peers returns the balancers taking part in the raft consensus.
+func (c *Client) Peers() ([]Peer, error) {
+	return c.PeersContext(context.Background())
+}
+
+// PeersContext is like Peers but aborts the request when ctx is done.
+func (c *Client) PeersContext(ctx context.Context) ([]Peer, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("cluster", "peers"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, formatError(resp)
+	}
+	var peers []Peer
+	err = decode(resp.Body, &peers)
+	return peers, err
+}
+
+// AddPeer adds the balancer with the raft address addr, as host:port, to the
+// cluster.
+func (c *Client) AddPeer(addr string) error {
+	return c.AddPeerContext(context.Background(), addr)
+}
+
+// AddPeerContext is like AddPeer but aborts the request when ctx is done.
+func (c *Client) AddPeerContext(ctx context.Context, addr string) error {
+	json, err := encode(Peer{Address: addr})
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, "POST", c.path("cluster", "peers"), json)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// RemovePeer removes the balancer with the raft address addr from the
+// cluster.
+func (c *Client) RemovePeer(addr string) error {
+	return c.RemovePeerContext(context.Background(), addr)
+}
+
+// RemovePeerContext is like RemovePeer but aborts the request when ctx is
+// done.
+func (c *Client) RemovePeerContext(ctx context.Context, addr string) error {
+	req, err := c.newRequest(ctx, "DELETE", c.path("cluster", "peers", url.PathEscape(addr)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNoSuchPeer
+	}
+	if resp.StatusCode != http.StatusOK {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// GetServices returns every service, reading them a page at a time.
+func (c *Client) GetServices() ([]*ipvs.Service, error) {
+	return c.GetServicesContext(context.Background())
+}
+
+// GetServicesContext is like GetServices but aborts the requests when ctx is
+// done. A ctx deadline earlier than the client timeout takes precedence.
+func (c *Client) GetServicesContext(ctx context.Context) ([]*ipvs.Service, error) {
+	return c.listAllServices(ctx, ListOptions{Limit: servicesPageSize})
+}
+
+// ListServicesByTag returns every service having the tags of selector, as
+// comma separated key=value requirements like "env=prod,team=payments".
+func (c *Client) ListServicesByTag(selector string) ([]*ipvs.Service, error) {
+	return c.ListServicesByTagContext(context.Background(), selector)
+}
+
+// ListServicesByTagContext is like ListServicesByTag but aborts the requests
+// when ctx is done.
+func (c *Client) ListServicesByTagContext(ctx context.Context, selector string) ([]*ipvs.Service, error) {
+	if _, err := ipvs.ParseLabelSelector([]string{selector}); err != nil {
+		return nil, err
+	}
+	return c.listAllServices(ctx, ListOptions{Limit: servicesPageSize, Tags: []string{selector}})
+}
+
+// listAllServices reads every page of the services selected by opts.
+func (c *Client) listAllServices(ctx context.Context, opts ListOptions) ([]*ipvs.Service, error) {
+	services := []*ipvs.Service{}
+	for {
+		page, err := c.ListServicesContext(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, page.Services...)
+		if page.Next == "" {
+			return services, nil
+		}
+		opts.Cursor = page.Next
+	}
+}
+
+// servicesPageSize is how many services GetServices reads per request.
+const servicesPageSize = 500
+
+// ListOptions selects the services returned by ListServices.
+type ListOptions struct {
+	// Limit is the maximum number of services of the page, 0 for all of
+	// them.
+	Limit int
+	// Cursor, when set, is where the page starts, as the Next of the
+	// previous page.
+	Cursor string
+
+	// Protocol and Port, when set, only keep the services matching them.
+	Protocol string
+	Port     uint16
+	// Tags, as key=value requirements, only keep the services having all
+	// of these tags.
+	Tags []string
+}
+
+func (opts ListOptions) query() string {
+	q := url.Values{}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		q.Set("cursor", opts.Cursor)
+	}
+	if opts.Protocol != "" {
+		q.Set("protocol", opts.Protocol)
+	}
+	if opts.Port != 0 {
+		q.Set("port", strconv.Itoa(int(opts.Port)))
+	}
+	if len(opts.Tags) > 0 {
+		q["tag"] = opts.Tags
+	}
+	return q.Encode()
+}
+
+// ServicePage is a page of services sorted by name. Next is the cursor of
+// the following page, empty on the last one.
+type ServicePage struct {
+	Services []*ipvs.Service
+	Next     string
+}
+
+// ListServices returns the page of services selected by opts.
+func (c *Client) ListServices(opts ListOptions) (*ServicePage, error) {
+	return c.ListServicesContext(context.Background(), opts)
+}
+
+// ListServicesContext is like ListServices but aborts the request when ctx is
+// done.
+func (c *Client) ListServicesContext(ctx context.Context, opts ListOptions) (*ServicePage, error) {
+	path := c.path("services")
+	if query := opts.query(); query != "" {
+		path += "?" + query
+	}
+	req, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	page := &ServicePage{Services: []*ipvs.Service{}, Next: resp.Header.Get(NextCursorHeader)}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &page.Services)
+	case http.StatusNoContent:
+	default:
+		return nil, formatError(resp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// GetService returns the service with the name, or the Id, id.
+func (c *Client) GetService(id string) (*ipvs.Service, error) {
+	return c.GetServiceContext(context.Background(), id)
+}
+
+// GetServiceContext is like GetService but aborts the request when ctx is done.
+func (c *Client) GetServiceContext(ctx context.Context, id string) (*ipvs.Service, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("services", id), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var svc *ipvs.Service
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &svc)
+	case http.StatusNotFound:
+		return nil, ErrNoSuchService
+	default:
+		return nil, formatError(resp)
+	}
+	return svc, err
+}
+
+// GetServiceByName returns the service named name. Unlike GetService, it
+// fails with ErrNoSuchService when name is only the Id of a service.
+func (c *Client) GetServiceByName(name string) (*ipvs.Service, error) {
+	return c.GetServiceByNameContext(context.Background(), name)
+}
+
+// GetServiceByNameContext is like GetServiceByName but aborts the request
+// when ctx is done.
+func (c *Client) GetServiceByNameContext(ctx context.Context, name string) (*ipvs.Service, error) {
+	svc, err := c.GetServiceContext(ctx, url.PathEscape(name))
+	if err != nil {
+		return nil, err
+	}
+	if svc.Name != name {
+		return nil, ErrNoSuchService
+	}
+	return svc, nil
+}
+
+func (c *Client) GetServiceStats(id string) (*ipvs.ServiceStats, error) {
+	return c.GetServiceStatsContext(context.Background(), id)
+}
+
+// GetServiceStatsContext is like GetServiceStats but aborts the request when
+// ctx is done.
+func (c *Client) GetServiceStatsContext(ctx context.Context, id string) (*ipvs.ServiceStats, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("services", id, "stats"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var stats *ipvs.ServiceStats
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &stats)
+	case http.StatusNotFound:
+		return nil, ErrNoSuchService
+	default:
+		return nil, formatError(resp)
+	}
+	return stats, err
+}
+
+// GetPersistenceEntries gets the persistence templates of the service id,
+// telling which clients are pinned to which destination.
+func (c *Client) GetPersistenceEntries(id string) ([]PersistenceEntry, error) {
+	return c.GetPersistenceEntriesContext(context.Background(), id)
+}
+
+// GetPersistenceEntriesContext is like GetPersistenceEntries but aborts the
+// request when ctx is done.
+func (c *Client) GetPersistenceEntriesContext(ctx context.Context, id string) ([]PersistenceEntry, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("services", id, "persistence"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var entries []PersistenceEntry
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &entries)
+	case http.StatusNotFound:
+		return nil, ErrNoSuchService
+	default:
+		return nil, formatError(resp)
+	}
+	return entries, err
+}
+
+// WatchServices streams service changes until ctx is done. The returned
+// channel is closed when the watch ends; if it ends because the connection
+// failed, the last event carries the error.
+func (c *Client) WatchServices(ctx context.Context) (<-chan ServiceEvent, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("watch", "services"), nil)
+	if err != nil {
+		return nil, err
+	}
+	// The stream is long lived, so the client wide timeout must not cut it.
+	hc := *c.HttpClient
+	hc.Timeout = 0
+	resp, err := c.doWith(&hc, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, formatError(resp)
+	}
+
+	events := make(chan ServiceEvent)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var event ServiceEvent
+			if err := dec.Decode(&event); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if err == io.EOF {
+					err = ErrWatchClosed
+				}
+				event = ServiceEvent{Err: err}
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+			if event.Err != nil {
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+func (c *Client) CreateService(svc ipvs.Service) (string, error) {
+	return c.CreateServiceContext(context.Background(), svc)
+}
+
+// CreateServiceContext is like CreateService but aborts the request when ctx
+// is done.
+func (c *Client) CreateServiceContext(ctx context.Context, svc ipvs.Service) (string, error) {
+	resp, err := c.postService(ctx, svc, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return idFromLocation(resp, "services")
+}
+
+// CreateServiceWithResult creates svc and returns it as stored by the server,
+// including the defaults it filled in. The service is decoded from the
+// creation response, or fetched when the server answers without a body.
+func (c *Client) CreateServiceWithResult(svc ipvs.Service) (*ipvs.Service, error) {
+	return c.CreateServiceWithResultContext(context.Background(), svc)
+}
+
+// CreateServiceWithResultContext is like CreateServiceWithResult but aborts
+// the requests when ctx is done.
+func (c *Client) CreateServiceWithResultContext(ctx context.Context, svc ipvs.Service) (*ipvs.Service, error) {
+	resp, err := c.postService(ctx, svc, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	return c.serviceFromResponse(ctx, resp)
+}
+
+// EnsureService creates svc unless a service with the same name already
+// exists. It succeeds when the service was created or when the existing one
+// is identical, returning the service stored by the server, and fails with
+// ErrServiceConflict when the existing service differs.
+func (c *Client) EnsureService(svc ipvs.Service) (*ipvs.Service, error) {
+	return c.EnsureServiceContext(context.Background(), svc)
+}
+
+// EnsureServiceContext is like EnsureService but aborts the requests when
+// ctx is done.
+func (c *Client) EnsureServiceContext(ctx context.Context, svc ipvs.Service) (*ipvs.Service, error) {
+	resp, err := c.postService(ctx, svc, http.StatusCreated, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return c.serviceFromResponse(ctx, resp)
+}
+
+// serviceFromResponse returns the service in the body of the response to a
+// create, or fetches it when the body is empty.
+func (c *Client) serviceFromResponse(ctx context.Context, resp *http.Response) (*ipvs.Service, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		id, err := idFromLocation(resp, "services")
+		if err != nil {
+			return nil, err
+		}
+		return c.GetServiceContext(ctx, id)
+	}
+	var created *ipvs.Service
+	if err := decode(bytes.NewReader(body), &created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// postService sends the request creating svc, returning the response only
+// when its status is one of statuses.
+func (c *Client) postService(ctx context.Context, svc ipvs.Service, statuses ...int) (*http.Response, error) {
+	if err := svc.Validate(); err != nil {
+		return nil, err
+	}
+	json, err := encode(svc)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "POST", c.path("services"), json)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	return nil, formatError(resp)
+}
+
+// UpdateService changes the configuration of svc. When svc.Version is set,
+// as in services returned by the client, the update fails with ErrConflict if
+// the service was modified since.
+func (c *Client) UpdateService(svc ipvs.Service) error {
+	return c.UpdateServiceContext(context.Background(), svc)
+}
+
+// ServiceETag returns the entity tag of the version of svc, as sent by the
+// server in the ETag header and expected in If-Match.
+func ServiceETag(svc ipvs.Service) string {
+	return strconv.Quote(strconv.FormatUint(svc.Version, 10))
+}
+
+// UpdateServiceContext is like UpdateService but aborts the request when ctx
+// is done.
+func (c *Client) UpdateServiceContext(ctx context.Context, svc ipvs.Service) error {
+	if err := svc.Validate(); err != nil {
+		return err
+	}
+	json, err := encode(svc)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, "PUT", c.path("services", svc.GetId()), json)
+	if err != nil {
+		return err
+	}
+	if svc.Version != 0 {
+		req.Header.Set("If-Match", ServiceETag(svc))
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrNoSuchService
+	case http.StatusPreconditionFailed:
+		return ErrConflict
+	default:
+		return formatError(resp)
+	}
+}
+
+// PatchService changes only the given fields of the service id, as a JSON
+// merge patch: objects are merged field by field and null fields are reset.
+// The server fails the patch when a field isn't one of ipvs.Service.
+func (c *Client) PatchService(id string, fields map[string]interface{}) error {
+	return c.PatchServiceContext(context.Background(), id, fields)
+}
+
+// PatchServiceContext is like PatchService but aborts the request when ctx is
+// done.
+func (c *Client) PatchServiceContext(ctx context.Context, id string, fields map[string]interface{}) error {
+	json, err := encode(fields)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, "PATCH", c.path("services", id), json)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", MergePatchContentType)
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrNoSuchService
+	case http.StatusPreconditionFailed:
+		return ErrConflict
+	default:
+		return formatError(resp)
+	}
+}
+
+// SetServiceMaintenance turns the maintenance of the service id on or off.
+// In maintenance the service keeps its configuration and destinations, which
+// stop getting new connections until it's turned off. A concurrent update of
+// the service makes it fail with ErrConflict.
+func (c *Client) SetServiceMaintenance(id string, on bool) error {
+	return c.SetServiceMaintenanceContext(context.Background(), id, on)
+}
+
+// SetServiceMaintenanceContext is like SetServiceMaintenance but aborts the
+// requests when ctx is done.
+func (c *Client) SetServiceMaintenanceContext(ctx context.Context, id string, on bool) error {
+	svc, err := c.GetServiceContext(ctx, id)
+	if err != nil {
+		return err
+	}
+	if svc.Maintenance == on {
+		return nil
+	}
+	svc.Maintenance = on
+	return c.UpdateServiceContext(ctx, *svc)
+}
+
+// CreateServices creates svcs in a single request and returns their ids in
+// order. When one of them fails, the ids of the ones created before it are
+// returned along with a *BatchError.
+func (c *Client) CreateServices(svcs []ipvs.Service) ([]string, error) {
+	return c.CreateServicesContext(context.Background(), svcs)
+}
+
+// CreateServicesContext is like CreateServices but aborts the request when
+// ctx is done.
+func (c *Client) CreateServicesContext(ctx context.Context, svcs []ipvs.Service) ([]string, error) {
+	return c.batchCreate(ctx, c.path("batch", "services"), svcs)
+}
+
+func (c *Client) DeleteService(id string) error {
+	return c.DeleteServiceContext(context.Background(), id)
+}
+
+// DeleteServiceContext is like DeleteService but aborts the request when ctx
+// is done.
+func (c *Client) DeleteServiceContext(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, "DELETE", c.path("services", id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// FlushServices deletes every service, and their destinations, in a single
+// server side operation.
+func (c *Client) FlushServices() error {
+	return c.FlushServicesContext(context.Background())
+}
+
+// FlushServicesContext is like FlushServices but aborts the request when ctx
+// is done.
+func (c *Client) FlushServicesContext(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "DELETE", c.path("services"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return formatError(resp)
+	}
+	return nil
+}
+
+// GetDestinations returns the destinations of the service. When selector
+// requirements in the key=value form are given, only the destinations with
+// all of these labels are returned.
+func (c *Client) GetDestinations(serviceId string, selector ...string) ([]*ipvs.Destination, error) {
+	return c.GetDestinationsContext(context.Background(), serviceId, selector...)
+}
+
+// GetDestinationsContext is like GetDestinations but aborts the request when
+// ctx is done.
+func (c *Client) GetDestinationsContext(ctx context.Context, serviceId string, selector ...string) ([]*ipvs.Destination, error) {
+	path := c.path("services", serviceId, "destinations")
+	if len(selector) > 0 {
+		path += "?" + url.Values{"label": selector}.Encode()
+	}
+	req, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var destinations []*ipvs.Destination
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &destinations)
+	case http.StatusNoContent:
+		destinations = []*ipvs.Destination{}
+	case http.StatusNotFound:
+		return nil, ErrNoSuchService
+	default:
+		return nil, formatError(resp)
+	}
+	return destinations, err
+}
+
+func (c *Client) GetDestination(serviceId, id string) (*ipvs.Destination, error) {
+	return c.GetDestinationContext(context.Background(), serviceId, id)
+}
+
+// GetDestinationContext is like GetDestination but aborts the request when
+// ctx is done.
+func (c *Client) GetDestinationContext(ctx context.Context, serviceId, id string) (*ipvs.Destination, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("services", serviceId, "destinations", id), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var dst *ipvs.Destination
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &dst)
+	case http.StatusNotFound:
+		return nil, destinationNotFound(resp)
+	default:
+		return nil, formatError(resp)
+	}
+	return dst, err
+}
+
+// GetDestinationStats gets the IPVS counters of a single destination.
+func (c *Client) GetDestinationStats(serviceId, id string) (*ipvs.DestinationStats, error) {
+	return c.GetDestinationStatsContext(context.Background(), serviceId, id)
+}
+
+// GetDestinationStatsContext is like GetDestinationStats but aborts the
+// request when ctx is done.
+func (c *Client) GetDestinationStatsContext(ctx context.Context, serviceId, id string) (*ipvs.DestinationStats, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("services", serviceId, "destinations", id, "stats"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var stats *ipvs.DestinationStats
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = decode(resp.Body, &stats)
+	case http.StatusNotFound:
+		return nil, destinationNotFound(resp)
+	default:
+		return nil, formatError(resp)
+	}
+	return stats, err
+}
+
+// GetDestinationHealth gets the health of a destination as seen by the node
+// at Addr, which checks destinations on its own.
+func (c *Client) GetDestinationHealth(serviceId, id string) (*HealthStatus, error) {
+	return c.GetDestinationHealthContext(context.Background(), serviceId, id)
 }
 
-func (c *Client) GetServices() ([]*ipvs.Service, error) {
-	resp, err := c.HttpClient.Get(c.path("services"))
+// GetDestinationHealthContext is like GetDestinationHealth but aborts the
+// request when ctx is done.
+func (c *Client) GetDestinationHealthContext(ctx context.Context, serviceId, id string) (*HealthStatus, error) {
+	req, err := c.newRequest(ctx, "GET", c.path("services", serviceId, "destinations", id, "health"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	var services []*ipvs.Service
+	var status *HealthStatus
 	switch resp.StatusCode {
 	case http.StatusOK:
-		err = decode(resp.Body, &services)
-	case http.StatusNoContent:
-		services = []*ipvs.Service{}
+		err = decode(resp.Body, &status)
+	case http.StatusNotFound:
+		return nil, destinationNotFound(resp)
 	default:
 		return nil, formatError(resp)
 	}
-	return services, err
+	return status, err
 }
 
-func (c *Client) GetService(id string) (*ipvs.Service, error) {
-	resp, err := c.HttpClient.Get(c.path("services", id))
+// GetAllDestinationHealth gets the health of every destination, keyed by
+// destination id, as seen by the node at Addr. When service ids are given,
+// only the destinations of these services are returned, and it fails with
+// ErrNoSuchService when one of them doesn't exist.
+func (c *Client) GetAllDestinationHealth(serviceIds ...string) (map[string]HealthStatus, error) {
+	return c.GetAllDestinationHealthContext(context.Background(), serviceIds...)
+}
+
+// GetAllDestinationHealthContext is like GetAllDestinationHealth but aborts
+// the request when ctx is done.
+func (c *Client) GetAllDestinationHealthContext(ctx context.Context, serviceIds ...string) (map[string]HealthStatus, error) {
+	path := c.path("health", "destinations")
+	if len(serviceIds) > 0 {
+		path += "?" + url.Values{"service_id": serviceIds}.Encode()
+	}
+	req, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	var svc *ipvs.Service
+	var statuses map[string]HealthStatus
 	switch resp.StatusCode {
 	case http.StatusOK:
-		err = decode(resp.Body, &svc)
+		err = decode(resp.Body, &statuses)
 	case http.StatusNotFound:
 		return nil, ErrNoSuchService
 	default:
 		return nil, formatError(resp)
 	}
-	return svc, err
+	return statuses, err
 }
 
-func (c *Client) CreateService(svc ipvs.Service) (string, error) {
-	json, err := encode(svc)
+// AddDestination adds dst and returns its id. It fails with
+// ErrDestinationConflict when another destination of the service has the
+// same host and port.
+func (c *Client) AddDestination(dst ipvs.Destination) (string, error) {
+	return c.AddDestinationContext(context.Background(), dst)
+}
+
+// AddDestinationContext is like AddDestination but aborts the request when
+// ctx is done.
+func (c *Client) AddDestinationContext(ctx context.Context, dst ipvs.Destination) (string, error) {
+	return c.postDestination(ctx, dst, false)
+}
+
+// UpsertDestination adds dst or, when another destination of the service
+// has the same host and port, updates that one with the configuration of
+// dst. It returns the id of the destination added or updated.
+func (c *Client) UpsertDestination(dst ipvs.Destination) (string, error) {
+	return c.UpsertDestinationContext(context.Background(), dst)
+}
+
+// UpsertDestinationContext is like UpsertDestination but aborts the request
+// when ctx is done.
+func (c *Client) UpsertDestinationContext(ctx context.Context, dst ipvs.Destination) (string, error) {
+	return c.postDestination(ctx, dst, true)
+}
+
+func (c *Client) postDestination(ctx context.Context, dst ipvs.Destination, upsert bool) (string, error) {
+	if err := dst.Validate(); err != nil {
+		return "", err
+	}
+	json, err := encode(dst)
+	if err != nil {
+		return "", err
+	}
+	path := c.path("services", dst.ServiceId, "destinations")
+	if upsert {
+		path += "?upsert=true"
+	}
+	req, err := c.newRequest(ctx, "POST", path, json)
 	if err != nil {
 		return "", err
 	}
-	resp, err := c.HttpClient.Post(c.path("services"), "application/json", json)
+	resp, err := c.do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusCreated {
-		return "", formatError(resp)
+	switch {
+	case resp.StatusCode == http.StatusCreated, upsert && resp.StatusCode == http.StatusOK:
+		return idFromLocation(resp, "services", dst.ServiceId, "destinations")
+	case resp.StatusCode == http.StatusConflict:
+		return "", destinationConflict(resp)
 	}
-	return idFromLocation(resp), nil
+	return "", formatError(resp)
 }
 
-func (c *Client) DeleteService(id string) error {
-	req, err := http.NewRequest("DELETE", c.path("services", id), nil)
+// AddDestinations adds dsts, which may belong to different services, in a
+// single request and returns their ids in order. When one of them fails, the
+// ids of the ones added before it are returned along with a *BatchError.
+func (c *Client) AddDestinations(dsts []ipvs.Destination) ([]string, error) {
+	return c.AddDestinationsContext(context.Background(), dsts)
+}
+
+// AddDestinationsContext is like AddDestinations but aborts the request when
+// ctx is done.
+func (c *Client) AddDestinationsContext(ctx context.Context, dsts []ipvs.Destination) ([]string, error) {
+	return c.batchCreate(ctx, c.path("batch", "destinations"), dsts)
+}
+
+// ApplyBatch applies ops in order, all at once: either every operation
+// succeeds or none is applied. The failing operation is told by the
+// *BatchError returned.
+func (c *Client) ApplyBatch(ops []Operation) error {
+	return c.ApplyBatchContext(context.Background(), ops)
+}
+
+// ApplyBatchContext is like ApplyBatch but aborts the request when ctx is
+// done.
+func (c *Client) ApplyBatchContext(ctx context.Context, ops []Operation) error {
+	json, err := encode(ops)
 	if err != nil {
 		return err
 	}
-	resp, err := c.HttpClient.Do(req)
+	req, err := c.newRequest(ctx, "POST", c.path("batch"), json)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return formatError(resp)
+	if resp.StatusCode == http.StatusOK {
+		return nil
 	}
-	return nil
+	body := readErrorBody(resp)
+	reqErr := &RequestError{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		Err:        classifyError(resp.StatusCode),
+	}
+	var result struct {
+		Index *int `json:"index"`
+	}
+	if decode(bytes.NewReader(body), &result) != nil || result.Index == nil {
+		return reqErr
+	}
+	return &BatchError{Index: *result.Index, Err: reqErr}
 }
 
-func (c *Client) AddDestination(dst ipvs.Destination) (string, error) {
+func (c *Client) batchCreate(ctx context.Context, url string, items interface{}) ([]string, error) {
+	json, err := encode(items)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, "POST", url, json)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		IDs   []string `json:"ids"`
+		Index *int     `json:"index"`
+	}
+	if resp.StatusCode == http.StatusCreated {
+		err = decode(resp.Body, &result)
+		return result.IDs, err
+	}
+	body := readErrorBody(resp)
+	reqErr := &RequestError{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		Err:        classifyError(resp.StatusCode),
+	}
+	if decode(bytes.NewReader(body), &result) != nil || result.Index == nil {
+		return nil, reqErr
+	}
+	return result.IDs, &BatchError{Index: *result.Index, Err: reqErr}
+}
+
+func (c *Client) UpdateDestination(dst ipvs.Destination) error {
+	return c.UpdateDestinationContext(context.Background(), dst)
+}
+
+// UpdateDestinationContext is like UpdateDestination but aborts the request
+// when ctx is done.
+func (c *Client) UpdateDestinationContext(ctx context.Context, dst ipvs.Destination) error {
+	if dst.ServiceId == "" || dst.GetId() == "" {
+		return ErrMissingIdentifier
+	}
+	if err := dst.Validate(); err != nil {
+		return err
+	}
 	json, err := encode(dst)
 	if err != nil {
-		return "", err
+		return err
 	}
-	resp, err := c.HttpClient.Post(c.path("services", dst.ServiceId, "destinations"), "application/json", json)
+	req, err := c.newRequest(ctx, "PUT", c.path("services", dst.ServiceId, "destinations", dst.GetId()), json)
 	if err != nil {
-		return "", err
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusCreated {
-		return "", formatError(resp)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return destinationNotFound(resp)
+	default:
+		return formatError(resp)
+	}
+}
+
+// RebalanceDestinations sets the weights of destinations of the service
+// serviceId in a single request, weights maps their ids to the new weight.
+// Either every weight is set or none is.
+func (c *Client) RebalanceDestinations(serviceId string, weights map[string]int) error {
+	return c.RebalanceDestinationsContext(context.Background(), serviceId, weights)
+}
+
+// RebalanceDestinationsContext is like RebalanceDestinations but aborts the
+// request when ctx is done.
+func (c *Client) RebalanceDestinationsContext(ctx context.Context, serviceId string, weights map[string]int) error {
+	for _, weight := range weights {
+		if weight < 0 {
+			return &ipvs.ValidationError{Field: "Weight", Reason: "must not be negative"}
+		}
+	}
+	json, err := encode(weights)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, "PUT", c.path("services", serviceId, "destinations", "weights"), json)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return destinationNotFound(resp)
+	default:
+		return formatError(resp)
 	}
-	return idFromLocation(resp), nil
 }
 
 func (c *Client) DeleteDestination(serviceId, destinationId string) error {
-	req, err := http.NewRequest("DELETE", c.path("services", serviceId, "destinations", destinationId), nil)
+	return c.DeleteDestinationContext(context.Background(), serviceId, destinationId)
+}
+
+// DeleteDestinationContext is like DeleteDestination but aborts the request
+// when ctx is done.
+func (c *Client) DeleteDestinationContext(ctx context.Context, serviceId, destinationId string) error {
+	req, err := c.newRequest(ctx, "DELETE", c.path("services", serviceId, "destinations", destinationId), nil)
 	if err != nil {
 		return err
 	}
-	resp, err := c.HttpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -145,6 +2073,375 @@ func (c *Client) DeleteDestination(serviceId, destinationId string) error {
 	return nil
 }
 
+// RegisterDestination adds dst, or updates the destination of the service at
+// its address, registered for ttl: it must then send a Heartbeat more often
+// than every ttl, else the leader quiesces it, then removes it after another
+// ttl. It returns the id of the destination registered.
+func (c *Client) RegisterDestination(dst ipvs.Destination, ttl time.Duration) (string, error) {
+	return c.RegisterDestinationContext(context.Background(), dst, ttl)
+}
+
+// RegisterDestinationContext is like RegisterDestination but aborts the
+// request when ctx is done.
+func (c *Client) RegisterDestinationContext(ctx context.Context, dst ipvs.Destination, ttl time.Duration) (string, error) {
+	dst.TTL = ipvs.Duration(ttl)
+	return c.UpsertDestinationContext(ctx, dst)
+}
+
+// DeregisterDestination removes a registered destination. Unlike
+// DeleteDestination it succeeds when the destination is already gone, like
+// when it expired.
+func (c *Client) DeregisterDestination(serviceId, destinationId string) error {
+	return c.DeregisterDestinationContext(context.Background(), serviceId, destinationId)
+}
+
+// DeregisterDestinationContext is like DeregisterDestination but aborts the
+// request when ctx is done.
+func (c *Client) DeregisterDestinationContext(ctx context.Context, serviceId, destinationId string) error {
+	req, err := c.newRequest(ctx, "DELETE", c.path("services", serviceId, "destinations", destinationId), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		if err := destinationNotFound(resp); err != ErrNoSuchDestination {
+			return err
+		}
+		return nil
+	}
+	return formatError(resp)
+}
+
+// Heartbeat renews the registration of a destination having a TTL, see
+// RegisterDestination.
+func (c *Client) Heartbeat(serviceId, destId string) error {
+	return c.HeartbeatContext(context.Background(), serviceId, destId)
+}
+
+// HeartbeatContext is like Heartbeat but aborts the request when ctx is
+// done.
+func (c *Client) HeartbeatContext(ctx context.Context, serviceId, destId string) error {
+	req, err := c.newRequest(ctx, "PUT", c.path("services", serviceId, "destinations", destId, "heartbeat"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return destinationNotFound(resp)
+	}
+	return formatError(resp)
+}
+
+// drainPollInterval is how often DrainDestination checks the connections left
+// on a destination.
+var drainPollInterval = time.Second
+
+// DrainDestination stops sending new connections to a destination, by
+// setting its weight to 0, and deletes it once its active connections are
+// gone. If they aren't gone within timeout, ErrDrainTimeout is returned and
+// the destination is left quiesced.
+func (c *Client) DrainDestination(serviceId, destinationId string, timeout time.Duration) error {
+	return c.DrainDestinationContext(context.Background(), serviceId, destinationId, timeout)
+}
+
+// DrainDestinationContext is like DrainDestination but aborts when ctx is
+// done.
+func (c *Client) DrainDestinationContext(ctx context.Context, serviceId, destinationId string, timeout time.Duration) error {
+	dst, err := c.GetDestinationContext(ctx, serviceId, destinationId)
+	if err != nil {
+		return err
+	}
+	if dst.Weight != 0 {
+		dst.Weight = 0
+		if err := c.UpdateDestinationContext(ctx, *dst); err != nil {
+			return err
+		}
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		stats, err := c.GetDestinationStatsContext(ctx, serviceId, destinationId)
+		if err != nil {
+			return err
+		}
+		if stats.ActiveConns == 0 {
+			return c.DeleteDestinationContext(ctx, serviceId, destinationId)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return ErrDrainTimeout
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
+
+// DeleteServiceGraceful stops sending new connections to the service, by
+// putting it in maintenance, and deletes it once its active connections are
+// gone. If they aren't gone within timeout, ErrDrainTimeout is returned and
+// the service is left in maintenance, to be deleted with DeleteService or put
+// back in service.
+func (c *Client) DeleteServiceGraceful(id string, timeout time.Duration) error {
+	return c.DeleteServiceGracefulContext(context.Background(), id, timeout)
+}
+
+// DeleteServiceGracefulContext is like DeleteServiceGraceful but aborts
+// when ctx is done.
+func (c *Client) DeleteServiceGracefulContext(ctx context.Context, id string, timeout time.Duration) error {
+	if err := c.SetServiceMaintenanceContext(ctx, id, true); err != nil {
+		return err
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		stats, err := c.GetServiceStatsContext(ctx, id)
+		if err != nil {
+			return err
+		}
+		if stats.ActiveConns == 0 {
+			return c.DeleteServiceContext(ctx, id)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return ErrDrainTimeout
+		case <-time.After(drainPollInterval):
+		}
+	}
+}
+
+// readyPollInterval is how often WaitForServiceReady checks the service
+// again.
+var readyPollInterval = 250 * time.Millisecond
+
+// WaitForServiceReady waits until the service id has a destination able to
+// take traffic: a healthy one, or one without health check and with a
+// weight. Services not found yet, like ones just created through another
+// node, are waited for too. If the service isn't ready within timeout,
+// ErrServiceNotReady is returned.
+func (c *Client) WaitForServiceReady(id string, timeout time.Duration) error {
+	return c.WaitForServiceReadyContext(context.Background(), id, timeout)
+}
+
+// WaitForServiceReadyContext is like WaitForServiceReady but aborts when ctx
+// is done.
+func (c *Client) WaitForServiceReadyContext(ctx context.Context, id string, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		ready, err := c.serviceReady(ctx, id)
+		if err != nil && err != ErrNoSuchService && err != ErrNoSuchDestination {
+			return err
+		}
+		if ready {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return ErrServiceNotReady
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+func (c *Client) serviceReady(ctx context.Context, id string) (bool, error) {
+	svc, err := c.GetServiceContext(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	for _, dst := range svc.Destinations {
+		if dst.HealthCheck == nil {
+			if dst.Weight > 0 {
+				return true, nil
+			}
+			continue
+		}
+		status, err := c.GetDestinationHealthContext(ctx, svc.GetId(), dst.GetId())
+		if err != nil {
+			return false, err
+		}
+		if status.State == HealthHealthy {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// newRequest builds a request bound to ctx carrying the client credentials.
+// Requests carrying a body are always sent as JSON.
+func (c *Client) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	compressed := false
+	if c.RequestCompression && body != nil {
+		var err error
+		if body, err = compress(body); err != nil {
+			return nil, err
+		}
+		compressed = true
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.Compression {
+		// Set by hand, the transport leaves decompressing to doWith
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	if c.DryRun && isWrite(req) {
+		req.Header.Set(DryRunHeader, "true")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.BasicAuth != nil {
+		req.SetBasicAuth(c.BasicAuth.User, c.BasicAuth.Password)
+	}
+	return req, nil
+}
+
+// do sends req, retrying it according to the client RetryPolicy. When the
+// request context is done before a response arrives, the context error is
+// returned instead of the wrapped transport one.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.FollowRedirects && isWrite(req) {
+		return c.doFollowingLeader(req)
+	}
+	return c.doWith(c.HttpClient, req)
+}
+
+// apiVersion returns the API version the client asks for.
+func (c *Client) apiVersion() int {
+	if c.APIVersion == 0 {
+		return APIVersion
+	}
+	return c.APIVersion
+}
+
+// doWith sends req through hc once the client has a request slot available,
+// retrying it according to the client RetryPolicy.
+func (c *Client) doWith(hc *http.Client, req *http.Request) (*http.Response, error) {
+	release, err := c.limiter.acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(hc, req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+func (c *Client) send(hc *http.Client, req *http.Request) (*http.Response, error) {
+	userAgent := c.UserAgent
+	if userAgent == "" {
+		userAgent = "fusis-client/" + Version
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(APIVersionHeader, strconv.Itoa(c.apiVersion()))
+	if c.RequestID != nil && req.Header.Get(RequestIDHeader) == "" {
+		if id := c.RequestID(); id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+	}
+
+	resp, err := hc.Do(req)
+	for retry := 0; ; retry++ {
+		delay, ok := c.RetryPolicy.shouldRetry(req, resp, err, retry)
+		if !ok {
+			break
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err = hc.Do(req)
+	}
+	if err != nil {
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		body, err := gzip.NewReader(resp.Body)
+		switch {
+		case err == io.EOF:
+			// Nothing was compressed, like the answers to HEAD requests
+		case err != nil:
+			resp.Body.Close()
+			return nil, err
+		default:
+			resp.Body = &gzipBody{Reader: body, body: resp.Body}
+		}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+	return resp, nil
+}
+
+// gzipBody decompresses a response body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// compress gzips body in memory, so that the request can be resent.
+func compress(body io.Reader) (io.Reader, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := io.Copy(gz, body); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf.Bytes()), nil
+}
+
 func encode(obj interface{}) (io.Reader, error) {
 	b, err := json.Marshal(obj)
 	if err != nil {
@@ -153,28 +2450,150 @@ func encode(obj interface{}) (io.Reader, error) {
 	return bytes.NewReader(b), nil
 }
 
+// maxErrorBodyPrefix bounds how much of an undecodable body is kept for the
+// error message.
+const maxErrorBodyPrefix = 512
+
+// decode streams the JSON in body into obj. Only the first bytes read are
+// retained, so that a decoding error can still show the offending content.
 func decode(body io.Reader, obj interface{}) error {
-	data, err := ioutil.ReadAll(body)
-	if err != nil {
-		return err
-	}
-	err = json.Unmarshal(data, obj)
+	prefix := &prefixWriter{max: maxErrorBodyPrefix}
+	err := json.NewDecoder(io.TeeReader(body, prefix)).Decode(obj)
 	if err != nil {
-		return fmt.Errorf("unable to unmarshal body %q: %s", string(data), err)
+		return fmt.Errorf("unable to unmarshal body %q: %s", prefix.String(), err)
 	}
 	return nil
 }
 
+// prefixWriter keeps the first max bytes written to it and discards the rest.
+type prefixWriter struct {
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	n := p.max - len(p.buf)
+	if n > len(b) {
+		n = len(b)
+	}
+	if n < len(b) {
+		p.truncated = true
+	}
+	p.buf = append(p.buf, b[:n]...)
+	return len(b), nil
+}
+
+func (p *prefixWriter) String() string {
+	if p.truncated {
+		return string(p.buf) + "..."
+	}
+	return string(p.buf)
+}
+
 func formatError(resp *http.Response) error {
-	body, _ := ioutil.ReadAll(resp.Body)
-	return fmt.Errorf("Request failed. Status Code: %v. Body: %q", resp.StatusCode, string(body))
+	body := readErrorBody(resp)
+	if resp.StatusCode == StatusNotLeader {
+		var notLeader struct {
+			Leader string `json:"leader"`
+		}
+		json.Unmarshal(body, &notLeader)
+		return &ErrNotLeader{Leader: notLeader.Leader}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &ErrRateLimited{RetryAfter: retryAfter(resp)}
+	}
+	err := classifyError(resp.StatusCode)
+	if err == ErrInvalidRequest {
+		if verr := validationError(body); verr != nil {
+			err = verr
+		}
+	}
+	return &RequestError{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		Err:        err,
+	}
+}
+
+func classifyError(status int) error {
+	switch {
+	case status == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case status == http.StatusConflict:
+		return ErrServiceConflict
+	case status == http.StatusPreconditionFailed:
+		return ErrConflict
+	case status == http.StatusNotAcceptable:
+		return ErrIncompatibleAPI
+	case status == http.StatusBadRequest, status == 422:
+		return ErrInvalidRequest
+	case status >= 500:
+		return ErrServerError
+	}
+	return nil
+}
+
+// destinationConflict is the error of a 409 answered to a destination write,
+// which conflicts with another destination rather than a service.
+func destinationConflict(resp *http.Response) error {
+	err := formatError(resp)
+	if reqErr, ok := err.(*RequestError); ok {
+		reqErr.Err = ErrDestinationConflict
+	}
+	return err
+}
+
+// destinationNotFound tells apart a missing service from a missing
+// destination on a 404 returned for a destination path.
+func destinationNotFound(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body.Error == "Service not found" {
+		return ErrNoSuchService
+	}
+	return ErrNoSuchDestination
 }
 
 func (c Client) path(paths ...string) string {
-	return strings.Join(append([]string{strings.TrimRight(c.Addr, "/")}, paths...), "/")
+	base := strings.TrimRight(c.Addr, "/")
+	if _, ok := unixSocket(c.Addr); ok {
+		base = "http://" + unixHost
+	}
+	return strings.Join(append([]string{base}, paths...), "/")
 }
 
-func idFromLocation(resp *http.Response) string {
-	parts := strings.Split(resp.Header.Get("Location"), "/")
-	return parts[len(parts)-1]
+// idFromLocation extracts the id of a created resource from the last
+// non-empty path segment of the Location header, which may be an absolute or
+// a relative URL. The segments before the id must be the ones of the
+// collection given, so a Location rewritten by a misconfigured proxy isn't
+// mistaken for the resource created.
+func idFromLocation(resp *http.Response, collection ...string) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", ErrInvalidLocation
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q: %v", ErrInvalidLocation, location, err)
+	}
+	var segments []string
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	expected := "/" + strings.Join(append(collection, "{id}"), "/")
+	if len(segments) < len(collection)+1 {
+		return "", fmt.Errorf("%w: %q doesn't match %s", ErrInvalidLocation, location, expected)
+	}
+	segments = segments[len(segments)-len(collection)-1:]
+	for i, segment := range collection {
+		if segments[i] != segment {
+			return "", fmt.Errorf("%w: %q doesn't match %s", ErrInvalidLocation, location, expected)
+		}
+	}
+	return segments[len(collection)], nil
 }
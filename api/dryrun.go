@@ -0,0 +1,21 @@
+package api
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DryRunHeader asks a write to be validated, and answered as if it was
+// applied, without changing anything. The server sends it back when honored.
+const DryRunHeader = "Dry-Run"
+
+// dryRun tells if the request served by c is a dry run, acknowledging it in
+// the response.
+func dryRun(c *gin.Context) bool {
+	if ok, _ := strconv.ParseBool(c.GetHeader(DryRunHeader)); !ok {
+		return false
+	}
+	c.Header(DryRunHeader, "true")
+	return true
+}
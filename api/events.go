@@ -0,0 +1,244 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Event records a change made through the API.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Operation is create, update or delete.
+	Operation string `json:"operation"`
+	// Route is the pattern of the path changed, like
+	// /services/:service_id/destinations.
+	Route      string `json:"route"`
+	ResourceID string `json:"resource_id,omitempty"`
+	// Identity is the common name of the client certificate, when the API
+	// requires them.
+	Identity  string `json:"identity,omitempty"`
+	RequestID string `json:"request_id"`
+}
+
+// eventLog keeps the last events in memory, and appends them to a file when
+// it has a path. The file is rotated once it reaches maxSize bytes, the
+// previous one being kept with a .1 suffix.
+type eventLog struct {
+	sync.Mutex
+	events []Event
+	// oldest is the index of the oldest event once events is full.
+	oldest int
+
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+// newEventLog returns a log of the last size events. When path is set the
+// events already in the file, and in the one rotated, are loaded and the new
+// ones appended to it.
+func newEventLog(size int, path string, maxSize int64) (*eventLog, error) {
+	l := &eventLog{events: make([]Event, 0, size), path: path, maxSize: maxSize}
+	if path == "" {
+		return l, nil
+	}
+	for _, file := range []string{path + ".1", path} {
+		if err := l.load(file); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *eventLog) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A line cut by a crash
+			continue
+		}
+		l.keep(e)
+	}
+	return scanner.Err()
+}
+
+func (l *eventLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// keep adds e to the events in memory, dropping the oldest one when full.
+func (l *eventLog) keep(e Event) {
+	if cap(l.events) == 0 {
+		return
+	}
+	if len(l.events) < cap(l.events) {
+		l.events = append(l.events, e)
+		return
+	}
+	l.events[l.oldest] = e
+	l.oldest = (l.oldest + 1) % len(l.events)
+}
+
+// record appends e to the log.
+func (l *eventLog) record(e Event) error {
+	l.Lock()
+	defer l.Unlock()
+
+	l.keep(e)
+	if l.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+func (l *eventLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// between returns the events kept from from up to to, oldest first. Zero
+// times leave the range open.
+func (l *eventLog) between(from, to time.Time) []Event {
+	l.Lock()
+	defer l.Unlock()
+
+	events := []Event{}
+	for i := range l.events {
+		e := l.events[(l.oldest+i)%len(l.events)]
+		if (!from.IsZero() && e.Time.Before(from)) || (!to.IsZero() && e.Time.After(to)) {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// operations maps the methods changing resources to their operation.
+var operations = map[string]string{
+	"POST":   "create",
+	"PUT":    "update",
+	"PATCH":  "update",
+	"DELETE": "delete",
+}
+
+// audit records the changes made by the requests in the event log, once
+// they succeeded. Dry runs change nothing and aren't recorded, nor are the
+// heartbeats of destinations, which would flood the log.
+func (l *eventLog) audit(c *gin.Context) {
+	c.Next()
+
+	operation, ok := operations[c.Request.Method]
+	if !ok || c.Writer.Status() >= 300 || c.Writer.Header().Get(DryRunHeader) != "" {
+		return
+	}
+	if strings.HasSuffix(c.FullPath(), "/heartbeat") {
+		return
+	}
+	e := Event{
+		Time:       time.Now().UTC(),
+		Operation:  operation,
+		Route:      c.FullPath(),
+		ResourceID: resourceID(c),
+		Identity:   identity(c),
+		RequestID:  c.GetString(requestIDKey),
+	}
+	if err := l.record(e); err != nil {
+		requestLogger(c).WithError(err).Error("Recording the audit event failed")
+	}
+}
+
+// resourceID returns the id of the resource changed by the request, the one
+// created being told by the Location header.
+func resourceID(c *gin.Context) string {
+	if location := c.Writer.Header().Get("Location"); location != "" {
+		return location[strings.LastIndex(location, "/")+1:]
+	}
+	for _, param := range []string{"destination_id", "service_id", "name", "peer", "state"} {
+		if id := c.Param(param); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// identity returns the common name of the verified client certificate of the
+// request.
+func identity(c *gin.Context) string {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return c.Request.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// eventList answers with the events between the RFC 3339 times of the from
+// and to query parameters, both optional.
+func (as ApiService) eventList(c *gin.Context) {
+	if as.events == nil {
+		c.JSON(404, gin.H{"error": "Audit log isn't enabled"})
+		return
+	}
+
+	var from, to time.Time
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("invalid %s time %q, expected RFC 3339", param, value)})
+			return
+		}
+		*t = parsed
+	}
+
+	c.JSON(http.StatusOK, as.events.between(from, to))
+}
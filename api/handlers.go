@@ -1,18 +1,93 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/raft"
+	"github.com/luizbafilho/fusis/engine"
+	"github.com/luizbafilho/fusis/fusis"
+	"github.com/luizbafilho/fusis/health"
 	"github.com/luizbafilho/fusis/ipvs"
 )
 
+// serviceList answers with every service unless a page is asked for with the
+// limit or cursor query parameters, or the services filtered by protocol,
+// port or tags. Pages are sorted by name and the NextCursorHeader tells where
+// the next one starts.
 func (as ApiService) serviceList(c *gin.Context) {
-	services := as.balancer.GetServices()
+	if len(c.Request.URL.Query()) == 0 {
+		c.JSON(http.StatusOK, *as.balancer.GetServices())
+		return
+	}
+
+	query, err := parseListQuery(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	services := *as.balancer.GetServicesByTags(query.tags)
+
+	sort.Slice(services, func(i, j int) bool { return services[i].GetId() < services[j].GetId() })
+	page := []ipvs.Service{}
+	for _, svc := range services {
+		if svc.GetId() <= query.cursor ||
+			(query.protocol != "" && svc.Protocol != query.protocol) ||
+			(query.port != 0 && svc.Port != query.port) {
+			continue
+		}
+		if query.limit > 0 && len(page) == query.limit {
+			c.Header(NextCursorHeader, page[len(page)-1].GetId())
+			break
+		}
+		page = append(page, svc)
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// listQuery is a page of services asked for in the query parameters.
+type listQuery struct {
+	limit    int
+	cursor   string
+	protocol string
+	port     uint16
+	tags     map[string]string
+}
 
-	c.JSON(http.StatusOK, services)
+func parseListQuery(c *gin.Context) (listQuery, error) {
+	query := listQuery{cursor: c.Query("cursor"), protocol: c.Query("protocol")}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return query, fmt.Errorf("invalid limit %q", limit)
+		}
+		query.limit = n
+	}
+	if port := c.Query("port"); port != "" {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return query, fmt.Errorf("invalid port %q", port)
+		}
+		query.port = uint16(n)
+	}
+	if tags := c.QueryArray("tag"); len(tags) > 0 {
+		selector, err := ipvs.ParseLabelSelector(tags)
+		if err != nil {
+			return query, err
+		}
+		query.tags = selector
+	}
+	return query, nil
 }
 
 func (as ApiService) serviceGet(c *gin.Context) {
@@ -28,41 +103,254 @@ func (as ApiService) serviceGet(c *gin.Context) {
 		return
 	}
 
+	c.Header("ETag", ServiceETag(*service))
 	c.JSON(http.StatusOK, service)
 }
 
+func (as ApiService) serviceStats(c *gin.Context) {
+	serviceId := c.Param("service_id")
+	stats, err := as.balancer.GetServiceStats(serviceId)
+
+	if err != nil {
+		if err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprintf("GetServiceStats(): %v", err)})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetServiceStats() failed: %v", err)})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// servicePersistence answers with the persistence templates of a service in
+// the IPVS table of the node answering.
+func (as ApiService) servicePersistence(c *gin.Context) {
+	serviceId := c.Param("service_id")
+	entries, err := as.balancer.GetPersistenceEntries(serviceId)
+
+	if err != nil {
+		if err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprint("Service not found")})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetPersistenceEntries() failed: %v", err)})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
 func (as ApiService) serviceCreate(c *gin.Context) {
 	newService := ipvs.Service{}
 
 	if c.BindJSON(&newService) != nil {
 		return
 	}
-	//Guarantees that no one tries to create a destination together with a service
-	newService.Destinations = []ipvs.Destination{}
 
-	if _, errs := govalidator.ValidateStruct(newService); errs != nil {
-		c.JSON(422, gin.H{"errors": govalidator.ErrorsByField(errs)})
+	status, body := as.createService(&newService, dryRun(c))
+	if body != nil {
+		c.JSON(status, body)
 		return
 	}
 
-	if _, err := newService.ValidateUniqueness(); err != nil {
-		c.JSON(409, gin.H{"error": err.Error()})
-		return
+	c.Header("Location", location(c, "services", newService.GetId()))
+	c.Header("ETag", ServiceETag(newService))
+	c.JSON(status, newService)
+}
+
+// createService validates and adds svc, returning the status and body to
+// answer with when it fails. Creating a service identical to an existing one
+// succeeds with 200 and fills svc with the existing service, so that retried
+// creates are idempotent. A dry run stops before adding svc.
+func (as ApiService) createService(svc *ipvs.Service, dryRun bool) (int, gin.H) {
+	//Guarantees that no one tries to create a destination together with a service
+	svc.Destinations = []ipvs.Destination{}
+
+	if existing, err := as.balancer.GetService(svc.GetId()); err == nil {
+		requested := *svc
+		if requested.Host == "" {
+			// The VIP was allocated by the provider
+			requested.Host = existing.Host
+		}
+		if !existing.Matches(requested) {
+			return 409, gin.H{"error": "Service already exists with a different configuration"}
+		}
+		*svc = *existing
+		return http.StatusOK, nil
+	}
+
+	if status, body := validateService(svc); body != nil {
+		return status, body
+	}
+
+	if dryRun {
+		return http.StatusCreated, nil
 	}
 
 	// If everthing is ok send it to Raft
-	err := as.balancer.AddService(&newService)
+	if err := as.balancer.AddService(svc); err != nil {
+		return 422, gin.H{"error": fmt.Sprintf("UpsertService() failed: %v", err)}
+	}
+
+	return http.StatusCreated, nil
+}
+
+// validateService checks the configuration of the new service svc, returning
+// the status and body to answer with when it is invalid.
+func validateService(svc *ipvs.Service) (int, gin.H) {
+	if _, errs := govalidator.ValidateStruct(svc); errs != nil {
+		return 422, invalidStruct(errs)
+	}
+
+	// The checks the client makes too, which it can't be trusted to do
+	if err := svc.Validate(); err != nil {
+		return 422, invalid(err)
+	}
+
+	if _, err := svc.ValidateUniqueness(); err != nil {
+		return 409, gin.H{"error": err.Error()}
+	}
+
+	return 0, nil
+}
+
+// serviceBatchCreate creates services in order, stopping at the first one
+// that fails. The ids of the services created before it are always returned.
+func (as ApiService) serviceBatchCreate(c *gin.Context) {
+	services := []ipvs.Service{}
+
+	if c.BindJSON(&services) != nil {
+		return
+	}
+
+	ids := []string{}
+	dryRun := dryRun(c)
+	for i := range services {
+		if status, body := as.createService(&services[i], dryRun); body != nil {
+			body["ids"] = ids
+			body["index"] = i
+			c.JSON(status, body)
+			return
+		}
+		ids = append(ids, services[i].GetId())
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"ids": ids})
+}
+
+// serviceUpdate replaces the configuration of the stored service with the one
+// of the request.
+func (as ApiService) serviceUpdate(c *gin.Context) {
+	as.changeService(c, func(service *ipvs.Service) (*ipvs.Service, bool) {
+		return decodeServiceUpdate(c)
+	})
+}
+
+// decodeServiceUpdate decodes the service of an update request. It is decoded
+// into a new service rather than onto the stored one, whose maps, slices and
+// pointers the state shares: the state must only change through raft, and
+// decoding onto a map would merge it rather than replace it.
+func decodeServiceUpdate(c *gin.Context) (*ipvs.Service, bool) {
+	updated := &ipvs.Service{}
+	if c.BindJSON(updated) != nil {
+		return nil, false
+	}
+	return updated, true
+}
+
+// servicePatch merges the JSON merge patch (RFC 7386) of the request onto the
+// stored service, then updates it like serviceUpdate. Fields unknown to
+// services are answered with 400.
+func (as ApiService) servicePatch(c *gin.Context) {
+	as.changeService(c, func(service *ipvs.Service) (*ipvs.Service, bool) {
+		updated, err := mergeService(*service, c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, false
+		}
+		return updated, true
+	})
+}
+
+// changeService updates the service of the request with the one returned by
+// decode, given the stored service, once validated. decode answers the
+// request itself when it fails.
+func (as ApiService) changeService(c *gin.Context, decode func(service *ipvs.Service) (*ipvs.Service, bool)) {
+	serviceId := c.Param("service_id")
+	service, err := as.balancer.GetService(serviceId)
 
 	if err != nil {
-		c.JSON(422, gin.H{"error": fmt.Sprintf("UpsertService() failed: %v", err)})
+		if err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprint("Service not found")})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		}
+		return
+	}
+
+	if match := c.GetHeader("If-Match"); match != "" && match != "*" && match != ServiceETag(*service) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Service was modified"})
+		return
+	}
+
+	decoded, ok := decode(service)
+	if !ok {
+		return
+	}
+	updated, status, body := validateServiceUpdate(service, decoded)
+	if body != nil {
+		c.JSON(status, body)
+		return
+	}
+
+	if dryRun(c) {
+		c.JSON(http.StatusOK, updated)
+		return
+	}
+
+	err = as.balancer.UpdateService(&updated)
+
+	if err == fusis.ErrServiceModified {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Service was modified"})
+	} else if err != nil {
+		requestLogger(c).WithError(err).Warn("UpdateService() failed")
+		c.JSON(422, gin.H{"error": fmt.Sprintf("UpdateService() failed: %v", err)})
 	} else {
-		c.JSON(http.StatusOK, newService)
+		c.Header("ETag", ServiceETag(updated))
+		c.JSON(http.StatusOK, updated)
+	}
+}
+
+// validateServiceUpdate returns decoded as an update of service, or the status
+// and body to answer with when it is invalid.
+func validateServiceUpdate(service, decoded *ipvs.Service) (ipvs.Service, int, gin.H) {
+	updated := *decoded
+	//The identity of a service and its destinations can't be changed by an update
+	updated.Id = service.Id
+	updated.Name = service.Name
+	updated.Destinations = service.Destinations
+	updated.Version = service.Version
+
+	if updated.Host != service.Host || updated.Port != service.Port || updated.Protocol != service.Protocol || updated.Fwmark != service.Fwmark {
+		return updated, 422, gin.H{"error": "Host, Port, Protocol and Fwmark can't be changed"}
+	}
+
+	if _, errs := govalidator.ValidateStruct(updated); errs != nil {
+		return updated, 422, invalidStruct(errs)
+	}
+
+	// Checks the destinations against the updated service too
+	if err := updated.Validate(); err != nil {
+		return updated, 422, invalid(err)
 	}
+
+	return updated, 0, nil
 }
 
 func (as ApiService) serviceDelete(c *gin.Context) {
 	serviceId := c.Param("service_id")
-	_, err := as.balancer.GetService(serviceId)
+	service, err := as.balancer.GetService(serviceId)
 
 	if err != nil {
 		if err == ipvs.ErrNotFound {
@@ -73,54 +361,183 @@ func (as ApiService) serviceDelete(c *gin.Context) {
 		return
 	}
 
-	err = as.balancer.DeleteService(serviceId)
+	if dryRun(c) {
+		c.JSON(http.StatusOK, service)
+		return
+	}
+
+	err = as.balancer.DeleteService(service.GetId())
 
 	if err != nil {
+		requestLogger(c).WithError(err).Warn("DeleteService() failed")
 		c.JSON(422, gin.H{"error": fmt.Sprintf("DeleteService() failed: %v\n", err)})
 	} else {
 		c.Data(http.StatusOK, gin.MIMEHTML, nil)
 	}
 }
 
-func (as ApiService) destinationCreate(c *gin.Context) {
+// serviceFlush deletes every service and their destinations at once.
+// A dry run answers with the services that would be deleted.
+func (as ApiService) serviceFlush(c *gin.Context) {
+	if dryRun(c) {
+		c.JSON(http.StatusOK, as.balancer.GetServices())
+		return
+	}
+
+	if err := as.balancer.FlushServices(); err != nil {
+		requestLogger(c).WithError(err).Warn("FlushServices() failed")
+		c.JSON(422, gin.H{"error": fmt.Sprintf("FlushServices() failed: %v", err)})
+		return
+	}
+
+	c.Data(http.StatusOK, gin.MIMEHTML, nil)
+}
+
+func (as ApiService) serviceWatch(c *gin.Context) {
+	events, unsubscribe := as.balancer.Subscribe()
+	defer unsubscribe()
+
+	c.Header("Content-Type", "application/json")
+	c.Writer.WriteHeader(http.StatusOK)
+	c.Writer.Flush()
+
+	enc := json.NewEncoder(c.Writer)
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			for _, event := range as.serviceEvents(e) {
+				if err := enc.Encode(event); err != nil {
+					return
+				}
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+func (as ApiService) serviceEvents(e fusis.Event) []ServiceEvent {
+	if e.Health != nil {
+		return []ServiceEvent{{Type: HealthChanged, Health: e.Health}}
+	}
+	if e.Ejection != nil {
+		return []ServiceEvent{{Type: DestinationEjected, Ejection: e.Ejection}}
+	}
+
+	cmd := e.Command
+	switch cmd.Op {
+	case engine.AddServiceOp:
+		return []ServiceEvent{{Type: ServiceAdded, Service: cmd.Service}}
+	case engine.DelServiceOp:
+		return []ServiceEvent{{Type: ServiceDeleted, Service: cmd.Service}}
+	case engine.FlushServicesOp:
+		events := []ServiceEvent{}
+		for i := range cmd.Services {
+			events = append(events, ServiceEvent{Type: ServiceDeleted, Service: &cmd.Services[i]})
+		}
+		return events
+	}
+
+	// Everything else changes an existing service, so send its current state
+	svc, err := as.balancer.GetService(cmd.Service.GetId())
+	if err != nil {
+		svc = cmd.Service
+	}
+	return []ServiceEvent{{Type: ServiceUpdated, Service: svc}}
+}
+
+func (as ApiService) destinationList(c *gin.Context) {
 	serviceId := c.Param("service_id")
 	service, err := as.balancer.GetService(serviceId)
 	if err != nil {
-		c.JSON(400, gin.H{"error": err.Error()})
+		if err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprint("Service not found")})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		}
 		return
 	}
 
-	destination := &ipvs.Destination{Weight: 1, Mode: "route", ServiceId: serviceId}
-
-	if c.BindJSON(destination) != nil {
+	requirements := c.QueryArray("label")
+	if len(requirements) == 0 {
+		c.JSON(http.StatusOK, service.Destinations)
 		return
 	}
-
-	if _, errs := govalidator.ValidateStruct(destination); errs != nil {
-		c.JSON(422, gin.H{"errors": govalidator.ErrorsByField(errs)})
+	selector, err := ipvs.ParseLabelSelector(requirements)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	destinations := []ipvs.Destination{}
+	for _, dst := range service.Destinations {
+		if dst.HasLabels(selector) {
+			destinations = append(destinations, dst)
+		}
+	}
+	c.JSON(http.StatusOK, destinations)
+}
 
-	if _, err := destination.ValidateUniqueness(service); err != nil {
-		c.JSON(409, gin.H{"error": err.Error()})
+func (as ApiService) destinationGet(c *gin.Context) {
+	serviceId := c.Param("service_id")
+	if _, err := as.balancer.GetService(serviceId); err != nil {
+		if err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprint("Service not found")})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		}
 		return
 	}
 
-	err = as.balancer.AddDestination(service, destination)
-
-	if err != nil {
-		c.JSON(422, gin.H{"error": fmt.Sprintf("UpsertDestination() failed: %v\n", err)})
-	} else {
-		c.JSON(http.StatusOK, destination)
+	destinationId := c.Param("destination_id")
+	dst, err := as.balancer.GetDestination(destinationId)
+	if err != nil || dst.ServiceId != serviceId {
+		if err == nil || err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprint("Destination not found")})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetDestination() failed: %v", err)})
+		}
+		return
 	}
+
+	c.JSON(http.StatusOK, dst)
 }
 
-func (as ApiService) destinationDelete(c *gin.Context) {
+func (as ApiService) destinationStats(c *gin.Context) {
+	serviceId := c.Param("service_id")
 	destinationId := c.Param("destination_id")
 	dst, err := as.balancer.GetDestination(destinationId)
+	if err != nil || dst.ServiceId != serviceId {
+		if err == nil || err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprint("Destination not found")})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetDestination() failed: %v", err)})
+		}
+		return
+	}
 
+	stats, err := as.balancer.GetDestinationStats(dst)
 	if err != nil {
 		if err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprintf("GetDestinationStats(): %v", err)})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetDestinationStats() failed: %v", err)})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+func (as ApiService) destinationHealth(c *gin.Context) {
+	serviceId := c.Param("service_id")
+	destinationId := c.Param("destination_id")
+	dst, err := as.balancer.GetDestination(destinationId)
+	if err != nil || dst.ServiceId != serviceId {
+		if err == nil || err == ipvs.ErrNotFound {
 			c.JSON(404, gin.H{"error": fmt.Sprint("Destination not found")})
 		} else {
 			c.JSON(422, gin.H{"error": fmt.Sprintf("GetDestination() failed: %v", err)})
@@ -128,13 +545,854 @@ func (as ApiService) destinationDelete(c *gin.Context) {
 		return
 	}
 
-	err = as.balancer.DeleteDestination(dst)
+	c.JSON(http.StatusOK, as.balancer.GetDestinationHealth(dst))
+}
+
+// destinationHealthList answers with the health of every destination, keyed
+// by destination id, or of the destinations of the services given by the
+// service_id query parameter.
+func (as ApiService) destinationHealthList(c *gin.Context) {
+	services := *as.balancer.GetServices()
+	if ids := c.QueryArray("service_id"); len(ids) > 0 {
+		services = make([]ipvs.Service, 0, len(ids))
+		for _, id := range ids {
+			service, err := as.balancer.GetService(id)
+			if err != nil {
+				if err == ipvs.ErrNotFound {
+					c.JSON(404, gin.H{"error": fmt.Sprint("Service not found")})
+				} else {
+					c.JSON(422, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+				}
+				return
+			}
+			services = append(services, *service)
+		}
+	}
+
+	statuses := make(map[string]health.Status)
+	for _, service := range services {
+		for i := range service.Destinations {
+			dst := &service.Destinations[i]
+			statuses[dst.GetId()] = as.balancer.GetDestinationHealth(dst)
+		}
+	}
+	c.JSON(http.StatusOK, statuses)
+}
+
+func (as ApiService) destinationCreate(c *gin.Context) {
+	serviceId := c.Param("service_id")
+	destination := &ipvs.Destination{Weight: 1, Mode: "route", ServiceId: serviceId}
+
+	if c.BindJSON(destination) != nil {
+		return
+	}
+	destination.ServiceId = serviceId
+
+	if upsert, _ := strconv.ParseBool(c.Query("upsert")); upsert {
+		if service, err := as.balancer.GetService(serviceId); err == nil {
+			if existing := service.DestinationAt(*destination); existing != nil {
+				as.upsertDestination(c, service, existing, destination)
+				return
+			}
+		}
+	}
+
+	if status, body := as.createDestination(destination, dryRun(c)); body != nil {
+		c.JSON(status, body)
+		return
+	}
+
+	c.Header("Location", location(c, "services", serviceId, "destinations", destination.GetId()))
+	c.JSON(http.StatusCreated, destination)
+}
+
+// upsertDestination updates existing, the destination of service at the
+// address of dst, with the configuration of dst instead of creating it. The
+// identity of existing is kept.
+func (as ApiService) upsertDestination(c *gin.Context, service *ipvs.Service, existing, dst *ipvs.Destination) {
+	updated := *dst
+	updated.Id = existing.Id
+	updated.Name = existing.Name
+	updated.Host = existing.Host
+	updated.EffectiveWeight = 0
+	// Registering again renews the registration
+	updated.Expired = false
+
+	if status, body := validateDestinationConfig(&updated, service); body != nil {
+		c.JSON(status, body)
+		return
+	}
 
+	c.Header("Location", location(c, "services", service.GetId(), "destinations", updated.GetId()))
+	if dryRun(c) {
+		c.JSON(http.StatusOK, updated)
+		return
+	}
+
+	if err := as.balancer.UpdateDestination(service, &updated); err != nil {
+		requestLogger(c).WithError(err).Warn("UpdateDestination() failed")
+		c.JSON(422, gin.H{"error": fmt.Sprintf("UpdateDestination() failed: %v\n", err)})
+		return
+	}
+	if updated.TTL > 0 {
+		as.balancer.Heartbeat(&updated)
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// createDestination validates and adds dst to the service it references,
+// returning the status and body to answer with when it fails. A dry run stops
+// before adding dst.
+func (as ApiService) createDestination(dst *ipvs.Destination, dryRun bool) (int, gin.H) {
+	// Only the leader expires destinations
+	dst.Expired = false
+
+	service, err := as.balancer.GetService(dst.ServiceId)
 	if err != nil {
-		c.JSON(422, gin.H{"error": fmt.Sprintf("DeleteDestination() failed: %v\n", err)})
-	} else {
-		c.Data(http.StatusOK, gin.MIMEHTML, nil)
+		return 400, gin.H{"error": err.Error()}
+	}
+
+	if status, body := validateDestination(dst, service); body != nil {
+		return status, body
+	}
+
+	if dryRun {
+		return http.StatusCreated, nil
+	}
+
+	if err := as.balancer.AddDestination(service, dst); err != nil {
+		if errors.Is(err, ipvs.ErrDestinationExists) {
+			return 409, gin.H{"error": err.Error()}
+		}
+		return 422, gin.H{"error": fmt.Sprintf("UpsertDestination() failed: %v\n", err)}
+	}
+
+	return http.StatusCreated, nil
+}
+
+// validateDestination checks the configuration of the new destination dst
+// of service, returning the status and body to answer with when it is
+// invalid or at the address of another destination of service.
+func validateDestination(dst *ipvs.Destination, service *ipvs.Service) (int, gin.H) {
+	if status, body := validateDestinationConfig(dst, service); body != nil {
+		return status, body
+	}
+
+	if _, err := dst.ValidateUniqueness(service); err != nil {
+		return 409, gin.H{"error": err.Error()}
+	}
+
+	return 0, nil
+}
+
+// validateDestinationConfig checks the configuration of dst as a destination
+// of service.
+func validateDestinationConfig(dst *ipvs.Destination, service *ipvs.Service) (int, gin.H) {
+	if dst.GetId() == "weights" {
+		// Taken by the path setting the weights of the service destinations
+		return 422, invalidField("Name", "Destination name weights is reserved")
+	}
+
+	if _, errs := govalidator.ValidateStruct(dst); errs != nil {
+		return 422, invalidStruct(errs)
+	}
+
+	if err := dst.ValidateFamily(*service); err != nil {
+		return 422, invalid(err)
+	}
+
+	if err := dst.ValidateMode(*service); err != nil {
+		return 422, invalid(err)
+	}
+
+	if err := dst.ValidateLabels(); err != nil {
+		return 422, invalid(err)
+	}
+
+	if err := dst.ValidateTTL(); err != nil {
+		return 422, invalid(err)
+	}
+
+	if dst.HealthCheck != nil {
+		if err := dst.HealthCheck.Validate(); err != nil {
+			return 422, invalid(err)
+		}
+	}
+
+	return 0, nil
+}
+
+// destinationBatchCreate creates destinations in order, stopping at the first
+// one that fails. The ids of the destinations created before it are always
+// returned.
+func (as ApiService) destinationBatchCreate(c *gin.Context) {
+	destinations := []json.RawMessage{}
+
+	if c.BindJSON(&destinations) != nil {
+		return
+	}
+
+	ids := []string{}
+	dryRun := dryRun(c)
+	for i, raw := range destinations {
+		dst, err := decodeDestination(raw)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error(), "ids": ids, "index": i})
+			return
+		}
+
+		if status, body := as.createDestination(dst, dryRun); body != nil {
+			body["ids"] = ids
+			body["index"] = i
+			c.JSON(status, body)
+			return
+		}
+		ids = append(ids, dst.GetId())
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"ids": ids})
+}
+
+// decodeDestination decodes raw onto the weight and mode destinations are
+// created with, so that only the fields raw leaves out get them: an explicit
+// weight of 0 creates a quiesced destination, as with single creates.
+func decodeDestination(raw []byte) (*ipvs.Destination, error) {
+	dst := &ipvs.Destination{Weight: 1, Mode: "route"}
+	if err := json.Unmarshal(raw, dst); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// batchOperation is an Operation as decoded by batch, keeping its
+// destination raw until it is decoded by decodeDestination.
+type batchOperation struct {
+	Operation
+	Destination json.RawMessage `json:"destination,omitempty"`
+}
+
+// batch applies a list of operations in order, all at once: when one of them
+// fails nothing is applied. Each operation is checked against the services as
+// left by the operations before it.
+func (as ApiService) batch(c *gin.Context) {
+	requested := []batchOperation{}
+
+	if c.BindJSON(&requested) != nil {
+		return
+	}
+
+	ops := make([]Operation, len(requested))
+	for i, op := range requested {
+		ops[i] = op.Operation
+		if len(op.Destination) == 0 || string(op.Destination) == "null" {
+			continue
+		}
+		dst, err := decodeDestination(op.Destination)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error(), "index": i})
+			return
+		}
+		ops[i].Destination = dst
+	}
+
+	// The services and destinations created (or deleted, when nil) by the
+	// operations checked so far
+	services := map[string]*ipvs.Service{}
+	destinations := map[string]*ipvs.Destination{}
+	getService := func(id string) *ipvs.Service {
+		if svc, ok := services[id]; ok {
+			return svc
+		}
+		svc, _ := as.balancer.GetService(id)
+		return svc
+	}
+	getDestination := func(id string) *ipvs.Destination {
+		if dst, ok := destinations[id]; ok {
+			return dst
+		}
+		dst, _ := as.balancer.GetDestination(id)
+		return dst
+	}
+
+	cmds := []engine.Command{}
+	for i, op := range ops {
+		status, body := 0, gin.H(nil)
+		switch op.Op {
+		case OpCreateService:
+			if op.Service == nil {
+				status, body = 400, gin.H{"error": "Operation has no service"}
+				break
+			}
+			svc := op.Service
+			svc.Destinations = []ipvs.Destination{}
+			if getService(svc.GetId()) != nil {
+				status, body = 409, gin.H{"error": "Service already exists"}
+				break
+			}
+			if status, body = validateService(svc); body != nil {
+				break
+			}
+			services[svc.GetId()] = svc
+			cmds = append(cmds, engine.Command{Op: engine.AddServiceOp, Service: svc})
+		case OpDeleteService:
+			if op.Service == nil {
+				status, body = 400, gin.H{"error": "Operation has no service"}
+				break
+			}
+			svc := getService(op.Service.GetId())
+			if svc == nil {
+				status, body = 404, gin.H{"error": fmt.Sprint("Service not found")}
+				break
+			}
+			services[svc.GetId()] = nil
+			cmds = append(cmds, engine.Command{Op: engine.DelServiceOp, Service: svc})
+		case OpAddDestination:
+			if op.Destination == nil {
+				status, body = 400, gin.H{"error": "Operation has no destination"}
+				break
+			}
+			dst := op.Destination
+			svc := getService(dst.ServiceId)
+			if svc == nil {
+				status, body = 404, gin.H{"error": fmt.Sprint("Service not found")}
+				break
+			}
+			if getDestination(dst.GetId()) != nil {
+				status, body = 409, gin.H{"error": "Destination already exists"}
+				break
+			}
+			if status, body = validateDestination(dst, svc); body != nil {
+				break
+			}
+			destinations[dst.GetId()] = dst
+			cmds = append(cmds, engine.Command{Op: engine.AddDestinationOp, Service: svc, Destination: dst})
+		case OpDeleteDestination:
+			if op.Destination == nil {
+				status, body = 400, gin.H{"error": "Operation has no destination"}
+				break
+			}
+			dst := getDestination(op.Destination.GetId())
+			if dst == nil || getService(dst.ServiceId) == nil {
+				status, body = 404, gin.H{"error": fmt.Sprint("Destination not found")}
+				break
+			}
+			destinations[dst.GetId()] = nil
+			cmds = append(cmds, engine.Command{Op: engine.DelDestinationOp, Service: getService(dst.ServiceId), Destination: dst})
+		default:
+			status, body = 400, gin.H{"error": fmt.Sprintf("Unknown operation %q", op.Op)}
+		}
+
+		if body != nil {
+			body["index"] = i
+			c.JSON(status, body)
+			return
+		}
+	}
+
+	if dryRun(c) {
+		c.JSON(http.StatusOK, ops)
+		return
+	}
+
+	if err := as.balancer.ApplyBatch(cmds); err != nil {
+		requestLogger(c).WithError(err).Warn("ApplyBatch() failed")
+		body := gin.H{"error": fmt.Sprintf("ApplyBatch() failed: %v", err)}
+		if batchErr, ok := err.(*engine.BatchError); ok {
+			body["index"] = batchErr.Index
+		}
+		status := 422
+		if errors.Is(err, ipvs.ErrDestinationExists) {
+			// Destinations of the batch at the same address
+			status = 409
+		}
+		c.JSON(status, body)
+		return
+	}
+
+	c.JSON(http.StatusOK, ops)
+}
+
+func (as ApiService) destinationUpdate(c *gin.Context) {
+	// The router can't tell the weights path apart from a destination id
+	if c.Param("destination_id") == "weights" {
+		as.destinationWeights(c)
+		return
+	}
+
+	serviceId := c.Param("service_id")
+	service, err := as.balancer.GetService(serviceId)
+	if err != nil {
+		if err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprint("Service not found")})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		}
+		return
+	}
+
+	destinationId := c.Param("destination_id")
+	dst, err := as.balancer.GetDestination(destinationId)
+	if err != nil || dst.ServiceId != serviceId {
+		if err == nil || err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprint("Destination not found")})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetDestination() failed: %v", err)})
+		}
+		return
+	}
+
+	decoded, ok := decodeDestinationUpdate(c)
+	if !ok {
+		return
+	}
+	updated, status, body := validateDestinationUpdate(dst, decoded)
+	if body != nil {
+		c.JSON(status, body)
+		return
+	}
+
+	if dryRun(c) {
+		c.JSON(http.StatusOK, updated)
+		return
+	}
+
+	err = as.balancer.UpdateDestination(service, &updated)
+
+	if err != nil {
+		requestLogger(c).WithError(err).Warn("UpdateDestination() failed")
+		c.JSON(422, gin.H{"error": fmt.Sprintf("UpdateDestination() failed: %v\n", err)})
+	} else {
+		c.JSON(http.StatusOK, updated)
+	}
+}
+
+// decodeDestinationUpdate decodes the destination of an update request. Like
+// services, it is decoded into a new destination rather than onto the stored
+// one, whose labels and health check the state shares.
+func decodeDestinationUpdate(c *gin.Context) (*ipvs.Destination, bool) {
+	updated := &ipvs.Destination{}
+	if c.BindJSON(updated) != nil {
+		return nil, false
+	}
+	return updated, true
+}
+
+// validateDestinationUpdate returns decoded as an update of dst, or the status
+// and body to answer with when it is invalid.
+func validateDestinationUpdate(dst, decoded *ipvs.Destination) (ipvs.Destination, int, gin.H) {
+	updated := *decoded
+	//The identity of a destination can't be changed by an update
+	updated.Id = dst.Id
+	updated.Name = dst.Name
+	updated.ServiceId = dst.ServiceId
+	// The effective weight is computed by each balancer, it isn't configuration
+	updated.EffectiveWeight = 0
+	updated.Expired = dst.Expired
+
+	if updated.Host != dst.Host || updated.Port != dst.Port {
+		return updated, 422, gin.H{"error": "Host and Port can't be changed"}
+	}
+
+	if _, errs := govalidator.ValidateStruct(updated); errs != nil {
+		return updated, 422, invalidStruct(errs)
+	}
+
+	if err := updated.ValidateLabels(); err != nil {
+		return updated, 422, invalid(err)
+	}
+
+	if err := updated.ValidateTTL(); err != nil {
+		return updated, 422, invalid(err)
+	}
+
+	if updated.HealthCheck != nil {
+		if err := updated.HealthCheck.Validate(); err != nil {
+			return updated, 422, invalid(err)
+		}
+	}
+
+	return updated, 0, nil
+}
+
+// destinationHeartbeat renews the registration of a destination having a
+// TTL.
+func (as ApiService) destinationHeartbeat(c *gin.Context) {
+	dst, err := as.balancer.GetDestination(c.Param("destination_id"))
+	if err != nil || dst.ServiceId != c.Param("service_id") {
+		if err == nil || err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprint("Destination not found")})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetDestination() failed: %v", err)})
+		}
+		return
+	}
+
+	if err := as.balancer.Heartbeat(dst); err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("Heartbeat() failed: %v", err)})
+		return
+	}
+
+	c.Data(http.StatusOK, gin.MIMEHTML, nil)
+}
+
+// destinationWeights sets the weights of destinations of a service at once,
+// from a map of their ids to the new weight, and answers with the service.
+func (as ApiService) destinationWeights(c *gin.Context) {
+	serviceId := c.Param("service_id")
+	service, err := as.balancer.GetService(serviceId)
+	if err != nil {
+		if err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprint("Service not found")})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		}
+		return
+	}
+
+	weights := map[string]int32{}
+	if c.BindJSON(&weights) != nil {
+		return
+	}
+
+	for id, weight := range weights {
+		found := false
+		for _, d := range service.Destinations {
+			found = found || d.GetId() == id
+		}
+		if !found {
+			c.JSON(404, gin.H{"error": fmt.Sprint("Destination not found"), "destination": id})
+			return
+		}
+		if weight < 0 {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("Weight of destination %s must not be negative", id), "destination": id})
+			return
+		}
+	}
+
+	if dryRun(c) {
+		c.JSON(http.StatusOK, service)
+		return
+	}
+
+	if err := as.balancer.RebalanceDestinations(service, weights); err != nil {
+		requestLogger(c).WithError(err).Warn("RebalanceDestinations() failed")
+		c.JSON(422, gin.H{"error": fmt.Sprintf("RebalanceDestinations() failed: %v", err)})
+		return
+	}
+
+	service, err = as.balancer.GetService(serviceId)
+	if err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("GetService() failed: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, service)
+}
+
+func (as ApiService) destinationDelete(c *gin.Context) {
+	destinationId := c.Param("destination_id")
+	dst, err := as.balancer.GetDestination(destinationId)
+
+	if err != nil {
+		if err == ipvs.ErrNotFound {
+			c.JSON(404, gin.H{"error": fmt.Sprint("Destination not found")})
+		} else {
+			c.JSON(422, gin.H{"error": fmt.Sprintf("GetDestination() failed: %v", err)})
+		}
+		return
+	}
+
+	if dryRun(c) {
+		c.JSON(http.StatusOK, dst)
+		return
+	}
+
+	err = as.balancer.DeleteDestination(dst)
+
+	if err != nil {
+		requestLogger(c).WithError(err).Warn("DeleteDestination() failed")
+		c.JSON(422, gin.H{"error": fmt.Sprintf("DeleteDestination() failed: %v\n", err)})
+	} else {
+		c.Data(http.StatusOK, gin.MIMEHTML, nil)
+	}
+}
+
+// reconcile corrects the IPVS table of the node answering, each balancer
+// programs its own.
+func (as ApiService) reconcile(c *gin.Context) {
+	report, err := as.balancer.Reconcile()
+	if err != nil {
+		requestLogger(c).WithError(err).Warn("Reconcile() failed")
+		body := gin.H{"error": fmt.Sprintf("Reconcile() failed: %v", err)}
+		if report != nil {
+			body["corrections"] = report.Corrections
+		}
+		c.JSON(422, body)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// dump answers with the IPVS table of the node answering, in the format of
+// `ipvsadm -L -n`.
+func (as ApiService) dump(c *gin.Context) {
+	table, err := as.balancer.DumpTable()
+	if err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("DumpTable() failed: %v", err)})
+		return
+	}
+
+	c.String(http.StatusOK, table)
+}
+
+func (as ApiService) health(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// live answers as long as the process runs, for liveness probes.
+func (as ApiService) live(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ready answers with a 503 until the balancer can balance, for readiness
+// probes.
+func (as ApiService) ready(c *gin.Context) {
+	if err := as.balancer.Ready(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+func (as ApiService) clusterLeader(c *gin.Context) {
+	leader := as.balancer.LeaderApiAddr()
+	if leader == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "no cluster leader"})
+		return
+	}
+
+	c.JSON(http.StatusOK, NodeInfo{Address: leader, State: NodeLeader})
+}
+
+func (as ApiService) memberList(c *gin.Context) {
+	nodes := []NodeInfo{}
+	for _, m := range as.balancer.Members() {
+		node := NodeInfo{Name: m.Name, Address: m.ApiAddr, State: NodeFollower}
+		if m.Leader {
+			node.State = NodeLeader
+		}
+		if !m.LastSeen.IsZero() {
+			lastSeen := m.LastSeen
+			node.LastSeen = &lastSeen
+		}
+		nodes = append(nodes, node)
+	}
+	c.JSON(http.StatusOK, nodes)
+}
+
+func (as ApiService) memberRemove(c *gin.Context) {
+	err := as.balancer.RemoveMember(c.Param("name"))
+	if err == fusis.ErrUnknownMember {
+		c.JSON(404, gin.H{"error": fmt.Sprint("Member not found")})
+		return
+	}
+	if err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("RemoveMember() failed: %v", err)})
+		return
+	}
+
+	c.Data(http.StatusOK, gin.MIMEHTML, nil)
+}
+
+// clusterState serves the replicated services to the anti-entropy syncs of
+// gossiping balancers.
+func (as ApiService) clusterState(c *gin.Context) {
+	entries, ok := as.balancer.GossipState()
+	if !ok {
+		c.JSON(404, gin.H{"error": "Gossip mode isn't enabled"})
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// version describes the build of this balancer and the API versions it
+// serves.
+func (as ApiService) version(c *gin.Context) {
+	c.JSON(http.StatusOK, CurrentVersion())
+}
+
+// syncList lists the IPVS sync daemons running on this balancer.
+func (as ApiService) syncList(c *gin.Context) {
+	daemons, err := as.balancer.SyncDaemons()
+	if err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("SyncDaemons() failed: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, daemons)
+}
+
+// syncStart starts an IPVS sync daemon on this balancer, replacing the one
+// of the same state.
+func (as ApiService) syncStart(c *gin.Context) {
+	daemon := ipvs.SyncDaemon{}
+	if c.BindJSON(&daemon) != nil {
+		return
+	}
+
+	if err := daemon.Validate(); err != nil {
+		c.JSON(422, invalid(err))
+		return
+	}
+
+	if err := as.balancer.StartSyncDaemon(daemon); err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("StartSyncDaemon() failed: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, daemon)
+}
+
+func (as ApiService) timeoutsGet(c *gin.Context) {
+	timeouts, err := as.balancer.Timeouts()
+	if err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("Timeouts() failed: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, timeouts)
+}
+
+// timeoutsSet sets the IPVS timeouts of this balancer, the ones that are 0
+// being left unchanged, and answers with the timeouts in effect.
+func (as ApiService) timeoutsSet(c *gin.Context) {
+	timeouts := ipvs.Timeouts{}
+	if c.BindJSON(&timeouts) != nil {
+		return
+	}
+
+	if err := timeouts.Validate(); err != nil {
+		c.JSON(422, invalid(err))
+		return
+	}
+
+	if err := as.balancer.SetTimeouts(timeouts); err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("SetTimeouts() failed: %v", err)})
+		return
+	}
+
+	as.timeoutsGet(c)
+}
+
+func (as ApiService) syncStop(c *gin.Context) {
+	state := ipvs.SyncState(c.Param("state"))
+	if err := state.Validate(); err != nil {
+		c.JSON(422, invalid(err))
+		return
+	}
+
+	err := as.balancer.StopSyncDaemon(state)
+	if err == ipvs.ErrSyncDaemonNotRunning {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("No %s sync daemon running", state)})
+		return
+	}
+	if err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("StopSyncDaemon() failed: %v", err)})
+		return
+	}
+
+	c.Data(http.StatusOK, gin.MIMEHTML, nil)
+}
+
+// bgpState tells whether this balancer announces its VIPs, and the state of
+// its BGP sessions.
+func (as ApiService) bgpState(c *gin.Context) {
+	state, ok := as.balancer.BGPState()
+	if !ok {
+		c.JSON(404, gin.H{"error": "BGP isn't enabled"})
+		return
+	}
+
+	c.JSON(http.StatusOK, state)
+}
+
+// bgpRoutes lists the routes this balancer announces to its BGP peers.
+func (as ApiService) bgpRoutes(c *gin.Context) {
+	routes, ok := as.balancer.BGPRoutes()
+	if !ok {
+		c.JSON(404, gin.H{"error": "BGP isn't enabled"})
+		return
+	}
+
+	c.JSON(http.StatusOK, routes)
+}
+
+func (as ApiService) peerList(c *gin.Context) {
+	addrs, err := as.balancer.Peers()
+	if err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("Peers() failed: %v", err)})
+		return
+	}
+
+	peers := []Peer{}
+	for _, addr := range addrs {
+		peers = append(peers, Peer{Address: addr})
+	}
+	c.JSON(http.StatusOK, peers)
+}
+
+func (as ApiService) peerAdd(c *gin.Context) {
+	var peer Peer
+	if c.BindJSON(&peer) != nil {
+		return
+	}
+
+	if _, _, err := net.SplitHostPort(peer.Address); err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("invalid peer address %q: %v", peer.Address, err)})
+		return
+	}
+
+	err := as.balancer.AddPeer(peer.Address)
+	if err == raft.ErrKnownPeer {
+		c.JSON(409, gin.H{"error": "Peer already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("AddPeer() failed: %v", err)})
+		return
+	}
+
+	c.Header("Location", location(c, "cluster", "peers", peer.Address))
+	c.JSON(http.StatusCreated, peer)
+}
+
+func (as ApiService) peerRemove(c *gin.Context) {
+	err := as.balancer.RemovePeer(c.Param("peer"))
+	if err == raft.ErrUnknownPeer {
+		c.JSON(404, gin.H{"error": fmt.Sprint("Peer not found")})
+		return
+	}
+	if err != nil {
+		c.JSON(422, gin.H{"error": fmt.Sprintf("RemovePeer() failed: %v", err)})
+		return
+	}
+
+	c.Data(http.StatusOK, gin.MIMEHTML, nil)
+}
+
+// location returns the absolute URL of the resource at the path segments,
+// on the host the request was sent to.
+func location(c *gin.Context, segments ...string) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: c.Request.Host, Path: "/" + strings.Join(segments, "/")}
+	if u.Host == "" {
+		return u.Path
 	}
+	return u.String()
 }
 
 func (as ApiService) flush(c *gin.Context) {
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// limiter bounds the requests a client has in flight. A nil limiter doesn't
+// bound them.
+type limiter chan struct{}
+
+func newLimiter(max int) limiter {
+	if max <= 0 {
+		return nil
+	}
+	return make(limiter, max)
+}
+
+// acquire waits for a request slot, or for ctx to be done. The slot is given
+// back by calling the function returned, any number of times.
+func (l limiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-l }) }, nil
+}
+
+// limitedBody gives back the request slot of a response once its body is
+// closed, since the request is in flight until then.
+type limitedBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *limitedBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/luizbafilho/fusis/logging"
+	"github.com/pborman/uuid"
+)
+
+// requestIDKey is the gin context key of the request ID.
+const requestIDKey = "request_id"
+
+// logRequests logs every API request once served, with its request ID. The
+// ID sent by the client in RequestIDHeader is kept, otherwise one is made up,
+// and it is sent back in the response.
+func logRequests(c *gin.Context) {
+	start := time.Now()
+	id := c.Request.Header.Get(RequestIDHeader)
+	if id == "" {
+		id = uuid.New()
+	}
+	c.Set(requestIDKey, id)
+	c.Header(RequestIDHeader, id)
+
+	c.Next()
+
+	requestLogger(c).WithFields(logrus.Fields{
+		"method":   c.Request.Method,
+		"path":     c.Request.URL.Path,
+		"status":   c.Writer.Status(),
+		"duration": time.Since(start).String(),
+	}).Info("API request")
+}
+
+// requestLogger returns the logger of the request served by c.
+func requestLogger(c *gin.Context) *logrus.Entry {
+	return logging.Logger().WithField(requestIDKey, c.GetString(requestIDKey))
+}
+
+// LogLevel is the level of the balancer logs.
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+func (as ApiService) logLevelGet(c *gin.Context) {
+	c.JSON(http.StatusOK, LogLevel{Level: logging.Level()})
+}
+
+func (as ApiService) logLevelSet(c *gin.Context) {
+	var level LogLevel
+	if c.BindJSON(&level) != nil {
+		return
+	}
+
+	if err := logging.SetLevel(level.Level); err != nil {
+		c.JSON(422, gin.H{"error": err.Error()})
+		return
+	}
+
+	requestLogger(c).Infof("Log level set to %s", level.Level)
+	c.JSON(http.StatusOK, LogLevel{Level: logging.Level()})
+}
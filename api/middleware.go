@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luizbafilho/fusis/metrics"
+)
+
+// Middleware wraps the API handlers. It runs the rest of the chain, and the
+// handler, by calling c.Next or stops it with c.Abort.
+type Middleware func(c *gin.Context)
+
+// DefaultMiddleware wraps every API handler, outermost first: requests are
+// logged and measured with the status sent, even when the handler panicked,
+// then the API version they ask for is negotiated.
+var DefaultMiddleware = []Middleware{logRequests, observeRequests, recoverPanics, negotiateVersion}
+
+// use wraps every handler of router with chain.
+func use(router *gin.Engine, chain []Middleware) {
+	for _, m := range chain {
+		router.Use(gin.HandlerFunc(m))
+	}
+}
+
+// observeRequests counts the API requests for the metrics, by route pattern.
+func observeRequests(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	metrics.ObserveRequest(c.Request.Method, route, c.Writer.Status(), time.Since(start))
+}
+
+// recoverPanics answers a 500 to requests whose handler panicked, logging the
+// stack, instead of letting the panic take the balancer down.
+func recoverPanics(c *gin.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			requestLogger(c).WithField("stack", string(debug.Stack())).Errorf("API handler panicked: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		}
+	}()
+	c.Next()
+}
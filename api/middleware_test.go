@@ -0,0 +1,263 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luizbafilho/fusis/ipvs"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestMiddlewareRecoversPanics(c *check.C) {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	use(router, DefaultMiddleware)
+	router.GET("/panic", func(c *gin.Context) { panic("boom") })
+	router.GET("/health", func(c *gin.Context) { c.Data(http.StatusOK, gin.MIMEHTML, nil) })
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL + "/panic")
+		c.Assert(err, check.IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, check.Equals, http.StatusInternalServerError)
+		c.Assert(resp.Header.Get(RequestIDHeader), check.Not(check.Equals), "")
+	}
+
+	resp, err := http.Get(srv.URL + "/health")
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+}
+
+func (s *S) TestNegotiateVersion(c *check.C) {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	use(router, []Middleware{negotiateVersion})
+	handler := versioned(map[int]gin.HandlerFunc{
+		1: func(c *gin.Context) { c.String(http.StatusOK, "v1") },
+	})
+	router.GET("/health", handler)
+	router.GET("/v1/health", handler)
+
+	get := func(path, version string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		if version != "" {
+			req.Header.Set(APIVersionHeader, version)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Requests not asking for a version are served the first one
+	for _, t := range []struct{ path, version string }{{"/health", ""}, {"/health", "1"}, {"/v1/health", ""}, {"/v1/health", "1"}} {
+		w := get(t.path, t.version)
+		c.Assert(w.Code, check.Equals, http.StatusOK, check.Commentf("%s %q", t.path, t.version))
+		c.Assert(w.Body.String(), check.Equals, "v1")
+		c.Assert(w.Header().Get(APIVersionHeader), check.Equals, "1")
+	}
+
+	w := get("/health", "2")
+	c.Assert(w.Code, check.Equals, http.StatusNotAcceptable)
+	c.Assert(w.Body.String(), check.Equals, `{"api_version":1,"error":"API version 2 isn't supported","min_api_version":1}`)
+	c.Assert(get("/health", "latest").Code, check.Equals, http.StatusNotAcceptable)
+	c.Assert(get("/v1/health", "2").Code, check.Equals, http.StatusNotAcceptable)
+}
+
+func (s *S) TestVersionedFallsBackToOlderHandler(c *check.C) {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.GET("/health", func(c *gin.Context) {
+		c.Set(apiVersionKey, 3)
+		c.Next()
+	}, versioned(map[int]gin.HandlerFunc{
+		1: func(c *gin.Context) { c.String(http.StatusOK, "v1") },
+		2: func(c *gin.Context) { c.String(http.StatusOK, "v2") },
+		4: func(c *gin.Context) { c.String(http.StatusOK, "v4") },
+	}))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	c.Assert(w.Body.String(), check.Equals, "v2")
+}
+
+func (s *S) TestRateLimit(c *check.C) {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	use(router, []Middleware{RateLimit(1, 2)})
+	router.GET("/health", func(c *gin.Context) { c.Data(http.StatusOK, gin.MIMEHTML, nil) })
+
+	router.ForwardedByClientIP = false
+	get := func(addr, forged string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/health", nil)
+		req.RemoteAddr = addr
+		if forged != "" {
+			req.Header.Set("Authorization", "Bearer "+forged)
+			req.Header.Set("X-Forwarded-For", forged)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	c.Assert(get("10.0.0.1:1234", "").Code, check.Equals, http.StatusOK)
+	c.Assert(get("10.0.0.1:1234", "").Code, check.Equals, http.StatusOK)
+	w := get("10.0.0.1:1234", "")
+	c.Assert(w.Code, check.Equals, http.StatusTooManyRequests)
+	c.Assert(w.Header().Get("Retry-After"), check.Equals, "1")
+
+	// Made up credentials or forwarding headers don't get a new bucket
+	c.Assert(get("10.0.0.1:4321", "10.0.0.2").Code, check.Equals, http.StatusTooManyRequests)
+	// Another client has its own bucket
+	c.Assert(get("10.0.0.2:1234", "").Code, check.Equals, http.StatusOK)
+}
+
+func (s *S) TestRateLimiterRefills(c *check.C) {
+	now := time.Unix(0, 0)
+	l := &rateLimiter{rate: 2, burst: 1, buckets: make(map[string]*tokenBucket), now: func() time.Time { return now }}
+	c.Assert(l.take("a"), check.Equals, time.Duration(0))
+	c.Assert(l.take("a"), check.Equals, 500*time.Millisecond)
+	now = now.Add(500 * time.Millisecond)
+	c.Assert(l.take("a"), check.Equals, time.Duration(0))
+
+	now = now.Add(time.Hour)
+	l.take("b")
+	c.Assert(l.buckets, check.HasLen, 1)
+}
+
+func (s *S) TestGzip(c *check.C) {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	use(router, []Middleware{Gzip()})
+	var encoding string
+	router.POST("/batch/services", func(c *gin.Context) {
+		encoding = c.Request.Header.Get("Content-Encoding")
+		var svcs []ipvs.Service
+		if c.BindJSON(&svcs) != nil {
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"ids": []string{svcs[0].GetId()}})
+	})
+	router.GET("/services", func(c *gin.Context) {
+		c.JSON(http.StatusOK, []ipvs.Service{{Name: "name1"}})
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	cli := NewClient(srv.URL)
+	cli.Compression = true
+	cli.RequestCompression = true
+	ids, err := cli.CreateServices([]ipvs.Service{{Name: "name1"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(ids, check.DeepEquals, []string{"name1"})
+	c.Assert(encoding, check.Equals, "")
+
+	svcs, err := cli.GetServices()
+	c.Assert(err, check.IsNil)
+	c.Assert(svcs, check.HasLen, 1)
+
+	req, _ := http.NewRequest("GET", srv.URL+"/services", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.Header.Get("Content-Encoding"), check.Equals, "gzip")
+
+	resp, err = http.Get(srv.URL + "/services")
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.Uncompressed, check.Equals, true)
+}
+
+func (s *S) TestCompressionWithoutGzip(c *check.C) {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	var encoding string
+	router.POST("/batch/services", func(c *gin.Context) {
+		encoding = c.Request.Header.Get("Content-Encoding")
+		var svcs []ipvs.Service
+		if c.BindJSON(&svcs) != nil {
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"ids": []string{svcs[0].GetId()}})
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	// Asking for gzipped responses works against servers not compressing
+	cli := NewClient(srv.URL)
+	cli.Compression = true
+	ids, err := cli.CreateServices([]ipvs.Service{{Name: "name1"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(ids, check.DeepEquals, []string{"name1"})
+	c.Assert(encoding, check.Equals, "")
+}
+
+func (s *S) TestAudit(c *check.C) {
+	gin.SetMode(gin.ReleaseMode)
+	events, err := newEventLog(10, "", 0)
+	c.Assert(err, check.IsNil)
+	router := gin.New()
+	use(router, []Middleware{logRequests, events.audit})
+	router.POST("/services", func(c *gin.Context) {
+		if dryRun(c) {
+			c.Status(http.StatusOK)
+			return
+		}
+		c.Header("Location", "/services/svc1")
+		c.Status(http.StatusCreated)
+	})
+	router.DELETE("/services/:service_id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.PUT("/services/:service_id", func(c *gin.Context) { c.Status(422) })
+	router.GET("/services", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.PUT("/services/:service_id/destinations/:destination_id/heartbeat", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	serve := func(method, path string, header ...string) {
+		req := httptest.NewRequest(method, path, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve("POST", "/services", RequestIDHeader, "req1")
+	serve("POST", "/services", DryRunHeader, "true")
+	serve("PUT", "/services/svc1")
+	serve("GET", "/services")
+	serve("PUT", "/services/svc1/destinations/dst1/heartbeat")
+	serve("DELETE", "/services/svc1", RequestIDHeader, "req2")
+
+	// Only the writes succeeding are recorded, heartbeats aren't writes
+	recorded := events.between(time.Time{}, time.Time{})
+	c.Assert(recorded, check.HasLen, 2)
+	for i := range recorded {
+		recorded[i].Time = time.Time{}
+	}
+	c.Assert(recorded, check.DeepEquals, []Event{
+		{Operation: "create", Route: "/services", ResourceID: "svc1", RequestID: "req1"},
+		{Operation: "delete", Route: "/services/:service_id", ResourceID: "svc1", RequestID: "req2"},
+	})
+}
+
+func (s *S) TestLocation(c *check.C) {
+	gin.SetMode(gin.ReleaseMode)
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"http://fusis.example.com:8000/services", "http://fusis.example.com:8000/services/svc1/destinations/dst1"},
+		{"https://fusis.example.com/v2/services", "https://fusis.example.com/services/svc1/destinations/dst1"},
+	}
+	for _, tt := range tests {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest("POST", tt.url, nil)
+		c.Assert(location(ctx, "services", "svc1", "destinations", "dst1"), check.Equals, tt.expected)
+	}
+
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest("POST", "/services", nil)
+	ctx.Request.Host = ""
+	c.Assert(location(ctx, "services", "svc1"), check.Equals, "/services/svc1")
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// MergePatchContentType is the media type of JSON merge patches.
+const MergePatchContentType = "application/merge-patch+json"
+
+// mergeService returns svc with the JSON merge patch read from r applied:
+// the fields of the patch replace the ones of svc, objects being merged
+// field by field, and null fields are reset.
+func mergeService(svc ipvs.Service, r io.Reader) (*ipvs.Service, error) {
+	var patch map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&patch); err != nil {
+		return nil, errors.New("the patch must be a JSON object")
+	}
+	fields := jsonFields(reflect.TypeOf(svc))
+	canonical := make(map[string]interface{}, len(patch))
+	for name, value := range patch {
+		field, ok := fields[strings.ToLower(name)]
+		if !ok {
+			return nil, errors.New("unknown field " + name)
+		}
+		canonical[field] = value
+	}
+
+	b, err := json.Marshal(svc)
+	if err != nil {
+		return nil, err
+	}
+	var current map[string]interface{}
+	if err := json.Unmarshal(b, &current); err != nil {
+		return nil, err
+	}
+	if b, err = json.Marshal(mergePatch(current, canonical)); err != nil {
+		return nil, err
+	}
+
+	var merged ipvs.Service
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&merged); err != nil {
+		return nil, err
+	}
+	return &merged, nil
+}
+
+// mergePatch applies patch onto target as RFC 7386 describes.
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = make(map[string]interface{})
+	}
+	for name, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(target, name)
+		case map[string]interface{}:
+			current, _ := target[name].(map[string]interface{})
+			target[name] = mergePatch(current, value)
+		default:
+			target[name] = value
+		}
+	}
+	return target
+}
+
+// jsonFields maps the lowercased JSON names of the fields of the struct t to
+// their names, as encoding/json matches them regardless of case.
+func jsonFields(t reflect.Type) map[string]string {
+	fields := make(map[string]string, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields[strings.ToLower(name)] = name
+	}
+	return fields
+}
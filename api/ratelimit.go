@@ -0,0 +1,92 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit returns a middleware allowing each client rate requests per
+// second on average, and bursts of up to burst requests. Clients are told
+// apart by their IP, as the API doesn't check credentials: keyed by them, a
+// client would get a new bucket for each one it made up. Gin takes the IP
+// from the X-Forwarded-For and X-Real-Ip headers when the router has
+// ForwardedByClientIP set, which the API router clears for the same reason.
+// Requests over the limit are answered with a 429 and a Retry-After header.
+func RateLimit(rate float64, burst int) Middleware {
+	l := &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+	return l.limit
+}
+
+// tokenBucket holds the requests a client may still send at last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+func (l *rateLimiter) limit(c *gin.Context) {
+	if wait := l.take(c.ClientIP()); wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+		return
+	}
+	c.Next()
+}
+
+// take spends a token of the bucket of key, returning how long to wait for
+// one when it is empty.
+func (l *rateLimiter) take(key string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// sweep forgets, once a minute at most, the buckets that have been refilled
+// since, as they are the same as new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// maxLeaderRedirects bounds how many times a write is resent to a new leader,
+// so that nodes disagreeing on the leader during an election can't make a
+// request bounce forever.
+const maxLeaderRedirects = 3
+
+// leaderCache remembers the last leader a write was redirected to. It is
+// shared by shallow copies of a client.
+type leaderCache struct {
+	sync.Mutex
+	addr string
+}
+
+func (l *leaderCache) get() string {
+	if l == nil {
+		return ""
+	}
+	l.Lock()
+	defer l.Unlock()
+	return l.addr
+}
+
+func (l *leaderCache) set(addr string) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.addr = addr
+}
+
+func isWrite(req *http.Request) bool {
+	return req.Method != "GET" && req.Method != "HEAD"
+}
+
+// doFollowingLeader sends a write to the cached leader, if any, and resends
+// it to the leader a node points to when it answers that it isn't the leader.
+func (c *Client) doFollowingLeader(req *http.Request) (*http.Response, error) {
+	for redirects := 0; ; redirects++ {
+		cached := c.leader.get()
+		if cached != "" {
+			var err error
+			if req, err = withHost(req, cached); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := c.doWith(c.HttpClient, req)
+		if err != nil {
+			if cached != "" {
+				// The leader we knew about is gone, start over from Addr.
+				c.leader.set("")
+			}
+			return nil, err
+		}
+		if redirects == maxLeaderRedirects {
+			return resp, nil
+		}
+
+		leader := leaderFromResponse(resp)
+		if leader == "" || leader == req.URL.Host {
+			return resp, nil
+		}
+		resp.Body.Close()
+		c.leader.set(leader)
+	}
+}
+
+// leaderFromResponse returns the leader address a node redirected a write
+// to. The body of resp stays readable.
+func leaderFromResponse(resp *http.Response) string {
+	switch resp.StatusCode {
+	case http.StatusTemporaryRedirect:
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			return ""
+		}
+		return location.Host
+	case StatusNotLeader:
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var notLeader struct {
+			Leader string `json:"leader"`
+		}
+		json.Unmarshal(body, &notLeader)
+		return notLeader.Leader
+	}
+	return ""
+}
+
+// withHost returns a copy of req, with a fresh body, addressed to host.
+func withHost(req *http.Request, host string) (*http.Request, error) {
+	if req.URL.Host == host {
+		return req, nil
+	}
+	newReq := req.Clone(req.Context())
+	newReq.URL.Host = host
+	newReq.Host = host
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		newReq.Body = body
+	}
+	return newReq, nil
+}
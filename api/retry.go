@@ -0,0 +1,76 @@
+package api
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy configures how idempotent requests (GET and DELETE) are retried
+// when the API is unreachable or answers with a 5xx status. Every request
+// rate limited by the server is retried, once the time it asks for elapsed.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. It doubles on every
+	// following attempt.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between two attempts.
+	MaxDelay time.Duration
+}
+
+// backoff returns the jittered delay to wait before the given retry, where
+// retry 0 is the first retry.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < retry && (p.MaxDelay == 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// Waiting somewhere between half and the whole delay keeps clients that
+	// failed together from retrying together.
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// shouldRetry tells if req must be sent again after the given retry, where
+// retry 0 is the first attempt, and how long to wait before.
+func (p *RetryPolicy) shouldRetry(req *http.Request, resp *http.Response, err error, retry int) (time.Duration, bool) {
+	if p == nil || retry >= p.MaxAttempts-1 {
+		return 0, false
+	}
+
+	delay := p.backoff(retry)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		// The request wasn't processed, a write can be resent if its body can
+		if req.Body != nil && req.GetBody == nil {
+			return 0, false
+		}
+		if after := retryAfter(resp); after > delay {
+			delay = after
+		}
+		return delay, true
+	}
+
+	idempotent := req.Method == "GET" || req.Method == "DELETE"
+	return delay, idempotent && (err != nil || resp.StatusCode >= 500)
+}
+
+// retryAfter returns how long the Retry-After header of resp asks to wait,
+// given either in seconds or as a date.
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"crypto/tls"
+
+	"github.com/luizbafilho/fusis/config"
+)
+
+// NewTLSClient returns a client talking HTTPS to addr. certFile and keyFile,
+// when set, hold the PEM client certificate presented to servers requiring
+// mTLS, and caFile, when set, the PEM CAs trusted to sign the server
+// certificate instead of the system ones.
+func NewTLSClient(addr, certFile, keyFile, caFile string) (*Client, error) {
+	tlsConfig, err := ClientTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithOptions(addr, ClientOptions{TLSConfig: tlsConfig}), nil
+}
+
+// ClientTLSConfig loads the PEM files used by NewTLSClient into a TLS
+// configuration.
+func ClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	return config.ClientTLS(certFile, keyFile, caFile)
+}
+
+// serverTLSConfig builds the TLS configuration of the API server. When
+// clientCAFile is set, clients must present a certificate signed by one of
+// its CAs or the handshake fails.
+func serverTLSConfig(clientCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if clientCAFile != "" {
+		pool, err := config.LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixScheme prefixes the addresses of APIs listening on a Unix socket, like
+// unix:///var/run/fusis.sock.
+const unixScheme = "unix://"
+
+// unixHost stands for the socket in the URLs of the requests sent over it.
+const unixHost = "unix"
+
+// unixSocket returns the socket path of addr, when addr is a Unix socket
+// address.
+func unixSocket(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixScheme), true
+}
+
+// overSocket returns a copy of hc whose requests to unixHost are sent over
+// the socket. Requests to other hosts, like the cluster leader, still go
+// over TCP. Clients with a custom RoundTripper are returned unchanged.
+func overSocket(hc *http.Client, socket string) *http.Client {
+	transport, ok := hc.Transport.(*http.Transport)
+	if hc.Transport == nil {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if !ok {
+		return hc
+	}
+
+	t := transport.Clone()
+	dialer := &net.Dialer{Timeout: DefaultDialTimeout}
+	dial := t.DialContext
+	if dial == nil {
+		dial = dialer.DialContext
+		if t.Dial != nil {
+			tcp := t.Dial
+			dial = func(ctx context.Context, network, addr string) (net.Conn, error) { return tcp(network, addr) }
+		}
+	}
+	t.Dial = nil
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == net.JoinHostPort(unixHost, "80") {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		return dial(ctx, network, addr)
+	}
+
+	clone := *hc
+	clone.Transport = t
+	return &clone
+}
+
+// listenUnix listens on the socket at path, replacing a stale one, and gives
+// it the permissions in mode, an octal string like "0660".
+func listenUnix(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %q: %v", mode, err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
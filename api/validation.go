@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/gin-gonic/gin"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// FieldError tells why a field of a service or destination is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned, wrapped in a *RequestError, when the server
+// rejected a service or destination because of the fields in Errors. It
+// unwraps to ErrInvalidRequest.
+type ValidationError struct {
+	Message string
+	Errors  []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidRequest
+}
+
+// validationError decodes the fields at fault from the body of a 400 or 422
+// response, returning nil when the body lists none.
+func validationError(body []byte) *ValidationError {
+	var decoded struct {
+		Error  string       `json:"error"`
+		Errors []FieldError `json:"errors"`
+	}
+	if json.Unmarshal(body, &decoded) != nil || len(decoded.Errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Message: decoded.Error, Errors: decoded.Errors}
+}
+
+// invalid is the body answered to a request rejected by err, listing the
+// field at fault when err is an *ipvs.ValidationError.
+func invalid(err error) gin.H {
+	var verr *ipvs.ValidationError
+	if errors.As(err, &verr) {
+		return gin.H{"error": err.Error(), "errors": []FieldError{{Field: verr.Field, Message: verr.Reason}}}
+	}
+	return gin.H{"error": err.Error()}
+}
+
+// invalidField is the body answered to a request whose field is invalid.
+func invalidField(field, message string) gin.H {
+	return gin.H{"error": message, "errors": []FieldError{{Field: field, Message: message}}}
+}
+
+// invalidStruct is the body answered to a request whose fields govalidator
+// rejected, sorted by field.
+func invalidStruct(err error) gin.H {
+	fields := []FieldError{}
+	for field, message := range govalidator.ErrorsByField(err) {
+		fields = append(fields, FieldError{Field: field, Message: message})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Field < fields[j].Field })
+
+	messages := []string{}
+	for _, f := range fields {
+		messages = append(messages, f.Field+": "+f.Message)
+	}
+	return gin.H{"error": strings.Join(messages, "; "), "errors": fields}
+}
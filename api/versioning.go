@@ -0,0 +1,97 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIVersionHeader carries the API version a request asks for, and the one
+// the response was served in.
+const APIVersionHeader = "X-Fusis-API-Version"
+
+// unversionedAPIVersion is served to the requests not asking for a version,
+// the API as it was before versions were negotiated.
+const unversionedAPIVersion = 1
+
+// apiVersionKey holds the API version of a request in its context.
+const apiVersionKey = "api_version"
+
+// negotiateVersion picks the API version of a request: the one of its /v<N>
+// path prefix, else the one of its X-Fusis-API-Version header. Requests for
+// a version that isn't served are answered with 406. The version served is
+// sent back in the header.
+func negotiateVersion(c *gin.Context) {
+	version := unversionedAPIVersion
+	header := c.GetHeader(APIVersionHeader)
+	if header != "" {
+		v, err := strconv.Atoi(strings.TrimPrefix(header, "v"))
+		if err != nil {
+			unsupportedVersion(c, header)
+			return
+		}
+		version = v
+	}
+	if v, ok := pathVersion(c.Request.URL.Path); ok {
+		if header != "" && v != version {
+			c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"error": fmt.Sprintf("API version %s doesn't match the path version %d", header, v)})
+			return
+		}
+		version = v
+	}
+	if version < MinAPIVersion || version > APIVersion {
+		unsupportedVersion(c, strconv.Itoa(version))
+		return
+	}
+
+	c.Set(apiVersionKey, version)
+	c.Header(APIVersionHeader, strconv.Itoa(version))
+	c.Next()
+}
+
+func unsupportedVersion(c *gin.Context, version string) {
+	c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{
+		"error":           fmt.Sprintf("API version %s isn't supported", version),
+		"api_version":     APIVersion,
+		"min_api_version": MinAPIVersion,
+	})
+}
+
+// pathVersion returns the version of a /v<N> path prefix.
+func pathVersion(path string) (int, bool) {
+	if !strings.HasPrefix(path, "/v") {
+		return 0, false
+	}
+	prefix := strings.SplitN(path[2:], "/", 2)[0]
+	v, err := strconv.Atoi(prefix)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// requestAPIVersion returns the API version negotiated for the request.
+func requestAPIVersion(c *gin.Context) int {
+	if v, ok := c.Get(apiVersionKey); ok {
+		return v.(int)
+	}
+	return unversionedAPIVersion
+}
+
+// versioned routes requests to the handler of their API version or, when it
+// has none, of the closest older version. Only the versions changing a route
+// need a handler of their own.
+func versioned(handlers map[int]gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for v := requestAPIVersion(c); v >= MinAPIVersion; v-- {
+			if h, ok := handlers[v]; ok {
+				h(c)
+				return
+			}
+		}
+		unsupportedVersion(c, strconv.Itoa(requestAPIVersion(c)))
+	}
+}
@@ -0,0 +1,276 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// BGP-4 message types, RFC 4271.
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+)
+
+const (
+	headerLen  = 19
+	maxMsgLen  = 4096
+	bgpVersion = 4
+	// asTrans stands for a 4 octets AS in the 2 octets fields, RFC 6793.
+	asTrans = 23456
+)
+
+// Path attributes of the announced routes.
+const (
+	attrOrigin    = 1
+	attrASPath    = 2
+	attrNextHop   = 3
+	attrLocalPref = 5
+
+	flagTransitive = 0x40
+	originIGP      = 0
+	asSequence     = 2
+	localPref      = 100
+)
+
+// Capabilities, RFC 5492.
+const (
+	paramCapabilities = 2
+	capMultiprotocol  = 1
+	capFourOctetAS    = 65
+)
+
+// NOTIFICATION error codes.
+const (
+	errOpenMessage   = 2
+	errHoldTimer     = 4
+	errCease         = 6
+	subBadPeerAS     = 2
+	subAdminShutdown = 2
+)
+
+// message is a BGP message without its header.
+type message struct {
+	Type byte
+	Body []byte
+}
+
+// open is the content of an OPEN message.
+type open struct {
+	AS       uint32
+	HoldTime uint16
+	RouterID net.IP
+	// FourOctetAS tells if the sender supports 4 octets AS numbers.
+	FourOctetAS bool
+}
+
+func writeMessage(w io.Writer, typ byte, body []byte) error {
+	msg := make([]byte, headerLen, headerLen+len(body))
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:], uint16(headerLen+len(body)))
+	msg[18] = typ
+	_, err := w.Write(append(msg, body...))
+	return err
+}
+
+func readMessage(r io.Reader) (message, error) {
+	var header [headerLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return message{}, err
+	}
+	for _, b := range header[:16] {
+		if b != 0xff {
+			return message{}, errors.New("bad message marker")
+		}
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < headerLen || length > maxMsgLen {
+		return message{}, fmt.Errorf("bad message length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return message{}, err
+	}
+	return message{Type: header[18], Body: body}, nil
+}
+
+// encodeOpen announces IPv4 unicast routes and 4 octets AS support.
+func encodeOpen(o open) []byte {
+	as := uint16(o.AS)
+	if o.AS > 0xffff {
+		as = asTrans
+	}
+	caps := []byte{
+		capMultiprotocol, 4, 0, 1, 0, 1, // AFI IPv4, SAFI unicast
+		capFourOctetAS, 4, 0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint32(caps[8:], o.AS)
+
+	body := []byte{bgpVersion, 0, 0, 0, 0, 0, 0, 0, 0, byte(2 + len(caps)), paramCapabilities, byte(len(caps))}
+	binary.BigEndian.PutUint16(body[1:], as)
+	binary.BigEndian.PutUint16(body[3:], o.HoldTime)
+	copy(body[5:9], o.RouterID.To4())
+	return append(body, caps...)
+}
+
+func decodeOpen(body []byte) (open, error) {
+	if len(body) < 10 || body[0] != bgpVersion {
+		return open{}, errors.New("bad OPEN message")
+	}
+	o := open{
+		AS:       uint32(binary.BigEndian.Uint16(body[1:])),
+		HoldTime: binary.BigEndian.Uint16(body[3:]),
+		RouterID: net.IP(append([]byte{}, body[5:9]...)),
+	}
+	params := body[10:]
+	if len(params) != int(body[9]) {
+		return open{}, errors.New("bad OPEN optional parameters")
+	}
+	for len(params) >= 2 {
+		typ, length := params[0], int(params[1])
+		if len(params) < 2+length {
+			return open{}, errors.New("bad OPEN optional parameters")
+		}
+		if typ == paramCapabilities {
+			for caps := params[2 : 2+length]; len(caps) >= 2; {
+				code, capLen := caps[0], int(caps[1])
+				if len(caps) < 2+capLen {
+					return open{}, errors.New("bad OPEN capability")
+				}
+				if code == capFourOctetAS && capLen == 4 {
+					o.FourOctetAS = true
+					o.AS = binary.BigEndian.Uint32(caps[2:])
+				}
+				caps = caps[2+capLen:]
+			}
+		}
+		params = params[2+length:]
+	}
+	return o, nil
+}
+
+// update is the content of an UPDATE message, limited to the IPv4 routes
+// this package announces.
+type update struct {
+	Withdrawn []net.IP
+	NLRI      []net.IP
+	NextHop   net.IP
+}
+
+// encodeUpdate encodes u for a peer. The local AS is prepended to the path
+// when announcing to external peers, and internal peers get a local
+// preference instead.
+func encodeUpdate(u update, localAS uint32, external, fourOctetAS bool) []byte {
+	var buf bytes.Buffer
+	withdrawn := encodePrefixes(u.Withdrawn)
+	binary.Write(&buf, binary.BigEndian, uint16(len(withdrawn)))
+	buf.Write(withdrawn)
+
+	var attrs []byte
+	if len(u.NLRI) > 0 {
+		attrs = append(attrs, flagTransitive, attrOrigin, 1, originIGP)
+		switch {
+		case !external:
+			attrs = append(attrs, flagTransitive, attrASPath, 0)
+		case fourOctetAS:
+			attrs = append(attrs, flagTransitive, attrASPath, 6, asSequence, 1)
+			attrs = binary.BigEndian.AppendUint32(attrs, localAS)
+		default:
+			as := uint16(localAS)
+			if localAS > 0xffff {
+				as = asTrans
+			}
+			attrs = append(attrs, flagTransitive, attrASPath, 4, asSequence, 1)
+			attrs = binary.BigEndian.AppendUint16(attrs, as)
+		}
+		attrs = append(attrs, flagTransitive, attrNextHop, 4)
+		attrs = append(attrs, u.NextHop.To4()...)
+		if !external {
+			attrs = append(attrs, flagTransitive, attrLocalPref, 4)
+			attrs = binary.BigEndian.AppendUint32(attrs, localPref)
+		}
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(len(attrs)))
+	buf.Write(attrs)
+	buf.Write(encodePrefixes(u.NLRI))
+	return buf.Bytes()
+}
+
+// decodeUpdate reads the withdrawn routes, next hop and NLRI of an UPDATE.
+func decodeUpdate(body []byte) (update, error) {
+	var u update
+	if len(body) < 2 {
+		return u, errors.New("bad UPDATE message")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n+2 {
+		return u, errors.New("bad UPDATE withdrawn routes")
+	}
+	var err error
+	if u.Withdrawn, err = decodePrefixes(body[2 : 2+n]); err != nil {
+		return u, err
+	}
+	body = body[2+n:]
+	n = int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return u, errors.New("bad UPDATE path attributes")
+	}
+	for attrs := body[2 : 2+n]; len(attrs) > 0; {
+		if len(attrs) < 3 {
+			return u, errors.New("bad UPDATE path attribute")
+		}
+		flags, typ, length, offset := attrs[0], attrs[1], int(attrs[2]), 3
+		if flags&0x10 != 0 {
+			if len(attrs) < 4 {
+				return u, errors.New("bad UPDATE path attribute")
+			}
+			length, offset = int(binary.BigEndian.Uint16(attrs[2:])), 4
+		}
+		if len(attrs) < offset+length {
+			return u, errors.New("bad UPDATE path attribute")
+		}
+		if typ == attrNextHop && length == 4 {
+			u.NextHop = net.IP(append([]byte{}, attrs[offset:offset+4]...))
+		}
+		attrs = attrs[offset+length:]
+	}
+	u.NLRI, err = decodePrefixes(body[2+n:])
+	return u, err
+}
+
+// encodePrefixes encodes host routes to ips.
+func encodePrefixes(ips []net.IP) []byte {
+	var b []byte
+	for _, ip := range ips {
+		b = append(append(b, 32), ip.To4()...)
+	}
+	return b
+}
+
+// decodePrefixes decodes IPv4 prefixes, keeping only their address.
+func decodePrefixes(b []byte) ([]net.IP, error) {
+	var ips []net.IP
+	for len(b) > 0 {
+		bits := int(b[0])
+		size := (bits + 7) / 8
+		if bits > 32 || len(b) < 1+size {
+			return nil, errors.New("bad prefix")
+		}
+		ip := make(net.IP, 4)
+		copy(ip, b[1:1+size])
+		ips = append(ips, ip)
+		b = b[1+size:]
+	}
+	return ips, nil
+}
+
+func encodeNotification(code, subcode byte) []byte {
+	return []byte{code, subcode}
+}
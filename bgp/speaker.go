@@ -0,0 +1,488 @@
+// Package bgp announces the VIPs of the services to BGP peers, so routers
+// send their traffic to the balancers holding them.
+//
+// It implements the small part of BGP-4 needed to announce IPv4 host routes
+// to configured peers, without learning any route from them.
+package bgp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/logging"
+)
+
+const (
+	// DefaultPort is where BGP peers are connected to unless configured
+	// otherwise.
+	DefaultPort = 179
+	// DefaultHoldTime, in seconds, is proposed to the peers when no hold
+	// time is configured.
+	DefaultHoldTime = 90
+	// maxPrefixesPerUpdate keeps the UPDATE messages under the BGP size
+	// limit.
+	maxPrefixesPerUpdate = 500
+)
+
+// connectRetry is how long a failed session waits before connecting again.
+var connectRetry = 5 * time.Second
+
+// Route is a VIP announced to the peers, with the services it is the VIP
+// of.
+type Route struct {
+	Prefix   string   `json:"prefix"`
+	NextHop  string   `json:"next_hop"`
+	Services []string `json:"services"`
+}
+
+// State is what a speaker announces, and to whom.
+type State struct {
+	Advertising bool `json:"advertising"`
+	// Reason tells why the routes are withdrawn when not advertising.
+	Reason string       `json:"reason,omitempty"`
+	Routes []Route      `json:"routes"`
+	Peers  []PeerStatus `json:"peers"`
+}
+
+// PeerStatus is the state of the session with a peer.
+type PeerStatus struct {
+	Address     string `json:"address"`
+	AS          uint32 `json:"as"`
+	Established bool   `json:"established"`
+	// Error is why the last session failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// Speaker keeps BGP sessions with the configured peers and announces them
+// the routes set.
+type Speaker struct {
+	sync.Mutex
+	localAS  uint32
+	routerID net.IP
+	nextHop  net.IP
+	holdTime uint16
+	peers    []*peer
+	// routes maps the VIPs to announce to their services.
+	routes map[string][]string
+	// withdrawn, when not empty, is why no route is announced.
+	withdrawn string
+	logger    *logrus.Entry
+	cancel    context.CancelFunc
+}
+
+// New returns a speaker for cfg. It doesn't connect to the peers until
+// started.
+func New(cfg config.BGP) (*Speaker, error) {
+	if cfg.LocalAS == 0 {
+		return nil, fmt.Errorf("bgp: LocalAS is required")
+	}
+	routerID := net.ParseIP(cfg.RouterID).To4()
+	if routerID == nil {
+		return nil, fmt.Errorf("bgp: RouterID %q is not an IPv4 address", cfg.RouterID)
+	}
+	nextHop := routerID
+	if cfg.NextHop != "" {
+		if nextHop = net.ParseIP(cfg.NextHop).To4(); nextHop == nil {
+			return nil, fmt.Errorf("bgp: NextHop %q is not an IPv4 address", cfg.NextHop)
+		}
+	}
+	holdTime := cfg.HoldTime
+	if holdTime == 0 {
+		holdTime = DefaultHoldTime
+	}
+	if holdTime < 3 || holdTime > 0xffff {
+		return nil, fmt.Errorf("bgp: HoldTime must be between 3 and 65535 seconds")
+	}
+
+	s := &Speaker{
+		localAS:  cfg.LocalAS,
+		routerID: routerID,
+		nextHop:  nextHop,
+		holdTime: uint16(holdTime),
+		routes:   make(map[string][]string),
+		logger:   logging.Logger().WithField("component", "bgp"),
+	}
+	for _, p := range cfg.Peers {
+		if net.ParseIP(p.Address) == nil {
+			return nil, fmt.Errorf("bgp: peer address %q is not an IP address", p.Address)
+		}
+		if p.AS == 0 {
+			return nil, fmt.Errorf("bgp: peer %s has no AS", p.Address)
+		}
+		port := p.Port
+		if port == 0 {
+			port = DefaultPort
+		}
+		addr := net.JoinHostPort(p.Address, strconv.Itoa(port))
+		s.peers = append(s.peers, &peer{
+			speaker: s,
+			addr:    addr,
+			as:      p.AS,
+			changed: make(chan struct{}, 1),
+			status:  PeerStatus{Address: addr, AS: p.AS},
+		})
+	}
+	return s, nil
+}
+
+// Start connects to the peers, reconnecting whenever a session fails.
+func (s *Speaker) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Lock()
+	s.cancel = cancel
+	s.Unlock()
+	for _, p := range s.peers {
+		go p.run(ctx)
+	}
+}
+
+// Stop closes the sessions, which makes the peers withdraw every route.
+func (s *Speaker) Stop() {
+	s.Lock()
+	cancel := s.cancel
+	s.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// SetRoutes announces the VIPs of the given services, keyed by service id,
+// and withdraws the VIPs not in it anymore. IPv6 VIPs aren't announced.
+func (s *Speaker) SetRoutes(vips map[string]net.IP) {
+	routes := make(map[string][]string)
+	for id, vip := range vips {
+		if vip.To4() == nil {
+			continue
+		}
+		key := vip.To4().String()
+		routes[key] = append(routes[key], id)
+	}
+	for _, services := range routes {
+		sort.Strings(services)
+	}
+
+	s.Lock()
+	s.routes = routes
+	s.Unlock()
+	s.notify()
+}
+
+// Withdraw stops announcing every route, for the given reason, until
+// Resume is called. The sessions stay up so announcing again is immediate.
+func (s *Speaker) Withdraw(reason string) {
+	s.Lock()
+	changed := s.withdrawn != reason
+	s.withdrawn = reason
+	s.Unlock()
+	if changed {
+		s.logger.Warnf("Withdrawing every route: %s", reason)
+		s.notify()
+	}
+}
+
+// Resume announces the routes set again after Withdraw.
+func (s *Speaker) Resume() {
+	s.Lock()
+	changed := s.withdrawn != ""
+	s.withdrawn = ""
+	s.Unlock()
+	if changed {
+		s.logger.Infof("Announcing the routes again")
+		s.notify()
+	}
+}
+
+// notify makes the sessions send the changes of the routes.
+func (s *Speaker) notify() {
+	for _, p := range s.peers {
+		select {
+		case p.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// State returns the routes announced and the state of the sessions.
+func (s *Speaker) State() State {
+	s.Lock()
+	defer s.Unlock()
+
+	state := State{
+		Advertising: s.withdrawn == "",
+		Reason:      s.withdrawn,
+		Routes:      s.announced(),
+		Peers:       []PeerStatus{},
+	}
+	for _, p := range s.peers {
+		state.Peers = append(state.Peers, p.status)
+	}
+	return state
+}
+
+// Routes returns the routes announced, sorted by prefix.
+func (s *Speaker) Routes() []Route {
+	s.Lock()
+	defer s.Unlock()
+	return s.announced()
+}
+
+func (s *Speaker) announced() []Route {
+	routes := []Route{}
+	if s.withdrawn != "" {
+		return routes
+	}
+	for vip, services := range s.routes {
+		routes = append(routes, Route{
+			Prefix:   vip + "/32",
+			NextHop:  s.nextHop.String(),
+			Services: append([]string{}, services...),
+		})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Prefix < routes[j].Prefix })
+	return routes
+}
+
+// vips returns the VIPs to announce.
+func (s *Speaker) vips() map[string]bool {
+	s.Lock()
+	defer s.Unlock()
+
+	vips := make(map[string]bool, len(s.routes))
+	if s.withdrawn != "" {
+		return vips
+	}
+	for vip := range s.routes {
+		vips[vip] = true
+	}
+	return vips
+}
+
+// peer is a BGP neighbor, with the VIPs announced to it in the current
+// session.
+type peer struct {
+	speaker *Speaker
+	addr    string
+	as      uint32
+	changed chan struct{}
+	// fourOctetAS tells if the peer of the current session supports 4
+	// octets AS numbers.
+	fourOctetAS bool
+	// status is guarded by the speaker lock.
+	status PeerStatus
+}
+
+func (p *peer) run(ctx context.Context) {
+	for {
+		err := p.session(ctx)
+		p.setStatus(false, err)
+		if ctx.Err() != nil {
+			return
+		}
+		p.speaker.logger.Warnf("Session with peer %s failed: %v", p.addr, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(connectRetry):
+		}
+	}
+}
+
+// session opens a session with the peer and keeps it up to date with the
+// routes of the speaker until it fails or ctx is done.
+func (p *peer) session(ctx context.Context) error {
+	s := p.speaker
+	var dialer net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, connectRetry)
+	conn, err := dialer.DialContext(dialCtx, "tcp", p.addr)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Established sessions are kept alive below, but a peer never
+	// answering the handshake must not hang it
+	conn.SetDeadline(time.Now().Add(time.Duration(s.holdTime) * time.Second))
+	if err := writeMessage(conn, msgOpen, encodeOpen(open{AS: s.localAS, HoldTime: s.holdTime, RouterID: s.routerID})); err != nil {
+		return err
+	}
+	remote, err := p.handshake(conn)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	holdTime := time.Duration(s.holdTime) * time.Second
+	if remote.HoldTime != 0 && time.Duration(remote.HoldTime)*time.Second < holdTime {
+		holdTime = time.Duration(remote.HoldTime) * time.Second
+	}
+	s.logger.Infof("Session with peer %s established", p.addr)
+	p.setStatus(true, nil)
+
+	// Every message received resets the hold timer
+	received := make(chan error)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			msg, err := readMessage(conn)
+			if err == nil && msg.Type == msgNotification {
+				err = notificationError(msg.Body)
+			}
+			select {
+			case received <- err:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	sent := map[string]bool{}
+	send := func() error {
+		update := p.diff(sent, s.vips())
+		for _, body := range update {
+			if err := writeMessage(conn, msgUpdate, body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := send(); err != nil {
+		return err
+	}
+
+	keepalive := time.NewTicker(holdTime / 3)
+	defer keepalive.Stop()
+	hold := time.NewTimer(holdTime)
+	defer hold.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			writeMessage(conn, msgNotification, encodeNotification(errCease, subAdminShutdown))
+			return ctx.Err()
+		case err := <-received:
+			if err != nil {
+				return err
+			}
+			hold.Reset(holdTime)
+		case <-hold.C:
+			writeMessage(conn, msgNotification, encodeNotification(errHoldTimer, 0))
+			return fmt.Errorf("hold timer expired")
+		case <-keepalive.C:
+			if err := writeMessage(conn, msgKeepalive, nil); err != nil {
+				return err
+			}
+		case <-p.changed:
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *peer) setStatus(established bool, err error) {
+	p.speaker.Lock()
+	defer p.speaker.Unlock()
+
+	p.status.Established = established
+	if err != nil {
+		p.status.Error = err.Error()
+	} else if established {
+		p.status.Error = ""
+	}
+}
+
+// handshake waits for the OPEN and KEEPALIVE of the peer, answering the
+// OPEN with a KEEPALIVE.
+func (p *peer) handshake(conn net.Conn) (open, error) {
+	msg, err := readMessage(conn)
+	if err != nil {
+		return open{}, err
+	}
+	if msg.Type == msgNotification {
+		return open{}, notificationError(msg.Body)
+	}
+	if msg.Type != msgOpen {
+		return open{}, fmt.Errorf("expected OPEN, got message type %d", msg.Type)
+	}
+	remote, err := decodeOpen(msg.Body)
+	if err != nil {
+		return open{}, err
+	}
+	if remote.AS != p.as {
+		writeMessage(conn, msgNotification, encodeNotification(errOpenMessage, subBadPeerAS))
+		return open{}, fmt.Errorf("peer AS is %d, expected %d", remote.AS, p.as)
+	}
+	if err := writeMessage(conn, msgKeepalive, nil); err != nil {
+		return open{}, err
+	}
+
+	msg, err = readMessage(conn)
+	if err != nil {
+		return open{}, err
+	}
+	if msg.Type == msgNotification {
+		return open{}, notificationError(msg.Body)
+	}
+	if msg.Type != msgKeepalive {
+		return open{}, fmt.Errorf("expected KEEPALIVE, got message type %d", msg.Type)
+	}
+	p.fourOctetAS = remote.FourOctetAS
+	return remote, nil
+}
+
+// diff returns the UPDATE messages taking the peer from the sent VIPs to
+// the wanted ones, and records them as sent.
+func (p *peer) diff(sent, wanted map[string]bool) [][]byte {
+	var withdrawn, announced []net.IP
+	for vip := range sent {
+		if !wanted[vip] {
+			withdrawn = append(withdrawn, net.ParseIP(vip))
+			delete(sent, vip)
+		}
+	}
+	for vip := range wanted {
+		if !sent[vip] {
+			announced = append(announced, net.ParseIP(vip))
+			sent[vip] = true
+		}
+	}
+
+	s := p.speaker
+	external := p.as != s.localAS
+	var bodies [][]byte
+	for len(withdrawn) > 0 || len(announced) > 0 {
+		var u update
+		u.Withdrawn, withdrawn = split(withdrawn)
+		if len(u.Withdrawn) == 0 {
+			u.NLRI, announced = split(announced)
+			u.NextHop = s.nextHop
+		}
+		bodies = append(bodies, encodeUpdate(u, s.localAS, external, p.fourOctetAS))
+	}
+	return bodies
+}
+
+func split(ips []net.IP) ([]net.IP, []net.IP) {
+	if len(ips) > maxPrefixesPerUpdate {
+		return ips[:maxPrefixesPerUpdate], ips[maxPrefixesPerUpdate:]
+	}
+	return ips, nil
+}
+
+func notificationError(body []byte) error {
+	if len(body) < 2 {
+		return fmt.Errorf("peer sent a NOTIFICATION")
+	}
+	return fmt.Errorf("peer sent a NOTIFICATION, error %d subcode %d", body[0], body[1])
+}
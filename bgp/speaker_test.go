@@ -0,0 +1,204 @@
+package bgp
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/luizbafilho/fusis/config"
+	"gopkg.in/check.v1"
+)
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+// router accepts a single BGP session from a speaker, as a peer of the
+// given AS.
+type router struct {
+	ln   net.Listener
+	conn net.Conn
+	as   uint32
+}
+
+func newRouter(c *check.C, as uint32) *router {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	return &router{ln: ln, as: as}
+}
+
+func (r *router) port() int {
+	return r.ln.Addr().(*net.TCPAddr).Port
+}
+
+// accept completes the handshake of the session, returning the OPEN of the
+// speaker.
+func (r *router) accept(c *check.C) open {
+	conn, err := r.ln.Accept()
+	c.Assert(err, check.IsNil)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r.conn = conn
+
+	msg := r.read(c, msgOpen)
+	o, err := decodeOpen(msg.Body)
+	c.Assert(err, check.IsNil)
+	body := encodeOpen(open{AS: r.as, HoldTime: 30, RouterID: net.ParseIP("10.0.0.254")})
+	c.Assert(writeMessage(conn, msgOpen, body), check.IsNil)
+	c.Assert(writeMessage(conn, msgKeepalive, nil), check.IsNil)
+	r.read(c, msgKeepalive)
+	return o
+}
+
+// read returns the next message of the speaker which isn't a KEEPALIVE,
+// unless one is expected.
+func (r *router) read(c *check.C, typ byte) message {
+	for {
+		msg, err := readMessage(r.conn)
+		c.Assert(err, check.IsNil)
+		if msg.Type == msgKeepalive && typ != msgKeepalive {
+			continue
+		}
+		c.Assert(msg.Type, check.Equals, typ)
+		return msg
+	}
+}
+
+func (r *router) update(c *check.C) update {
+	u, err := decodeUpdate(r.read(c, msgUpdate).Body)
+	c.Assert(err, check.IsNil)
+	return u
+}
+
+func (r *router) close() {
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.ln.Close()
+}
+
+func speaker(c *check.C, localAS uint32, peers ...config.BGPPeer) *Speaker {
+	s, err := New(config.BGP{LocalAS: localAS, RouterID: "10.0.0.1", NextHop: "10.0.0.2", Peers: peers})
+	c.Assert(err, check.IsNil)
+	return s
+}
+
+func (s *S) TestSpeakerAnnouncesAndWithdraws(c *check.C) {
+	r := newRouter(c, 65001)
+	defer r.close()
+	sp := speaker(c, 65000, config.BGPPeer{Address: "127.0.0.1", AS: 65001, Port: r.port()})
+	sp.SetRoutes(map[string]net.IP{"web": net.ParseIP("192.168.0.10")})
+	sp.Start()
+	defer sp.Stop()
+
+	o := r.accept(c)
+	c.Assert(o.AS, check.Equals, uint32(65000))
+	c.Assert(o.FourOctetAS, check.Equals, true)
+	c.Assert(o.RouterID.String(), check.Equals, "10.0.0.1")
+
+	u := r.update(c)
+	c.Assert(u.NLRI, check.DeepEquals, []net.IP{net.ParseIP("192.168.0.10").To4()})
+	c.Assert(u.NextHop.String(), check.Equals, "10.0.0.2")
+
+	sp.SetRoutes(map[string]net.IP{
+		"web":  net.ParseIP("192.168.0.10"),
+		"api":  net.ParseIP("192.168.0.10"),
+		"ipv6": net.ParseIP("2001:db8::1"),
+	})
+	c.Assert(sp.Routes(), check.DeepEquals, []Route{
+		{Prefix: "192.168.0.10/32", NextHop: "10.0.0.2", Services: []string{"api", "web"}},
+	})
+
+	sp.SetRoutes(nil)
+	u = r.update(c)
+	c.Assert(u.Withdrawn, check.DeepEquals, []net.IP{net.ParseIP("192.168.0.10").To4()})
+	c.Assert(u.NLRI, check.HasLen, 0)
+	c.Assert(sp.Routes(), check.HasLen, 0)
+
+	sp.Stop()
+	msg := r.read(c, msgNotification)
+	c.Assert(msg.Body, check.DeepEquals, []byte{errCease, subAdminShutdown})
+}
+
+func (s *S) TestSpeakerWithdrawAndResume(c *check.C) {
+	r := newRouter(c, 65000)
+	defer r.close()
+	sp := speaker(c, 65000, config.BGPPeer{Address: "127.0.0.1", AS: 65000, Port: r.port()})
+	sp.SetRoutes(map[string]net.IP{"web": net.ParseIP("192.168.0.10")})
+	sp.Start()
+	defer sp.Stop()
+
+	r.accept(c)
+	c.Assert(r.update(c).NLRI, check.HasLen, 1)
+	state := sp.State()
+	c.Assert(state.Advertising, check.Equals, true)
+	c.Assert(state.Peers, check.DeepEquals, []PeerStatus{
+		{Address: net.JoinHostPort("127.0.0.1", strconv.Itoa(r.port())), AS: 65000, Established: true},
+	})
+
+	sp.Withdraw("shutting down")
+	u := r.update(c)
+	c.Assert(u.Withdrawn, check.DeepEquals, []net.IP{net.ParseIP("192.168.0.10").To4()})
+	state = sp.State()
+	c.Assert(state.Advertising, check.Equals, false)
+	c.Assert(state.Reason, check.Equals, "shutting down")
+	c.Assert(state.Routes, check.HasLen, 0)
+
+	// Routes set while withdrawn are only announced once resumed
+	sp.SetRoutes(map[string]net.IP{"web": net.ParseIP("192.168.0.10"), "api": net.ParseIP("192.168.0.11")})
+	sp.Resume()
+	u = r.update(c)
+	c.Assert(u.NLRI, check.HasLen, 2)
+	c.Assert(sp.State().Routes, check.HasLen, 2)
+}
+
+func (s *S) TestSpeakerRejectsWrongPeerAS(c *check.C) {
+	r := newRouter(c, 65002)
+	defer r.close()
+	sp := speaker(c, 65000, config.BGPPeer{Address: "127.0.0.1", AS: 65001, Port: r.port()})
+	sp.Start()
+	defer sp.Stop()
+
+	conn, err := r.ln.Accept()
+	c.Assert(err, check.IsNil)
+	r.conn = conn
+	r.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r.read(c, msgOpen)
+	c.Assert(writeMessage(conn, msgOpen, encodeOpen(open{AS: r.as, HoldTime: 30, RouterID: net.ParseIP("10.0.0.254")})), check.IsNil)
+	msg := r.read(c, msgNotification)
+	c.Assert(msg.Body, check.DeepEquals, []byte{errOpenMessage, subBadPeerAS})
+}
+
+func (s *S) TestEncodeUpdateASPath(c *check.C) {
+	u := update{NLRI: []net.IP{net.ParseIP("192.168.0.10")}, NextHop: net.ParseIP("10.0.0.2")}
+
+	// External peers get the local AS in the path, 2 octets wide unless
+	// they support 4 octets
+	body := encodeUpdate(u, 65000, true, false)
+	c.Assert(body[4:13], check.DeepEquals, []byte{
+		flagTransitive, attrOrigin, 1, originIGP,
+		flagTransitive, attrASPath, 4, asSequence, 1,
+	})
+	c.Assert(body[13:15], check.DeepEquals, []byte{0xfd, 0xe8})
+
+	// Internal peers get an empty path and a local preference
+	body = encodeUpdate(u, 65000, false, true)
+	decoded, err := decodeUpdate(body)
+	c.Assert(err, check.IsNil)
+	c.Assert(decoded.NextHop.String(), check.Equals, "10.0.0.2")
+	c.Assert(body[8:11], check.DeepEquals, []byte{flagTransitive, attrASPath, 0})
+}
+
+func (s *S) TestNewValidatesConfig(c *check.C) {
+	_, err := New(config.BGP{RouterID: "10.0.0.1"})
+	c.Assert(err, check.ErrorMatches, "bgp: LocalAS is required")
+	_, err = New(config.BGP{LocalAS: 65000, RouterID: "::1"})
+	c.Assert(err, check.ErrorMatches, `bgp: RouterID "::1" is not an IPv4 address`)
+	_, err = New(config.BGP{LocalAS: 65000, RouterID: "10.0.0.1", Peers: []config.BGPPeer{{Address: "router", AS: 1}}})
+	c.Assert(err, check.ErrorMatches, `bgp: peer address "router" is not an IP address`)
+	sp, err := New(config.BGP{LocalAS: 65000, RouterID: "10.0.0.1", Peers: []config.BGPPeer{{Address: "10.0.0.254", AS: 1}}})
+	c.Assert(err, check.IsNil)
+	c.Assert(sp.peers[0].addr, check.Equals, net.JoinHostPort("10.0.0.254", strconv.Itoa(DefaultPort)))
+}
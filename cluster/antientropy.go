@@ -0,0 +1,64 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Fetcher returns the entries of the member at addr.
+type Fetcher func(addr string) ([]Entry, error)
+
+// HTTPFetcher fetches the entries members serve on their /cluster/state API,
+// addr being their API address and scheme either http or https.
+func HTTPFetcher(client *http.Client, scheme string) Fetcher {
+	return func(addr string) ([]Entry, error) {
+		resp, err := client.Get(fmt.Sprintf("%s://%s/cluster/state", scheme, addr))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching the state of %s failed: %s", addr, resp.Status)
+		}
+
+		var entries []Entry
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+		return entries, err
+	}
+}
+
+// Sync merges the entries of one of peers, picked at random.
+func (g *Gossip) Sync(peers []string, fetch Fetcher) error {
+	if len(peers) == 0 {
+		return nil
+	}
+
+	entries, err := fetch(peers[rand.Intn(len(peers))])
+	if err != nil {
+		return err
+	}
+	return g.Merge(entries)
+}
+
+// RunAntiEntropy syncs with the members returned by peers every interval,
+// until stop is closed.
+func (g *Gossip) RunAntiEntropy(interval time.Duration, peers func() []string, fetch Fetcher, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := g.Sync(peers(), fetch); err != nil {
+				log.Warnf("Anti-entropy sync failed: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
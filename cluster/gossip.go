@@ -0,0 +1,243 @@
+// Package cluster replicates services between balancers through serf user
+// events, for clusters that run without a raft leader.
+//
+// Every service is replicated whole, destinations included, and versioned by
+// a Lamport clock: the newest version of a service always wins, whichever
+// order events arrive in. Deleted services are kept as tombstones so that a
+// late event can't bring them back. Since user events are best effort, a
+// periodic anti-entropy sync merges the state of a random member to repair
+// the events that were missed.
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/serf/serf"
+	"github.com/luizbafilho/fusis/engine"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// EventName is the name of the serf user events carrying service changes.
+const EventName = "fusis-service"
+
+// ErrUnknownService is returned when changing a destination of a service the
+// cluster doesn't know.
+var ErrUnknownService = errors.New("unknown service")
+
+// Entry is a version of a service. Service is nil once it is deleted.
+type Entry struct {
+	Id      string
+	LTime   uint64
+	Node    string
+	Service *ipvs.Service `json:",omitempty"`
+}
+
+// newer tells if e supersedes other. Concurrent versions, with the same
+// clock, are ordered by node name so every balancer picks the same one.
+func (e Entry) newer(other Entry) bool {
+	if e.LTime != other.LTime {
+		return e.LTime > other.LTime
+	}
+	return e.Node > other.Node
+}
+
+// Broadcaster sends user events to the cluster, like *serf.Serf does.
+type Broadcaster interface {
+	UserEvent(name string, payload []byte, coalesce bool) error
+}
+
+// Applier programs the local balancer. Both calls must be idempotent.
+type Applier interface {
+	SyncService(svc *ipvs.Service) error
+	RemoveService(id string) error
+}
+
+// Gossip keeps the replicated services and applies them locally.
+type Gossip struct {
+	sync.Mutex
+	node    string
+	clock   uint64
+	entries map[string]Entry
+	events  Broadcaster
+	applier Applier
+}
+
+// New returns a Gossip for the balancer named node.
+func New(node string, events Broadcaster, applier Applier) *Gossip {
+	return &Gossip{
+		node:    node,
+		entries: make(map[string]Entry),
+		events:  events,
+		applier: applier,
+	}
+}
+
+// Apply makes the change described by c, in the same terms as the raft
+// commands, and broadcasts the services it changed.
+func (g *Gossip) Apply(c *engine.Command) error {
+	switch c.Op {
+	case engine.AddServiceOp, engine.UpdateServiceOp:
+		svc := *c.Service
+		svc.Destinations = g.destinations(svc.GetId())
+		return g.upsert(svc)
+	case engine.DelServiceOp:
+		return g.remove(c.Service.GetId())
+	case engine.AddDestinationOp, engine.UpdateDestinationOp, engine.DelDestinationOp:
+		return g.applyDestination(c)
+	case engine.FlushServicesOp:
+		for _, e := range g.Entries() {
+			if e.Service == nil {
+				continue
+			}
+			if err := g.remove(e.Id); err != nil {
+				return err
+			}
+		}
+		return nil
+	case engine.BatchOp:
+		// Gossip has no log to commit the batch at once: the commands are
+		// published one by one and a failure leaves the previous ones applied.
+		for i := range c.Commands {
+			if err := g.Apply(&c.Commands[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown operation %d", c.Op)
+}
+
+func (g *Gossip) applyDestination(c *engine.Command) error {
+	g.Lock()
+	current, ok := g.entries[c.Destination.ServiceId]
+	g.Unlock()
+	if !ok || current.Service == nil {
+		return ErrUnknownService
+	}
+
+	svc := *current.Service
+	dsts := []ipvs.Destination{}
+	for _, d := range svc.Destinations {
+		if d.GetId() != c.Destination.GetId() {
+			dsts = append(dsts, d)
+		}
+	}
+	if c.Op != engine.DelDestinationOp {
+		dsts = append(dsts, *c.Destination)
+	}
+	svc.Destinations = dsts
+
+	return g.upsert(svc)
+}
+
+func (g *Gossip) destinations(id string) []ipvs.Destination {
+	g.Lock()
+	defer g.Unlock()
+	if e, ok := g.entries[id]; ok && e.Service != nil {
+		return e.Service.Destinations
+	}
+	return []ipvs.Destination{}
+}
+
+func (g *Gossip) upsert(svc ipvs.Service) error {
+	return g.publish(Entry{Id: svc.GetId(), Service: &svc})
+}
+
+func (g *Gossip) remove(id string) error {
+	return g.publish(Entry{Id: id})
+}
+
+// publish versions e as a local change, applies and broadcasts it.
+func (g *Gossip) publish(e Entry) error {
+	g.Lock()
+	g.clock++
+	e.LTime = g.clock
+	e.Node = g.node
+	g.Unlock()
+
+	if _, err := g.merge(e); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// Members that miss the event get the service at the next anti-entropy
+	// sync, so failing to send isn't fatal.
+	if err := g.events.UserEvent(EventName, payload, false); err != nil {
+		log.Warnf("Broadcasting service %s failed: %v", e.Id, err)
+	}
+	return nil
+}
+
+// HandleEvent merges the service carried by a user event sent by another
+// member. Events with other names are ignored.
+func (g *Gossip) HandleEvent(ev serf.UserEvent) {
+	if ev.Name != EventName {
+		return
+	}
+
+	var e Entry
+	if err := json.Unmarshal(ev.Payload, &e); err != nil {
+		log.Errorf("Decoding service event failed: %v", err)
+		return
+	}
+	if _, err := g.merge(e); err != nil {
+		log.Errorf("Applying service %s failed: %v", e.Id, err)
+	}
+}
+
+// Merge merges entries, as returned by the Entries of another member.
+func (g *Gossip) Merge(entries []Entry) error {
+	for _, e := range entries {
+		if _, err := g.merge(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merge applies e if it is newer than the known version of its service,
+// telling if it was.
+func (g *Gossip) merge(e Entry) (bool, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	if e.LTime > g.clock {
+		g.clock = e.LTime
+	}
+	if current, ok := g.entries[e.Id]; ok && !e.newer(current) {
+		return false, nil
+	}
+
+	var err error
+	if e.Service == nil {
+		err = g.applier.RemoveService(e.Id)
+	} else {
+		svc := *e.Service
+		err = g.applier.SyncService(&svc)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	g.entries[e.Id] = e
+	return true, nil
+}
+
+// Entries returns the known version of every service, deleted ones included.
+func (g *Gossip) Entries() []Entry {
+	g.Lock()
+	defer g.Unlock()
+
+	entries := make([]Entry, 0, len(g.entries))
+	for _, e := range g.entries {
+		entries = append(entries, e)
+	}
+	return entries
+}
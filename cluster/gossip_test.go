@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/luizbafilho/fusis/engine"
+	"github.com/luizbafilho/fusis/ipvs"
+	"gopkg.in/check.v1"
+)
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+// fakeBalancer records what a Gossip applies and broadcasts.
+type fakeBalancer struct {
+	sync.Mutex
+	services map[string]ipvs.Service
+	events   [][]byte
+}
+
+func newFakeBalancer() *fakeBalancer {
+	return &fakeBalancer{services: make(map[string]ipvs.Service)}
+}
+
+func (f *fakeBalancer) SyncService(svc *ipvs.Service) error {
+	f.Lock()
+	defer f.Unlock()
+	f.services[svc.GetId()] = *svc
+	return nil
+}
+
+func (f *fakeBalancer) RemoveService(id string) error {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.services, id)
+	return nil
+}
+
+func (f *fakeBalancer) UserEvent(name string, payload []byte, coalesce bool) error {
+	f.Lock()
+	defer f.Unlock()
+	f.events = append(f.events, payload)
+	return nil
+}
+
+// deliver sends the events broadcast by f to every gossip of to.
+func (f *fakeBalancer) deliver(to ...*Gossip) {
+	f.Lock()
+	events := f.events
+	f.events = nil
+	f.Unlock()
+	for _, payload := range events {
+		for _, g := range to {
+			g.HandleEvent(serf.UserEvent{Name: EventName, Payload: payload})
+		}
+	}
+}
+
+func testService(name string) *ipvs.Service {
+	return &ipvs.Service{Id: name, Name: name, Host: "10.0.0.1", Port: 80, Protocol: "tcp", Scheduler: "rr"}
+}
+
+func (s *S) TestApplyPropagates(c *check.C) {
+	b1, b2 := newFakeBalancer(), newFakeBalancer()
+	g1, g2 := New("node1", b1, b1), New("node2", b2, b2)
+
+	c.Assert(g1.Apply(&engine.Command{Op: engine.AddServiceOp, Service: testService("svc1")}), check.IsNil)
+	dst := &ipvs.Destination{Id: "dst1", Name: "dst1", Host: "10.0.1.1", Port: 80, Mode: "nat", ServiceId: "svc1"}
+	c.Assert(g1.Apply(&engine.Command{Op: engine.AddDestinationOp, Destination: dst}), check.IsNil)
+	b1.deliver(g2)
+
+	c.Assert(b2.services["svc1"].Destinations, check.DeepEquals, []ipvs.Destination{*dst})
+	c.Assert(b1.services, check.DeepEquals, b2.services)
+
+	c.Assert(g2.Apply(&engine.Command{Op: engine.DelServiceOp, Service: testService("svc1")}), check.IsNil)
+	b2.deliver(g1)
+	c.Assert(b1.services, check.HasLen, 0)
+}
+
+func (s *S) TestStaleEventsAreIgnored(c *check.C) {
+	b1, b2 := newFakeBalancer(), newFakeBalancer()
+	g1, g2 := New("node1", b1, b1), New("node2", b2, b2)
+
+	c.Assert(g1.Apply(&engine.Command{Op: engine.AddServiceOp, Service: testService("svc1")}), check.IsNil)
+	c.Assert(g1.Apply(&engine.Command{Op: engine.DelServiceOp, Service: testService("svc1")}), check.IsNil)
+
+	// The delete arrives before the create, which must not resurrect it
+	b1.Lock()
+	b1.events[0], b1.events[1] = b1.events[1], b1.events[0]
+	b1.Unlock()
+	b1.deliver(g2, g2)
+	c.Assert(b2.services, check.HasLen, 0)
+	c.Assert(g2.Entries(), check.DeepEquals, g1.Entries())
+
+	// Later changes are ordered after everything seen
+	c.Assert(g2.Apply(&engine.Command{Op: engine.AddServiceOp, Service: testService("svc1")}), check.IsNil)
+	b2.deliver(g1)
+	c.Assert(b1.services["svc1"].Name, check.Equals, "svc1")
+}
+
+func (s *S) TestConcurrentChangesConverge(c *check.C) {
+	b1, b2 := newFakeBalancer(), newFakeBalancer()
+	g1, g2 := New("node1", b1, b1), New("node2", b2, b2)
+
+	svc1 := testService("svc1")
+	svc2 := testService("svc1")
+	svc2.Scheduler = "lc"
+	c.Assert(g1.Apply(&engine.Command{Op: engine.AddServiceOp, Service: svc1}), check.IsNil)
+	c.Assert(g2.Apply(&engine.Command{Op: engine.AddServiceOp, Service: svc2}), check.IsNil)
+	b1.deliver(g2)
+	b2.deliver(g1)
+
+	c.Assert(b1.services["svc1"].Scheduler, check.Equals, ipvs.SchedulerLC)
+	c.Assert(b2.services["svc1"].Scheduler, check.Equals, ipvs.SchedulerLC)
+}
+
+func (s *S) TestApplyDestinationUnknownService(c *check.C) {
+	b := newFakeBalancer()
+	g := New("node1", b, b)
+	dst := &ipvs.Destination{Name: "dst1", ServiceId: "svc1"}
+	err := g.Apply(&engine.Command{Op: engine.AddDestinationOp, Destination: dst})
+	c.Assert(err, check.Equals, ErrUnknownService)
+}
+
+func (s *S) TestSyncRepairsMissedEvents(c *check.C) {
+	b1, b2 := newFakeBalancer(), newFakeBalancer()
+	g1, g2 := New("node1", b1, b1), New("node2", b2, b2)
+	c.Assert(g1.Apply(&engine.Command{Op: engine.AddServiceOp, Service: testService("svc1")}), check.IsNil)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/cluster/state")
+		json.NewEncoder(w).Encode(g1.Entries())
+	}))
+	defer srv.Close()
+
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	c.Assert(g2.Sync([]string{addr}, HTTPFetcher(http.DefaultClient, "http")), check.IsNil)
+	c.Assert(b2.services, check.DeepEquals, b1.services)
+
+	failing := func(addr string) ([]Entry, error) { return nil, errors.New("unreachable") }
+	c.Assert(g2.Sync([]string{addr}, failing), check.ErrorMatches, "unreachable")
+	c.Assert(g2.Sync(nil, failing), check.IsNil)
+}
@@ -1,11 +1,18 @@
 package command
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/luizbafilho/fusis/api"
 	"github.com/luizbafilho/fusis/config"
 	"github.com/luizbafilho/fusis/fusis"
+	"github.com/luizbafilho/fusis/logging"
 	"github.com/luizbafilho/fusis/net"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -35,6 +42,26 @@ func setupBalancerConfig() {
 	balancerCmd.Flags().BoolVarP(&config.Balancer.Single, "single", "s", false, "Configuration directory")
 	balancerCmd.Flags().StringVarP(&config.Balancer.ConfigPath, "config-path", "", "/etc/fusis", "Configuration directory")
 	balancerCmd.Flags().IntVar(&config.Balancer.RaftPort, "raft-port", 4382, "Raft port")
+	balancerCmd.Flags().IntVar(&config.Balancer.ApiPort, "api-port", 8000, "API port")
+	balancerCmd.Flags().StringVar(&config.Balancer.ApiSocket, "api-socket", "", "Unix socket to also serve the API on")
+	balancerCmd.Flags().StringVar(&config.Balancer.ApiSocketMode, "api-socket-mode", "0660", "Octal permissions of the API socket")
+	balancerCmd.Flags().BoolVar(&config.Balancer.Gossip, "gossip", false, "Replicate services through gossip instead of raft")
+	balancerCmd.Flags().StringVar(&config.Balancer.TLSCert, "tls-cert", "", "PEM certificate to serve the API over HTTPS")
+	balancerCmd.Flags().StringVar(&config.Balancer.TLSKey, "tls-key", "", "PEM key of the API certificate")
+	balancerCmd.Flags().StringVar(&config.Balancer.TLSClientCA, "tls-client-ca", "", "PEM CAs that API client certificates must be signed by")
+	balancerCmd.Flags().StringVar(&config.Balancer.TLSCA, "tls-ca", "", "PEM CAs trusted to sign the API certificates of the other balancers")
+	balancerCmd.Flags().Float64Var(&config.Balancer.RateLimit, "rate-limit", 0, "API requests per second allowed to each client, 0 for no limit")
+	balancerCmd.Flags().IntVar(&config.Balancer.RateBurst, "rate-burst", 20, "API requests each client may send at once when rate limited")
+	balancerCmd.Flags().BoolVar(&config.Balancer.Compression, "compression", false, "Gzip API responses for clients accepting it and accept gzipped request bodies")
+	balancerCmd.Flags().IntVar(&config.Balancer.MaxConcurrentProbes, "max-concurrent-probes", 0, "Destination health checks allowed to run at once, 0 for no limit")
+	balancerCmd.Flags().IntVar(&config.Balancer.AuditLogSize, "audit-log-size", 1000, "API writes kept in memory and served on /events, 0 to keep none")
+	balancerCmd.Flags().StringVar(&config.Balancer.AuditLogPath, "audit-log", "", "File the API writes are appended to")
+	balancerCmd.Flags().Int64Var(&config.Balancer.AuditLogMaxSize, "audit-log-max-size", 100<<20, "Bytes the audit log file is rotated at, 0 to never rotate")
+	balancerCmd.Flags().DurationVar(&config.Balancer.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "How long API requests in flight are waited for on shutdown")
+	balancerCmd.Flags().DurationVar(&config.Balancer.DrainDelay, "drain-delay", 0, "How long the API keeps serving on shutdown, reporting not ready, before it stops")
+	balancerCmd.Flags().StringVar(&config.Balancer.LogLevel, "log-level", "info", "Log level: debug, info, warning, error, fatal or panic")
+	balancerCmd.Flags().StringVar(&config.Balancer.LogFormat, "log-format", "text", "Log format: text or json")
+	balancerCmd.Flags().StringVar(&config.Balancer.ServicesFile, "services-file", "", "YAML or JSON file declaring the services, applied on startup and SIGHUP")
 
 	err := viper.BindPFlags(balancerCmd.Flags())
 	if err != nil {
@@ -42,7 +69,25 @@ func setupBalancerConfig() {
 	}
 }
 
+// reloadServicesFile applies the services file again every time SIGHUP is
+// received. A file that became invalid is reported and leaves the services
+// as they are.
+func reloadServicesFile(balancer *fusis.Balancer) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		log.Infof("Reloading the services file %s", config.Balancer.ServicesFile)
+		if err := balancer.ApplyServicesFile(); err != nil {
+			log.Errorf("Applying the services file failed: %v", err)
+		}
+	}
+}
+
 func run(cmd *cobra.Command, args []string) {
+	if err := logging.Configure(config.Balancer.LogLevel, config.Balancer.LogFormat); err != nil {
+		log.Fatal(err)
+	}
+
 	if err := net.SetIpForwarding(); err != nil {
 		log.Warn("Fusis couldn't set net.ipv4.ip_forward=1")
 		log.Fatal(err)
@@ -57,8 +102,25 @@ func run(cmd *cobra.Command, args []string) {
 		balancer.JoinPool()
 	}
 
-	apiService := api.NewAPI(balancer)
+	var middleware []api.Middleware
+	if config.Balancer.RateLimit > 0 {
+		middleware = append(middleware, api.RateLimit(config.Balancer.RateLimit, config.Balancer.RateBurst))
+	}
+	if config.Balancer.Compression {
+		middleware = append(middleware, api.Gzip())
+	}
+	apiService := api.NewAPI(balancer, middleware...)
 	go apiService.Serve()
 
-	waitSignals(balancer)
+	if config.Balancer.ServicesFile != "" {
+		go reloadServicesFile(balancer)
+	}
+
+	waitSignals(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), config.Balancer.ShutdownTimeout)
+		defer cancel()
+		if err := apiService.Shutdown(ctx); err != nil {
+			log.Errorf("Draining the API requests failed: %v", err)
+		}
+	})
 }
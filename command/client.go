@@ -0,0 +1,40 @@
+package command
+
+import (
+	"github.com/luizbafilho/fusis/api"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// apiAddr is the address of the balancer API the client commands talk
+	// to.
+	apiAddr string
+	// dryRun makes the server only validate the writes of the commands.
+	dryRun bool
+)
+
+// addClientFlags adds the flags of the commands using the API client to cmd.
+func addClientFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVarP(&apiAddr, "addr", "a", "http://localhost:8000", "Balancer API address, or unix:///path of its socket")
+}
+
+// addDryRunFlag adds the flag previewing the writes of cmd.
+func addDryRunFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Validate the changes on the server without applying them")
+}
+
+// newClient returns a client of the balancer API at apiAddr.
+func newClient() (*api.Client, error) {
+	return newClientAt(apiAddr)
+}
+
+// newClientAt returns a client of the balancer API at addr.
+func newClientAt(addr string) (*api.Client, error) {
+	client := api.NewClient("")
+	if err := client.SetAddr(addr); err != nil {
+		return nil, err
+	}
+	client.FollowRedirects = true
+	client.DryRun = dryRun
+	return client, nil
+}
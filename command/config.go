@@ -0,0 +1,211 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/luizbafilho/fusis/api"
+	"github.com/luizbafilho/fusis/ipvs"
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Export and import the balancer configuration",
+	Long: `fusis config saves every service and destination of a cluster to a file,
+and creates them back from it.`,
+}
+
+var configExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Save the services and their destinations to a file",
+	RunE:  runConfigExport,
+}
+
+var configImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Create or update the services and destinations saved in a file",
+	Long: `fusis config import creates the services and destinations saved by fusis
+config export. The ones that already exist are updated when they differ, so
+importing the same file twice is harmless.`,
+	RunE: runConfigImport,
+}
+
+var (
+	exportOutput string
+	importFile   string
+)
+
+func init() {
+	FusisCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configExportCmd)
+	configCmd.AddCommand(configImportCmd)
+	addClientFlags(configCmd)
+
+	configExportCmd.Flags().StringVarP(&exportOutput, "output", "o", "-", "File to write, - for the standard output")
+	configImportCmd.Flags().StringVarP(&importFile, "file", "f", "-", "File to read, - for the standard input")
+	addDryRunFlag(configImportCmd)
+}
+
+func runConfigExport(cmd *cobra.Command, args []string) error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	services, err := client.GetServices()
+	if err != nil {
+		return err
+	}
+	for _, svc := range services {
+		for i := range svc.Destinations {
+			svc.Destinations[i].EffectiveWeight = 0
+		}
+	}
+
+	b, err := json.MarshalIndent(services, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if exportOutput == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(exportOutput, b, 0644)
+}
+
+// importSummary counts what an import did, by kind of resource.
+type importSummary struct {
+	created, updated, unchanged, failed int
+}
+
+func (s importSummary) String() string {
+	return fmt.Sprintf("%d created, %d updated, %d unchanged, %d failed", s.created, s.updated, s.unchanged, s.failed)
+}
+
+// The batch endpoints aren't used since they stop at the first failure,
+// while an import tries every resource and reports each one failing.
+func runConfigImport(cmd *cobra.Command, args []string) error {
+	var r io.Reader = os.Stdin
+	if importFile != "-" {
+		f, err := os.Open(importFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var services []ipvs.Service
+	if err := json.NewDecoder(r).Decode(&services); err != nil {
+		return fmt.Errorf("reading %s failed: %v", importFile, err)
+	}
+
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	svcs, dsts, err := importServices(client, services, false)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Print("Dry run, nothing was changed. ")
+	}
+	fmt.Printf("services: %s\ndestinations: %s\n", svcs, dsts)
+	if svcs.failed > 0 || dsts.failed > 0 {
+		return fmt.Errorf("%d services and %d destinations failed to import", svcs.failed, dsts.failed)
+	}
+	return nil
+}
+
+// importServices creates the services, and their destinations, missing from
+// the balancer of client, and updates the ones differing unless keepExisting
+// is set. Each service and destination failing is reported, and the others
+// still imported.
+func importServices(client *api.Client, services []ipvs.Service, keepExisting bool) (svcs, dsts importSummary, err error) {
+	existing, err := client.GetServices()
+	if err != nil {
+		return svcs, dsts, err
+	}
+	current := make(map[string]*ipvs.Service)
+	for _, svc := range existing {
+		current[svc.GetId()] = svc
+	}
+
+	for _, svc := range services {
+		destinations := svc.Destinations
+		svc.Destinations = nil
+
+		var err error
+		old, found := current[svc.GetId()]
+		switch {
+		case !found:
+			_, err = client.CreateService(svc)
+			if err == nil {
+				svcs.created++
+			}
+		case keepExisting || old.Matches(svc):
+			svcs.unchanged++
+		default:
+			// The imported service overrides whatever changed since
+			svc.Version = old.Version
+			err = client.UpdateService(svc)
+			if err == nil {
+				svcs.updated++
+			}
+		}
+		if err != nil {
+			svcs.failed++
+			dsts.failed += len(destinations)
+			fmt.Fprintf(os.Stderr, "service %s: %v\n", svc.GetId(), err)
+			continue
+		}
+
+		var oldDsts []ipvs.Destination
+		if found {
+			oldDsts = old.Destinations
+		}
+		importDestinations(client, svc, destinations, oldDsts, keepExisting, &dsts)
+	}
+	return svcs, dsts, nil
+}
+
+// importDestinations creates or updates the destinations of svc, counting
+// them in summary. existing are the destinations svc already has, which are
+// left alone with keepExisting.
+func importDestinations(client *api.Client, svc ipvs.Service, destinations, existing []ipvs.Destination, keepExisting bool, summary *importSummary) {
+	current := make(map[string]ipvs.Destination)
+	for _, dst := range existing {
+		current[dst.GetId()] = dst
+	}
+
+	for _, dst := range destinations {
+		dst.ServiceId = svc.GetId()
+		dst.EffectiveWeight = 0
+
+		var err error
+		old, found := current[dst.GetId()]
+		switch {
+		case !found:
+			_, err = client.AddDestination(dst)
+			if err == nil {
+				summary.created++
+			}
+		case keepExisting || old.Matches(dst):
+			summary.unchanged++
+		default:
+			err = client.UpdateDestination(dst)
+			if err == nil {
+				summary.updated++
+			}
+		}
+		if err != nil {
+			summary.failed++
+			fmt.Fprintf(os.Stderr, "destination %s of service %s: %v\n", dst.GetId(), svc.GetId(), err)
+		}
+	}
+}
@@ -53,14 +53,17 @@ func initConfig() {
 	}
 }
 
-type Node interface {
-	Shutdown()
-}
-
-func waitSignals(node Node) {
+// waitSignals blocks until SIGINT or SIGTERM is received then calls
+// shutdown. A second signal exits right away, without waiting for shutdown to
+// return.
+func waitSignals(shutdown func()) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	<-sigs
 
-	node.Shutdown()
+	go func() {
+		<-sigs
+		os.Exit(1)
+	}()
+	shutdown()
 }
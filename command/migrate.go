@@ -0,0 +1,81 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/luizbafilho/fusis/ipvs"
+	"github.com/spf13/cobra"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Copy the services and destinations of a cluster to another",
+	Long: `fusis migrate creates on the cluster at --to every service and destination
+of the cluster at --from, as when moving to an upgraded cluster. The ones the
+target already has are updated when they differ, so migrating twice is
+harmless.`,
+	RunE: runMigrate,
+}
+
+var (
+	migrateFrom string
+	migrateTo   string
+	// migratePreserveIds keeps the storage ids of the resources copied.
+	migratePreserveIds bool
+	// migrateSkipExisting leaves the resources the target has alone.
+	migrateSkipExisting bool
+)
+
+func init() {
+	FusisCmd.AddCommand(migrateCmd)
+	migrateCmd.Flags().StringVar(&migrateFrom, "from", "", "API address of the cluster to copy, or unix:///path of its socket")
+	migrateCmd.Flags().StringVar(&migrateTo, "to", "", "API address of the cluster to copy to, or unix:///path of its socket")
+	migrateCmd.Flags().BoolVar(&migratePreserveIds, "preserve-ids", false, "Keep the ids of the resources instead of letting the target assign them")
+	migrateCmd.Flags().BoolVar(&migrateSkipExisting, "skip-existing", false, "Leave the resources the target already has alone, even when they differ")
+	addDryRunFlag(migrateCmd)
+}
+
+func runMigrate(cmd *cobra.Command, args []string) error {
+	if migrateFrom == "" || migrateTo == "" {
+		return fmt.Errorf("both --from and --to are required")
+	}
+	source, err := newClientAt(migrateFrom)
+	if err != nil {
+		return err
+	}
+	source.DryRun = false
+	target, err := newClientAt(migrateTo)
+	if err != nil {
+		return err
+	}
+
+	existing, err := source.GetServices()
+	if err != nil {
+		return fmt.Errorf("listing the services of %s failed: %v", migrateFrom, err)
+	}
+	services := make([]ipvs.Service, 0, len(existing))
+	for _, svc := range existing {
+		if !migratePreserveIds {
+			svc.Id = ""
+			for i := range svc.Destinations {
+				svc.Destinations[i].Id = ""
+			}
+		}
+		svc.Version = 0
+		services = append(services, *svc)
+	}
+
+	svcs, dsts, err := importServices(target, services, migrateSkipExisting)
+	if err != nil {
+		return fmt.Errorf("listing the services of %s failed: %v", migrateTo, err)
+	}
+
+	if dryRun {
+		fmt.Print("Dry run, nothing was changed. ")
+	}
+	fmt.Printf("services: %s\ndestinations: %s\n", svcs, dsts)
+	if svcs.failed > 0 || dsts.failed > 0 {
+		return fmt.Errorf("%d services and %d destinations failed to migrate", svcs.failed, dsts.failed)
+	}
+	return nil
+}
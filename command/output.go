@@ -0,0 +1,51 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// outputFormat is how the commands print what they read from the API, one of
+// outputFormats.
+var outputFormat string
+
+var outputFormats = []string{"table", "json"}
+
+// addOutputFlags adds the flags of the commands printing what they read to
+// cmd, which then fails early on an unknown format.
+func addOutputFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&outputFormat, "output", "table", "Output format: table or json")
+	cmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		return checkOutputFormat()
+	}
+}
+
+// checkOutputFormat fails when outputFormat is unknown.
+func checkOutputFormat() error {
+	for _, format := range outputFormats {
+		if outputFormat == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid output format %q, expected one of %v", outputFormat, outputFormats)
+}
+
+// printOutput prints v to the standard output in outputFormat. v is encoded
+// as is in JSON, so the fields are the ones of the API, and writeTable writes
+// it in the table format.
+func printOutput(v interface{}, writeTable func(w io.Writer)) error {
+	if outputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	writeTable(tw)
+	return tw.Flush()
+}
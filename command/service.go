@@ -0,0 +1,277 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/luizbafilho/fusis/api"
+	"github.com/luizbafilho/fusis/ipvs"
+	"github.com/spf13/cobra"
+)
+
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Manage the services of the balancer",
+}
+
+var serviceListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the services",
+	RunE:  runServiceList,
+}
+
+var serviceGetCmd = &cobra.Command{
+	Use:   "get <service-id>",
+	Short: "Show a service and its destinations",
+	RunE:  runServiceGet,
+}
+
+var serviceDeleteCmd = &cobra.Command{
+	Use:   "delete <service-id>",
+	Short: "Delete a service and its destinations",
+	RunE:  runServiceDelete,
+}
+
+var serviceMaintenanceCmd = &cobra.Command{
+	Use:   "maintenance <service-id> on|off",
+	Short: "Stop or resume sending new connections to the destinations of a service",
+	RunE:  runServiceMaintenance,
+}
+
+var destinationCmd = &cobra.Command{
+	Use:   "destination",
+	Short: "Manage the destinations of the services",
+}
+
+var destinationListCmd = &cobra.Command{
+	Use:   "list <service-id>",
+	Short: "List the destinations of a service",
+	RunE:  runDestinationList,
+}
+
+var destinationGetCmd = &cobra.Command{
+	Use:   "get <service-id> <destination-id>",
+	Short: "Show a destination",
+	RunE:  runDestinationGet,
+}
+
+var destinationDeleteCmd = &cobra.Command{
+	Use:   "delete <service-id> <destination-id>",
+	Short: "Delete a destination",
+	RunE:  runDestinationDelete,
+}
+
+var (
+	// serviceTags selects the services listed by their tags.
+	serviceTags string
+	// destinationLabels selects the destinations listed by their labels.
+	destinationLabels []string
+	// serviceDrain is how long a service deleted is given to drain its
+	// connections, 0 deleting it at once.
+	serviceDrain time.Duration
+)
+
+func init() {
+	FusisCmd.AddCommand(serviceCmd)
+	serviceCmd.AddCommand(serviceListCmd)
+	serviceListCmd.Flags().StringVarP(&serviceTags, "tag", "t", "", "only list the services with these comma separated key=value tags")
+	serviceCmd.AddCommand(serviceGetCmd)
+	serviceCmd.AddCommand(serviceDeleteCmd)
+	addDryRunFlag(serviceDeleteCmd)
+	serviceDeleteCmd.Flags().DurationVar(&serviceDrain, "drain", 0, "put the service in maintenance and wait up to this long for its connections to drain before deleting it")
+	serviceCmd.AddCommand(serviceMaintenanceCmd)
+	addClientFlags(serviceCmd)
+	addOutputFlags(serviceCmd)
+
+	FusisCmd.AddCommand(destinationCmd)
+	destinationCmd.AddCommand(destinationListCmd)
+	destinationListCmd.Flags().StringArrayVarP(&destinationLabels, "label", "l", nil, "only list the destinations with this key=value label, repeatable")
+	destinationCmd.AddCommand(destinationGetCmd)
+	destinationCmd.AddCommand(destinationDeleteCmd)
+	addDryRunFlag(destinationDeleteCmd)
+	addClientFlags(destinationCmd)
+	addOutputFlags(destinationCmd)
+}
+
+func runServiceList(cmd *cobra.Command, args []string) error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	var services []*ipvs.Service
+	if serviceTags != "" {
+		services, err = client.ListServicesByTag(serviceTags)
+	} else {
+		services, err = client.GetServices()
+	}
+	if err != nil {
+		return err
+	}
+	return printOutput(services, func(w io.Writer) {
+		writeServicesHeader(w)
+		for _, svc := range services {
+			writeService(w, svc)
+		}
+	})
+}
+
+func runServiceGet(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a service id, got %d arguments", len(args))
+	}
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	svc, err := client.GetService(args[0])
+	if err != nil {
+		return err
+	}
+	return printOutput(svc, func(w io.Writer) {
+		writeServicesHeader(w)
+		writeService(w, svc)
+		if len(svc.Destinations) == 0 {
+			return
+		}
+		fmt.Fprintln(w)
+		writeDestinationsHeader(w)
+		for i := range svc.Destinations {
+			writeDestination(w, &svc.Destinations[i])
+		}
+	})
+}
+
+func runServiceDelete(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a service id, got %d arguments", len(args))
+	}
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	if serviceDrain > 0 {
+		err = client.DeleteServiceGraceful(args[0], serviceDrain)
+		if err == api.ErrDrainTimeout {
+			return fmt.Errorf("service %s still has active connections after %s, it was left in maintenance", args[0], serviceDrain)
+		}
+	} else {
+		err = client.DeleteService(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	printDeleted("Service", args[0])
+	return nil
+}
+
+func runServiceMaintenance(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected a service id and on or off, got %d arguments", len(args))
+	}
+	var on bool
+	switch args[1] {
+	case "on":
+		on = true
+	case "off":
+	default:
+		return fmt.Errorf("expected on or off, got %q", args[1])
+	}
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := client.SetServiceMaintenance(args[0], on); err != nil {
+		return err
+	}
+	fmt.Printf("Service %s maintenance %s\n", args[0], args[1])
+	return nil
+}
+
+func runDestinationList(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a service id, got %d arguments", len(args))
+	}
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	destinations, err := client.GetDestinations(args[0], destinationLabels...)
+	if err != nil {
+		return err
+	}
+	return printOutput(destinations, func(w io.Writer) {
+		writeDestinationsHeader(w)
+		for _, dst := range destinations {
+			writeDestination(w, dst)
+		}
+	})
+}
+
+func runDestinationGet(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected a service id and a destination id, got %d arguments", len(args))
+	}
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	dst, err := client.GetDestination(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return printOutput(dst, func(w io.Writer) {
+		writeDestinationsHeader(w)
+		writeDestination(w, dst)
+	})
+}
+
+func runDestinationDelete(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected a service id and a destination id, got %d arguments", len(args))
+	}
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := client.DeleteDestination(args[0], args[1]); err != nil {
+		return err
+	}
+	printDeleted("Destination", args[1])
+	return nil
+}
+
+// printDeleted tells that the resource id of the given kind was deleted, or
+// would have been on a dry run.
+func printDeleted(kind, id string) {
+	if dryRun {
+		fmt.Printf("%s %s would be deleted\n", kind, id)
+		return
+	}
+	fmt.Printf("%s %s deleted\n", kind, id)
+}
+
+func writeServicesHeader(w io.Writer) {
+	fmt.Fprintln(w, "NAME\tADDRESS\tSCHEDULER\tDESTINATIONS")
+}
+
+func writeService(w io.Writer, svc *ipvs.Service) {
+	addr := svc.Address() + "/" + svc.Protocol
+	if svc.IsFwmark() {
+		addr = fmt.Sprintf("fwmark %d", svc.Fwmark)
+	}
+	scheduler := string(svc.Scheduler)
+	if len(svc.SchedulerFlags) > 0 {
+		scheduler += " (" + strings.Join(svc.SchedulerFlags, ",") + ")"
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", svc.GetId(), addr, scheduler, len(svc.Destinations))
+}
+
+func writeDestinationsHeader(w io.Writer) {
+	fmt.Fprintln(w, "NAME\tADDRESS\tMODE\tWEIGHT\tEFFECTIVE WEIGHT")
+}
+
+func writeDestination(w io.Writer, dst *ipvs.Destination) {
+	fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", dst.GetId(), dst.Address(), dst.Mode, dst.Weight, dst.EffectiveWeight)
+}
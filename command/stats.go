@@ -0,0 +1,166 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/luizbafilho/fusis/api"
+	"github.com/luizbafilho/fusis/ipvs"
+	"github.com/spf13/cobra"
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show the traffic of the services",
+}
+
+var statsWatchCmd = &cobra.Command{
+	Use:   "watch <service-id>",
+	Short: "Refresh the traffic of a service and its destinations, like watch ipvsadm",
+	Long: `fusis stats watch redraws the connections, packets and bytes of a service
+and of each of its destinations every --interval, until interrupted. A service
+removed while watched is reported and watched until it comes back.
+
+With --output json, a JSON object is printed on its own line at every refresh.`,
+	RunE: runStatsWatch,
+}
+
+var statsInterval time.Duration
+
+func init() {
+	FusisCmd.AddCommand(statsCmd)
+	statsCmd.AddCommand(statsWatchCmd)
+	addClientFlags(statsCmd)
+	addOutputFlags(statsCmd)
+
+	statsWatchCmd.Flags().DurationVarP(&statsInterval, "interval", "n", 2*time.Second, "Time between refreshes")
+}
+
+// statsSnapshot holds the stats of a service read at Time. Error is set
+// instead when they couldn't be read.
+type statsSnapshot struct {
+	Time         time.Time                         `json:"time"`
+	Service      *ipvs.ServiceStats                `json:"service,omitempty"`
+	Destinations map[string]*ipvs.DestinationStats `json:"destinations,omitempty"`
+	Error        string                            `json:"error,omitempty"`
+
+	svc *ipvs.Service
+}
+
+func runStatsWatch(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a service id, got %d arguments", len(args))
+	}
+	if statsInterval <= 0 {
+		return fmt.Errorf("invalid interval %s", statsInterval)
+	}
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		snapshot := readStats(ctx, client, args[0])
+		if ctx.Err() != nil {
+			return nil
+		}
+		if outputFormat == "json" {
+			if err := json.NewEncoder(os.Stdout).Encode(snapshot); err != nil {
+				return err
+			}
+		} else {
+			// Clearing the terminal right before writing avoids flickering
+			fmt.Print("\033[H\033[2J" + renderStats(args[0], snapshot))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// readStats reads the stats of the service id and of its destinations.
+// Destinations removed in between, or along with the service, are left out.
+func readStats(ctx context.Context, client *api.Client, id string) *statsSnapshot {
+	snapshot := &statsSnapshot{Time: time.Now()}
+
+	svc, err := client.GetServiceContext(ctx, id)
+	if err == nil {
+		snapshot.Service, err = client.GetServiceStatsContext(ctx, id)
+	}
+	if err == api.ErrNoSuchService {
+		snapshot.Error = fmt.Sprintf("service %s doesn't exist anymore", id)
+		return snapshot
+	} else if err != nil {
+		snapshot.Error = fmt.Sprintf("reading the stats failed: %v", err)
+		return snapshot
+	}
+
+	snapshot.svc = svc
+	snapshot.Destinations = make(map[string]*ipvs.DestinationStats)
+	for _, dst := range svc.Destinations {
+		stats, err := client.GetDestinationStatsContext(ctx, svc.GetId(), dst.GetId())
+		if err == nil {
+			snapshot.Destinations[dst.GetId()] = stats
+		}
+	}
+	return snapshot
+}
+
+// renderStats returns the screen showing snapshot, the stats of the service
+// id.
+func renderStats(id string, snapshot *statsSnapshot) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Every %s: service %s\t%s\n\n", statsInterval, id, snapshot.Time.Format(time.RFC1123))
+	if snapshot.Error != "" {
+		fmt.Fprintf(buf, "%s, waiting for it to come back\n", snapshot.Error)
+		return buf.String()
+	}
+	writeStatsTable(buf, snapshot)
+	return buf.String()
+}
+
+// writeStatsTable writes a row with the stats of the service then one per
+// destination.
+func writeStatsTable(w io.Writer, snapshot *statsSnapshot) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "NAME\tACTIVE\tINACTIVE\tCONNS\tPKTS IN\tPKTS OUT\tBYTES IN\tBYTES OUT\t")
+	stats := snapshot.Service
+	fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n", snapshot.svc.GetId(), stats.ActiveConns, stats.InactiveConns,
+		stats.Connections, stats.PacketsIn, stats.PacketsOut, stats.BytesIn, stats.BytesOut)
+
+	for _, dst := range snapshot.svc.Destinations {
+		dstStats, ok := snapshot.Destinations[dst.GetId()]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(tw, "  %s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n", dst.GetId(), dstStats.ActiveConns, dstStats.InactiveConns,
+			dstStats.Connections, dstStats.PacketsIn, dstStats.PacketsOut, dstStats.BytesIn, dstStats.BytesOut)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,60 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/luizbafilho/fusis/api"
+	"github.com/spf13/cobra"
+)
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Show the version of fusis and of the balancer at --addr",
+	Long: `fusis version prints the build of this fusis and of the balancer at --addr,
+with the API versions they speak. A warning is printed when the balancer
+doesn't serve the API version of this client.`,
+	RunE: runVersion,
+}
+
+func init() {
+	FusisCmd.AddCommand(versionCmd)
+	addClientFlags(versionCmd)
+	addOutputFlags(versionCmd)
+}
+
+// versionOutput is what the version command prints.
+type versionOutput struct {
+	Client api.VersionInfo  `json:"client"`
+	Server *api.VersionInfo `json:"server"`
+}
+
+func runVersion(cmd *cobra.Command, args []string) error {
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+	server, err := client.CheckVersion()
+	if err == api.ErrIncompatibleAPI {
+		fmt.Fprintf(os.Stderr, "Warning: the balancer serves API versions %d to %d, this client speaks version %d\n",
+			server.MinAPIVersion, server.APIVersion, api.APIVersion)
+	} else if err != nil {
+		return err
+	}
+
+	out := versionOutput{Client: api.CurrentVersion(), Server: server}
+	return printOutput(out, func(w io.Writer) {
+		fmt.Fprintln(w, "\tVERSION\tCOMMIT\tGO\tAPI")
+		for _, v := range []struct {
+			name string
+			info api.VersionInfo
+		}{{"Client", out.Client}, {"Server", *out.Server}} {
+			commit := v.info.Commit
+			if commit == "" {
+				commit = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\tv%d (from v%d)\n", v.name, v.info.Version, commit, v.info.GoVersion, v.info.APIVersion, v.info.MinAPIVersion)
+		}
+	})
+}
@@ -1,6 +1,10 @@
 package config
 
-import "github.com/luizbafilho/fusis/net"
+import (
+	"time"
+
+	"github.com/luizbafilho/fusis/net"
+)
 
 // {
 // 	"provider": {
@@ -17,6 +21,41 @@ type Provider struct {
 	Params map[string]string
 }
 
+// BGP announces the VIPs of the services to routers. It is disabled
+// without peers.
+type BGP struct {
+	LocalAS uint32
+	// RouterID is the IPv4 address identifying the balancer to its peers.
+	RouterID string
+	// NextHop is announced as the next hop of the VIPs. It defaults to
+	// RouterID.
+	NextHop string
+	// HoldTime, in seconds, is how long a silent peer is waited for.
+	HoldTime int
+	Peers    []BGPPeer
+	// ECMP makes every balancer of a raft cluster hold and announce the
+	// VIPs, not only the leader, for routers to spread the traffic among
+	// them. The balancers stop announcing when the cluster loses quorum.
+	ECMP bool
+	// HealthHook is a shell command run periodically. Every route is
+	// withdrawn while it fails.
+	HealthHook string
+}
+
+// SyncDaemon is an IPVS connection synchronization daemon started with the
+// balancer. State is either master or backup.
+type SyncDaemon struct {
+	State     string
+	Interface string
+	SyncID    int
+}
+
+type BGPPeer struct {
+	Address string
+	AS      uint32
+	Port    int
+}
+
 type Config struct {
 	Interface string
 }
@@ -29,6 +68,64 @@ type BalancerConfig struct {
 	Provider   Provider
 	ConfigPath string
 	RaftPort   int
+	ApiPort    int
+	// ApiSocket, when set, is the path of a Unix socket the API is also
+	// served on, with the permissions of the octal ApiSocketMode.
+	ApiSocket     string
+	ApiSocketMode string
+	// Gossip replicates services through serf instead of raft, with every
+	// balancer accepting writes.
+	Gossip bool
+	BGP    BGP
+	// SyncDaemons keep the connections of a master balancer on its backups,
+	// which can then take over without breaking them.
+	SyncDaemons []SyncDaemon
+
+	// The API is served over HTTPS when TLSCert and TLSKey are set, and
+	// also requires client certificates signed by TLSClientCA if set.
+	// Balancers calling each other present TLSCert as their client
+	// certificate, and trust the CAs of TLSCA, or the system ones.
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	TLSCA       string
+
+	// LogLevel and LogFormat configure the balancer logs, the level can
+	// also be changed at runtime through the API.
+	LogLevel  string
+	LogFormat string
+
+	// RateLimit, when positive, is how many API requests per second each
+	// client may send on average, in bursts of up to RateBurst requests.
+	RateLimit float64
+	RateBurst int
+
+	// MaxConcurrentProbes, when positive, bounds how many destination
+	// health checks run at once.
+	MaxConcurrentProbes int
+
+	// AuditLogSize is how many of the last API writes are kept in memory
+	// and served on /events. They are also appended to AuditLogPath if
+	// set, which is rotated once it reaches AuditLogMaxSize bytes.
+	AuditLogSize    int
+	AuditLogPath    string
+	AuditLogMaxSize int64
+
+	// Compression enables gzip compressed API responses, for the clients
+	// accepting them, and request bodies.
+	Compression bool
+
+	// ShutdownTimeout is how long the API requests in flight are waited
+	// for when the balancer stops.
+	ShutdownTimeout time.Duration
+	// DrainDelay is how long the API keeps serving, reporting the balancer
+	// as not ready, before it stops.
+	DrainDelay time.Duration
+
+	// ServicesFile, when set, declares every service balanced, as read by
+	// LoadServices. It's applied on startup, by the leader with raft, and
+	// again on SIGHUP: the services it leaves out are deleted.
+	ServicesFile string
 }
 
 type AgentConfig struct {
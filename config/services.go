@@ -0,0 +1,325 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/luizbafilho/fusis/ipvs"
+	"gopkg.in/yaml.v2"
+)
+
+// LoadServices reads the services declared in the file at path, along with
+// their destinations. The file is YAML, or JSON when its extension is .json,
+// holding a services list whose entries have the fields services have in the
+// API:
+//
+//	services:
+//	- Name: web
+//	  Host: 10.0.0.1
+//	  Port: 80
+//	  Protocol: tcp
+//	  Scheduler: rr
+//	  Destinations:
+//	  - Name: web1
+//	    Host: 192.168.0.1
+//	    Port: 80
+//
+// Destinations get weight 1 and the route mode when they leave them out, as
+// when created through the API. Unknown fields and invalid entries
+// fail the whole file, with the line of the entry when it can be told.
+func LoadServices(path string) ([]ipvs.Service, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []serviceEntry
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		entries, err = jsonServiceEntries(data)
+	} else {
+		entries, err = yamlServiceEntries(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	services := make([]ipvs.Service, 0, len(entries))
+	declared := make(map[string]serviceEntry)
+	for i, entry := range entries {
+		at := fmt.Sprintf("%s: service %d", path, i+1)
+		if entry.line > 0 {
+			at = fmt.Sprintf("%s:%d", path, entry.line)
+		}
+
+		svc, err := decodeService(entry.raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", at, err)
+		}
+		if err := validateDeclaredService(svc); err != nil {
+			return nil, fmt.Errorf("%s: %v", at, err)
+		}
+		if previous, ok := declared[svc.GetId()]; ok {
+			if previous.line > 0 {
+				return nil, fmt.Errorf("%s: service %q is already declared on line %d", at, svc.GetId(), previous.line)
+			}
+			return nil, fmt.Errorf("%s: service %q is already declared", at, svc.GetId())
+		}
+		declared[svc.GetId()] = entry
+		services = append(services, *svc)
+	}
+	return services, nil
+}
+
+// serviceEntry is the JSON of a service of the file, and the line it starts
+// on, 0 when unknown.
+type serviceEntry struct {
+	line int
+	raw  []byte
+}
+
+// jsonServiceEntries splits the services of a JSON file, locating each of
+// them by its offset.
+func jsonServiceEntries(data []byte) ([]serviceEntry, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	fail := func(err error) ([]serviceEntry, error) {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			return nil, fmt.Errorf("line %d: %v", lineAt(data, syntaxErr.Offset), err)
+		}
+		return nil, err
+	}
+	expect := func(delim json.Delim) error {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if token != delim {
+			return fmt.Errorf("line %d: expected %v, found %v", lineAt(data, dec.InputOffset()), delim, token)
+		}
+		return nil
+	}
+
+	if err := expect('{'); err != nil {
+		return fail(err)
+	}
+	entries := []serviceEntry{}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return fail(err)
+		}
+		if key, _ := token.(string); !strings.EqualFold(key, "services") {
+			return nil, fmt.Errorf("line %d: unknown field %q, only services can be declared", lineAt(data, dec.InputOffset()), token)
+		}
+		if err := expect('['); err != nil {
+			return fail(err)
+		}
+		for dec.More() {
+			start := dec.InputOffset()
+			for start < int64(len(data)) && strings.IndexByte(" \t\r\n,", data[start]) >= 0 {
+				start++
+			}
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return fail(err)
+			}
+			entries = append(entries, serviceEntry{line: lineAt(data, start), raw: raw})
+		}
+		if err := expect(']'); err != nil {
+			return fail(err)
+		}
+	}
+	return entries, nil
+}
+
+// yamlServiceEntries splits the services of a YAML file, converting each of
+// them to JSON. The YAML parser doesn't tell where values are, so the lines
+// are those of the items of the services list in block style, and unknown
+// with flow style.
+func yamlServiceEntries(data []byte) ([]serviceEntry, error) {
+	var doc map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	var services []interface{}
+	for key, value := range doc {
+		if name := fmt.Sprint(key); !strings.EqualFold(name, "services") {
+			return nil, fmt.Errorf("unknown field %q, only services can be declared", name)
+		}
+		list, ok := value.([]interface{})
+		if value != nil && !ok {
+			return nil, fmt.Errorf("services must be a list")
+		}
+		services = list
+	}
+
+	lines := yamlItemLines(data)
+	if len(lines) != len(services) {
+		lines = nil
+	}
+	entries := make([]serviceEntry, 0, len(services))
+	for i, svc := range services {
+		raw, err := json.Marshal(jsonValue(svc))
+		if err != nil {
+			return nil, err
+		}
+		entry := serviceEntry{raw: raw}
+		if lines != nil {
+			entry.line = lines[i]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// yamlItemLines returns the lines of the items of the top level services
+// list, written in block style: the least indented lines starting with a
+// dash below the services key.
+func yamlItemLines(data []byte) []int {
+	var lines []int
+	indent := -1
+	inServices := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		depth := len(line) - len(trimmed)
+		isItem := trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+		if depth == 0 && !isItem {
+			key := strings.TrimSpace(strings.SplitN(trimmed, ":", 2)[0])
+			inServices = strings.EqualFold(strings.Trim(key, `"'`), "services")
+			continue
+		}
+		if !inServices || !isItem || (indent >= 0 && depth > indent) {
+			continue
+		}
+		if depth < indent {
+			// Not a list YAML would accept, the parser tells why
+			return nil
+		}
+		indent = depth
+		lines = append(lines, n)
+	}
+	return lines
+}
+
+// jsonValue converts the maps decoded from YAML, whose keys may be of any
+// type, to maps JSON can encode.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, value := range v {
+			l[i] = jsonValue(value)
+		}
+		return l
+	}
+	return v
+}
+
+// lineAt returns the line of the byte at offset in data, from 1.
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// declaredService is a service of the file, whose destinations are decoded
+// on their own.
+type declaredService struct {
+	ipvs.Service
+	Destinations []json.RawMessage
+}
+
+// decodeService decodes a service of the file, rejecting the fields services
+// don't have. Its destinations are decoded onto weight 1 and the route mode,
+// so only the ones leaving them out get them and weight 0 stays quiesced.
+func decodeService(raw []byte) (*ipvs.Service, error) {
+	declared := &declaredService{}
+	if err := decodeStrict(raw, declared); err != nil {
+		return nil, err
+	}
+
+	svc := &declared.Service
+	svc.Destinations = nil
+	for _, raw := range declared.Destinations {
+		dst := ipvs.Destination{Weight: 1, Mode: "route"}
+		if err := decodeStrict(raw, &dst); err != nil {
+			return nil, err
+		}
+		if dst.ServiceId != "" && dst.ServiceId != svc.GetId() {
+			return nil, fmt.Errorf("destination %q has ServiceId %q, it must be left out or be the service name %q", dst.GetId(), dst.ServiceId, svc.GetId())
+		}
+		dst.ServiceId = svc.GetId()
+		svc.Destinations = append(svc.Destinations, dst)
+	}
+	return svc, nil
+}
+
+// decodeStrict decodes raw into v, failing on the fields v doesn't have.
+func decodeStrict(raw []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// validateDeclaredService checks svc and its destinations like the API does
+// when they are created.
+func validateDeclaredService(svc *ipvs.Service) error {
+	// The destinations are checked below, telling which one is invalid
+	bare := *svc
+	bare.Destinations = nil
+	if err := bare.Validate(); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for i, dst := range svc.Destinations {
+		at := fmt.Sprintf("destination %q of service %q", dst.GetId(), svc.GetId())
+		switch {
+		case dst.GetId() == "":
+			return fmt.Errorf("destination %d of service %q: %v", i+1, svc.GetId(), &ipvs.ValidationError{Field: "Name", Reason: "is required"})
+		case dst.GetId() == "weights":
+			// Taken by the API path setting the weights of the destinations
+			return fmt.Errorf("%s: %v", at, &ipvs.ValidationError{Field: "Name", Reason: "weights is reserved"})
+		case names[dst.GetId()]:
+			return fmt.Errorf("%s is declared twice", at)
+		}
+		names[dst.GetId()] = true
+
+		if err := dst.Validate(); err != nil {
+			return fmt.Errorf("%s: %v", at, err)
+		}
+		// The family of the VIPs left to the pool is only known once allocated
+		if svc.Host != "" {
+			if err := dst.ValidateFamily(*svc); err != nil {
+				return fmt.Errorf("%s: %v", at, err)
+			}
+		}
+		if err := dst.ValidateMode(*svc); err != nil {
+			return fmt.Errorf("%s: %v", at, err)
+		}
+
+		others := *svc
+		others.Destinations = svc.Destinations[:i]
+		if existing := others.DestinationAt(dst); existing != nil {
+			return fmt.Errorf("%s is at the address of destination %q", at, existing.GetId())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/luizbafilho/fusis/ipvs"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ServicesSuite struct {
+	dir string
+}
+
+var _ = Suite(&ServicesSuite{})
+
+func (s *ServicesSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *ServicesSuite) write(c *C, name, content string) string {
+	path := filepath.Join(s.dir, name)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0600), IsNil)
+	return path
+}
+
+func (s *ServicesSuite) TestLoadServicesYAML(c *C) {
+	path := s.write(c, "services.yaml", `
+# The web frontends
+services:
+- name: web
+  host: 10.0.0.1
+  port: 80
+  protocol: tcp
+  scheduler: rr
+  destinations:
+  - name: web1
+    host: 192.168.0.1
+    port: 80
+    healthcheck:
+      type: tcp
+      interval: 5s
+  - name: web2
+    host: 192.168.0.2
+    port: 8080
+    mode: nat
+    weight: 3
+  - name: web3
+    host: 192.168.0.3
+    port: 80
+    weight: 0
+- Name: dns
+  Port: 53
+  Protocol: udp
+  Scheduler: sh
+`)
+	services, err := LoadServices(path)
+	c.Assert(err, IsNil)
+	c.Assert(services, HasLen, 2)
+
+	web := services[0]
+	c.Assert(web.Name, Equals, "web")
+	c.Assert(web.Host, Equals, "10.0.0.1")
+	c.Assert(web.Destinations, HasLen, 3)
+	// Left out, the weight and mode default like in API batches
+	c.Assert(web.Destinations[0].Weight, Equals, int32(1))
+	c.Assert(web.Destinations[0].Mode, Equals, "route")
+	c.Assert(web.Destinations[0].ServiceId, Equals, "web")
+	c.Assert(web.Destinations[0].HealthCheck.Interval, Equals, ipvs.Duration(5*time.Second))
+	c.Assert(web.Destinations[1].Weight, Equals, int32(3))
+	c.Assert(web.Destinations[1].Mode, Equals, "nat")
+	// Set to 0, the destination is quiesced
+	c.Assert(web.Destinations[2].Weight, Equals, int32(0))
+
+	// Without a Host the VIP is allocated from the pool
+	c.Assert(services[1].Host, Equals, "")
+}
+
+func (s *ServicesSuite) TestLoadServicesJSON(c *C) {
+	path := s.write(c, "services.json", `{"services": [
+		{"Name": "web", "Host": "10.0.0.1", "Port": 80, "Protocol": "tcp", "Scheduler": "rr",
+		 "Destinations": [{"Name": "web1", "Host": "192.168.0.1", "Port": 80}]}
+	]}`)
+	services, err := LoadServices(path)
+	c.Assert(err, IsNil)
+	c.Assert(services, HasLen, 1)
+	c.Assert(services[0].Destinations[0].ServiceId, Equals, "web")
+}
+
+func (s *ServicesSuite) TestLoadServicesEmpty(c *C) {
+	services, err := LoadServices(s.write(c, "services.yaml", "services: []\n"))
+	c.Assert(err, IsNil)
+	c.Assert(services, HasLen, 0)
+}
+
+func (s *ServicesSuite) TestLoadServicesInvalid(c *C) {
+	for content, expected := range map[string]string{
+		// Entries are located by their line
+		"services:\n- name: web\n  port: 80\n  protocol: tcp\n  scheduler: rr\n- name: bad\n  port: 0\n  protocol: tcp\n  scheduler: rr\n":                                                                  `.*services.yaml:6: invalid Port: must be between 1 and 65535`,
+		"services:\n  - name: web\n    port: 80\n    protocol: tcp\n    scheduler: rr\n    destinations:\n    - name: web1\n      host: 192.168.0.1\n      port: 80\n      mode: bridge\n":                  `.*services.yaml:2: destination "web1" of service "web": invalid Mode: .*`,
+		"services:\n- name: web\n  port: 80\n  protocol: tcp\n  scheduler: rr\n  sheduler: wrr\n":                                                                                                           `.*services.yaml:2: json: unknown field "sheduler"`,
+		"services:\n- name: web\n  port: 80\n  protocol: tcp\n  scheduler: rr\n  destinations:\n  - name: web1\n    host: 192.168.0.1\n    port: 80\n    wieght: 2\n":                                       `.*services.yaml:2: json: unknown field "wieght"`,
+		"services:\n- name: web\n  port: 80\n  protocol: tcp\n  scheduler: rr\n- name: web\n  port: 81\n  protocol: tcp\n  scheduler: rr\n":                                                                 `.*services.yaml:6: service "web" is already declared on line 2`,
+		"services:\n- name: web\n  port: 80\n  protocol: tcp\n  scheduler: rr\n  destinations:\n  - name: web1\n    host: 192.168.0.1\n    port: 80\n  - name: web2\n    host: 192.168.0.1\n    port: 80\n": `.*services.yaml:2: destination "web2" of service "web" is at the address of destination "web1"`,
+		"service:\n- name: web\n":               `.*services.yaml: unknown field "service", only services can be declared`,
+		"services:\n- name: web\n  port: [80\n": `.*services.yaml: yaml: line 3: .*`,
+		// Flow style lists can't be located
+		"services: [{name: web, port: 80, protocol: tcp, scheduler: fastest}]\n": `.*services.yaml: service 1: unknown scheduler "fastest".*`,
+	} {
+		_, err := LoadServices(s.write(c, "services.yaml", content))
+		c.Assert(err, ErrorMatches, expected, Commentf("%s", content))
+	}
+}
+
+func (s *ServicesSuite) TestLoadServicesInvalidJSON(c *C) {
+	for content, expected := range map[string]string{
+		"{\"services\": [\n  {\"Name\": \"web\", \"Port\": 80, \"Protocol\": \"tcp\", \"Scheduler\": \"rr\"},\n  {\"Name\": \"bad\", \"Port\": 80, \"Protocol\": \"icmp\", \"Scheduler\": \"rr\"}\n]}": `.*services.json:3: invalid Protocol: .*`,
+		"{\"services\": [\n  {\"Name\": \"web\",\n   \"Port\": 80,,\n}]}": `.*services.json: line 3: invalid character .*`,
+		"{\"frontends\": []}": `.*services.json: line 1: unknown field "frontends", only services can be declared`,
+	} {
+		_, err := LoadServices(s.write(c, "services.json", content))
+		c.Assert(err, ErrorMatches, expected, Commentf("%s", content))
+	}
+}
+
+func (s *ServicesSuite) TestLoadServicesMissing(c *C) {
+	_, err := LoadServices(filepath.Join(s.dir, "missing.yaml"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
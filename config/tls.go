@@ -0,0 +1,54 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// ClientTLS loads the PEM files of an HTTPS client into a TLS configuration.
+// certFile and keyFile, when set, hold the client certificate presented to
+// servers requiring mTLS, and caFile, when set, the CAs trusted to sign the
+// server certificate instead of the system ones.
+func ClientTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// PeerTLS returns the TLS configuration balancers use to call the API of the
+// others: they present their own API certificate, and trust the CAs of
+// TLSCA. It is nil when the API isn't served over HTTPS.
+func (b BalancerConfig) PeerTLS() (*tls.Config, error) {
+	if b.TLSCert == "" {
+		return nil, nil
+	}
+	return ClientTLS(b.TLSCert, b.TLSKey, b.TLSCA)
+}
+
+// LoadCertPool reads the PEM certificates of file into a pool.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/luizbafilho/fusis/ipvs"
+	"github.com/luizbafilho/fusis/metrics"
+)
+
+// adaptiveWeights keeps the latency averages of the destinations of
+// adaptively weighted services, and the weights computed from them.
+type adaptiveWeights struct {
+	sync.Mutex
+	// latencies maps service ids to the average latency, in nanoseconds, of
+	// each of their destinations.
+	latencies map[string]map[string]float64
+	weights   map[string]int32
+}
+
+func newAdaptiveWeights() *adaptiveWeights {
+	return &adaptiveWeights{
+		latencies: make(map[string]map[string]float64),
+		weights:   make(map[string]int32),
+	}
+}
+
+// record folds a latency sample of a destination of svc in, returning the
+// destinations whose weight changed.
+func (a *adaptiveWeights) record(svc ipvs.Service, dstId string, latency time.Duration) []string {
+	a.Lock()
+	defer a.Unlock()
+
+	latencies, ok := a.latencies[svc.GetId()]
+	if !ok {
+		latencies = make(map[string]float64)
+		a.latencies[svc.GetId()] = latencies
+	}
+	latencies[dstId] = svc.AdaptiveWeight.Average(latencies[dstId], float64(latency))
+
+	changed := []string{}
+	for id, w := range svc.AdaptiveWeight.Weights(latencies) {
+		if current, ok := a.weights[id]; !ok || current != w {
+			a.weights[id] = w
+			changed = append(changed, id)
+		}
+	}
+	return changed
+}
+
+func (a *adaptiveWeights) weight(dstId string) (int32, bool) {
+	a.Lock()
+	defer a.Unlock()
+	w, ok := a.weights[dstId]
+	return w, ok
+}
+
+// forget drops what is known about the destination dstId of serviceId.
+func (a *adaptiveWeights) forget(serviceId, dstId string) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.latencies[serviceId], dstId)
+	delete(a.weights, dstId)
+}
+
+// forgetService drops what is known about every destination of svc.
+func (a *adaptiveWeights) forgetService(serviceId string) {
+	a.Lock()
+	defer a.Unlock()
+	for id := range a.latencies[serviceId] {
+		delete(a.weights, id)
+	}
+	delete(a.latencies, serviceId)
+}
+
+// applyProbe counts the health checks of destinations, detects the outliers
+// of the services doing so, and reweights the destinations of adaptively
+// weighted services after a successful check.
+func (e *Engine) applyProbe(checked ipvs.Destination, latency time.Duration, err error) {
+	metrics.ObserveHealthCheck(checked, err == nil)
+
+	e.Lock()
+	ejections := e.probe(checked, latency, err)
+	e.Unlock()
+
+	if e.onEjection != nil {
+		for _, ejection := range ejections {
+			e.onEjection(ejection)
+		}
+	}
+}
+
+// probe applies a check of checked, returning the ejections and
+// readmissions of outliers it made. It must be called with the engine
+// locked, and ignores destinations deleted since they were checked.
+func (e *Engine) probe(checked ipvs.Destination, latency time.Duration, err error) []Ejection {
+	if _, getErr := e.State.GetDestination(checked.GetId()); getErr != nil {
+		return nil
+	}
+	svc, getErr := e.State.GetService(checked.ServiceId)
+	if getErr != nil {
+		return nil
+	}
+	var ejections []Ejection
+	if svc.OutlierDetection != nil {
+		ejections = e.detectOutliers(svc, checked, latency, err)
+	}
+	if err != nil || svc.AdaptiveWeight == nil {
+		return ejections
+	}
+
+	for _, id := range e.adaptive.record(*svc, checked.GetId(), latency) {
+		dst, err := e.State.GetDestination(id)
+		if err != nil {
+			continue
+		}
+		if err := e.programDestination(svc, dst); err != nil {
+			e.Logger.Errorf("Updating adaptive weight of destination %s failed: %v", id, err)
+		}
+	}
+	return ejections
+}
+
+// EffectiveWeight returns the weight dst has in IPVS on this balancer.
+func (e *Engine) EffectiveWeight(dst *ipvs.Destination) int32 {
+	return e.ipvsDestination(dst).Weight
+}
@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// BatchError is returned when a command of a batch fails. Index is the
+// position of the failing command in the batch.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch command %d failed: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// applyBatch applies cmds in order. When one of them fails the ones already
+// applied are undone in reverse order, so either every command is applied or
+// none is.
+func (e *Engine) applyBatch(cmds []Command) error {
+	undos := []func() error{}
+	for i := range cmds {
+		undo, err := e.applyStep(&cmds[i])
+		if err != nil {
+			for j := len(undos) - 1; j >= 0; j-- {
+				if err := undos[j](); err != nil {
+					e.Logger.Errorf("Undoing batch command %d failed: %v", j, err)
+				}
+			}
+			return &BatchError{Index: i, Err: err}
+		}
+		undos = append(undos, undo)
+	}
+	return nil
+}
+
+// applyStep applies a single command of a batch, returning the function
+// that undoes it. The service of a destination command is taken from the
+// state, as it may have been added by the batch itself.
+func (e *Engine) applyStep(c *Command) (func() error, error) {
+	if c.Op == AddDestinationOp || c.Op == UpdateDestinationOp || c.Op == DelDestinationOp {
+		svc, err := e.State.GetService(c.Destination.ServiceId)
+		if err != nil {
+			return nil, err
+		}
+		c.Service = svc
+	}
+
+	switch c.Op {
+	case AddServiceOp:
+		if err := e.applyAddService(c.Service); err != nil {
+			return nil, err
+		}
+		svc := c.Service
+		return func() error { return e.applyDelService(svc) }, nil
+	case UpdateServiceOp:
+		previous, err := e.State.GetService(c.Service.GetId())
+		if err != nil {
+			return nil, err
+		}
+		if err := e.applyUpdateService(c.Service); err != nil {
+			return nil, err
+		}
+		return func() error { return e.applyUpdateService(previous) }, nil
+	case DelServiceOp:
+		// The service in the state has the destinations to add back
+		svc, err := e.State.GetService(c.Service.GetId())
+		if err != nil {
+			return nil, err
+		}
+		deleted := *svc
+		deleted.Destinations = append([]ipvs.Destination{}, svc.Destinations...)
+		if err := e.applyDelService(&deleted); err != nil {
+			return nil, err
+		}
+		return func() error {
+			dsts := deleted.Destinations
+			deleted.Destinations = nil
+			if err := e.applyAddService(&deleted); err != nil {
+				return err
+			}
+			for i := range dsts {
+				if err := e.applyAddDestination(&deleted, &dsts[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+	case AddDestinationOp:
+		if err := e.addDestination(c.Service, c.Destination); err != nil {
+			return nil, err
+		}
+		svc, dst := c.Service, c.Destination
+		return func() error { return e.applyDelDestination(svc, dst) }, nil
+	case UpdateDestinationOp:
+		previous, err := e.State.GetDestination(c.Destination.GetId())
+		if err != nil {
+			return nil, err
+		}
+		if err := e.applyUpdateDestination(c.Service, c.Destination); err != nil {
+			return nil, err
+		}
+		svc := c.Service
+		return func() error { return e.applyUpdateDestination(svc, previous) }, nil
+	case DelDestinationOp:
+		if err := e.applyDelDestination(c.Service, c.Destination); err != nil {
+			return nil, err
+		}
+		svc, dst := c.Service, c.Destination
+		return func() error { return e.applyAddDestination(svc, dst) }, nil
+	}
+	return nil, fmt.Errorf("unsupported batch operation %d", c.Op)
+}
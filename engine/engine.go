@@ -7,9 +7,14 @@ import (
 	"sync"
 
 	"github.com/Sirupsen/logrus"
+	gipvs "github.com/google/seesaw/ipvs"
 	"github.com/hashicorp/raft"
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/health"
 	"github.com/luizbafilho/fusis/ipvs"
+	"github.com/luizbafilho/fusis/logging"
 	"github.com/luizbafilho/fusis/provider"
+	"github.com/luizbafilho/fusis/store"
 )
 
 // Engine ...
@@ -20,6 +25,20 @@ type Engine struct {
 	State     ipvs.State
 	Provider  provider.Provider
 	CommandCh chan Command
+	Health    *health.Monitor
+	// Store, when set, keeps a local copy of every service applied.
+	Store *store.Store
+	// Logger is where the engine logs what it applies.
+	Logger *logrus.Entry
+
+	adaptive       *adaptiveWeights
+	outliers       *outliers
+	leases         *leases
+	onHealthChange func(health.Change)
+	onEjection     func(Ejection)
+	// unwatched are the destinations to stop checking once the engine is
+	// unlocked, since their checks in progress may be waiting for it.
+	unwatched map[string]bool
 }
 
 // Represents possible actions on engine
@@ -29,6 +48,13 @@ const (
 
 	AddDestinationOp
 	DelDestinationOp
+
+	UpdateServiceOp
+	UpdateDestinationOp
+
+	FlushServicesOp
+
+	BatchOp
 )
 
 // Command represents a command in raft log
@@ -36,6 +62,13 @@ type Command struct {
 	Op          int
 	Service     *ipvs.Service
 	Destination *ipvs.Destination
+
+	// Services holds the services removed by a FlushServicesOp. It is
+	// filled when the command is applied.
+	Services []ipvs.Service
+
+	// Commands holds the commands of a BatchOp, applied in order.
+	Commands []Command
 }
 
 // New creates a new Engine
@@ -47,12 +80,22 @@ func New() (*Engine, error) {
 		return nil, err
 	}
 
-	return &Engine{
+	e := &Engine{
 		CommandCh: make(chan Command),
 		State:     state,
 		Provider:  provider,
 		Ipvs:      ipvs.New(),
-	}, nil
+		adaptive:  newAdaptiveWeights(),
+		outliers:  newOutliers(),
+		leases:    newLeases(),
+		unwatched: make(map[string]bool),
+		Logger:    logging.Logger().WithField("component", "engine"),
+	}
+	e.Health = health.NewMonitor(e.applyHealth, e.destinationLoad)
+	e.Health.OnProbe(e.applyProbe)
+	e.Health.SetMaxConcurrentProbes(config.Balancer.MaxConcurrentProbes)
+
+	return e, nil
 }
 
 // Apply actions to fsm
@@ -62,33 +105,136 @@ func (e *Engine) Apply(l *raft.Log) interface{} {
 		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
 	}
 
-	logrus.Infof("Actions received to be aplied to fsm: %v", c)
+	e.Logger.Infof("Actions received to be aplied to fsm: %v", c)
+	e.Lock()
+	err := e.apply(&c)
+	e.unlock()
+	if err != nil {
+		e.Logger.Error(err)
+		return err
+	}
+
+	if c.Op == BatchOp {
+		for _, sub := range c.Commands {
+			e.CommandCh <- sub
+			e.persist(sub)
+		}
+		return nil
+	}
+	e.CommandCh <- c
+	e.persist(c)
+	return nil
+}
+
+// apply applies c, filling the services removed by a FlushServicesOp. It
+// must be called with the engine locked.
+func (e *Engine) apply(c *Command) error {
 	switch c.Op {
 	case AddServiceOp:
-		if err := e.applyAddService(c.Service); err != nil {
-			logrus.Error(err)
-			return err
-		}
-		e.CommandCh <- c
+		return e.applyAddService(c.Service)
 	case DelServiceOp:
-		if err := e.applyDelService(c.Service); err != nil {
-			logrus.Error(err)
-			return err
-		}
-		e.CommandCh <- c
+		return e.applyDelService(c.Service)
+	case UpdateServiceOp:
+		return e.applyUpdateService(c.Service)
 	case AddDestinationOp:
-		if err := e.applyAddDestination(c.Service, c.Destination); err != nil {
-			logrus.Error(err)
-			return err
-		}
-		e.CommandCh <- c
+		return e.addDestination(c.Service, c.Destination)
+	case UpdateDestinationOp:
+		return e.applyUpdateDestination(c.Service, c.Destination)
 	case DelDestinationOp:
-		if err := e.applyDelDestination(c.Service, c.Destination); err != nil {
-			logrus.Error(err)
+		return e.applyDelDestination(c.Service, c.Destination)
+	case FlushServicesOp:
+		services, err := e.applyFlushServices()
+		c.Services = services
+		return err
+	case BatchOp:
+		return e.applyBatch(c.Commands)
+	}
+	return nil
+}
+
+// unlock unlocks the engine, then stops checking the destinations removed
+// while it was locked.
+func (e *Engine) unlock() {
+	unwatched := e.unwatched
+	e.unwatched = make(map[string]bool)
+	e.Unlock()
+
+	for id := range unwatched {
+		e.Health.Unwatch(id)
+	}
+}
+
+// watch starts checking dst as described by its HealthCheck, or stops
+// checking it once the engine is unlocked if it has none.
+func (e *Engine) watch(dst *ipvs.Destination) {
+	if dst.HealthCheck == nil {
+		e.unwatch(dst.GetId())
+		return
+	}
+	delete(e.unwatched, dst.GetId())
+	e.Health.Watch(*dst)
+}
+
+// unwatch stops checking the destination id once the engine is unlocked.
+func (e *Engine) unwatch(id string) {
+	e.unwatched[id] = true
+}
+
+// persist saves the services changed by c to the local store.
+func (e *Engine) persist(c Command) {
+	switch {
+	case c.Op == FlushServicesOp:
+		for _, svc := range c.Services {
+			e.persistService(svc.GetId())
+		}
+	case c.Service != nil:
+		e.persistService(c.Service.GetId())
+	}
+}
+
+// persistService saves the service id as it is in the state, or deletes it
+// from the local store if it isn't there anymore.
+func (e *Engine) persistService(id string) {
+	if e.Store == nil {
+		return
+	}
+
+	var err error
+	if svc, getErr := e.State.GetService(id); getErr == nil {
+		err = e.Store.SaveService(*svc)
+	} else {
+		err = e.Store.DeleteService(id)
+	}
+	if err != nil {
+		e.Logger.Errorf("Persisting service %s failed: %v", id, err)
+	}
+}
+
+// Load programs the services saved in the local store, so they are balanced
+// again before the cluster state is replayed.
+func (e *Engine) Load() error {
+	services, err := e.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	e.Lock()
+	defer e.unlock()
+
+	for i := range services {
+		svc := &services[i]
+		if err := e.applyAddService(svc); err != nil {
 			return err
 		}
-		e.CommandCh <- c
+
+		for j := range svc.Destinations {
+			if err := e.applyAddDestination(svc, &svc.Destinations[j]); err != nil {
+				return err
+			}
+		}
 	}
+
+	e.Logger.Infof("Loaded %d services from the local store", len(services))
 	return nil
 }
 
@@ -97,47 +243,370 @@ func (e *Engine) applyAddService(svc *ipvs.Service) error {
 		return err
 	}
 
+	if err := e.Ipvs.SetPersistenceNetmask(*svc); err != nil {
+		return err
+	}
+
+	if err := e.Ipvs.AddSNAT(*svc); err != nil {
+		return err
+	}
+
+	if err := e.Ipvs.AddACL(*svc); err != nil {
+		return err
+	}
+
+	if err := e.Ipvs.AddConnLimit(*svc); err != nil {
+		return err
+	}
+
 	e.State.AddService(svc)
 
 	return nil
 }
 
+func (e *Engine) applyUpdateService(svc *ipvs.Service) error {
+	if err := e.Ipvs.UpdateService(svc.ToIpvsService()); err != nil {
+		return err
+	}
+
+	if err := e.Ipvs.SetPersistenceNetmask(*svc); err != nil {
+		return err
+	}
+
+	if svc.SNAT {
+		if err := e.Ipvs.AddSNAT(*svc); err != nil {
+			return err
+		}
+	} else if err := e.Ipvs.DelSNAT(*svc); err != nil {
+		return err
+	}
+
+	previous, err := e.State.GetService(svc.GetId())
+	if err == nil {
+		if err := e.Ipvs.DelACL(*previous); err != nil {
+			return err
+		}
+		if err := e.Ipvs.DelConnLimit(*previous); err != nil {
+			return err
+		}
+	}
+	if err := e.Ipvs.AddACL(*svc); err != nil {
+		return err
+	}
+	if err := e.Ipvs.AddConnLimit(*svc); err != nil {
+		return err
+	}
+	e.State.AddService(svc)
+
+	if err != nil {
+		return nil
+	}
+	// Dropping the adaptive policy gives the destinations their configured
+	// weights back, and toggling maintenance quiesces or restores them
+	reweight := previous.Maintenance != svc.Maintenance
+	if previous.AdaptiveWeight != nil && svc.AdaptiveWeight == nil {
+		e.adaptive.forgetService(svc.GetId())
+		reweight = true
+	}
+	var readmitted []Ejection
+	if previous.OutlierDetection != nil && svc.OutlierDetection == nil {
+		readmitted = e.outliers.forgetService(svc.GetId())
+		reweight = true
+	}
+	if reweight {
+		for i := range svc.Destinations {
+			if err := e.programDestination(svc, &svc.Destinations[i]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, ejection := range readmitted {
+		if e.onEjection != nil {
+			e.onEjection(ejection)
+		}
+	}
+	return nil
+}
+
 func (e *Engine) applyDelService(svc *ipvs.Service) error {
 	if err := e.Ipvs.DeleteService(svc.ToIpvsService()); err != nil {
 		return err
 	}
 
+	if svc.SNAT {
+		if err := e.Ipvs.DelSNAT(*svc); err != nil {
+			return err
+		}
+	}
+
+	if err := e.Ipvs.DelACL(*svc); err != nil {
+		return err
+	}
+
+	if err := e.Ipvs.DelConnLimit(*svc); err != nil {
+		return err
+	}
+
+	for _, d := range svc.Destinations {
+		e.State.DeleteDestination(&d)
+		e.unwatch(d.GetId())
+	}
+	e.adaptive.forgetService(svc.GetId())
+	e.outliers.forgetService(svc.GetId())
+
 	e.State.DeleteService(svc)
 	return nil
 }
 
 func (e *Engine) applyAddDestination(svc *ipvs.Service, dst *ipvs.Destination) error {
-	err := e.Ipvs.AddDestination(*svc.ToIpvsService(), *dst.ToIpvsDestination())
+	err := e.Ipvs.AddDestination(*svc.ToIpvsService(), *e.ipvsDestination(dst))
 	if err != nil {
-		return nil
+		return err
 	}
 
 	e.State.AddDestination(dst)
+	e.watch(dst)
 
 	return nil
 }
 
-func (e *Engine) applyDelDestination(svc *ipvs.Service, dst *ipvs.Destination) error {
-	err := e.Ipvs.DeleteDestination(*svc.ToIpvsService(), *dst.ToIpvsDestination())
-	if err != nil {
+// addDestination adds dst to svc unless another destination of svc in the
+// state is at its address, failing with ipvs.ErrDestinationExists.
+func (e *Engine) addDestination(svc *ipvs.Service, dst *ipvs.Destination) error {
+	if current, err := e.State.GetService(svc.GetId()); err == nil {
+		if _, err := dst.ValidateUniqueness(current); err != nil {
+			return err
+		}
+	}
+	return e.applyAddDestination(svc, dst)
+}
+
+func (e *Engine) applyUpdateDestination(svc *ipvs.Service, dst *ipvs.Destination) error {
+	e.watch(dst)
+
+	if err := e.programDestination(svc, dst); err != nil {
+		return err
+	}
+
+	e.State.AddDestination(dst)
+
+	return nil
+}
+
+// ipvsDestination returns dst as programmed in IPVS, weighted adaptively if
+// its service is, and withdrawn with weight 0 while its health check fails,
+// its service is in maintenance, it's ejected as an outlier or it missed its
+// heartbeats.
+func (e *Engine) ipvsDestination(dst *ipvs.Destination) *gipvs.Destination {
+	d := dst.ToIpvsDestination()
+	if svc, err := e.State.GetService(dst.ServiceId); err == nil {
+		if svc.AdaptiveWeight != nil {
+			if w, ok := e.adaptive.weight(dst.GetId()); ok {
+				d.Weight = w
+			}
+		}
+		if svc.Maintenance {
+			d.Weight = 0
+		}
+		if svc.OutlierDetection != nil && e.outliers.ejected(svc.GetId(), dst.GetId()) {
+			d.Weight = 0
+		}
+	}
+	// The check of a destination that just lost it is only unwatched once
+	// the engine is unlocked
+	if status, ok := e.Health.Status(dst.GetId()); ok && dst.HealthCheck != nil && status.State == health.Unhealthy {
+		d.Weight = 0
+	}
+	if dst.Expired {
+		d.Weight = 0
+	}
+	return d
+}
+
+// withdrawn tells if dst is kept out of IPVS, which the destinations failing
+// a health check not inhibiting are.
+func (e *Engine) withdrawn(dst *ipvs.Destination) bool {
+	if dst.HealthCheck == nil || dst.HealthCheck.Inhibits() {
+		return false
+	}
+	status, ok := e.Health.Status(dst.GetId())
+	return ok && status.State == health.Unhealthy
+}
+
+// programDestination updates dst, a destination of svc, in IPVS. It's
+// removed while withdrawn, and added back once it isn't anymore.
+func (e *Engine) programDestination(svc *ipvs.Service, dst *ipvs.Destination) error {
+	_, _, err := e.readStats(svc, dst)
+	if err != nil && err != ipvs.ErrNotFound {
+		return err
+	}
+	present := err == nil
+
+	switch {
+	case e.withdrawn(dst):
+		if present {
+			return e.Ipvs.DeleteDestination(*svc.ToIpvsService(), *dst.ToIpvsDestination())
+		}
 		return nil
+	case !present:
+		return e.Ipvs.AddDestination(*svc.ToIpvsService(), *e.ipvsDestination(dst))
+	default:
+		return e.Ipvs.UpdateDestination(*svc.ToIpvsService(), *e.ipvsDestination(dst))
+	}
+}
+
+// OnHealthChange makes the engine call fn every time a destination changes
+// state, once IPVS is updated. It must be set before any destination is
+// applied.
+func (e *Engine) OnHealthChange(fn func(health.Change)) {
+	e.onHealthChange = fn
+}
+
+// applyHealth withdraws destinations that became unhealthy from IPVS, and
+// restores them once they are healthy again. The weights kept in the
+// state are never changed, so every balancer checks on its own.
+func (e *Engine) applyHealth(change health.Change) {
+	// The destination is read with the engine locked, so one deleted
+	// meanwhile isn't added back
+	e.Lock()
+	dst, err := e.State.GetDestination(change.DestinationId)
+	if err == nil {
+		var svc *ipvs.Service
+		if svc, err = e.State.GetService(dst.ServiceId); err == nil {
+			if err := e.programDestination(svc, dst); err != nil {
+				e.Logger.Errorf("Updating weight of %s destination %s failed: %v", change.To, dst.GetId(), err)
+			}
+		}
+	}
+	e.Unlock()
+	if err != nil {
+		return
+	}
+
+	if e.onHealthChange != nil {
+		e.onHealthChange(change)
+	}
+}
+
+func (e *Engine) applyDelDestination(svc *ipvs.Service, dst *ipvs.Destination) error {
+	// Withdrawn destinations are already out of IPVS
+	if stored, err := e.State.GetDestination(dst.GetId()); err != nil || !e.withdrawn(stored) {
+		err := e.Ipvs.DeleteDestination(*svc.ToIpvsService(), *dst.ToIpvsDestination())
+		if err != nil {
+			return err
+		}
 	}
 
 	e.State.DeleteDestination(dst)
+	e.unwatch(dst.GetId())
+	e.adaptive.forget(dst.ServiceId, dst.GetId())
+	e.outliers.forget(dst.ServiceId, dst.GetId())
 
 	return nil
 }
 
+// applyFlushServices removes every service and destination at once,
+// returning the services removed.
+func (e *Engine) applyFlushServices() ([]ipvs.Service, error) {
+	services := *e.State.GetServices()
+
+	if err := e.Ipvs.Flush(); err != nil {
+		return nil, err
+	}
+
+	if err := e.Ipvs.FlushSNAT(); err != nil {
+		return nil, err
+	}
+
+	if err := e.Ipvs.FlushACL(); err != nil {
+		return nil, err
+	}
+
+	if err := e.Ipvs.FlushConnLimit(); err != nil {
+		return nil, err
+	}
+
+	for i := range services {
+		svc := &services[i]
+		for j := range svc.Destinations {
+			e.State.DeleteDestination(&svc.Destinations[j])
+			e.unwatch(svc.Destinations[j].GetId())
+		}
+		e.adaptive.forgetService(svc.GetId())
+		e.outliers.forgetService(svc.GetId())
+		e.State.DeleteService(svc)
+	}
+
+	return services, nil
+}
+
+// GetServiceStats reads the counters of svc from the IPVS table, and the
+// drops of its connection rate limit from the firewall
+func (e *Engine) GetServiceStats(svc *ipvs.Service) (*ipvs.ServiceStats, error) {
+	s, err := e.Ipvs.GetService(svc.ToIpvsService())
+	if err != nil {
+		return nil, err
+	}
+
+	stats := ipvs.NewServiceStats(s)
+	if stats.ConnLimitDrops, err = e.Ipvs.ConnLimitDrops(*svc); err != nil {
+		// The IPVS counters are still worth answering with
+		e.Logger.Warnf("Reading the connection limit drops of %s failed: %v", svc.GetId(), err)
+	}
+	return stats, nil
+}
+
+// GetPersistenceEntries reads the persistence templates of svc from the
+// IPVS connection table
+func (e *Engine) GetPersistenceEntries(svc *ipvs.Service) ([]ipvs.PersistenceEntry, error) {
+	return e.Ipvs.GetPersistenceEntries(*svc)
+}
+
+// GetDestinationStats reads the counters of dst, a destination of svc, from
+// the IPVS table
+func (e *Engine) GetDestinationStats(svc *ipvs.Service, dst *ipvs.Destination) (*ipvs.DestinationStats, error) {
+	dstStats, _, err := e.readStats(svc, dst)
+	return dstStats, err
+}
+
+// destinationLoad reads the counters passive health checks are based on.
+func (e *Engine) destinationLoad(dst ipvs.Destination) (*ipvs.DestinationStats, *ipvs.ServiceStats, error) {
+	svc, err := e.State.GetService(dst.ServiceId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e.readStats(svc, &dst)
+}
+
+func (e *Engine) readStats(svc *ipvs.Service, dst *ipvs.Destination) (*ipvs.DestinationStats, *ipvs.ServiceStats, error) {
+	s, err := e.Ipvs.GetService(svc.ToIpvsService())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	want := dst.ToIpvsDestination()
+	for _, d := range s.Destinations {
+		if d.Address.Equal(want.Address) && d.Port == want.Port {
+			return ipvs.NewDestinationStats(d), ipvs.NewServiceStats(s), nil
+		}
+	}
+
+	return nil, nil, ipvs.ErrNotFound
+}
+
+// AssignVIP binds the service VIP to the balancer. Firewall mark services
+// have no VIP of their own to bind.
 func (e *Engine) AssignVIP(svc *ipvs.Service) error {
+	if svc.IsFwmark() {
+		return nil
+	}
 	return e.Provider.AssignVIP(*svc)
 }
 
 func (e *Engine) UnassignVIP(svc *ipvs.Service) error {
+	if svc.IsFwmark() {
+		return nil
+	}
 	return e.Provider.UnassignVIP(*svc)
 }
 
@@ -146,7 +615,7 @@ type fusisSnapshot struct {
 }
 
 func (e *Engine) Snapshot() (raft.FSMSnapshot, error) {
-	logrus.Info("Snapshotting Fusis State")
+	e.Logger.Info("Snapshotting Fusis State")
 	e.Lock()
 	defer e.Unlock()
 
@@ -157,26 +626,113 @@ func (e *Engine) Snapshot() (raft.FSMSnapshot, error) {
 
 // Restore stores the key-value store to a previous state.
 func (e *Engine) Restore(rc io.ReadCloser) error {
-	logrus.Info("Restoring Fusis state")
+	e.Logger.Info("Restoring Fusis state")
 	var services []ipvs.Service
 	if err := json.NewDecoder(rc).Decode(&services); err != nil {
 		return err
 	}
 
-	// Set the state from the snapshot, no lock required according to
-	// Hashicorp docs.
+	// Raft doesn't apply commands while restoring, but the health checks
+	// keep running. Services loaded from the local store are updated in
+	// place, so they keep being balanced while the snapshot is restored.
+	e.Lock()
+	defer e.unlock()
+
+	restored := make(map[string]bool)
 	for _, s := range services {
-		if err := e.applyAddService(&s); err != nil {
+		if err := e.restoreService(&s); err != nil {
+			return err
+		}
+		restored[s.GetId()] = true
+	}
+
+	for _, s := range *e.State.GetServices() {
+		if restored[s.GetId()] {
+			continue
+		}
+		if err := e.applyDelService(&s); err != nil {
 			return err
 		}
+		e.persistService(s.GetId())
+	}
+
+	return nil
+}
 
-		for _, d := range s.Destinations {
-			if err := e.applyAddDestination(&s, &d); err != nil {
+// SyncService makes svc and its destinations balanced as given, whether svc
+// is already balanced or not. It replicates services outside of raft.
+func (e *Engine) SyncService(svc *ipvs.Service) error {
+	e.Lock()
+	op := UpdateServiceOp
+	if _, err := e.State.GetService(svc.GetId()); err != nil {
+		op = AddServiceOp
+	}
+	err := e.restoreService(svc)
+	e.unlock()
+	if err != nil {
+		return err
+	}
+
+	e.CommandCh <- Command{Op: op, Service: svc}
+	return nil
+}
+
+// RemoveService stops balancing the service id, if it is balanced.
+func (e *Engine) RemoveService(id string) error {
+	e.Lock()
+	svc, err := e.State.GetService(id)
+	if err != nil {
+		e.unlock()
+		return nil
+	}
+	err = e.applyDelService(svc)
+	e.persistService(id)
+	e.unlock()
+	if err != nil {
+		return err
+	}
+
+	e.CommandCh <- Command{Op: DelServiceOp, Service: svc}
+	return nil
+}
+
+// restoreService makes svc and its destinations, and only them, balanced.
+func (e *Engine) restoreService(svc *ipvs.Service) error {
+	current, err := e.State.GetService(svc.GetId())
+	if err != nil {
+		if err := e.applyAddService(svc); err != nil {
+			return err
+		}
+		current = &ipvs.Service{}
+	} else if err := e.applyUpdateService(svc); err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, d := range current.Destinations {
+		existing[d.GetId()] = true
+	}
+	for i := range svc.Destinations {
+		d := &svc.Destinations[i]
+		if existing[d.GetId()] {
+			delete(existing, d.GetId())
+			err = e.applyUpdateDestination(svc, d)
+		} else {
+			err = e.applyAddDestination(svc, d)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, d := range current.Destinations {
+		if existing[d.GetId()] {
+			if err := e.applyDelDestination(svc, &d); err != nil {
 				return err
 			}
 		}
 	}
 
+	e.persistService(svc.GetId())
 	return nil
 }
 
@@ -5,13 +5,22 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	gipvs "github.com/google/seesaw/ipvs"
 	"github.com/hashicorp/raft"
 	"github.com/luizbafilho/fusis/config"
 	"github.com/luizbafilho/fusis/engine"
+	"github.com/luizbafilho/fusis/health"
 	"github.com/luizbafilho/fusis/ipvs"
+	"github.com/luizbafilho/fusis/store"
 	"github.com/spf13/viper"
 
 	_ "github.com/luizbafilho/fusis/provider/none" // to intialize
@@ -153,6 +162,220 @@ func (s *EngineSuite) TestApplyAddService(c *C) {
 	c.Assert(svcs[0].Address.String(), DeepEquals, s.service.Host)
 }
 
+func (s *EngineSuite) TestApplyServiceOnePacket(c *C) {
+	svc := ipvs.Service{
+		Name:      "dns",
+		Host:      "10.0.1.53",
+		Port:      53,
+		Protocol:  "udp",
+		Scheduler: ipvs.SchedulerRR,
+		OnePacket: true,
+	}
+	c.Assert(svc.Validate(), IsNil)
+	cmd := &engine.Command{Op: engine.AddServiceOp, Service: &svc}
+	if resp := s.engine.Apply(makeLog(cmd)); resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+
+	svcs, err := s.engine.Ipvs.GetServices()
+	c.Assert(err, IsNil)
+	c.Assert(len(svcs), Equals, 1)
+	c.Assert(svcs[0].Protocol, Equals, gipvs.IPProto(syscall.IPPROTO_UDP))
+	c.Assert(svcs[0].Flags&gipvs.SFOnePacket, Equals, gipvs.SFOnePacket)
+
+	out, err := exec.Command("ipvsadm", "-L", "-n", "-u", "10.0.1.53:53").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Matches, `(?s).*UDP  10.0.1.53:53 rr ops.*`)
+}
+
+func (s *EngineSuite) TestApplyServiceSNAT(c *C) {
+	svc := *s.service
+	svc.SNAT = true
+	cmd := &engine.Command{Op: engine.AddServiceOp, Service: &svc}
+	if resp := s.engine.Apply(makeLog(cmd)); resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+
+	out, err := exec.Command("iptables", "-t", "nat", "-S", "FUSIS-SNAT").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Matches, `(?s).*--vaddr 10.0.1.1/32 --vport 80 .*-j MASQUERADE.*`)
+
+	cmd = &engine.Command{Op: engine.FlushServicesOp}
+	if resp := s.engine.Apply(makeLog(cmd)); resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+
+	out, err = exec.Command("iptables", "-t", "nat", "-S", "FUSIS-SNAT").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Not(Matches), `(?s).*MASQUERADE.*`)
+}
+
+func (s *EngineSuite) TestApplyServiceACL(c *C) {
+	svc := *s.service
+	svc.AccessControl = &ipvs.AccessControl{Allow: []string{"192.168.0.0/16"}, Deny: []string{"192.168.1.0/24"}}
+	cmd := &engine.Command{Op: engine.AddServiceOp, Service: &svc}
+	if resp := s.engine.Apply(makeLog(cmd)); resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+
+	out, err := exec.Command("iptables", "-S", "FUSIS-ACL").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Matches, `(?s).*-s 192.168.1.0/24 -d 10.0.1.1/32 -p tcp .*-j DROP.*-s 192.168.0.0/16 -d 10.0.1.1/32 .*-j RETURN.*`)
+
+	cmd = &engine.Command{Op: engine.DelServiceOp, Service: &svc}
+	if resp := s.engine.Apply(makeLog(cmd)); resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+
+	out, err = exec.Command("iptables", "-S", "FUSIS-ACL").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Not(Matches), `(?s).*fusis:.*`)
+}
+
+func (s *EngineSuite) TestApplyServiceConnLimit(c *C) {
+	svc := *s.service
+	svc.ConnLimit = &ipvs.ConnLimit{Rate: 100, Burst: 200}
+	cmd := &engine.Command{Op: engine.AddServiceOp, Service: &svc}
+	if resp := s.engine.Apply(makeLog(cmd)); resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+
+	out, err := exec.Command("iptables", "-S", "FUSIS-LIMIT").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Matches, `(?s).*-d 10.0.1.1/32 -p tcp .*--limit 100/sec --limit-burst 200 .*-j RETURN.*-j DROP.*`)
+
+	stats, err := s.engine.GetServiceStats(&svc)
+	c.Assert(err, IsNil)
+	c.Assert(stats.ConnLimitDrops, Equals, uint64(0))
+
+	cmd = &engine.Command{Op: engine.FlushServicesOp}
+	if resp := s.engine.Apply(makeLog(cmd)); resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+
+	out, err = exec.Command("iptables", "-S", "FUSIS-LIMIT").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Not(Matches), `(?s).*fusis:.*`)
+}
+
+func (s *EngineSuite) TestApplyPersistsToStore(c *C) {
+	dir, err := ioutil.TempDir("", "fusis-engine")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	st, err := store.Open(filepath.Join(dir, "services.db"))
+	c.Assert(err, IsNil)
+	defer st.Close()
+	s.engine.Store = st
+
+	s.addService(c)
+	s.addDestination(c)
+	services, err := st.Load()
+	c.Assert(err, IsNil)
+	c.Assert(len(services), Equals, 1)
+	c.Assert(services[0].Destinations, DeepEquals, []ipvs.Destination{*s.destination})
+
+	// A restarting balancer programs IPVS from the store
+	c.Assert(s.engine.Ipvs.Flush(), IsNil)
+	eng, err := engine.New()
+	c.Assert(err, IsNil)
+	eng.Store = st
+	c.Assert(eng.Load(), IsNil)
+	dests, err := eng.Ipvs.GetDestinations(s.service.ToIpvsService())
+	c.Assert(err, IsNil)
+	c.Assert(len(dests), Equals, 1)
+
+	s.delService(c)
+	services, err = st.Load()
+	c.Assert(err, IsNil)
+	c.Assert(services, DeepEquals, []ipvs.Service{})
+}
+
+func (s *EngineSuite) TestReconcile(c *C) {
+	s.addService(c)
+	s.addDestination(c)
+
+	report, err := s.engine.Reconcile()
+	c.Assert(err, IsNil)
+	c.Assert(report.Corrections, DeepEquals, []ipvs.Correction{})
+
+	// Someone edits the table by hand
+	c.Assert(exec.Command("ipvsadm", "-d", "-t", "10.0.1.1:80", "-r", "192.168.1.1:80").Run(), IsNil)
+	c.Assert(exec.Command("ipvsadm", "-A", "-t", "10.0.9.9:80", "-s", "rr").Run(), IsNil)
+
+	report, err = s.engine.Reconcile()
+	c.Assert(err, IsNil)
+	c.Assert(report.Corrections, HasLen, 2)
+	c.Assert(report.Corrections[0], DeepEquals, ipvs.Correction{Action: ipvs.CorrectionAdd, Service: "test", Destination: "test"})
+	c.Assert(report.Corrections[1].Action, Equals, ipvs.CorrectionDelete)
+
+	svcs, err := s.engine.Ipvs.GetServices()
+	c.Assert(err, IsNil)
+	c.Assert(svcs, HasLen, 1)
+	c.Assert(svcs[0].Destinations, HasLen, 1)
+}
+
+func (s *EngineSuite) TestApplyBatch(c *C) {
+	cmd := &engine.Command{
+		Op: engine.BatchOp,
+		Commands: []engine.Command{
+			{Op: engine.AddServiceOp, Service: s.service},
+			{Op: engine.AddDestinationOp, Service: s.service, Destination: s.destination},
+		},
+	}
+
+	resp := s.engine.Apply(makeLog(cmd))
+	c.Assert(resp, IsNil)
+
+	svc, err := s.engine.State.GetService(s.service.GetId())
+	c.Assert(err, IsNil)
+	c.Assert(svc.Destinations, HasLen, 1)
+}
+
+func (s *EngineSuite) TestApplyBatchRollsBack(c *C) {
+	cmd := &engine.Command{
+		Op: engine.BatchOp,
+		Commands: []engine.Command{
+			{Op: engine.AddServiceOp, Service: s.service},
+			{Op: engine.DelServiceOp, Service: &ipvs.Service{Name: "unknown"}},
+		},
+	}
+
+	resp := s.engine.Apply(makeLog(cmd))
+	batchErr, ok := resp.(*engine.BatchError)
+	c.Assert(ok, Equals, true)
+	c.Assert(batchErr.Index, Equals, 1)
+
+	c.Assert(s.engine.State.GetServices(), DeepEquals, &[]ipvs.Service{})
+	svcs, err := s.engine.Ipvs.GetServices()
+	c.Assert(err, IsNil)
+	c.Assert(svcs, HasLen, 0)
+}
+
+func (s *EngineSuite) TestApplyBatchRollsBackIpvsFailure(c *C) {
+	missing := *s.destination
+	missing.Name = "missing"
+	missing.Host = "192.168.1.2"
+	cmd := &engine.Command{
+		Op: engine.BatchOp,
+		Commands: []engine.Command{
+			{Op: engine.AddServiceOp, Service: s.service},
+			{Op: engine.AddDestinationOp, Service: s.service, Destination: s.destination},
+			// Not in IPVS, deleting it fails
+			{Op: engine.DelDestinationOp, Service: s.service, Destination: &missing},
+		},
+	}
+
+	resp := s.engine.Apply(makeLog(cmd))
+	batchErr, ok := resp.(*engine.BatchError)
+	c.Assert(ok, Equals, true)
+	c.Assert(batchErr.Index, Equals, 2)
+
+	c.Assert(s.engine.State.GetServices(), DeepEquals, &[]ipvs.Service{})
+	svcs, err := s.engine.Ipvs.GetServices()
+	c.Assert(err, IsNil)
+	c.Assert(svcs, HasLen, 0)
+}
+
 func (s *EngineSuite) TestApplyDelService(c *C) {
 	s.addService(c)
 	s.delService(c)
@@ -179,6 +402,241 @@ func (s *EngineSuite) TestApplyAddDestination(c *C) {
 	c.Assert(dests[0].Address.String(), DeepEquals, s.destination.Host)
 }
 
+func (s *EngineSuite) TestApplyServiceMaintenance(c *C) {
+	s.addService(c)
+	s.addDestination(c)
+
+	weight := func() int32 {
+		dests, err := s.engine.Ipvs.GetDestinations(s.service.ToIpvsService())
+		c.Assert(err, IsNil)
+		c.Assert(len(dests), Equals, 1)
+		return dests[0].Weight
+	}
+
+	svc := *s.service
+	svc.Destinations = []ipvs.Destination{*s.destination}
+	svc.Maintenance = true
+	cmd := &engine.Command{Op: engine.UpdateServiceOp, Service: &svc}
+	if resp := s.engine.Apply(makeLog(cmd)); resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+	// The destinations are quiesced, keeping their weights in the state
+	c.Assert(weight(), Equals, int32(0))
+	dst, err := s.engine.State.GetDestination(s.destination.GetId())
+	c.Assert(err, IsNil)
+	c.Assert(dst.Weight, Equals, s.destination.Weight)
+
+	svc.Maintenance = false
+	if resp := s.engine.Apply(makeLog(cmd)); resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+	c.Assert(weight(), Equals, s.destination.Weight)
+}
+
+func (s *EngineSuite) TestExpiredDestinations(c *C) {
+	svc := *s.service
+	s.engine.State.AddService(&svc)
+	dst := *s.destination
+	dst.TTL = ipvs.Duration(10 * time.Second)
+	s.engine.State.AddDestination(&dst)
+	permanent := *s.destination
+	permanent.Name = "permanent"
+	permanent.Host = "192.168.1.2"
+	s.engine.State.AddDestination(&permanent)
+
+	// The leases start when the destinations are first seen
+	now := time.Now()
+	expired, removed := s.engine.ExpiredDestinations(now)
+	c.Assert(expired, HasLen, 0)
+	c.Assert(removed, HasLen, 0)
+
+	expired, removed = s.engine.ExpiredDestinations(now.Add(15 * time.Second))
+	c.Assert(expired, HasLen, 1)
+	c.Assert(expired[0].GetId(), Equals, dst.GetId())
+	c.Assert(removed, HasLen, 0)
+
+	// Expired destinations aren't expired again, only removed
+	dst.Expired = true
+	s.engine.State.AddDestination(&dst)
+	expired, _ = s.engine.ExpiredDestinations(now.Add(15 * time.Second))
+	c.Assert(expired, HasLen, 0)
+	_, removed = s.engine.ExpiredDestinations(now.Add(25 * time.Second))
+	c.Assert(removed, HasLen, 1)
+	c.Assert(removed[0].GetId(), Equals, dst.GetId())
+
+	// A heartbeat renews the lease
+	s.engine.RenewLease(dst.GetId())
+	_, removed = s.engine.ExpiredDestinations(time.Now().Add(15 * time.Second))
+	c.Assert(removed, HasLen, 0)
+}
+
+func (s *EngineSuite) TestReconcileCommands(c *C) {
+	kept := *s.service
+	s.engine.State.AddService(&kept)
+	dst := *s.destination
+	s.engine.State.AddDestination(&dst)
+	removed := *s.destination
+	removed.Name = "removed"
+	removed.Host = "192.168.1.2"
+	s.engine.State.AddDestination(&removed)
+	gone := *s.service
+	gone.Name = "gone"
+	gone.Port = 81
+	s.engine.State.AddService(&gone)
+
+	// Services and destinations already matching need nothing
+	declared := kept
+	declared.Destinations = []ipvs.Destination{dst, removed}
+	c.Assert(s.engine.ReconcileCommands([]ipvs.Service{declared, gone}), HasLen, 0)
+
+	declared.Scheduler = "rr"
+	moved := dst
+	moved.Port = 8080
+	added := *s.destination
+	added.Name = "added"
+	added.Host = "192.168.1.3"
+	declared.Destinations = []ipvs.Destination{moved, added}
+	other := *s.service
+	other.Name = "other"
+	other.Port = 82
+	other.Destinations = []ipvs.Destination{{Name: "other1", Host: "192.168.2.1", Port: 82, Mode: "route", Weight: 1, ServiceId: "other"}}
+
+	cmds := s.engine.ReconcileCommands([]ipvs.Service{declared, other})
+	ops := []int{}
+	for _, cmd := range cmds {
+		ops = append(ops, cmd.Op)
+	}
+	c.Assert(ops, DeepEquals, []int{
+		engine.DelServiceOp,
+		engine.UpdateServiceOp,
+		// A destination whose address changed is replaced
+		engine.DelDestinationOp, engine.DelDestinationOp,
+		engine.AddDestinationOp, engine.AddDestinationOp,
+		engine.AddServiceOp, engine.AddDestinationOp,
+	})
+	c.Assert(cmds[0].Service.GetId(), Equals, "gone")
+	c.Assert(cmds[1].Service.Scheduler, Equals, ipvs.Scheduler("rr"))
+	c.Assert(cmds[1].Service.Version, Equals, kept.Version+1)
+	c.Assert(cmds[2].Destination.GetId(), Equals, "removed")
+	c.Assert(cmds[3].Destination.GetId(), Equals, "test")
+	c.Assert(cmds[6].Service.GetId(), Equals, "other")
+}
+
+func (s *EngineSuite) TestApplyHealthInhibitOnFailure(c *C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	addr := ln.Addr().(*net.TCPAddr)
+
+	changes := make(chan health.Change, 10)
+	s.engine.OnHealthChange(func(change health.Change) { changes <- change })
+	s.addService(c)
+	dst := *s.destination
+	dst.Host = "127.0.0.1"
+	dst.Port = uint16(addr.Port)
+	dst.HealthCheck = &ipvs.HealthCheck{
+		Type:               ipvs.TCPCheck,
+		Interval:           ipvs.Duration(50 * time.Millisecond),
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+		InhibitOnFailure:   true,
+	}
+	cmd := &engine.Command{Op: engine.AddDestinationOp, Service: s.service, Destination: &dst}
+	if resp := s.engine.Apply(makeLog(cmd)); resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+	waitFor := func(state health.State) {
+		for {
+			select {
+			case change := <-changes:
+				if change.To == state {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				c.Fatalf("destination never became %s", state)
+			}
+		}
+	}
+	waitFor(health.Healthy)
+
+	// The failing destination is kept with weight 0, along with its
+	// counters, and given its weight back once it recovers
+	ln.Close()
+	waitFor(health.Unhealthy)
+	_, err = s.engine.GetDestinationStats(s.service, &dst)
+	c.Assert(err, IsNil)
+	c.Assert(s.engine.EffectiveWeight(&dst), Equals, int32(0))
+
+	ln, err = net.Listen("tcp", addr.String())
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	waitFor(health.Healthy)
+	dests, err := s.engine.Ipvs.GetDestinations(s.service.ToIpvsService())
+	c.Assert(err, IsNil)
+	c.Assert(len(dests), Equals, 1)
+	c.Assert(dests[0].Weight, Equals, dst.Weight)
+
+	// Without inhibition it's removed while failing
+	dst.HealthCheck.InhibitOnFailure = false
+	cmd = &engine.Command{Op: engine.UpdateDestinationOp, Service: s.service, Destination: &dst}
+	if resp := s.engine.Apply(makeLog(cmd)); resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+	ln.Close()
+	waitFor(health.Unhealthy)
+	_, err = s.engine.GetDestinationStats(s.service, &dst)
+	c.Assert(err, Equals, ipvs.ErrNotFound)
+}
+
+func (s *EngineSuite) TestApplyAddDestinationRouteMode(c *C) {
+	s.addService(c)
+
+	dst := *s.destination
+	dst.Mode = "route"
+	cmd := &engine.Command{
+		Op:          engine.AddDestinationOp,
+		Service:     s.service,
+		Destination: &dst,
+	}
+	resp := s.engine.Apply(makeLog(cmd))
+	if resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+
+	dests, err := s.engine.Ipvs.GetDestinations(s.service.ToIpvsService())
+	c.Assert(err, IsNil)
+	c.Assert(len(dests), Equals, 1)
+	c.Assert(dests[0].Flags&gipvs.DFForwardMask, Equals, ipvs.RouteMode)
+
+	out, err := exec.Command("ipvsadm", "-S", "-n").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Matches, `(?s).*-a -t 10.0.1.1:80 -r 192.168.1.1:80 -g .*`)
+}
+
+func (s *EngineSuite) TestApplyAddDestinationTunnelMode(c *C) {
+	s.addService(c)
+
+	dst := *s.destination
+	dst.Mode = "tunnel"
+	cmd := &engine.Command{
+		Op:          engine.AddDestinationOp,
+		Service:     s.service,
+		Destination: &dst,
+	}
+	resp := s.engine.Apply(makeLog(cmd))
+	if resp != nil {
+		c.Fatalf("resp: %v", resp)
+	}
+
+	dests, err := s.engine.Ipvs.GetDestinations(s.service.ToIpvsService())
+	c.Assert(err, IsNil)
+	c.Assert(len(dests), Equals, 1)
+	c.Assert(dests[0].Flags&gipvs.DFForwardMask, Equals, ipvs.TunnelMode)
+
+	out, err := exec.Command("ipvsadm", "-S", "-n").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Matches, `(?s).*-a -t 10.0.1.1:80 -r 192.168.1.1:80 -i .*`)
+}
+
 func (s *EngineSuite) TestApplyDelDestination(c *C) {
 	s.addService(c)
 	s.addDestination(c)
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// leases records when the destinations having a TTL last sent a heartbeat.
+// They are only kept by the balancer reaping the destinations, the leader.
+type leases struct {
+	sync.Mutex
+	renewed map[string]time.Time
+}
+
+func newLeases() *leases {
+	return &leases{renewed: make(map[string]time.Time)}
+}
+
+// RenewLease records a heartbeat of the destination dstId.
+func (e *Engine) RenewLease(dstId string) {
+	e.leases.Lock()
+	defer e.leases.Unlock()
+	e.leases.renewed[dstId] = time.Now()
+}
+
+// ResetLeases forgets every heartbeat, so the destinations are given a whole
+// TTL from the next ExpiredDestinations on. A new leader does so, not knowing
+// the heartbeats sent to the previous one.
+func (e *Engine) ResetLeases() {
+	e.leases.Lock()
+	defer e.leases.Unlock()
+	e.leases.renewed = make(map[string]time.Time)
+}
+
+// ExpiredDestinations returns the destinations having sent no heartbeat for
+// their TTL at now, which aren't expired yet, and the ones having sent none
+// for twice their TTL, which are to be removed. The lease of a destination
+// seen for the first time starts at now.
+func (e *Engine) ExpiredDestinations(now time.Time) (expired, removed []ipvs.Destination) {
+	e.leases.Lock()
+	defer e.leases.Unlock()
+
+	seen := make(map[string]bool)
+	for _, svc := range *e.State.GetServices() {
+		for _, dst := range svc.Destinations {
+			if dst.TTL <= 0 {
+				continue
+			}
+			seen[dst.GetId()] = true
+			renewed, ok := e.leases.renewed[dst.GetId()]
+			if !ok {
+				e.leases.renewed[dst.GetId()] = now
+				continue
+			}
+			switch idle := now.Sub(renewed); {
+			case idle > 2*time.Duration(dst.TTL):
+				removed = append(removed, dst)
+			case idle > time.Duration(dst.TTL) && !dst.Expired:
+				expired = append(expired, dst)
+			}
+		}
+	}
+	for id := range e.leases.renewed {
+		if !seen[id] {
+			delete(e.leases.renewed, id)
+		}
+	}
+	return expired, removed
+}
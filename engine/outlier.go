@@ -0,0 +1,267 @@
+package engine
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// Thresholds of outlier detection. A destination is an outlier when its
+// average is outlierDeviations standard deviations above the mean of the
+// other destinations of its service, and by a margin too, so destinations
+// all about as fast aren't ejected for the slightest difference: its latency
+// must be outlierLatencyRatio times the mean, or its error rate
+// outlierErrorMargin above it.
+const (
+	// outlierMinSamples is how many checks of a destination are averaged
+	// before it's compared with the others.
+	outlierMinSamples = 5
+	// outlierMinDestinations is how many destinations with enough samples,
+	// the one compared included, a distribution needs to mean anything.
+	outlierMinDestinations = 3
+	outlierDeviations      = 3
+	outlierLatencyRatio    = 1.5
+	outlierErrorMargin     = 0.1
+)
+
+// Reasons of an Ejection.
+const (
+	EjectedForLatency = "latency"
+	EjectedForErrors  = "errors"
+)
+
+// Ejection is a destination being ejected by the outlier detection of its
+// service, or readmitted.
+type Ejection struct {
+	ServiceId     string `json:"service_id"`
+	DestinationId string `json:"destination_id"`
+	Ejected       bool   `json:"ejected"`
+	// Until is when an ejected destination is readmitted. It's zero for
+	// readmissions.
+	Until time.Time `json:"until"`
+	// Reason tells what an ejected destination stood out by.
+	Reason string `json:"reason,omitempty"`
+}
+
+// outlierStats are the averages of the health checks of a destination.
+type outlierStats struct {
+	samples int
+	// latency is the average latency, in nanoseconds, of the checks that
+	// passed, and errors the share of checks that failed.
+	latency float64
+	errors  float64
+
+	// ejections counts the ejections following closely each other, each
+	// one lasting a base ejection time more.
+	ejections  int
+	until      time.Time
+	readmitted time.Time
+}
+
+func (s *outlierStats) ejected() bool {
+	return !s.until.IsZero()
+}
+
+// outliers keeps the averages of the destinations of services detecting
+// outliers, and which of them are ejected.
+type outliers struct {
+	sync.Mutex
+	// stats maps service ids to the stats of each of their destinations.
+	stats map[string]map[string]*outlierStats
+}
+
+func newOutliers() *outliers {
+	return &outliers{stats: make(map[string]map[string]*outlierStats)}
+}
+
+// record folds a check of a destination of svc in at now, returning the
+// destinations ejected or readmitted. The ejected destinations whose time is
+// over are readmitted at the first check of the service afterwards.
+func (o *outliers) record(svc ipvs.Service, dstId string, latency time.Duration, failed bool, now time.Time) []Ejection {
+	o.Lock()
+	defer o.Unlock()
+
+	stats, ok := o.stats[svc.GetId()]
+	if !ok {
+		stats = make(map[string]*outlierStats)
+		o.stats[svc.GetId()] = stats
+	}
+	checked, ok := stats[dstId]
+	if !ok {
+		checked = &outlierStats{}
+		stats[dstId] = checked
+	}
+	checked.samples++
+	failure := 0.0
+	if failed {
+		failure = 1
+	}
+	checked.errors = average(checked.errors, failure, checked.samples == 1)
+	if !failed {
+		checked.latency = average(checked.latency, float64(latency), checked.latency == 0)
+	}
+
+	changes := []Ejection{}
+	ejected := 0
+	for id, s := range stats {
+		if !s.ejected() {
+			continue
+		}
+		if now.Before(s.until) {
+			ejected++
+			continue
+		}
+		s.until, s.readmitted = time.Time{}, now
+		changes = append(changes, Ejection{ServiceId: svc.GetId(), DestinationId: id})
+	}
+
+	od := svc.OutlierDetection.WithDefaults()
+	if checked.ejected() || ejected >= od.MaxEjections(len(svc.Destinations)) {
+		return changes
+	}
+	reason := outlierReason(stats, dstId)
+	if reason == "" {
+		return changes
+	}
+
+	base := time.Duration(od.BaseEjectionTime)
+	if !checked.readmitted.IsZero() && now.Sub(checked.readmitted) > time.Duration(checked.ejections)*base {
+		// Back for longer than it was last ejected, it starts over
+		checked.ejections = 0
+	}
+	checked.ejections++
+	checked.until = now.Add(time.Duration(checked.ejections) * base)
+	return append(changes, Ejection{
+		ServiceId:     svc.GetId(),
+		DestinationId: dstId,
+		Ejected:       true,
+		Until:         checked.until,
+		Reason:        reason,
+	})
+}
+
+// outlierReason tells what the destination dstId stands out by from the
+// other destinations not ejected, or returns an empty string when it
+// doesn't.
+func outlierReason(stats map[string]*outlierStats, dstId string) string {
+	checked := stats[dstId]
+	if checked.samples < outlierMinSamples {
+		return ""
+	}
+
+	var latencies, errors []float64
+	for id, s := range stats {
+		if id == dstId || s.ejected() || s.samples < outlierMinSamples {
+			continue
+		}
+		errors = append(errors, s.errors)
+		if s.latency > 0 {
+			latencies = append(latencies, s.latency)
+		}
+	}
+
+	if len(errors)+1 >= outlierMinDestinations {
+		mean, stdev := distribution(errors)
+		if checked.errors > mean+outlierDeviations*stdev && checked.errors >= mean+outlierErrorMargin {
+			return EjectedForErrors
+		}
+	}
+	if len(latencies)+1 >= outlierMinDestinations && checked.latency > 0 {
+		mean, stdev := distribution(latencies)
+		if checked.latency > mean+outlierDeviations*stdev && checked.latency >= mean*outlierLatencyRatio {
+			return EjectedForLatency
+		}
+	}
+	return ""
+}
+
+// distribution returns the mean and standard deviation of values.
+func distribution(values []float64) (mean, stdev float64) {
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	for _, v := range values {
+		stdev += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(stdev / float64(len(values)))
+}
+
+// average folds sample into the moving average avg, which it starts when
+// first.
+func average(avg, sample float64, first bool) float64 {
+	if first {
+		return sample
+	}
+	return ipvs.DefaultSmoothing*sample + (1-ipvs.DefaultSmoothing)*avg
+}
+
+func (o *outliers) ejected(serviceId, dstId string) bool {
+	o.Lock()
+	defer o.Unlock()
+	s, ok := o.stats[serviceId][dstId]
+	return ok && s.ejected()
+}
+
+// forget drops what is known about the destination dstId of serviceId.
+func (o *outliers) forget(serviceId, dstId string) {
+	o.Lock()
+	defer o.Unlock()
+	delete(o.stats[serviceId], dstId)
+}
+
+// forgetService drops what is known about every destination of serviceId,
+// returning the readmissions of the ones ejected.
+func (o *outliers) forgetService(serviceId string) []Ejection {
+	o.Lock()
+	defer o.Unlock()
+	readmitted := []Ejection{}
+	for id, s := range o.stats[serviceId] {
+		if s.ejected() {
+			readmitted = append(readmitted, Ejection{ServiceId: serviceId, DestinationId: id})
+		}
+	}
+	delete(o.stats, serviceId)
+	return readmitted
+}
+
+// OnEjection makes the engine call fn every time outlier detection ejects or
+// readmits a destination, once IPVS is updated. It must be set before any
+// destination is applied.
+func (e *Engine) OnEjection(fn func(Ejection)) {
+	e.onEjection = fn
+}
+
+// detectOutliers records a check of checked, a destination of svc, and
+// quiesces the destinations it made outliers, or restores the ones whose
+// ejection is over, returning those ejections. Like health, outliers are
+// detected by every balancer on its own.
+func (e *Engine) detectOutliers(svc *ipvs.Service, checked ipvs.Destination, latency time.Duration, err error) []Ejection {
+	applied := []Ejection{}
+	for _, ejection := range e.outliers.record(*svc, checked.GetId(), latency, err != nil, time.Now()) {
+		if e.applyEjection(svc, ejection) {
+			applied = append(applied, ejection)
+		}
+	}
+	return applied
+}
+
+// applyEjection updates the destination of ejection in IPVS, telling if it
+// is still in the state.
+func (e *Engine) applyEjection(svc *ipvs.Service, ejection Ejection) bool {
+	dst, err := e.State.GetDestination(ejection.DestinationId)
+	if err != nil {
+		return false
+	}
+	if ejection.Ejected {
+		e.Logger.Warnf("Ejecting destination %s of %s until %s, its %s stands out", dst.GetId(), svc.GetId(), ejection.Until.Format(time.RFC3339), ejection.Reason)
+	} else {
+		e.Logger.Infof("Readmitting destination %s of %s", dst.GetId(), svc.GetId())
+	}
+	if err := e.programDestination(svc, dst); err != nil {
+		e.Logger.Errorf("Updating weight of destination %s failed: %v", dst.GetId(), err)
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/luizbafilho/fusis/ipvs"
+
+	. "gopkg.in/check.v1"
+)
+
+// OutlierSuite runs in the test binary of engine_test, which hooks gocheck
+// up. Unlike the engine ones its tests don't need IPVS.
+type OutlierSuite struct{}
+
+var _ = Suite(&OutlierSuite{})
+
+func (s *OutlierSuite) TestRecord(c *C) {
+	svc := ipvs.Service{Name: "svc"}
+	svc.OutlierDetection = &ipvs.OutlierDetection{MaxEjectionPercent: 25, BaseEjectionTime: ipvs.Duration(10 * time.Second)}
+	svc.Destinations = make([]ipvs.Destination, 6)
+	o := newOutliers()
+	now := time.Now()
+	probe := func(dstId string, latency time.Duration) []Ejection {
+		return o.record(svc, dstId, latency, false, now)
+	}
+
+	// Destinations aren't compared before they were checked enough
+	for _, id := range []string{"dst1", "dst2", "dst3", "dst4"} {
+		for i := 0; i < outlierMinSamples; i++ {
+			c.Assert(probe(id, 10*time.Millisecond), HasLen, 0)
+		}
+	}
+	for i := 0; i < outlierMinSamples-1; i++ {
+		c.Assert(probe("slow1", 100*time.Millisecond), HasLen, 0)
+	}
+
+	ejections := probe("slow1", 100*time.Millisecond)
+	c.Assert(ejections, DeepEquals, []Ejection{{
+		ServiceId:     svc.GetId(),
+		DestinationId: "slow1",
+		Ejected:       true,
+		Until:         now.Add(10 * time.Second),
+		Reason:        EjectedForLatency,
+	}})
+	c.Assert(o.ejected(svc.GetId(), "slow1"), Equals, true)
+
+	// A single destination out of six can be ejected at once
+	for i := 0; i < outlierMinSamples; i++ {
+		c.Assert(probe("slow2", 100*time.Millisecond), HasLen, 0)
+	}
+	o.forget(svc.GetId(), "slow2")
+
+	// Once its time is over the destination is readmitted, and ejected
+	// again for twice as long if it still stands out
+	now = now.Add(10 * time.Second)
+	ejections = probe("slow1", 100*time.Millisecond)
+	c.Assert(ejections, HasLen, 2)
+	c.Assert(ejections[0], DeepEquals, Ejection{ServiceId: svc.GetId(), DestinationId: "slow1"})
+	c.Assert(ejections[1].Until, Equals, now.Add(20*time.Second))
+
+	// Failing checks make outliers too
+	o = newOutliers()
+	for i := 0; i < outlierMinSamples; i++ {
+		for _, id := range []string{"dst1", "dst2", "dst3"} {
+			c.Assert(o.record(svc, id, 10*time.Millisecond, false, now), HasLen, 0)
+		}
+	}
+	var last []Ejection
+	for i := 0; i < outlierMinSamples; i++ {
+		last = o.record(svc, "failing", 0, i%2 == 0, now)
+	}
+	c.Assert(last, HasLen, 1)
+	c.Assert(last[0].Reason, Equals, EjectedForErrors)
+
+	// Disabling detection readmits the destinations ejected
+	c.Assert(o.forgetService(svc.GetId()), DeepEquals, []Ejection{{ServiceId: svc.GetId(), DestinationId: "failing"}})
+	c.Assert(o.ejected(svc.GetId(), "failing"), Equals, false)
+}
+
+func (s *OutlierSuite) TestProbeDeletedDestination(c *C) {
+	e := &Engine{State: ipvs.NewFusisState(), adaptive: newAdaptiveWeights(), outliers: newOutliers()}
+	svc := &ipvs.Service{Name: "svc", OutlierDetection: &ipvs.OutlierDetection{}}
+	e.State.AddService(svc)
+	dst := ipvs.Destination{Name: "dst1", ServiceId: "svc"}
+
+	// Deleted while it was checked, it isn't recorded again
+	c.Assert(e.probe(dst, 10*time.Millisecond, nil), IsNil)
+	c.Assert(e.outliers.stats, HasLen, 0)
+
+	e.State.AddDestination(&dst)
+	c.Assert(e.probe(dst, 10*time.Millisecond, nil), HasLen, 0)
+	c.Assert(e.outliers.stats["svc"], HasLen, 1)
+}
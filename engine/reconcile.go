@@ -0,0 +1,247 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	gipvs "github.com/google/seesaw/ipvs"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// Reconcile reprograms the IPVS table to match the services balanced when it
+// drifted, e.g. because it was edited with ipvsadm. Services and destinations
+// unknown to fusis are removed, missing ones are added back and the changed
+// ones are updated. The corrections made are returned, even when one of them
+// failed.
+func (e *Engine) Reconcile() (*ipvs.ReconcileReport, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	kernel, err := e.Ipvs.GetServices()
+	if err != nil {
+		return nil, err
+	}
+	actual := make(map[string]*gipvs.Service)
+	for _, s := range kernel {
+		actual[serviceKey(s)] = s
+	}
+
+	report := &ipvs.ReconcileReport{Corrections: []ipvs.Correction{}}
+	for _, svc := range *e.State.GetServices() {
+		desired := svc.ToIpvsService()
+		key := serviceKey(desired)
+		current := actual[key]
+		delete(actual, key)
+
+		if err := e.reconcileService(&svc, desired, current, report); err != nil {
+			return report, err
+		}
+	}
+
+	for key, s := range actual {
+		if err := e.Ipvs.DeleteService(s); err != nil {
+			return report, err
+		}
+		report.Corrections = append(report.Corrections, ipvs.Correction{Action: ipvs.CorrectionDelete, Service: key})
+	}
+
+	if len(report.Corrections) > 0 {
+		e.Logger.Warnf("IPVS drifted from the state, reconciled: %v", report.Corrections)
+	}
+	return report, nil
+}
+
+// ReconcileCommands returns the commands making the services balanced match
+// services, and their destinations: the services and destinations missing are
+// added, the ones that differ updated and the others deleted. The ones whose
+// address changed are deleted then added back, since IPVS updates them at
+// their address. Services without a Host keep the VIP allocated to them.
+// Deletions come first, so the services and destinations declared again
+// elsewhere don't clash with them.
+func (e *Engine) ReconcileCommands(services []ipvs.Service) []Command {
+	e.Lock()
+	defer e.Unlock()
+
+	existing := make(map[string]*ipvs.Service)
+	for i := range services {
+		if svc, err := e.State.GetService(services[i].GetId()); err == nil {
+			existing[svc.GetId()] = svc
+		}
+	}
+	declared := make(map[string]bool)
+	for i := range services {
+		svc := &services[i]
+		if current, ok := existing[svc.GetId()]; ok && !sameServiceAddress(*current, *svc) {
+			continue
+		}
+		declared[svc.GetId()] = true
+	}
+
+	cmds := []Command{}
+	current := *e.State.GetServices()
+	sort.Slice(current, func(i, j int) bool { return current[i].GetId() < current[j].GetId() })
+	for i := range current {
+		if !declared[current[i].GetId()] {
+			cmds = append(cmds, Command{Op: DelServiceOp, Service: &current[i]})
+			delete(existing, current[i].GetId())
+		}
+	}
+
+	for i := range services {
+		svc := services[i]
+		dsts := svc.Destinations
+		svc.Destinations = nil
+
+		current, ok := existing[svc.GetId()]
+		if !ok {
+			cmds = append(cmds, Command{Op: AddServiceOp, Service: &svc})
+			for j := range dsts {
+				cmds = append(cmds, Command{Op: AddDestinationOp, Destination: &dsts[j]})
+			}
+			continue
+		}
+
+		if svc.Host == "" && !svc.IsFwmark() {
+			svc.Host = current.Host
+		}
+		if !current.Matches(svc) {
+			svc.Id, svc.Version = current.Id, current.Version+1
+			cmds = append(cmds, Command{Op: UpdateServiceOp, Service: &svc})
+		}
+		cmds = append(cmds, reconcileDestinations(current.Destinations, dsts)...)
+	}
+	return cmds
+}
+
+// sameServiceAddress tells if declared is balanced at the address of current,
+// a declared service without a Host being at the VIP allocated to current.
+func sameServiceAddress(current, declared ipvs.Service) bool {
+	if declared.Host == "" && !declared.IsFwmark() {
+		declared.Host = current.Host
+	}
+	return current.Host == declared.Host && current.Port == declared.Port &&
+		current.Protocol == declared.Protocol && current.Fwmark == declared.Fwmark
+}
+
+// reconcileDestinations returns the commands making the destinations current
+// of a service match declared.
+func reconcileDestinations(current, declared []ipvs.Destination) []Command {
+	kept := make(map[string]ipvs.Destination)
+	for _, d := range declared {
+		kept[d.GetId()] = d
+	}
+
+	cmds := []Command{}
+	existing := make(map[string]ipvs.Destination)
+	sort.Slice(current, func(i, j int) bool { return current[i].GetId() < current[j].GetId() })
+	for i := range current {
+		d, ok := kept[current[i].GetId()]
+		if !ok || d.Address() != current[i].Address() {
+			cmds = append(cmds, Command{Op: DelDestinationOp, Destination: &current[i]})
+			continue
+		}
+		existing[current[i].GetId()] = current[i]
+	}
+	for i := range declared {
+		dst := declared[i]
+		previous, ok := existing[dst.GetId()]
+		switch {
+		case !ok:
+			cmds = append(cmds, Command{Op: AddDestinationOp, Destination: &dst})
+		case !previous.Matches(dst):
+			dst.Id, dst.Expired = previous.Id, previous.Expired
+			cmds = append(cmds, Command{Op: UpdateDestinationOp, Destination: &dst})
+		}
+	}
+	return cmds
+}
+
+// reconcileService makes the service current in the kernel, nil when it is
+// missing, match svc programmed as desired.
+func (e *Engine) reconcileService(svc *ipvs.Service, desired, current *gipvs.Service, report *ipvs.ReconcileReport) error {
+	correct := func(action, dst string) {
+		report.Corrections = append(report.Corrections, ipvs.Correction{Action: action, Service: svc.GetId(), Destination: dst})
+	}
+
+	if current == nil {
+		if err := e.Ipvs.AddService(desired); err != nil {
+			return err
+		}
+		if err := e.Ipvs.SetPersistenceNetmask(*svc); err != nil {
+			return err
+		}
+		if err := e.Ipvs.AddSNAT(*svc); err != nil {
+			return err
+		}
+		if err := e.Ipvs.AddACL(*svc); err != nil {
+			return err
+		}
+		if err := e.Ipvs.AddConnLimit(*svc); err != nil {
+			return err
+		}
+		correct(ipvs.CorrectionAdd, "")
+		current = &gipvs.Service{}
+	} else if current.Scheduler != desired.Scheduler || current.Timeout != desired.Timeout ||
+		current.Flags&^gipvs.SFHashed != desired.Flags {
+		if err := e.Ipvs.UpdateService(desired); err != nil {
+			return err
+		}
+		if err := e.Ipvs.SetPersistenceNetmask(*svc); err != nil {
+			return err
+		}
+		correct(ipvs.CorrectionUpdate, "")
+	}
+
+	actual := make(map[string]*gipvs.Destination)
+	for _, d := range current.Destinations {
+		actual[destinationKey(d)] = d
+	}
+	for i := range svc.Destinations {
+		dst := &svc.Destinations[i]
+		if e.withdrawn(dst) {
+			// Left in actual to be deleted
+			continue
+		}
+		want := e.ipvsDestination(dst)
+		key := destinationKey(want)
+		have, ok := actual[key]
+		delete(actual, key)
+
+		switch {
+		case !ok:
+			if err := e.Ipvs.AddDestination(*desired, *want); err != nil {
+				return err
+			}
+			correct(ipvs.CorrectionAdd, dst.GetId())
+		case have.Weight != want.Weight || have.Flags&gipvs.DFForwardMask != want.Flags&gipvs.DFForwardMask ||
+			have.LowerThreshold != want.LowerThreshold || have.UpperThreshold != want.UpperThreshold:
+			if err := e.Ipvs.UpdateDestination(*desired, *want); err != nil {
+				return err
+			}
+			correct(ipvs.CorrectionUpdate, dst.GetId())
+		}
+	}
+
+	for key, d := range actual {
+		if err := e.Ipvs.DeleteDestination(*desired, *d); err != nil {
+			return err
+		}
+		correct(ipvs.CorrectionDelete, key)
+	}
+	return nil
+}
+
+// serviceKey identifies s in the IPVS table.
+func serviceKey(s *gipvs.Service) string {
+	if s.FirewallMark != 0 {
+		return "fwmark " + strconv.FormatUint(uint64(s.FirewallMark), 10)
+	}
+	return fmt.Sprintf("%v %s", s.Protocol, net.JoinHostPort(s.Address.String(), strconv.Itoa(int(s.Port))))
+}
+
+// destinationKey identifies d among the destinations of its service.
+func destinationKey(d *gipvs.Destination) string {
+	return net.JoinHostPort(d.Address.String(), strconv.Itoa(int(d.Port)))
+}
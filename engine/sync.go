@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// StartSyncDaemons starts the IPVS sync daemons configured. Every balancer
+// synchronizes on its own, nothing goes through raft.
+func (e *Engine) StartSyncDaemons(daemons []config.SyncDaemon) error {
+	for _, d := range daemons {
+		if err := e.StartSyncDaemon(ipvs.SyncDaemon{State: ipvs.SyncState(d.State), Interface: d.Interface, SyncID: d.SyncID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartSyncDaemon starts d, replacing the daemon of the same state.
+func (e *Engine) StartSyncDaemon(d ipvs.SyncDaemon) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	if err := e.Ipvs.StartSyncDaemon(d); err != nil {
+		return err
+	}
+	e.Logger.Infof("Started %s sync daemon on %s with sync ID %d", d.State, d.Interface, d.SyncID)
+	return nil
+}
+
+// StopSyncDaemon stops the sync daemon of the given state.
+func (e *Engine) StopSyncDaemon(state ipvs.SyncState) error {
+	if err := state.Validate(); err != nil {
+		return err
+	}
+	if err := e.Ipvs.StopSyncDaemon(state); err != nil {
+		return err
+	}
+	e.Logger.Infof("Stopped %s sync daemon", state)
+	return nil
+}
+
+// SyncDaemons returns the sync daemons running.
+func (e *Engine) SyncDaemons() ([]ipvs.SyncDaemon, error) {
+	return e.Ipvs.SyncDaemons()
+}
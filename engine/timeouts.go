@@ -0,0 +1,21 @@
+package engine
+
+import "github.com/luizbafilho/fusis/ipvs"
+
+// SetTimeouts sets the IPVS timeouts of this balancer, leaving the ones that
+// are 0 unchanged. Like the sync daemons they aren't replicated.
+func (e *Engine) SetTimeouts(t ipvs.Timeouts) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	if err := e.Ipvs.SetTimeouts(t); err != nil {
+		return err
+	}
+	e.Logger.Infof("Set IPVS timeouts to tcp %d, tcpfin %d and udp %d", t.TCP, t.TCPFin, t.UDP)
+	return nil
+}
+
+// Timeouts returns the IPVS timeouts of this balancer.
+func (e *Engine) Timeouts() (ipvs.Timeouts, error) {
+	return e.Ipvs.Timeouts()
+}
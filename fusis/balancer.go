@@ -14,11 +14,15 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/luizbafilho/fusis/bgp"
+	"github.com/luizbafilho/fusis/cluster"
 	"github.com/luizbafilho/fusis/config"
 	"github.com/luizbafilho/fusis/engine"
 	"github.com/luizbafilho/fusis/ipvs"
+	"github.com/luizbafilho/fusis/logging"
 	fusis_net "github.com/luizbafilho/fusis/net"
 	_ "github.com/luizbafilho/fusis/provider/none" // to intialize
+	"github.com/luizbafilho/fusis/store"
 
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/raft-boltdb"
@@ -44,25 +48,57 @@ type Balancer struct {
 	logger        *logrus.Logger
 
 	engine     *engine.Engine
-	shutdownCh chan bool
+	gossip     *cluster.Gossip // Replaces raft when set, see setupGossip
+	bgp        *bgp.Speaker    // Announces the VIPs when set, see setupBGP
+	shutdownCh chan struct{}
+	draining   int32 // Set by Drain
+
+	subscribersLock sync.Mutex
+	subscribers     map[chan Event]struct{}
+
+	// routesLock serializes the updates of the BGP routes.
+	routesLock sync.Mutex
+	hookErr    error // Outcome of the last BGP health hook run
+
+	// lastSeen records when each serf member was last heard of.
+	lastSeenLock sync.Mutex
+	lastSeen     map[string]time.Time
 }
 
 // NewBalancer initializes a new balancer
 //TODO: Graceful shutdown on initialization errors
 func NewBalancer() (*Balancer, error) {
-	engine, err := engine.New()
+	eng, err := engine.New()
 	if err != nil {
 		return nil, err
 	}
 
 	balancer := &Balancer{
-		eventCh: make(chan serf.Event, 64),
-		engine:  engine,
-		logger:  logrus.New(),
+		eventCh:     make(chan serf.Event, 64),
+		engine:      eng,
+		logger:      logging.Logger(),
+		subscribers: make(map[chan Event]struct{}),
+		lastSeen:    make(map[string]time.Time),
+		shutdownCh:  make(chan struct{}),
+	}
+	eng.OnHealthChange(balancer.publishHealth)
+	eng.OnEjection(balancer.publishEjection)
+
+	// Balancing the services saved locally avoids a black hole until the
+	// cluster state is replayed
+	st, err := store.Open(filepath.Join(config.Balancer.ConfigPath, "services.db"))
+	if err != nil {
+		log.Fatalf("Opening the local store failed. Err: %v", err)
+	}
+	eng.Store = st
+	if err := eng.Load(); err != nil {
+		log.Fatalf("Loading the local store failed. Err: %v", err)
 	}
 
-	if err = balancer.setupRaft(); err != nil {
-		log.Fatalf("Setuping Raft", err)
+	if !config.Balancer.Gossip {
+		if err = balancer.setupRaft(); err != nil {
+			log.Fatalf("Setuping Raft failed. Err: %v", err)
+		}
 	}
 
 	if err = balancer.setupSerf(); err != nil {
@@ -74,7 +110,37 @@ func NewBalancer() (*Balancer, error) {
 		log.Fatalf("Fusis wasn't capable of cleanup network vips. Err: %v", err)
 	}
 
+	if err := eng.StartSyncDaemons(config.Balancer.SyncDaemons); err != nil {
+		log.Fatalf("Starting the IPVS sync daemons failed. Err: %v", err)
+	}
+
+	if err = balancer.setupBGP(); err != nil {
+		log.Fatalf("Setuping BGP failed. Err: %v", err)
+	}
+
+	// An invalid services file fails the startup even on the balancers not
+	// applying it
+	if config.Balancer.ServicesFile != "" {
+		if _, err := config.LoadServices(config.Balancer.ServicesFile); err != nil {
+			log.Fatalf("Reading the services file failed. Err: %v", err)
+		}
+	}
+
+	if config.Balancer.Gossip {
+		if err = balancer.setupGossip(); err != nil {
+			log.Fatalf("Setuping gossip failed. Err: %v", err)
+		}
+		if err := balancer.ApplyServicesFile(); err != nil {
+			log.Fatalf("Applying the services file failed. Err: %v", err)
+		}
+		return balancer, nil
+	}
+
+	if config.Balancer.BGP.ECMP {
+		balancer.setVips()
+	}
 	go balancer.watchLeaderChanges()
+	go balancer.watchLeases()
 
 	return balancer, nil
 }
@@ -181,13 +247,19 @@ func (b *Balancer) watchCommands() {
 				b.AssignVIP(c.Service)
 			case engine.DelServiceOp:
 				b.UnassignVIP(c.Service)
+			case engine.FlushServicesOp:
+				for i := range c.Services {
+					b.UnassignVIP(&c.Services[i])
+				}
 			}
+			b.publish(Event{Command: &c})
+			b.updateRoutes()
 		}
 	}
 }
 
 func (b *Balancer) UnassignVIP(svc *ipvs.Service) {
-	if b.isLeader() {
+	if b.holdsVIPs() {
 		if err := b.engine.UnassignVIP(svc); err != nil {
 			b.logger.Errorf("Unassigning VIP to Service: %#v. Err: %#v", svc, err)
 		}
@@ -195,17 +267,48 @@ func (b *Balancer) UnassignVIP(svc *ipvs.Service) {
 }
 
 func (b *Balancer) AssignVIP(svc *ipvs.Service) {
-	if b.isLeader() {
+	if b.holdsVIPs() {
 		if err := b.engine.AssignVIP(svc); err != nil {
 			b.logger.Errorf("Assigning VIP to Service: %#v. Err: %#v", svc, err)
 		}
 	}
 }
 
+// isLeader tells if the balancer is the raft leader. Without raft, in gossip
+// mode, every balancer acts as one.
 func (b *Balancer) isLeader() bool {
+	if b.raft == nil {
+		return true
+	}
 	return b.raft.State() == raft.Leader
 }
 
+// holdsVIPs tells if the balancer binds the VIPs: only the leader does,
+// unless every balancer announces them to ECMP routers.
+func (b *Balancer) holdsVIPs() bool {
+	return b.isLeader() || config.Balancer.BGP.ECMP
+}
+
+// IsLeader tells if this balancer is the raft leader and so can accept writes
+func (b *Balancer) IsLeader() bool {
+	return b.isLeader()
+}
+
+// LeaderApiAddr returns the API address of the raft leader, or an empty string
+// when there is no leader. Every balancer is expected to serve the API on the
+// same port.
+func (b *Balancer) LeaderApiAddr() string {
+	if b.raft == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(b.raft.Leader())
+	if err != nil {
+		return ""
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(config.Balancer.ApiPort))
+}
+
 // JoinPool joins the Fusis Serf cluster
 func (b *Balancer) JoinPool() error {
 	b.logger.Infof("Balancer: joining: %v ignore: %v", config.Balancer.Join)
@@ -223,12 +326,25 @@ func (b *Balancer) watchLeaderChanges() {
 	b.logger.Infof("Watching to Leader changes")
 
 	for {
-		if <-b.raft.LeaderCh() {
+		leader := <-b.raft.LeaderCh()
+		if leader {
+			b.engine.ResetLeases()
+		}
+		switch {
+		case config.Balancer.BGP.ECMP:
+			// Every balancer keeps the VIPs
+		case leader:
 			b.flushVips()
 			b.setVips()
-		} else {
+		default:
 			b.flushVips()
 		}
+		b.updateRoutes()
+		if leader {
+			if err := b.ApplyServicesFile(); err != nil {
+				b.logger.Errorf("Applying the services file failed: %v", err)
+			}
+		}
 	}
 }
 
@@ -236,6 +352,9 @@ func (b *Balancer) handleEvents() {
 	for {
 		select {
 		case e := <-b.eventCh:
+			if me, ok := e.(serf.MemberEvent); ok {
+				b.seen(me.Members)
+			}
 			switch e.EventType() {
 			case serf.EventMemberJoin:
 				me := e.(serf.MemberEvent)
@@ -246,6 +365,10 @@ func (b *Balancer) handleEvents() {
 			case serf.EventMemberLeave:
 				memberEvent := e.(serf.MemberEvent)
 				b.handleMemberLeave(memberEvent)
+			case serf.EventUser:
+				if b.gossip != nil {
+					b.gossip.HandleEvent(e.(serf.UserEvent))
+				}
 			// case serf.EventQuery:
 			// 	query := e.(*serf.Query)
 			// 	b.handleQuery(query)
@@ -277,7 +400,7 @@ func (b *Balancer) flushVips() {
 func (b *Balancer) handleMemberJoin(event serf.MemberEvent) {
 	b.logger.Infof("handleMemberJoin: %s", event)
 
-	if !b.isLeader() {
+	if b.raft == nil || !b.isLeader() {
 		return
 	}
 
@@ -298,6 +421,33 @@ func (b *Balancer) addMemberToPool(m serf.Member) {
 	}
 }
 
+// Peers returns the raft addresses of the balancers in the cluster.
+func (b *Balancer) Peers() ([]string, error) {
+	if b.raft == nil {
+		return nil, ErrGossipMode
+	}
+	return b.raftPeers.Peers()
+}
+
+// AddPeer adds the balancer with the raft address addr to the cluster. Only
+// the leader can change the peers, raft.ErrKnownPeer is returned if addr is
+// already one of them.
+func (b *Balancer) AddPeer(addr string) error {
+	if b.raft == nil {
+		return ErrGossipMode
+	}
+	return b.raft.AddPeer(addr).Error()
+}
+
+// RemovePeer removes the balancer with the raft address addr from the
+// cluster. raft.ErrUnknownPeer is returned if addr isn't one of the peers.
+func (b *Balancer) RemovePeer(addr string) error {
+	if b.raft == nil {
+		return ErrGossipMode
+	}
+	return b.raft.RemovePeer(addr).Error()
+}
+
 func isBalancer(m serf.Member) bool {
 	return m.Tags["role"] == "balancer"
 }
@@ -315,6 +465,9 @@ func (b *Balancer) handleMemberLeave(memberEvent serf.MemberEvent) {
 
 func (b *Balancer) handleBalancerLeave(m serf.Member) {
 	b.logger.Info("Removing left balancer from raft")
+	if b.raft == nil {
+		return
+	}
 	if !b.isLeader() {
 		b.logger.Info("Member is not leader")
 		return
@@ -339,6 +492,13 @@ func (b *Balancer) Leave() {
 	b.logger.Info("balancer: server starting leave")
 	// s.left = true
 
+	if b.raft == nil {
+		if err := b.serf.Leave(); err != nil {
+			b.logger.Errorf("balancer: failed to leave LAN Serf cluster: %v", err)
+		}
+		return
+	}
+
 	// Check the number of known peers
 	numPeers, err := b.numOtherPeers()
 	if err != nil {
@@ -404,19 +564,30 @@ func (b *Balancer) numOtherPeers() (int, error) {
 }
 
 func (b *Balancer) Shutdown() {
+	if b.bgp != nil {
+		b.bgp.Stop()
+	}
 	b.Leave()
 	b.serf.Shutdown()
+	close(b.shutdownCh)
 
-	future := b.raft.Shutdown()
-	if err := future.Error(); err != nil {
-		b.logger.Errorf("balancer: Error shutting down raft: %s", err)
-	}
+	if b.raft != nil {
+		future := b.raft.Shutdown()
+		if err := future.Error(); err != nil {
+			b.logger.Errorf("balancer: Error shutting down raft: %s", err)
+		}
 
-	if b.raftStore != nil {
-		b.raftStore.Close()
+		if b.raftStore != nil {
+			b.raftStore.Close()
+		}
+
+		b.raftPeers.SetPeers(nil)
 	}
 
-	b.raftPeers.SetPeers(nil)
+	// Nothing is applied anymore, the local store can be closed
+	if err := b.engine.Store.Close(); err != nil {
+		b.logger.Errorf("balancer: Error closing the local store: %s", err)
+	}
 }
 
 func (b *Balancer) handleAgentLeave(m serf.Member) {
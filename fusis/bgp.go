@@ -0,0 +1,156 @@
+package fusis
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"time"
+
+	"github.com/luizbafilho/fusis/bgp"
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/health"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// routeCheckInterval is how often the balancer checks it can still serve the
+// VIPs it announces, and the longest the health hook may run.
+var routeCheckInterval = 2 * time.Second
+
+// setupBGP announces the VIPs of the services to the configured peers.
+// BGP is disabled when no peer is configured.
+func (b *Balancer) setupBGP() error {
+	if len(config.Balancer.BGP.Peers) == 0 {
+		return nil
+	}
+	speaker, err := bgp.New(config.Balancer.BGP)
+	if err != nil {
+		return err
+	}
+	b.bgp = speaker
+	b.hookErr = runHealthHook(config.Balancer.BGP.HealthHook)
+	b.updateRoutes()
+	speaker.Start()
+
+	go b.watchRoutes()
+	return nil
+}
+
+// watchRoutes periodically updates the routes for the changes no event
+// signals: the readiness of the balancer and the health hook outcome.
+func (b *Balancer) watchRoutes() {
+	ticker := time.NewTicker(routeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.shutdownCh:
+			return
+		case <-ticker.C:
+		}
+
+		err := runHealthHook(config.Balancer.BGP.HealthHook)
+		b.routesLock.Lock()
+		b.hookErr = err
+		b.routesLock.Unlock()
+		b.updateRoutes()
+	}
+}
+
+// runHealthHook runs the health hook command, if there is one.
+func runHealthHook(hook string) error {
+	if hook == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), routeCheckInterval)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "/bin/sh", "-c", hook).CombinedOutput()
+	if err != nil {
+		if out = bytes.TrimSpace(out); len(out) > 0 {
+			return fmt.Errorf("%v: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
+
+// updateRoutes announces the VIPs of the services having a healthy
+// destination, so routers move the traffic of the others to balancers that
+// can still serve it. Every route is withdrawn while the balancer can't
+// serve the VIPs at all.
+func (b *Balancer) updateRoutes() {
+	if b.bgp == nil {
+		return
+	}
+	b.routesLock.Lock()
+	defer b.routesLock.Unlock()
+
+	vips := make(map[string]net.IP)
+	for _, svc := range *b.GetServices() {
+		if !svc.IsFwmark() && b.hasHealthyDestination(svc) {
+			vips[svc.GetId()] = svc.IP()
+		}
+	}
+
+	// Withdrawing first never announces routes about to be withdrawn
+	if reason := b.withdrawReason(); reason != "" {
+		b.bgp.Withdraw(reason)
+		b.bgp.SetRoutes(vips)
+		return
+	}
+	b.bgp.SetRoutes(vips)
+	b.bgp.Resume()
+}
+
+// withdrawReason tells why the balancer can't serve the VIPs, or returns an
+// empty string when it can. It must be called with routesLock held.
+func (b *Balancer) withdrawReason() string {
+	if err := b.Ready(); err != nil {
+		return err.Error()
+	}
+	if !b.holdsVIPs() {
+		return "not the cluster leader"
+	}
+	if b.hookErr != nil {
+		return fmt.Sprintf("health hook failed: %v", b.hookErr)
+	}
+	return ""
+}
+
+// hasHealthyDestination tells if svc has a destination taking traffic:
+// one passing its health checks, or one without checks and a weight.
+func (b *Balancer) hasHealthyDestination(svc ipvs.Service) bool {
+	for _, dst := range svc.Destinations {
+		if dst.HealthCheck == nil {
+			if dst.Weight > 0 {
+				return true
+			}
+			continue
+		}
+		if b.GetDestinationHealth(&dst).State == health.Healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// BGPRoutes returns the routes announced to the BGP peers, and false if BGP
+// isn't enabled.
+func (b *Balancer) BGPRoutes() ([]bgp.Route, bool) {
+	if b.bgp == nil {
+		return nil, false
+	}
+	return b.bgp.Routes(), true
+}
+
+// BGPState returns whether the VIPs are announced, why not if they aren't,
+// and the state of the sessions with the peers. It returns false if BGP
+// isn't enabled.
+func (b *Balancer) BGPState() (bgp.State, bool) {
+	if b.bgp == nil {
+		return bgp.State{}, false
+	}
+	return b.bgp.State(), true
+}
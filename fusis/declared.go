@@ -0,0 +1,42 @@
+package fusis
+
+import (
+	"github.com/luizbafilho/fusis/config"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// ApplyServices makes the services balanced, and their destinations, match
+// services in a single batch. The services and destinations left out are
+// deleted.
+func (b *Balancer) ApplyServices(services []ipvs.Service) error {
+	cmds := b.engine.ReconcileCommands(services)
+	if len(cmds) == 0 {
+		return nil
+	}
+	b.logger.Infof("Applying %d changes to match the declared services", len(cmds))
+	return b.ApplyBatch(cmds)
+}
+
+// ApplyServicesFile reads the services file, when there is one, and applies
+// it. With raft only the leader applies it, once its state is up to date,
+// the others reading it only to check it.
+func (b *Balancer) ApplyServicesFile() error {
+	path := config.Balancer.ServicesFile
+	if path == "" {
+		return nil
+	}
+	services, err := config.LoadServices(path)
+	if err != nil {
+		return err
+	}
+	if !b.isLeader() {
+		b.logger.Infof("Leaving %s to the leader, which applies its own services file", path)
+		return nil
+	}
+	if b.raft != nil {
+		if err := b.raft.Barrier(raftTimeout).Error(); err != nil {
+			return err
+		}
+	}
+	return b.ApplyServices(services)
+}
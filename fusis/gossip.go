@@ -0,0 +1,68 @@
+package fusis
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/luizbafilho/fusis/cluster"
+	"github.com/luizbafilho/fusis/config"
+)
+
+// antiEntropyInterval is how often a gossiping balancer merges the state of
+// another one.
+const antiEntropyInterval = 30 * time.Second
+
+// ErrGossipMode is returned by the raft operations of balancers replicating
+// services through gossip.
+var ErrGossipMode = errors.New("raft is disabled in gossip mode")
+
+// setupGossip replicates services through serf user events instead of raft.
+// Every balancer accepts writes and binds the VIPs itself.
+func (b *Balancer) setupGossip() error {
+	b.gossip = cluster.New(b.serf.LocalMember().Name, b.serf, b.engine)
+
+	scheme := "http"
+	if config.Balancer.TLSCert != "" {
+		scheme = "https"
+	}
+	// The other balancers may require client certificates, or have
+	// certificates signed by a private CA
+	tlsConfig, err := config.Balancer.PeerTLS()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}
+	fetch := cluster.HTTPFetcher(client, scheme)
+	go b.gossip.RunAntiEntropy(antiEntropyInterval, b.gossipPeers, fetch, b.shutdownCh)
+
+	go b.watchCommands()
+	b.setVips()
+
+	return nil
+}
+
+// gossipPeers returns the API addresses of the other alive balancers.
+func (b *Balancer) gossipPeers() []string {
+	local := b.serf.LocalMember().Name
+
+	peers := []string{}
+	for _, m := range b.Members() {
+		if m.Name != local && m.Status == "alive" {
+			peers = append(peers, m.ApiAddr)
+		}
+	}
+	return peers
+}
+
+// GossipState returns the replicated services, and false if the balancer
+// isn't in gossip mode.
+func (b *Balancer) GossipState() ([]cluster.Entry, bool) {
+	if b.gossip == nil {
+		return nil, false
+	}
+	return b.gossip.Entries(), true
+}
@@ -0,0 +1,79 @@
+package fusis
+
+import (
+	"errors"
+	"time"
+
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// ErrNoTTL is returned by the heartbeats of destinations without a TTL.
+var ErrNoTTL = errors.New("destination has no TTL")
+
+// leaseReapInterval is how often the leader looks for the destinations that
+// missed their heartbeats.
+var leaseReapInterval = time.Second
+
+// Heartbeat renews the registration of dst, which must have a TTL. A
+// destination quiesced for missing its heartbeats is given its weight back.
+// Heartbeats are only kept by the leader.
+func (b *Balancer) Heartbeat(dst *ipvs.Destination) error {
+	if dst.TTL <= 0 {
+		return ErrNoTTL
+	}
+	b.engine.RenewLease(dst.GetId())
+	if !dst.Expired {
+		return nil
+	}
+
+	svc, err := b.GetService(dst.ServiceId)
+	if err != nil {
+		return err
+	}
+	renewed := *dst
+	renewed.Expired = false
+	renewed.EffectiveWeight = 0
+	return b.UpdateDestination(svc, &renewed)
+}
+
+// watchLeases makes the leader quiesce the destinations that missed their
+// heartbeats for their TTL, and remove the ones that missed them for twice
+// their TTL. In gossip mode, without a leader, destinations never expire.
+func (b *Balancer) watchLeases() {
+	ticker := time.NewTicker(leaseReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.shutdownCh:
+			return
+		case <-ticker.C:
+		}
+		if !b.isLeader() {
+			continue
+		}
+
+		expired, removed := b.engine.ExpiredDestinations(time.Now())
+		for i := range expired {
+			dst := &expired[i]
+			svc, err := b.GetService(dst.ServiceId)
+			if err != nil {
+				continue
+			}
+			dst.Expired = true
+			if err := b.UpdateDestination(svc, dst); err != nil {
+				b.logger.Errorf("Quiescing expired destination %s failed: %v", dst.GetId(), err)
+				continue
+			}
+			b.logger.Warnf("Destination %s sent no heartbeat for %v, quiesced", dst.GetId(), time.Duration(dst.TTL))
+		}
+		for i := range removed {
+			dst := &removed[i]
+			if err := b.DeleteDestination(dst); err != nil {
+				b.logger.Errorf("Removing expired destination %s failed: %v", dst.GetId(), err)
+				continue
+			}
+			b.logger.Warnf("Destination %s sent no heartbeat for %v, removed", dst.GetId(), 2*time.Duration(dst.TTL))
+		}
+	}
+}
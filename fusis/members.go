@@ -0,0 +1,117 @@
+package fusis
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"github.com/luizbafilho/fusis/config"
+)
+
+// ErrUnknownMember is returned when removing a member serf doesn't know.
+var ErrUnknownMember = errors.New("unknown cluster member")
+
+// Member is a balancer of the cluster, as seen through serf.
+type Member struct {
+	Name string
+	// ApiAddr is the address the balancer serves the API on.
+	ApiAddr string
+	// RaftAddr is the address the balancer takes part in the consensus on.
+	RaftAddr string
+	Leader   bool
+	Status   string
+	// LastSeen is when the balancer was last known to be alive.
+	LastSeen time.Time
+}
+
+// Members returns the balancers of the cluster.
+func (b *Balancer) Members() []Member {
+	leader := ""
+	if b.raft != nil {
+		leader = b.raft.Leader()
+	}
+	now := time.Now()
+
+	members := []Member{}
+	for _, m := range b.serf.Members() {
+		if !isBalancer(m) {
+			continue
+		}
+
+		member := Member{
+			Name:     m.Name,
+			ApiAddr:  net.JoinHostPort(m.Addr.String(), strconv.Itoa(config.Balancer.ApiPort)),
+			RaftAddr: raftAddr(m),
+			Status:   m.Status.String(),
+			LastSeen: b.lastSeenAt(m.Name),
+		}
+		member.Leader = member.RaftAddr == leader
+		if m.Status == serf.StatusAlive {
+			member.LastSeen = now
+		}
+		members = append(members, member)
+	}
+
+	return members
+}
+
+// RemoveMember gracefully removes the balancer name from the cluster. The
+// local balancer leaves by itself, others are removed from the raft peers and
+// from serf, which they must have already failed or left.
+func (b *Balancer) RemoveMember(name string) error {
+	if name == b.serf.LocalMember().Name {
+		b.Leave()
+		return nil
+	}
+
+	for _, m := range b.serf.Members() {
+		if m.Name != name {
+			continue
+		}
+
+		if isBalancer(m) {
+			err := b.RemovePeer(raftAddr(m))
+			if err != nil && err != raft.ErrUnknownPeer && err != ErrGossipMode {
+				return err
+			}
+		}
+		b.forgetSeen(name)
+		return b.serf.RemoveFailedNode(name)
+	}
+
+	return ErrUnknownMember
+}
+
+// seen records when the members of a serf event were last heard of.
+func (b *Balancer) seen(members []serf.Member) {
+	b.lastSeenLock.Lock()
+	defer b.lastSeenLock.Unlock()
+
+	now := time.Now()
+	for _, m := range members {
+		b.lastSeen[m.Name] = now
+	}
+}
+
+func (b *Balancer) lastSeenAt(name string) time.Time {
+	b.lastSeenLock.Lock()
+	defer b.lastSeenLock.Unlock()
+	return b.lastSeen[name]
+}
+
+func (b *Balancer) forgetSeen(name string) {
+	b.lastSeenLock.Lock()
+	defer b.lastSeenLock.Unlock()
+	delete(b.lastSeen, name)
+}
+
+func raftAddr(m serf.Member) string {
+	port := m.Tags["raft-port"]
+	if port == "" {
+		port = strconv.Itoa(config.Balancer.RaftPort)
+	}
+	return net.JoinHostPort(m.Addr.String(), port)
+}
@@ -2,41 +2,54 @@ package fusis
 
 import (
 	"encoding/json"
+	"errors"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/luizbafilho/fusis/engine"
+	"github.com/luizbafilho/fusis/health"
 	"github.com/luizbafilho/fusis/ipvs"
 	"github.com/pborman/uuid"
 )
 
+// ErrServiceModified is returned when updating a service changed since the
+// version the update is based on.
+var ErrServiceModified = errors.New("service was modified")
+
 // GetServices get all services
 func (b *Balancer) GetServices() *[]ipvs.Service {
 	return b.engine.State.GetServices()
 }
 
+// GetServicesByTags returns the services having every tag of selector.
+func (b *Balancer) GetServicesByTags(selector map[string]string) *[]ipvs.Service {
+	return b.engine.State.GetServicesByTags(selector)
+}
+
 // AddService ...
 func (b *Balancer) AddService(svc *ipvs.Service) error {
 	b.Lock()
 	defer b.Unlock()
 
-	if err := b.engine.Provider.AllocateVIP(svc); err != nil {
-		return err
+	// Services created without a VIP get one from the pool
+	allocated := !svc.IsFwmark() && svc.Host == ""
+	if allocated {
+		if err := b.engine.Provider.AllocateVIP(svc); err != nil {
+			return err
+		}
 	}
 
 	svc.Id = uuid.New()
+	svc.Version = 1
 
 	c := &engine.Command{
 		Op:      engine.AddServiceOp,
 		Service: svc,
 	}
 
-	bytes, err := json.Marshal(c)
-	if err != nil {
-		return err
-	}
-
-	f := b.raft.Apply(bytes, raftTimeout)
-	if err, ok := f.(error); ok {
+	if err := b.applyCommand(c); err != nil {
+		if !allocated {
+			return err
+		}
 		if err := b.engine.Provider.ReleaseVIP(*svc); err != nil {
 			return err
 		}
@@ -47,11 +60,89 @@ func (b *Balancer) AddService(svc *ipvs.Service) error {
 	return nil
 }
 
+// releaseVIP returns the VIP of a deleted service to the pool.
+func (b *Balancer) releaseVIP(svc ipvs.Service) {
+	if svc.IsFwmark() {
+		return
+	}
+	if err := b.engine.Provider.ReleaseVIP(svc); err != nil {
+		log.Errorf("Releasing VIP of service %s failed: %v", svc.GetId(), err)
+	}
+}
+
 //GetService get a service
 func (b *Balancer) GetService(name string) (*ipvs.Service, error) {
 	return b.engine.State.GetService(name)
 }
 
+// Reconcile corrects the drift of the IPVS table of this balancer from the
+// services balanced.
+func (b *Balancer) Reconcile() (*ipvs.ReconcileReport, error) {
+	return b.engine.Reconcile()
+}
+
+// DumpTable renders the IPVS table of this balancer like ipvsadm does.
+func (b *Balancer) DumpTable() (string, error) {
+	return b.engine.Ipvs.Dump()
+}
+
+// GetServiceStats gets the IPVS counters of a service
+func (b *Balancer) GetServiceStats(name string) (*ipvs.ServiceStats, error) {
+	svc, err := b.GetService(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.engine.GetServiceStats(svc)
+}
+
+// GetPersistenceEntries gets the clients pinned to the destinations of a
+// service by its persistence
+func (b *Balancer) GetPersistenceEntries(name string) ([]ipvs.PersistenceEntry, error) {
+	svc, err := b.GetService(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.engine.GetPersistenceEntries(svc)
+}
+
+// GetDestinationStats gets the IPVS counters of a destination
+func (b *Balancer) GetDestinationStats(dst *ipvs.Destination) (*ipvs.DestinationStats, error) {
+	svc, err := b.GetService(dst.ServiceId)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.engine.GetDestinationStats(svc, dst)
+}
+
+// UpdateService changes the configuration of a service. It fails with
+// ErrServiceModified when svc.Version isn't the current version of the
+// service, which is then incremented.
+func (b *Balancer) UpdateService(svc *ipvs.Service) error {
+	log.Infof("Updating Service: %v", svc.GetId())
+
+	b.Lock()
+	defer b.Unlock()
+
+	current, err := b.GetService(svc.GetId())
+	if err != nil {
+		return err
+	}
+	if current.Version != svc.Version {
+		return ErrServiceModified
+	}
+	svc.Version++
+
+	c := &engine.Command{
+		Op:      engine.UpdateServiceOp,
+		Service: svc,
+	}
+
+	return b.applyCommand(c)
+}
+
 func (b *Balancer) DeleteService(name string) error {
 	log.Infof("Deleting Service: %v", name)
 
@@ -65,21 +156,104 @@ func (b *Balancer) DeleteService(name string) error {
 		Service: svc,
 	}
 
-	bytes, err := json.Marshal(c)
-	if err != nil {
+	if err := b.applyCommand(c); err != nil {
 		return err
 	}
+	b.releaseVIP(*svc)
 
-	f := b.raft.Apply(bytes, raftTimeout)
-	if err, ok := f.(error); ok {
+	return nil
+}
+
+// ApplyBatch applies cmds in order as a single command: either all of them
+// succeed or none is applied. The services added get their VIP and id here,
+// the destinations added their id. In gossip mode the commands are applied
+// one at a time, without rollback.
+func (b *Balancer) ApplyBatch(cmds []engine.Command) error {
+	log.Infof("Applying batch of %d commands", len(cmds))
+
+	b.Lock()
+	defer b.Unlock()
+
+	allocated := []ipvs.Service{}
+	release := func() {
+		for _, svc := range allocated {
+			if err := b.engine.Provider.ReleaseVIP(svc); err != nil {
+				log.Errorf("Releasing VIP of service %s failed: %v", svc.GetId(), err)
+			}
+		}
+	}
+
+	for i, c := range cmds {
+		switch c.Op {
+		case engine.AddServiceOp:
+			if !c.Service.IsFwmark() && c.Service.Host == "" {
+				if err := b.engine.Provider.AllocateVIP(c.Service); err != nil {
+					release()
+					return &engine.BatchError{Index: i, Err: err}
+				}
+				allocated = append(allocated, *c.Service)
+			}
+			c.Service.Id = uuid.New()
+			c.Service.Version = 1
+		case engine.AddDestinationOp:
+			c.Destination.Id = uuid.New()
+		}
+	}
+
+	c := &engine.Command{
+		Op:       engine.BatchOp,
+		Commands: cmds,
+	}
+
+	if err := b.applyCommand(c); err != nil {
+		release()
 		return err
 	}
+	for _, c := range cmds {
+		if c.Op == engine.DelServiceOp {
+			b.releaseVIP(*c.Service)
+		}
+	}
 
 	return nil
 }
 
+// FlushServices deletes every service and destination in a single command
+func (b *Balancer) FlushServices() error {
+	log.Infof("Flushing Services")
+
+	svcs := b.GetServices()
+	c := &engine.Command{
+		Op: engine.FlushServicesOp,
+	}
+
+	if err := b.applyCommand(c); err != nil {
+		return err
+	}
+	for _, svc := range *svcs {
+		b.releaseVIP(svc)
+	}
+
+	return nil
+}
+
+// GetDestinationHealth gets the outcome of the health checks of a
+// destination on this balancer. Destinations without checks are unknown.
+func (b *Balancer) GetDestinationHealth(dst *ipvs.Destination) health.Status {
+	if status, ok := b.engine.Health.Status(dst.GetId()); ok {
+		return status
+	}
+	return health.Status{State: health.Unknown}
+}
+
 func (b *Balancer) GetDestination(name string) (*ipvs.Destination, error) {
-	return b.engine.State.GetDestination(name)
+	dst, err := b.engine.State.GetDestination(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dst.EffectiveWeight = b.engine.EffectiveWeight(dst)
+	return dst, nil
 }
 
 func (b *Balancer) AddDestination(svc *ipvs.Service, dst *ipvs.Destination) error {
@@ -91,17 +265,40 @@ func (b *Balancer) AddDestination(svc *ipvs.Service, dst *ipvs.Destination) erro
 		Destination: dst,
 	}
 
-	bytes, err := json.Marshal(c)
-	if err != nil {
-		return err
+	return b.applyCommand(c)
+}
+
+// UpdateDestination updates the weight and forwarding mode of an existing destination
+func (b *Balancer) UpdateDestination(svc *ipvs.Service, dst *ipvs.Destination) error {
+	c := &engine.Command{
+		Op:          engine.UpdateDestinationOp,
+		Service:     svc,
+		Destination: dst,
 	}
 
-	f := b.raft.Apply(bytes, raftTimeout)
-	if err, ok := f.(error); ok {
-		return err
+	return b.applyCommand(c)
+}
+
+// RebalanceDestinations sets the weights of destinations of svc at once,
+// weights maps their ids to the new weight. Destinations left out keep theirs.
+func (b *Balancer) RebalanceDestinations(svc *ipvs.Service, weights map[string]int32) error {
+	cmds := []engine.Command{}
+	for _, d := range svc.Destinations {
+		weight, ok := weights[d.GetId()]
+		if !ok {
+			continue
+		}
+		dst := d
+		dst.Weight = weight
+		dst.EffectiveWeight = 0
+		cmds = append(cmds, engine.Command{
+			Op:          engine.UpdateDestinationOp,
+			Service:     svc,
+			Destination: &dst,
+		})
 	}
 
-	return nil
+	return b.ApplyBatch(cmds)
 }
 
 func (b *Balancer) DeleteDestination(dst *ipvs.Destination) error {
@@ -116,13 +313,27 @@ func (b *Balancer) DeleteDestination(dst *ipvs.Destination) error {
 		Destination: dst,
 	}
 
+	return b.applyCommand(c)
+}
+
+// applyCommand replicates c through raft and returns either the replication
+// error or the error returned by the engine when applying it.
+func (b *Balancer) applyCommand(c *engine.Command) error {
+	if b.gossip != nil {
+		return b.gossip.Apply(c)
+	}
+
 	bytes, err := json.Marshal(c)
 	if err != nil {
 		return err
 	}
 
 	f := b.raft.Apply(bytes, raftTimeout)
-	if err, ok := f.(error); ok {
+	if err := f.Error(); err != nil {
+		return err
+	}
+
+	if err, ok := f.Response().(error); ok {
 		return err
 	}
 
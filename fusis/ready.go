@@ -0,0 +1,55 @@
+package fusis
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/luizbafilho/fusis/config"
+)
+
+// Drain marks the balancer as shutting down, Ready fails from then on so
+// the traffic moves elsewhere. The BGP routes are withdrawn right away.
+func (b *Balancer) Drain() {
+	atomic.StoreInt32(&b.draining, 1)
+	b.updateRoutes()
+}
+
+// Ready tells why the balancer can't balance yet, or nil when it can: it
+// must have joined the cluster, replayed the cluster state and be able to
+// program IPVS, and must not be shutting down.
+func (b *Balancer) Ready() error {
+	if atomic.LoadInt32(&b.draining) == 1 {
+		return errors.New("shutting down")
+	}
+
+	if config.Balancer.Join != "" && b.aliveMembers() < 2 {
+		return errors.New("cluster not joined")
+	}
+
+	if b.raft != nil {
+		if b.raft.Leader() == "" {
+			return errors.New("no cluster leader")
+		}
+		if applied, last := b.raft.AppliedIndex(), b.raft.LastIndex(); applied < last {
+			return fmt.Errorf("replaying the cluster state, %d of %d entries applied", applied, last)
+		}
+	}
+
+	if _, err := b.engine.Ipvs.GetServices(); err != nil {
+		return fmt.Errorf("IPVS unavailable: %v", err)
+	}
+
+	return nil
+}
+
+func (b *Balancer) aliveMembers() int {
+	alive := 0
+	for _, m := range b.serf.Members() {
+		if m.Status == serf.StatusAlive {
+			alive++
+		}
+	}
+	return alive
+}
@@ -0,0 +1,70 @@
+package fusis
+
+import (
+	"github.com/luizbafilho/fusis/engine"
+	"github.com/luizbafilho/fusis/health"
+)
+
+// subscriptionBuffer is how many events a subscriber may fall behind before
+// it is considered too slow and dropped.
+const subscriptionBuffer = 64
+
+// Event is sent to subscribers for every command applied to the local state,
+// every health change of a local check and every ejection of the local
+// outlier detection. Only one of its fields is set.
+type Event struct {
+	Command  *engine.Command
+	Health   *health.Change
+	Ejection *engine.Ejection
+}
+
+// Subscribe returns a channel receiving every event of the balancer, and a
+// function that ends the subscription. The channel is closed when the
+// subscription ends or when the subscriber falls too far behind.
+func (b *Balancer) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriptionBuffer)
+
+	b.subscribersLock.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.subscribersLock.Unlock()
+
+	return ch, func() { b.unsubscribe(ch) }
+}
+
+func (b *Balancer) unsubscribe(ch chan Event) {
+	b.subscribersLock.Lock()
+	defer b.subscribersLock.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publishHealth sends health changes to subscribers. Health is checked by
+// every balancer on its own, so they only describe the local checks.
+func (b *Balancer) publishHealth(change health.Change) {
+	b.publish(Event{Health: &change})
+	b.updateRoutes()
+}
+
+// publishEjection sends the ejections and readmissions of outliers to
+// subscribers. Like health, they only describe the local checks.
+func (b *Balancer) publishEjection(ejection engine.Ejection) {
+	b.publish(Event{Ejection: &ejection})
+}
+
+func (b *Balancer) publish(e Event) {
+	b.subscribersLock.Lock()
+	defer b.subscribersLock.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			b.logger.Warnf("Dropping slow subscriber")
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
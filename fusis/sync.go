@@ -0,0 +1,31 @@
+package fusis
+
+import "github.com/luizbafilho/fusis/ipvs"
+
+// SyncDaemons returns the IPVS sync daemons running on this balancer.
+func (b *Balancer) SyncDaemons() ([]ipvs.SyncDaemon, error) {
+	return b.engine.SyncDaemons()
+}
+
+// StartSyncDaemon starts an IPVS sync daemon on this balancer, replacing
+// the one of the same state.
+func (b *Balancer) StartSyncDaemon(d ipvs.SyncDaemon) error {
+	return b.engine.StartSyncDaemon(d)
+}
+
+// StopSyncDaemon stops the IPVS sync daemon of the given state on this
+// balancer.
+func (b *Balancer) StopSyncDaemon(state ipvs.SyncState) error {
+	return b.engine.StopSyncDaemon(state)
+}
+
+// Timeouts returns the IPVS timeouts of this balancer.
+func (b *Balancer) Timeouts() (ipvs.Timeouts, error) {
+	return b.engine.Timeouts()
+}
+
+// SetTimeouts sets the IPVS timeouts of this balancer, leaving the ones that
+// are 0 unchanged.
+func (b *Balancer) SetTimeouts(t ipvs.Timeouts) error {
+	return b.engine.SetTimeouts(t)
+}
@@ -0,0 +1,77 @@
+package health
+
+import (
+	"time"
+
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// BreakerState is the state of the circuit breaker of a destination.
+type BreakerState string
+
+const (
+	// BreakerClosed lets the destination be balanced.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen withdraws the destination until OpenDuration has passed.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen keeps the destination withdrawn while its checks
+	// tell if it recovered.
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// breaker follows the results of the active checks of a destination as
+// described by its CircuitBreaker.
+type breaker struct {
+	cb    ipvs.CircuitBreaker
+	state BreakerState
+	// failures holds the times of the failures within the window.
+	failures  []time.Time
+	openedAt  time.Time
+	successes int
+}
+
+func newBreaker(cb ipvs.CircuitBreaker) *breaker {
+	return &breaker{cb: cb, state: BreakerClosed}
+}
+
+// record updates the breaker with the result of a check made at now,
+// telling if it opened.
+func (b *breaker) record(now time.Time, err error) bool {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= time.Duration(b.cb.OpenDuration) {
+		b.state = BreakerHalfOpen
+		b.successes = 0
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if err != nil {
+			b.open(now)
+			return true
+		}
+		b.successes++
+		if b.successes >= b.cb.HalfOpenProbes {
+			b.state = BreakerClosed
+			b.failures = nil
+		}
+	case BreakerClosed:
+		if err == nil {
+			return false
+		}
+		b.failures = append(b.failures, now)
+		start := now.Add(-time.Duration(b.cb.Window))
+		for len(b.failures) > 0 && !b.failures[0].After(start) {
+			b.failures = b.failures[1:]
+		}
+		if len(b.failures) >= b.cb.FailureThreshold {
+			b.open(now)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *breaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.failures = nil
+}
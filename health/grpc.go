@@ -0,0 +1,168 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// Serving statuses of grpc.health.v1.HealthCheckResponse.
+var servingStatuses = []string{"UNKNOWN", "SERVING", "NOT_SERVING", "SERVICE_UNKNOWN"}
+
+const servingStatus = 1
+
+// grpcProbe returns a probe succeeding when dst answers the standard gRPC
+// health check for hc.GRPCService with SERVING. The call is made over
+// HTTP/2 directly rather than through a gRPC library, as it is a single
+// unary call with one-field messages.
+func grpcProbe(hc ipvs.HealthCheck) probe {
+	scheme := "http"
+	protocols := new(http.Protocols)
+	if hc.TLS {
+		scheme = "https"
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: hc.InsecureSkipVerify},
+			Protocols:         protocols,
+		},
+	}
+
+	return func(ctx context.Context, dst ipvs.Destination) error {
+		url := scheme + "://" + dst.Address() + "/grpc.health.v1.Health/Check"
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(healthCheckRequest(hc.GRPCService)))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return statusError(fmt.Sprintf("unexpected status %d, expected 200", resp.StatusCode))
+		}
+		// A failed call may have no message, with its status in the headers.
+		if err := checkGRPCStatus(resp.Header); err != nil {
+			return err
+		}
+		msg, err := readGRPCMessage(resp.Body)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		if err := checkGRPCStatus(resp.Trailer); err != nil {
+			return err
+		}
+		status, err := decodeServingStatus(msg)
+		if err != nil {
+			return err
+		}
+		if status != servingStatus {
+			return statusError(fmt.Sprintf("service is %s, expected SERVING", servingStatusName(status)))
+		}
+		return nil
+	}
+}
+
+// healthCheckRequest encodes a length-prefixed HealthCheckRequest message,
+// whose only field is the service name.
+func healthCheckRequest(service string) []byte {
+	var msg []byte
+	if service != "" {
+		msg = append(msg, 0x0a) // field 1, length-delimited
+		msg = binary.AppendUvarint(msg, uint64(len(service)))
+		msg = append(msg, service...)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, fmt.Errorf("reading health check response: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed health check response")
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("reading health check response: %v", err)
+	}
+	return msg, nil
+}
+
+func checkGRPCStatus(h http.Header) error {
+	code := h.Get("Grpc-Status")
+	if code == "" || code == "0" {
+		return nil
+	}
+	if message := h.Get("Grpc-Message"); message != "" {
+		return statusError(fmt.Sprintf("grpc status %s: %s", code, message))
+	}
+	return statusError("grpc status " + code)
+}
+
+// decodeServingStatus returns the status field of a HealthCheckResponse,
+// skipping any field it doesn't know.
+func decodeServingStatus(msg []byte) (uint64, error) {
+	var status uint64
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("malformed health check response")
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("malformed health check response")
+			}
+			msg = msg[n:]
+			if key>>3 == 1 {
+				status = value
+			}
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return 0, errors.New("malformed health check response")
+			}
+			msg = msg[size:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				return 0, errors.New("malformed health check response")
+			}
+			msg = msg[n+int(size):]
+		default:
+			return 0, errors.New("malformed health check response")
+		}
+	}
+	return status, nil
+}
+
+func servingStatusName(status uint64) string {
+	if status < uint64(len(servingStatuses)) {
+		return servingStatuses[status]
+	}
+	return fmt.Sprint(status)
+}
@@ -0,0 +1,467 @@
+// Package health actively checks destinations and reports when they become
+// healthy or unhealthy.
+package health
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// State is the health of a destination.
+type State string
+
+const (
+	Unknown   State = "unknown"
+	Healthy   State = "healthy"
+	Unhealthy State = "unhealthy"
+)
+
+// Status is the outcome of the checks of a destination so far.
+type Status struct {
+	State                State     `json:"state"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	LastCheck            time.Time `json:"last_check"`
+	LastError            string    `json:"last_error,omitempty"`
+	// Passive is the status of the passive checks alone, when the
+	// destination has them.
+	Passive *Status `json:"passive,omitempty"`
+	// Breaker is the state of the circuit breaker of the destination, when
+	// it has one.
+	Breaker BreakerState `json:"breaker,omitempty"`
+}
+
+// Reason tells why a destination changed state.
+type Reason string
+
+const (
+	// ReasonPassed is given for destinations passing their checks again.
+	ReasonPassed            Reason = "passed"
+	ReasonTimeout           Reason = "timeout"
+	ReasonBadStatus         Reason = "bad_status"
+	ReasonConnectionRefused Reason = "connection_refused"
+	// ReasonPassive is given for destinations failing their passive check.
+	ReasonPassive Reason = "passive"
+	// ReasonCircuitOpen is given for destinations whose circuit breaker
+	// opened.
+	ReasonCircuitOpen Reason = "circuit_open"
+	// ReasonFailed is given for any other failure, described by the error.
+	ReasonFailed Reason = "failed"
+)
+
+// Change is a checked destination going from a state to another.
+type Change struct {
+	ServiceId     string `json:"service_id"`
+	DestinationId string `json:"destination_id"`
+	From          State  `json:"from"`
+	To            State  `json:"to"`
+	Reason        Reason `json:"reason"`
+	// Error is the failure that made the destination unhealthy.
+	Error string `json:"error,omitempty"`
+}
+
+// ChangeFunc is called when a checked destination becomes healthy or
+// unhealthy.
+type ChangeFunc func(change Change)
+
+// StatsFunc reads the IPVS counters of a destination and of its service,
+// which passive checks are based on.
+type StatsFunc func(dst ipvs.Destination) (*ipvs.DestinationStats, *ipvs.ServiceStats, error)
+
+// ProbeFunc is called after every active check of a destination with how
+// long it took and why it failed, if it did.
+type ProbeFunc func(dst ipvs.Destination, latency time.Duration, err error)
+
+// Monitor runs the health checks of the destinations it watches.
+type Monitor struct {
+	sync.Mutex
+	onChange ChangeFunc
+	onProbe  ProbeFunc
+	stats    StatsFunc
+	checks   map[string]*checker
+	// probes holds a slot for every active check running, when they are
+	// bounded.
+	probes chan struct{}
+	// offset picks how long the first active check of a destination waits,
+	// given its interval.
+	offset func(interval time.Duration) time.Duration
+}
+
+// SetMaxConcurrentProbes bounds how many active checks run at once across
+// the destinations, the others waiting for their turn. It only applies to
+// destinations watched afterwards, 0 removes the bound.
+func (m *Monitor) SetMaxConcurrentProbes(n int) {
+	m.Lock()
+	defer m.Unlock()
+	if n <= 0 {
+		m.probes = nil
+		return
+	}
+	m.probes = make(chan struct{}, n)
+}
+
+// OnProbe makes the monitor call fn after every active check. It only
+// applies to destinations watched afterwards.
+func (m *Monitor) OnProbe(fn ProbeFunc) {
+	m.Lock()
+	defer m.Unlock()
+	m.onProbe = fn
+}
+
+// NewMonitor returns a monitor calling onChange on every state change. Passive
+// checks read counters through stats, and don't run when it is nil.
+func NewMonitor(onChange ChangeFunc, stats StatsFunc) *Monitor {
+	return &Monitor{
+		onChange: onChange,
+		stats:    stats,
+		checks:   make(map[string]*checker),
+		offset:   randomOffset,
+	}
+}
+
+// Watch starts checking dst as described by its HealthCheck, or stops
+// checking it if it has none. Watching a destination again keeps its status
+// unless its address or check changed, in which case the previous checks
+// are cancelled without waiting for the one in progress.
+func (m *Monitor) Watch(dst ipvs.Destination) {
+	if dst.HealthCheck == nil {
+		m.Unwatch(dst.GetId())
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if c, ok := m.checks[dst.GetId()]; ok {
+		if c.dst.Address() == dst.Address() && reflect.DeepEqual(*c.dst.HealthCheck, *dst.HealthCheck) {
+			c.setDestination(dst)
+			return
+		}
+		c.cancel()
+	}
+
+	c := newCheck(dst, m.onChange, m.onProbe, m.stats, m.probes, m.offset)
+	m.checks[dst.GetId()] = c
+	c.run()
+}
+
+// Unwatch stops checking the destination with the given id, returning once
+// its check in progress, if any, is over and reported. It must not be called
+// from the callbacks of that destination.
+func (m *Monitor) Unwatch(id string) {
+	m.Lock()
+	c, ok := m.checks[id]
+	delete(m.checks, id)
+	m.Unlock()
+
+	if ok {
+		c.stop()
+	}
+}
+
+// Stop stops every check, returning once the checks in progress are over.
+func (m *Monitor) Stop() {
+	m.Lock()
+	checks := m.checks
+	m.checks = make(map[string]*checker)
+	m.Unlock()
+
+	for _, c := range checks {
+		c.cancel()
+	}
+	for _, c := range checks {
+		c.stop()
+	}
+}
+
+// Status returns the status of the destination with the given id, and false
+// if it isn't checked.
+func (m *Monitor) Status(id string) (Status, bool) {
+	m.Lock()
+	c, ok := m.checks[id]
+	m.Unlock()
+	if !ok {
+		return Status{}, false
+	}
+	return c.getStatus(), true
+}
+
+// checker runs the checks of a single destination. Its active probes and
+// passive sampling are separate signals, and the destination is unhealthy as
+// soon as one of them is.
+type checker struct {
+	sync.Mutex
+	dst      ipvs.Destination
+	hc       ipvs.HealthCheck
+	active   *signal
+	passive  *signal
+	breaker  *breaker
+	state    State
+	onChange ChangeFunc
+	onProbe  ProbeFunc
+	probes   chan struct{}
+	cancel   context.CancelFunc
+	ctx      context.Context
+	// loops are the goroutines running the signals.
+	loops sync.WaitGroup
+}
+
+// signal is a single source of check results with its own counters.
+type signal struct {
+	interval time.Duration
+	timeout  time.Duration
+	check    func(ctx context.Context, dst ipvs.Destination, withdrawn bool) error
+	status   Status
+	// probes tells if the signal is an active check, timed for onProbe.
+	probes bool
+	// offset is how long the first check waits.
+	offset time.Duration
+}
+
+func newCheck(dst ipvs.Destination, onChange ChangeFunc, onProbe ProbeFunc, stats StatsFunc, probes chan struct{}, offset func(time.Duration) time.Duration) *checker {
+	hc := dst.HealthCheck.WithDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &checker{
+		dst:      dst,
+		hc:       hc,
+		state:    Unknown,
+		onChange: onChange,
+		onProbe:  onProbe,
+		probes:   probes,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	if hc.Type != "" {
+		probe := probeFor(hc)
+		c.active = &signal{
+			interval: time.Duration(hc.Interval),
+			timeout:  time.Duration(hc.Timeout),
+			check: func(ctx context.Context, dst ipvs.Destination, withdrawn bool) error {
+				return probe(ctx, dst)
+			},
+			status: Status{State: Unknown},
+			probes: true,
+			offset: offset(time.Duration(hc.Interval)),
+		}
+		if hc.CircuitBreaker != nil {
+			c.breaker = newBreaker(*hc.CircuitBreaker)
+		}
+	}
+	if hc.PassiveCheck != nil && stats != nil {
+		sampler := &passiveSampler{pc: *hc.PassiveCheck, stats: stats}
+		c.passive = &signal{
+			interval: time.Duration(hc.PassiveCheck.Interval),
+			check:    sampler.sample,
+			status:   Status{State: Unknown},
+		}
+	}
+	return c
+}
+
+func (c *checker) run() {
+	for _, sig := range []*signal{c.active, c.passive} {
+		if sig != nil {
+			c.loops.Add(1)
+			go func(sig *signal) {
+				defer c.loops.Done()
+				c.loop(sig)
+			}(sig)
+		}
+	}
+}
+
+// randomOffset returns a random offset within the first interval, so the
+// destinations watched together, as on startup, aren't all probed at once.
+func randomOffset(interval time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(interval)))
+}
+
+// loop runs the checks of sig every interval. Active checks start after the
+// offset of sig.
+func (c *checker) loop(sig *signal) {
+	if sig.probes {
+		offset := time.NewTimer(sig.offset)
+		select {
+		case <-c.ctx.Done():
+			offset.Stop()
+			return
+		case <-offset.C:
+		}
+	}
+	ticker := time.NewTicker(sig.interval)
+	defer ticker.Stop()
+
+	for {
+		c.runOnce(sig)
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *checker) runOnce(sig *signal) {
+	if sig.probes && c.probes != nil {
+		select {
+		case c.probes <- struct{}{}:
+			defer func() { <-c.probes }()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+	ctx := c.ctx
+	if sig.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(c.ctx, sig.timeout)
+		defer cancel()
+	}
+	dst, withdrawn := c.destination()
+	start := time.Now()
+	err := sig.check(ctx, dst, withdrawn)
+	latency := time.Since(start)
+	if c.ctx.Err() != nil {
+		return
+	}
+
+	if change, changed := c.record(sig, err); changed {
+		log.Infof("Destination %s is now %s (%s)", change.DestinationId, change.To, change.Reason)
+		if c.onChange != nil {
+			c.onChange(change)
+		}
+	}
+	if sig.probes && c.onProbe != nil {
+		c.onProbe(dst, latency, err)
+	}
+}
+
+// record updates the status of sig with the result of a check, telling if
+// the destination changed state.
+func (c *checker) record(sig *signal, err error) (Change, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	sig.status.LastCheck = time.Now()
+	if err == nil {
+		sig.status.ConsecutiveSuccesses++
+		sig.status.ConsecutiveFailures = 0
+		sig.status.LastError = ""
+		if sig.status.ConsecutiveSuccesses >= c.hc.HealthyThreshold {
+			sig.status.State = Healthy
+		}
+	} else {
+		sig.status.ConsecutiveFailures++
+		sig.status.ConsecutiveSuccesses = 0
+		sig.status.LastError = err.Error()
+		if sig.status.ConsecutiveFailures >= c.hc.UnhealthyThreshold {
+			sig.status.State = Unhealthy
+		}
+	}
+	tripped := false
+	if sig.probes && c.breaker != nil {
+		tripped = c.breaker.record(sig.status.LastCheck, err)
+	}
+
+	change := Change{
+		ServiceId:     c.dst.ServiceId,
+		DestinationId: c.dst.GetId(),
+		From:          c.state,
+		To:            c.combinedState(),
+		Reason:        ReasonPassed,
+	}
+	c.state = change.To
+	if change.To == Unhealthy && err != nil {
+		change.Reason = reasonFor(sig, err)
+		if tripped {
+			change.Reason = ReasonCircuitOpen
+		}
+		change.Error = err.Error()
+	}
+	return change, change.From != change.To
+}
+
+func reasonFor(sig *signal, err error) Reason {
+	var netErr net.Error
+	var status statusError
+	switch {
+	case !sig.probes:
+		return ReasonPassive
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReasonConnectionRefused
+	case errors.As(err, &status):
+		return ReasonBadStatus
+	}
+	return ReasonFailed
+}
+
+// combinedState is unhealthy if any signal is or the circuit breaker isn't
+// closed, and healthy once all signals are.
+func (c *checker) combinedState() State {
+	if c.breaker != nil && c.breaker.state != BreakerClosed {
+		return Unhealthy
+	}
+	state := Healthy
+	for _, sig := range []*signal{c.active, c.passive} {
+		if sig == nil {
+			continue
+		}
+		switch sig.status.State {
+		case Unhealthy:
+			return Unhealthy
+		case Unknown:
+			state = Unknown
+		}
+	}
+	return state
+}
+
+// destination returns the checked destination and if it is withdrawn.
+func (c *checker) destination() (ipvs.Destination, bool) {
+	c.Lock()
+	defer c.Unlock()
+	return c.dst, c.state == Unhealthy
+}
+
+func (c *checker) setDestination(dst ipvs.Destination) {
+	c.Lock()
+	defer c.Unlock()
+	c.dst = dst
+}
+
+func (c *checker) getStatus() Status {
+	c.Lock()
+	defer c.Unlock()
+
+	var status Status
+	if c.active != nil {
+		status = c.active.status
+	} else if c.passive != nil {
+		status = c.passive.status
+	}
+	status.State = c.state
+	if c.breaker != nil {
+		status.Breaker = c.breaker.state
+	}
+	if c.passive != nil {
+		passive := c.passive.status
+		status.Passive = &passive
+	}
+	return status
+}
+
+// stop cancels the checks and waits for the signals to stop.
+func (c *checker) stop() {
+	c.cancel()
+	c.loops.Wait()
+}
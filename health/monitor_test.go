@@ -0,0 +1,732 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luizbafilho/fusis/ipvs"
+	"gopkg.in/check.v1"
+)
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+// changes records the state changes reported by a monitor.
+type changes struct {
+	sync.Mutex
+	changes []Change
+	ch      chan Change
+}
+
+func newChanges() *changes {
+	return &changes{ch: make(chan Change, 16)}
+}
+
+func (c *changes) record(change Change) {
+	c.Lock()
+	c.changes = append(c.changes, change)
+	c.Unlock()
+	c.ch <- change
+}
+
+func (c *changes) next(ck *check.C) State {
+	return c.nextChange(ck).To
+}
+
+func (c *changes) nextChange(ck *check.C) Change {
+	select {
+	case change := <-c.ch:
+		return change
+	case <-time.After(2 * time.Second):
+		ck.Fatal("no state change")
+	}
+	return Change{}
+}
+
+func destination(c *check.C, addr string, hc ipvs.HealthCheck) ipvs.Destination {
+	host, port, err := net.SplitHostPort(addr)
+	c.Assert(err, check.IsNil)
+	p, err := strconv.Atoi(port)
+	c.Assert(err, check.IsNil)
+	return ipvs.Destination{Name: "dst1", Host: host, Port: uint16(p), ServiceId: "svc1", HealthCheck: &hc}
+}
+
+func (s *S) TestMonitorHTTP(c *check.C) {
+	var lock sync.Mutex
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/health")
+		lock.Lock()
+		defer lock.Unlock()
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	changes := newChanges()
+	m := NewMonitor(changes.record, nil)
+	defer m.Stop()
+	m.Watch(destination(c, srv.Listener.Addr().String(), ipvs.HealthCheck{
+		Type:               ipvs.HTTPCheck,
+		Path:               "/health",
+		Interval:           ipvs.Duration(5 * time.Millisecond),
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+	}))
+	change := changes.nextChange(c)
+	c.Assert(change, check.Equals, Change{ServiceId: "svc1", DestinationId: "dst1", From: Unknown, To: Healthy, Reason: ReasonPassed})
+
+	lock.Lock()
+	status = http.StatusServiceUnavailable
+	lock.Unlock()
+	change = changes.nextChange(c)
+	c.Assert(change.To, check.Equals, Unhealthy)
+	c.Assert(change.Reason, check.Equals, ReasonBadStatus)
+	c.Assert(change.Error, check.Equals, "unexpected status 503, expected 2xx")
+
+	st, ok := m.Status("dst1")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(st.State, check.Equals, Unhealthy)
+	c.Assert(st.ConsecutiveFailures >= 2, check.Equals, true)
+	c.Assert(st.LastError, check.Equals, "unexpected status 503, expected 2xx")
+}
+
+func (s *S) TestBreaker(c *check.C) {
+	b := newBreaker(ipvs.CircuitBreaker{
+		FailureThreshold: 3,
+		Window:           ipvs.Duration(10 * time.Second),
+		OpenDuration:     ipvs.Duration(30 * time.Second),
+		HalfOpenProbes:   2,
+	})
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	failure := errors.New("refused")
+
+	// Failures out of the window don't count
+	c.Assert(b.record(at(0), failure), check.Equals, false)
+	c.Assert(b.record(at(5), nil), check.Equals, false)
+	c.Assert(b.record(at(6), failure), check.Equals, false)
+	c.Assert(b.record(at(12), failure), check.Equals, false)
+	c.Assert(b.state, check.Equals, BreakerClosed)
+	c.Assert(b.record(at(13), failure), check.Equals, true)
+	c.Assert(b.state, check.Equals, BreakerOpen)
+
+	// Successes while open change nothing
+	c.Assert(b.record(at(20), nil), check.Equals, false)
+	c.Assert(b.state, check.Equals, BreakerOpen)
+
+	// Half-open, a failure opens it again
+	c.Assert(b.record(at(43), nil), check.Equals, false)
+	c.Assert(b.state, check.Equals, BreakerHalfOpen)
+	c.Assert(b.record(at(44), failure), check.Equals, true)
+	c.Assert(b.state, check.Equals, BreakerOpen)
+
+	c.Assert(b.record(at(74), nil), check.Equals, false)
+	c.Assert(b.state, check.Equals, BreakerHalfOpen)
+	c.Assert(b.record(at(75), nil), check.Equals, false)
+	c.Assert(b.state, check.Equals, BreakerClosed)
+	c.Assert(b.record(at(76), failure), check.Equals, false)
+}
+
+func (s *S) TestMonitorCircuitBreaker(c *check.C) {
+	var lock sync.Mutex
+	requests := 0
+	flapping := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		if flapping && requests%2 == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	changes := newChanges()
+	m := NewMonitor(changes.record, nil)
+	defer m.Stop()
+	// Failing every other check never fails twice in a row
+	m.Watch(destination(c, srv.Listener.Addr().String(), ipvs.HealthCheck{
+		Type:               ipvs.HTTPCheck,
+		Path:               "/health",
+		Interval:           ipvs.Duration(5 * time.Millisecond),
+		UnhealthyThreshold: 2,
+		CircuitBreaker: &ipvs.CircuitBreaker{
+			FailureThreshold: 3,
+			OpenDuration:     ipvs.Duration(50 * time.Millisecond),
+			HalfOpenProbes:   2,
+		},
+	}))
+	change := changes.nextChange(c)
+	c.Assert(change.To, check.Equals, Unhealthy)
+	c.Assert(change.Reason, check.Equals, ReasonCircuitOpen)
+	st, ok := m.Status("dst1")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(st.Breaker, check.Not(check.Equals), BreakerClosed)
+
+	lock.Lock()
+	flapping = false
+	lock.Unlock()
+	change = changes.nextChange(c)
+	c.Assert(change.To, check.Equals, Healthy)
+	st, _ = m.Status("dst1")
+	c.Assert(st.Breaker, check.Equals, BreakerClosed)
+}
+
+func (s *S) TestMonitorTCP(c *check.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	changes := newChanges()
+	m := NewMonitor(changes.record, nil)
+	defer m.Stop()
+	m.Watch(destination(c, ln.Addr().String(), ipvs.HealthCheck{
+		Type:     ipvs.TCPCheck,
+		Interval: ipvs.Duration(5 * time.Millisecond),
+	}))
+	c.Assert(changes.next(c), check.Equals, Healthy)
+
+	ln.Close()
+	change := changes.nextChange(c)
+	c.Assert(change.From, check.Equals, Healthy)
+	c.Assert(change.To, check.Equals, Unhealthy)
+	c.Assert(change.Reason, check.Equals, ReasonConnectionRefused)
+	c.Assert(change.DestinationId, check.Equals, "dst1")
+	c.Assert(change.ServiceId, check.Equals, "svc1")
+}
+
+func (s *S) TestTCPExchangeProbe(c *check.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer ln.Close()
+	// A Redis like server answering PING, and never answering anything else
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 64)
+				n, _ := conn.Read(buf)
+				if string(buf[:n]) == "PING\r\n" {
+					conn.Write([]byte("+PONG\r\n"))
+				} else if string(buf[:n]) == "QUIT\r\n" {
+					conn.Write([]byte("+OK\r\n"))
+				} else {
+					time.Sleep(time.Second)
+				}
+			}()
+		}
+	}()
+	dst := destination(c, ln.Addr().String(), ipvs.HealthCheck{})
+	probe := func(send, expect string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		return probeFor(ipvs.HealthCheck{Type: ipvs.TCPCheck, Send: send, Expect: expect})(ctx, dst)
+	}
+
+	c.Assert(probe("PING\r\n", "PONG"), check.IsNil)
+	err = probe("QUIT\r\n", "PONG")
+	c.Assert(err, check.ErrorMatches, `answer doesn't contain "PONG"`)
+	c.Assert(reasonFor(&signal{probes: true}, err), check.Equals, ReasonBadStatus)
+	// The timeout bounds the whole exchange
+	err = probe("INFO\r\n", "PONG")
+	c.Assert(reasonFor(&signal{probes: true}, err), check.Equals, ReasonTimeout)
+}
+
+func (s *S) TestPing(c *check.C) {
+	conn, _, err := listenICMP(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		c.Skip("ICMP sockets not allowed: " + err.Error())
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.Assert(probePing(ctx, ipvs.Destination{Host: "127.0.0.1", Port: 80}), check.IsNil)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	c.Assert(probePing(ctx, ipvs.Destination{Host: "127.0.0.1", Port: 80}), check.Equals, context.Canceled)
+}
+
+func (s *S) TestEchoMessageChecksum(c *check.C) {
+	msg := echoMessage(icmpEchoRequest, 0x1234, 1)
+	c.Assert(msg[0], check.Equals, byte(icmpEchoRequest))
+	// A message including its checksum sums to zero
+	c.Assert(checksum(msg), check.Equals, uint16(0))
+}
+
+func (s *S) TestMonitorOnProbe(c *check.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	probes := make(chan error, 16)
+	m := NewMonitor(nil, nil)
+	defer m.Stop()
+	m.OnProbe(func(dst ipvs.Destination, latency time.Duration, err error) {
+		c.Check(dst.GetId(), check.Equals, "dst1")
+		c.Check(latency > 0, check.Equals, true)
+		select {
+		case probes <- err:
+		default:
+		}
+	})
+	m.Watch(destination(c, ln.Addr().String(), ipvs.HealthCheck{
+		Type:     ipvs.TCPCheck,
+		Interval: ipvs.Duration(5 * time.Millisecond),
+	}))
+	select {
+	case err := <-probes:
+		c.Assert(err, check.IsNil)
+	case <-time.After(2 * time.Second):
+		c.Fatal("no probe reported")
+	}
+}
+
+func (s *S) TestMonitorUnwatch(c *check.C) {
+	m := NewMonitor(nil, nil)
+	m.Watch(destination(c, "127.0.0.1:1", ipvs.HealthCheck{
+		Type:     ipvs.TCPCheck,
+		Interval: ipvs.Duration(time.Hour),
+	}))
+	_, ok := m.Status("dst1")
+	c.Assert(ok, check.Equals, true)
+
+	m.Unwatch("dst1")
+	_, ok = m.Status("dst1")
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *S) TestMonitorUnwatchWaitsForProbe(c *check.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	probing := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var lock sync.Mutex
+	probes := 0
+	m := NewMonitor(nil, nil)
+	m.offset = func(time.Duration) time.Duration { return 0 }
+	m.OnProbe(func(dst ipvs.Destination, latency time.Duration, err error) {
+		select {
+		case probing <- struct{}{}:
+		default:
+		}
+		<-release
+		lock.Lock()
+		probes++
+		lock.Unlock()
+	})
+	m.Watch(destination(c, ln.Addr().String(), ipvs.HealthCheck{
+		Type:     ipvs.TCPCheck,
+		Interval: ipvs.Duration(5 * time.Millisecond),
+	}))
+	select {
+	case <-probing:
+	case <-time.After(2 * time.Second):
+		c.Fatal("no probe reported")
+	}
+
+	unwatched := make(chan struct{})
+	go func() {
+		m.Unwatch("dst1")
+		close(unwatched)
+	}()
+	select {
+	case <-unwatched:
+		c.Fatal("unwatched while a probe is reported")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-unwatched:
+	case <-time.After(2 * time.Second):
+		c.Fatal("unwatch didn't return")
+	}
+
+	// No probe is reported afterwards
+	lock.Lock()
+	reported := probes
+	lock.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	c.Assert(probes, check.Equals, reported)
+}
+
+func (s *S) TestMonitorWatchWithoutCheck(c *check.C) {
+	m := NewMonitor(nil, nil)
+	dst := destination(c, "127.0.0.1:1", ipvs.HealthCheck{
+		Type:     ipvs.TCPCheck,
+		Interval: ipvs.Duration(time.Hour),
+	})
+	m.Watch(dst)
+	dst.HealthCheck = nil
+	m.Watch(dst)
+	_, ok := m.Status("dst1")
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *S) TestHTTPProbeHeadersAndTLS(c *check.C) {
+	var req *http.Request
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	dst := destination(c, srv.Listener.Addr().String(), ipvs.HealthCheck{})
+	hc := ipvs.HealthCheck{
+		Type:               ipvs.HTTPCheck,
+		Path:               "/health",
+		Headers:            map[string]string{"Host": "app.example.com", "X-Check": "fusis"},
+		TLS:                true,
+		InsecureSkipVerify: true,
+	}
+	err := probeFor(hc)(context.Background(), dst)
+	c.Assert(err, check.IsNil)
+	c.Assert(req.Host, check.Equals, "app.example.com")
+	c.Assert(req.Header.Get("X-Check"), check.Equals, "fusis")
+
+	hc.InsecureSkipVerify = false
+	err = probeFor(hc)(context.Background(), dst)
+	c.Assert(err, check.ErrorMatches, ".*certificate.*")
+}
+
+func (s *S) TestHTTPProbeRedirects(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			http.Redirect(w, r, "/ok", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+	dst := destination(c, srv.Listener.Addr().String(), ipvs.HealthCheck{})
+	hc := ipvs.HealthCheck{Type: ipvs.HTTPCheck, Path: "/health"}
+	err := probeFor(hc)(context.Background(), dst)
+	c.Assert(err, check.ErrorMatches, "unexpected status 302, expected 2xx")
+
+	hc.FollowRedirects = true
+	err = probeFor(hc)(context.Background(), dst)
+	c.Assert(err, check.IsNil)
+
+	hc = ipvs.HealthCheck{Type: ipvs.HTTPCheck, Path: "/health", ExpectedStatus: http.StatusFound}
+	err = probeFor(hc)(context.Background(), dst)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestGRPCProbe(c *check.C) {
+	var service string
+	status := byte(servingStatus)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.ProtoMajor, check.Equals, 2)
+		c.Check(r.URL.Path, check.Equals, "/grpc.health.v1.Health/Check")
+		msg, err := readGRPCMessage(r.Body)
+		c.Check(err, check.IsNil)
+		service = ""
+		if len(msg) > 2 {
+			service = string(msg[2:])
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, status})
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+	dst := destination(c, srv.Listener.Addr().String(), ipvs.HealthCheck{})
+
+	hc := ipvs.HealthCheck{Type: ipvs.GRPCCheck, GRPCService: "app.Backend"}
+	err := probeFor(hc)(context.Background(), dst)
+	c.Assert(err, check.IsNil)
+	c.Assert(service, check.Equals, "app.Backend")
+
+	status = 2
+	err = probeFor(hc)(context.Background(), dst)
+	c.Assert(err, check.ErrorMatches, "service is NOT_SERVING, expected SERVING")
+}
+
+func (s *S) TestGRPCProbeStatus(c *check.C) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "12")
+		w.Header().Set("Grpc-Message", "unknown service grpc.health.v1.Health")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+	dst := destination(c, srv.Listener.Addr().String(), ipvs.HealthCheck{})
+
+	err := probeFor(ipvs.HealthCheck{Type: ipvs.GRPCCheck})(context.Background(), dst)
+	c.Assert(err, check.ErrorMatches, "grpc status 12: unknown service grpc.health.v1.Health")
+}
+
+func (s *S) TestReasonFor(c *check.C) {
+	active := &signal{probes: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	var dialer net.Dialer
+	_, err := dialer.DialContext(ctx, "tcp", "127.0.0.1:1")
+	c.Assert(reasonFor(active, err), check.Equals, ReasonTimeout)
+	c.Assert(reasonFor(active, checkStatus(500, 0)), check.Equals, ReasonBadStatus)
+	c.Assert(reasonFor(active, errors.New("no route")), check.Equals, ReasonFailed)
+	c.Assert(reasonFor(&signal{}, errors.New("no traffic")), check.Equals, ReasonPassive)
+}
+
+// load serves counters for passive checks, changed by the tests.
+type load struct {
+	sync.Mutex
+	dst ipvs.DestinationStats
+	svc ipvs.ServiceStats
+}
+
+func (l *load) set(dstActive, dstInactive, svcActive uint32) {
+	l.Lock()
+	defer l.Unlock()
+	l.dst = ipvs.DestinationStats{ActiveConns: dstActive, InactiveConns: dstInactive}
+	l.svc = ipvs.ServiceStats{ActiveConns: svcActive}
+}
+
+func (l *load) stats(ipvs.Destination) (*ipvs.DestinationStats, *ipvs.ServiceStats, error) {
+	l.Lock()
+	defer l.Unlock()
+	dst, svc := l.dst, l.svc
+	return &dst, &svc, nil
+}
+
+func (s *S) TestMonitorPassive(c *check.C) {
+	l := &load{}
+	l.set(10, 0, 100)
+	changes := newChanges()
+	m := NewMonitor(changes.record, l.stats)
+	defer m.Stop()
+	m.Watch(destination(c, "127.0.0.1:1", ipvs.HealthCheck{
+		Interval:           ipvs.Duration(5 * time.Millisecond),
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+		PassiveCheck:       &ipvs.PassiveCheck{LoadThreshold: 50},
+	}))
+	c.Assert(changes.next(c), check.Equals, Healthy)
+
+	l.set(0, 0, 100)
+	change := changes.nextChange(c)
+	c.Assert(change.To, check.Equals, Unhealthy)
+	c.Assert(change.Reason, check.Equals, ReasonPassive)
+	st, _ := m.Status("dst1")
+	c.Assert(st.Passive, check.NotNil)
+
+	// Withdrawn destinations are readmitted to be judged again
+	c.Assert(changes.next(c), check.Equals, Healthy)
+}
+
+func (s *S) TestPassiveSamplerInactiveIncrease(c *check.C) {
+	l := &load{}
+	p := &passiveSampler{pc: ipvs.PassiveCheck{MaxInactiveIncrease: 5}, stats: l.stats}
+	dst := ipvs.Destination{}
+	l.set(1, 100, 1)
+	c.Assert(p.sample(context.Background(), dst, false), check.IsNil)
+	l.set(1, 104, 1)
+	c.Assert(p.sample(context.Background(), dst, false), check.IsNil)
+	l.set(1, 110, 1)
+	c.Assert(p.sample(context.Background(), dst, false), check.ErrorMatches, "inactive connections grew by 6, more than 5")
+	l.set(1, 200, 1)
+	c.Assert(p.sample(context.Background(), dst, true), check.IsNil)
+}
+
+func (s *S) TestMonitorActiveAndPassive(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	l := &load{}
+	l.set(0, 0, 100)
+	changes := newChanges()
+	m := NewMonitor(changes.record, l.stats)
+	defer m.Stop()
+	m.Watch(destination(c, srv.Listener.Addr().String(), ipvs.HealthCheck{
+		Type:               ipvs.HTTPCheck,
+		Path:               "/",
+		Interval:           ipvs.Duration(5 * time.Millisecond),
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+		PassiveCheck:       &ipvs.PassiveCheck{LoadThreshold: 50, Interval: ipvs.Duration(time.Hour)},
+	}))
+	// The active check passes but the passive one doesn't
+	c.Assert(changes.next(c), check.Equals, Unhealthy)
+}
+
+func (s *S) TestRandomOffset(c *check.C) {
+	const (
+		samples  = 1000
+		interval = 400 * time.Millisecond
+	)
+	var quarters [4]int
+	for i := 0; i < samples; i++ {
+		offset := randomOffset(interval)
+		c.Assert(offset >= 0 && offset < interval, check.Equals, true, check.Commentf("offset %v", offset))
+		quarters[offset*4/interval]++
+	}
+	// The offsets are spread over the interval
+	for q, n := range quarters {
+		c.Assert(n >= samples*15/100 && n <= samples*35/100, check.Equals, true, check.Commentf("%d offsets in quarter %d: %v", n, q, quarters))
+	}
+}
+
+func (s *S) TestMonitorSpreadsProbes(c *check.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	const (
+		destinations = 10
+		interval     = time.Minute
+	)
+	var (
+		mu        sync.Mutex
+		intervals []time.Duration
+		probed    = make(map[string]bool)
+		done      = make(chan struct{})
+	)
+	m := NewMonitor(nil, nil)
+	defer m.Stop()
+	// Every other destination waits past the end of the test
+	m.offset = func(interval time.Duration) time.Duration {
+		intervals = append(intervals, interval)
+		if len(intervals)%2 == 0 {
+			return time.Hour
+		}
+		return 0
+	}
+	m.OnProbe(func(dst ipvs.Destination, latency time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		probed[dst.GetId()] = true
+		if len(probed) == destinations/2 {
+			close(done)
+		}
+	})
+	for i := 0; i < destinations; i++ {
+		dst := destination(c, ln.Addr().String(), ipvs.HealthCheck{
+			Type:     ipvs.TCPCheck,
+			Interval: ipvs.Duration(interval),
+		})
+		dst.Name = fmt.Sprintf("dst%d", i)
+		m.Watch(dst)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the destinations without an offset weren't probed")
+	}
+
+	// The first probe of each destination waits for its offset
+	c.Assert(intervals, check.HasLen, destinations)
+	for _, i := range intervals {
+		c.Assert(i, check.Equals, interval)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < destinations; i += 2 {
+		c.Assert(probed[fmt.Sprintf("dst%d", i)], check.Equals, true)
+	}
+}
+
+func (s *S) TestMonitorMaxConcurrentProbes(c *check.C) {
+	var (
+		mu                  sync.Mutex
+		inFlight, maxFlight int
+		served              = make(chan struct{}, 100)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxFlight {
+			maxFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		select {
+		case served <- struct{}{}:
+		default:
+		}
+	}))
+	defer srv.Close()
+
+	m := NewMonitor(nil, nil)
+	defer m.Stop()
+	m.SetMaxConcurrentProbes(2)
+	for i := 0; i < 10; i++ {
+		dst := destination(c, srv.Listener.Addr().String(), ipvs.HealthCheck{
+			Type:     ipvs.HTTPCheck,
+			Path:     "/",
+			Interval: ipvs.Duration(5 * time.Millisecond),
+			Timeout:  ipvs.Duration(time.Second),
+		})
+		dst.Name = fmt.Sprintf("dst%d", i)
+		m.Watch(dst)
+	}
+	for i := 0; i < 30; i++ {
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			c.Fatal("no probe served")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(maxFlight <= 2, check.Equals, true, check.Commentf("%d probes ran at once", maxFlight))
+}
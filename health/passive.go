@@ -0,0 +1,45 @@
+package health
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// passiveSampler judges a destination from the IPVS counters of the traffic
+// it already gets, instead of probing it.
+type passiveSampler struct {
+	pc           ipvs.PassiveCheck
+	stats        StatsFunc
+	lastInactive uint32
+	sampled      bool
+}
+
+// sample fails when the inactive connections of dst grew by more than
+// MaxInactiveIncrease since the last sample, or when dst has no active
+// connection while its service has at least LoadThreshold. A withdrawn
+// destination gets no traffic to judge it by, so its samples pass and it is
+// readmitted after HealthyThreshold of them.
+func (p *passiveSampler) sample(ctx context.Context, dst ipvs.Destination, withdrawn bool) error {
+	d, svc, err := p.stats(dst)
+	if err != nil {
+		return err
+	}
+
+	increase := int64(d.InactiveConns) - int64(p.lastInactive)
+	first := !p.sampled
+	p.lastInactive = d.InactiveConns
+	p.sampled = true
+
+	if withdrawn {
+		return nil
+	}
+	if p.pc.MaxInactiveIncrease > 0 && !first && increase > int64(p.pc.MaxInactiveIncrease) {
+		return fmt.Errorf("inactive connections grew by %d, more than %d", increase, p.pc.MaxInactiveIncrease)
+	}
+	if p.pc.LoadThreshold > 0 && svc.ActiveConns >= p.pc.LoadThreshold && d.ActiveConns == 0 {
+		return fmt.Errorf("no active connections while the service has %d", svc.ActiveConns)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package health
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// ICMP echo message types
+const (
+	icmpEchoReply     = 0
+	icmpEchoRequest   = 8
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// probePing succeeds when dst answers an ICMP echo request. Raw sockets need
+// CAP_NET_RAW: without it the echo is sent through an unprivileged datagram
+// socket, which the net.ipv4.ping_group_range sysctl must allow.
+func probePing(ctx context.Context, dst ipvs.Destination) error {
+	ip := dst.IP()
+	if ip == nil {
+		return fmt.Errorf("%q is not an IP address", dst.Host)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	conn, raw, err := listenICMP(ip)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Closing the socket unblocks the read when ctx is canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	id, seq := uint16(rand.Intn(0xffff)), uint16(rand.Intn(0xffff))
+	request, reply := icmpEchoRequest, icmpEchoReply
+	if ip.To4() == nil {
+		request, reply = icmpv6EchoRequest, icmpv6EchoReply
+	}
+	var addr net.Addr = &net.UDPAddr{IP: ip}
+	if raw {
+		addr = &net.IPAddr{IP: ip}
+	}
+	if _, err := conn.WriteTo(echoMessage(request, id, seq), addr); err != nil {
+		return checkContext(ctx, err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return checkContext(ctx, err)
+		}
+		if !sameIP(from, ip) {
+			continue
+		}
+		// The kernel picks the id of unprivileged echoes
+		if msg := buf[:n]; len(msg) >= 8 && int(msg[0]) == reply &&
+			(!raw || binary.BigEndian.Uint16(msg[4:]) == id) && binary.BigEndian.Uint16(msg[6:]) == seq {
+			return nil
+		}
+	}
+}
+
+// listenICMP opens a raw ICMP socket for the family of ip, or an
+// unprivileged datagram one when raw sockets aren't allowed, telling which.
+func listenICMP(ip net.IP) (net.PacketConn, bool, error) {
+	network, address, family, proto := "ip4:icmp", "0.0.0.0", syscall.AF_INET, syscall.IPPROTO_ICMP
+	if ip.To4() == nil {
+		network, address, family, proto = "ip6:ipv6-icmp", "::", syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+
+	conn, err := net.ListenPacket(network, address)
+	if err == nil {
+		return conn, true, nil
+	}
+	if !errors.Is(err, syscall.EPERM) && !errors.Is(err, syscall.EACCES) {
+		return nil, false, err
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, false, fmt.Errorf("ICMP sockets not allowed: %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	conn, err = net.FilePacketConn(f)
+	return conn, false, err
+}
+
+// echoMessage builds an ICMP echo request. The checksum of ICMPv6 messages
+// is computed by the kernel.
+func echoMessage(typ int, id, seq uint16) []byte {
+	msg := make([]byte, 16)
+	msg[0] = byte(typ)
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	binary.BigEndian.PutUint64(msg[8:], uint64(time.Now().UnixNano()))
+	if typ == icmpEchoRequest {
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	}
+	return msg
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func sameIP(addr net.Addr, ip net.IP) bool {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP.Equal(ip)
+	case *net.UDPAddr:
+		return a.IP.Equal(ip)
+	}
+	return false
+}
+
+// checkContext reports the context error, clearer than the one of the
+// socket it interrupted.
+func checkContext(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// probe runs a single check of dst, returning why it failed.
+type probe func(ctx context.Context, dst ipvs.Destination) error
+
+func probeFor(hc ipvs.HealthCheck) probe {
+	switch hc.Type {
+	case ipvs.HTTPCheck:
+		return httpProbe(hc)
+	case ipvs.PingCheck:
+		return probePing
+	case ipvs.GRPCCheck:
+		return grpcProbe(hc)
+	}
+	if hc.Send != "" || hc.Expect != "" {
+		return tcpExchangeProbe(hc)
+	}
+	return probeTCP
+}
+
+// probeTCP succeeds when a connection to dst can be opened.
+func probeTCP(ctx context.Context, dst ipvs.Destination) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", dst.Address())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// maxAnswer bounds how much of the answer of a destination is searched for
+// the Expect of a TCP check.
+const maxAnswer = 64 << 10
+
+// tcpExchangeProbe returns a probe writing hc.Send to dst once connected,
+// succeeding when the answer contains hc.Expect before ctx is done.
+func tcpExchangeProbe(hc ipvs.HealthCheck) probe {
+	return func(ctx context.Context, dst ipvs.Destination) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", dst.Address())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+
+		if hc.Send != "" {
+			if _, err := io.WriteString(conn, hc.Send); err != nil {
+				return err
+			}
+		}
+		if hc.Expect == "" {
+			return nil
+		}
+
+		answer := make([]byte, 0, 512)
+		buf := make([]byte, 512)
+		for len(answer) < maxAnswer {
+			n, err := conn.Read(buf)
+			answer = append(answer, buf[:n]...)
+			if bytes.Contains(answer, []byte(hc.Expect)) {
+				return nil
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return statusError(fmt.Sprintf("answer doesn't contain %q", hc.Expect))
+	}
+}
+
+// httpProbe returns a probe succeeding when dst answers a request to hc.Path
+// with hc.ExpectedStatus, or any 2xx status if it isn't set.
+func httpProbe(hc ipvs.HealthCheck) probe {
+	scheme := "http"
+	if hc.TLS {
+		scheme = "https"
+	}
+	client := newHTTPClient(hc)
+
+	return func(ctx context.Context, dst ipvs.Destination) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", scheme+"://"+dst.Address()+hc.Path, nil)
+		if err != nil {
+			return err
+		}
+		for name, value := range hc.Headers {
+			if http.CanonicalHeaderKey(name) == "Host" {
+				req.Host = value
+			} else {
+				req.Header.Set(name, value)
+			}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return checkStatus(resp.StatusCode, hc.ExpectedStatus)
+	}
+}
+
+// statusError is a check failing because of what the destination answered
+// rather than because it couldn't be reached.
+type statusError string
+
+func (e statusError) Error() string { return string(e) }
+
+func checkStatus(status, expected int) error {
+	if expected != 0 {
+		if status != expected {
+			return statusError(fmt.Sprintf("unexpected status %d, expected %d", status, expected))
+		}
+		return nil
+	}
+	if status < 200 || status > 299 {
+		return statusError(fmt.Sprintf("unexpected status %d, expected 2xx", status))
+	}
+	return nil
+}
+
+// newHTTPClient doesn't keep connections open between checks, so every check
+// exercises connecting to the destination.
+func newHTTPClient(hc ipvs.HealthCheck) *http.Client {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: hc.InsecureSkipVerify},
+		},
+	}
+	if !hc.FollowRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
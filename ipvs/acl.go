@@ -0,0 +1,188 @@
+package ipvs
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// aclChain is the filter table chain, jumped to from INPUT, holding the
+// access control rules of the services. INPUT is traversed before IPVS
+// takes the packets, so dropped clients never reach a destination.
+const aclChain = "FUSIS-ACL"
+
+// AccessControl restricts the client networks that can reach a service.
+// Clients in Deny are always dropped. When Allow isn't empty, only the
+// clients in it are let through.
+type AccessControl struct {
+	Allow []string `json:",omitempty"`
+	Deny  []string `json:",omitempty"`
+}
+
+// Clone returns a copy of ac sharing nothing with it.
+func (ac AccessControl) Clone() *AccessControl {
+	ac.Allow = append([]string(nil), ac.Allow...)
+	ac.Deny = append([]string(nil), ac.Deny...)
+	return &ac
+}
+
+// Validate checks that every network of ac is a CIDR of the given family,
+// or of a single family when it is unknown.
+func (ac AccessControl) Validate(family AddressFamily) error {
+	for _, list := range []struct {
+		field string
+		cidrs []string
+	}{{"AccessControl.Deny", ac.Deny}, {"AccessControl.Allow", ac.Allow}} {
+		for _, cidr := range list.cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return &ValidationError{list.field, fmt.Sprintf("%q is not a CIDR", cidr)}
+			}
+			if family == UnknownFamily {
+				family = familyOf(network.IP)
+			}
+			if familyOf(network.IP) != family {
+				return &ValidationError{list.field, fmt.Sprintf("%q is not an %s network", cidr, family)}
+			}
+		}
+	}
+	return nil
+}
+
+// family returns the family of the networks of ac, which Validate checked
+// are all the same.
+func (ac AccessControl) family() AddressFamily {
+	for _, cidrs := range [][]string{ac.Deny, ac.Allow} {
+		for _, cidr := range cidrs {
+			if _, network, err := net.ParseCIDR(cidr); err == nil {
+				return familyOf(network.IP)
+			}
+		}
+	}
+	return UnknownFamily
+}
+
+// AddACL programs the access control rules of svc, if it has any.
+func (ipvs *Ipvs) AddACL(svc Service) error {
+	if svc.AccessControl == nil {
+		return nil
+	}
+
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	cmd := svc.aclCommand()
+	if err := ensureACLChain(cmd); err != nil {
+		return err
+	}
+	for _, rule := range svc.aclRules() {
+		if iptables(cmd, append([]string{"-C", aclChain}, rule...)...) == nil {
+			continue
+		}
+		if err := iptables(cmd, append([]string{"-A", aclChain}, rule...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DelACL removes the access control rules of svc, as it was programmed.
+func (ipvs *Ipvs) DelACL(svc Service) error {
+	if svc.AccessControl == nil {
+		return nil
+	}
+
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	cmd := svc.aclCommand()
+	for _, rule := range svc.aclRules() {
+		if iptables(cmd, append([]string{"-C", aclChain}, rule...)...) != nil {
+			continue
+		}
+		if err := iptables(cmd, append([]string{"-D", aclChain}, rule...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushACL removes the access control rules of every service.
+func (ipvs *Ipvs) FlushACL() error {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		if iptables(cmd, "-n", "-L", aclChain) != nil {
+			// The chain was never created
+			continue
+		}
+		if err := iptables(cmd, "-F", aclChain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ensureACLChain(cmd string) error {
+	if iptables(cmd, "-n", "-L", aclChain) != nil {
+		if err := iptables(cmd, "-N", aclChain); err != nil {
+			return err
+		}
+	}
+	if iptables(cmd, "-C", "INPUT", "-j", aclChain) != nil {
+		return iptables(cmd, "-I", "INPUT", "-j", aclChain)
+	}
+	return nil
+}
+
+// aclRules returns the iptables rules enforcing the access control of svc,
+// in order: the denied networks are dropped, the allowed ones let through
+// and, when there are allowed networks, everybody else dropped.
+func (svc Service) aclRules() [][]string {
+	rule := func(source, target string) []string {
+		r := svc.filterMatch()
+		if source != "" {
+			r = append(r, "-s", source)
+		}
+		return append(append(r, svc.filterComment()...), "-j", target)
+	}
+
+	ac := svc.AccessControl
+	rules := [][]string{}
+	for _, cidr := range ac.Deny {
+		rules = append(rules, rule(cidr, "DROP"))
+	}
+	for _, cidr := range ac.Allow {
+		rules = append(rules, rule(cidr, "RETURN"))
+	}
+	if len(ac.Allow) > 0 {
+		rules = append(rules, rule("", "DROP"))
+	}
+	return rules
+}
+
+// filterMatch returns the iptables match of the packets sent to svc.
+func (svc Service) filterMatch() []string {
+	if svc.IsFwmark() {
+		return []string{"-m", "mark", "--mark", strconv.FormatUint(uint64(svc.Fwmark), 10)}
+	}
+	return []string{
+		"-d", fmt.Sprintf("%s/%d", svc.IP(), svc.AddressFamily().PrefixLen()),
+		"-p", svc.Protocol, "--dport", strconv.Itoa(int(svc.Port)),
+	}
+}
+
+// filterComment tags the filter rules of svc, as the SNAT rules are.
+func (svc Service) filterComment() []string {
+	return []string{"-m", "comment", "--comment", "fusis:" + svc.GetId()}
+}
+
+// aclCommand is iptablesCommand, except that fwmark services have no
+// address and take the family of their networks.
+func (svc Service) aclCommand() string {
+	if svc.IsFwmark() && svc.AccessControl.family() == IPv6 {
+		return "ip6tables"
+	}
+	return svc.iptablesCommand()
+}
@@ -0,0 +1,67 @@
+package ipvs
+
+import "fmt"
+
+// DefaultSmoothing is the Smoothing used when an AdaptiveWeight leaves it 0.
+const DefaultSmoothing = 0.3
+
+// AdaptiveWeight weights the destinations of a service by the exponentially
+// weighted moving average of their health check latency: the fastest one
+// gets MaxWeight and the others proportionally less, down to MinWeight.
+// Destinations without an active health check keep their own weight.
+type AdaptiveWeight struct {
+	MinWeight int32
+	MaxWeight int32
+	// Smoothing, in (0, 1], is how much the newest latency counts in the
+	// average. It defaults to DefaultSmoothing.
+	Smoothing float64
+}
+
+// Validate checks that aw bounds weights sensibly.
+func (aw AdaptiveWeight) Validate() error {
+	if aw.MinWeight < 0 {
+		return &ValidationError{"AdaptiveWeight.MinWeight", "must not be negative"}
+	}
+	if aw.MaxWeight <= 0 || aw.MaxWeight < aw.MinWeight {
+		return &ValidationError{"AdaptiveWeight.MaxWeight", fmt.Sprintf("must be positive and at least MinWeight %d", aw.MinWeight)}
+	}
+	if aw.Smoothing < 0 || aw.Smoothing > 1 {
+		return &ValidationError{"AdaptiveWeight.Smoothing", "must be between 0 and 1"}
+	}
+	return nil
+}
+
+// Weights computes the weight of each destination from its average latency.
+func (aw AdaptiveWeight) Weights(latencies map[string]float64) map[string]int32 {
+	fastest := 0.0
+	for _, l := range latencies {
+		if fastest == 0 || l < fastest {
+			fastest = l
+		}
+	}
+
+	weights := make(map[string]int32, len(latencies))
+	for id, l := range latencies {
+		w := aw.MaxWeight
+		if l > 0 {
+			w = int32(float64(aw.MaxWeight) * fastest / l)
+		}
+		if w < aw.MinWeight {
+			w = aw.MinWeight
+		}
+		weights[id] = w
+	}
+	return weights
+}
+
+// Average folds sample into the moving average avg.
+func (aw AdaptiveWeight) Average(avg, sample float64) float64 {
+	if avg == 0 {
+		return sample
+	}
+	smoothing := aw.Smoothing
+	if smoothing == 0 {
+		smoothing = DefaultSmoothing
+	}
+	return smoothing*sample + (1-smoothing)*avg
+}
@@ -0,0 +1,177 @@
+package ipvs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// limitChain is the filter table chain, jumped to from the end of INPUT,
+// holding the connection rate limits of the services. Clients dropped by
+// the access control rules aren't counted against the rates.
+const limitChain = "FUSIS-LIMIT"
+
+// MaxConnLimit is the highest Rate and Burst of a ConnLimit, the most the
+// iptables limit match accepts.
+const MaxConnLimit = 10000
+
+// ConnLimit bounds the rate of new connections to a service. Connections
+// above the rate are dropped once the burst is used up.
+type ConnLimit struct {
+	// Rate is the number of new connections accepted per second.
+	Rate int
+	// Burst is how many new connections can be accepted at once before
+	// Rate applies. It defaults to Rate.
+	Burst int `json:",omitempty"`
+}
+
+// Validate checks that cl can be enforced.
+func (cl ConnLimit) Validate() error {
+	if cl.Rate <= 0 || cl.Rate > MaxConnLimit {
+		return &ValidationError{"ConnLimit.Rate", fmt.Sprintf("must be between 1 and %d", MaxConnLimit)}
+	}
+	if cl.Burst < 0 || cl.Burst > MaxConnLimit {
+		return &ValidationError{"ConnLimit.Burst", fmt.Sprintf("must be between 0 and %d", MaxConnLimit)}
+	}
+	if cl.Burst != 0 && cl.Burst < cl.Rate {
+		return &ValidationError{"ConnLimit.Burst", fmt.Sprintf("%d is smaller than the rate of %d", cl.Burst, cl.Rate)}
+	}
+	return nil
+}
+
+func (cl ConnLimit) burst() int {
+	if cl.Burst == 0 {
+		return cl.Rate
+	}
+	return cl.Burst
+}
+
+// AddConnLimit programs the connection rate limit of svc, if it has one.
+func (ipvs *Ipvs) AddConnLimit(svc Service) error {
+	if svc.ConnLimit == nil {
+		return nil
+	}
+
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	cmd := svc.iptablesCommand()
+	if err := ensureLimitChain(cmd); err != nil {
+		return err
+	}
+	for _, rule := range svc.limitRules() {
+		if iptables(cmd, append([]string{"-C", limitChain}, rule...)...) == nil {
+			continue
+		}
+		if err := iptables(cmd, append([]string{"-A", limitChain}, rule...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DelConnLimit removes the connection rate limit of svc, as it was
+// programmed.
+func (ipvs *Ipvs) DelConnLimit(svc Service) error {
+	if svc.ConnLimit == nil {
+		return nil
+	}
+
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	cmd := svc.iptablesCommand()
+	for _, rule := range svc.limitRules() {
+		if iptables(cmd, append([]string{"-C", limitChain}, rule...)...) != nil {
+			continue
+		}
+		if err := iptables(cmd, append([]string{"-D", limitChain}, rule...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushConnLimit removes the connection rate limits of every service.
+func (ipvs *Ipvs) FlushConnLimit() error {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		if iptables(cmd, "-n", "-L", limitChain) != nil {
+			// The chain was never created
+			continue
+		}
+		if err := iptables(cmd, "-F", limitChain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnLimitDrops returns how many new connections to svc were dropped for
+// going over its rate limit.
+func (ipvs *Ipvs) ConnLimitDrops(svc Service) (uint64, error) {
+	if svc.ConnLimit == nil {
+		return 0, nil
+	}
+
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	out, err := iptablesOutput(svc.iptablesCommand(), "-n", "-v", "-x", "-L", limitChain)
+	if err != nil {
+		return 0, err
+	}
+	return parseLimitDrops(out, svc.GetId()), nil
+}
+
+// parseLimitDrops sums the packet counters of the DROP rules of the service
+// id in a verbose listing of limitChain, whose lines look like:
+//
+//	pkts bytes target prot opt in out source destination
+//	  12   720 DROP   6    --  *  *   0.0.0.0/0 10.0.1.1 tcp dpt:80 ctstate NEW /* fusis:svc1 */
+func parseLimitDrops(out []byte, id string) uint64 {
+	comment := "/* fusis:" + id + " */"
+	var drops uint64
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[2] != "DROP" || !strings.HasSuffix(scanner.Text(), comment) {
+			continue
+		}
+		if pkts, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+			drops += pkts
+		}
+	}
+	return drops
+}
+
+func ensureLimitChain(cmd string) error {
+	if iptables(cmd, "-n", "-L", limitChain) != nil {
+		if err := iptables(cmd, "-N", limitChain); err != nil {
+			return err
+		}
+	}
+	if iptables(cmd, "-C", "INPUT", "-j", limitChain) != nil {
+		return iptables(cmd, "-A", "INPUT", "-j", limitChain)
+	}
+	return nil
+}
+
+// limitRules returns the iptables rules limiting the new connections to svc:
+// the ones within the rate go on, the others are dropped.
+func (svc Service) limitRules() [][]string {
+	cl := svc.ConnLimit
+	rule := func(limit []string, target string) []string {
+		r := append(svc.filterMatch(), "-m", "conntrack", "--ctstate", "NEW")
+		r = append(r, limit...)
+		return append(append(r, svc.filterComment()...), "-j", target)
+	}
+	return [][]string{
+		rule([]string{"-m", "limit", "--limit", fmt.Sprintf("%d/second", cl.Rate), "--limit-burst", strconv.Itoa(cl.burst())}, "RETURN"),
+		rule(nil, "DROP"),
+	}
+}
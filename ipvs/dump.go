@@ -0,0 +1,137 @@
+package ipvs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	gipvs "github.com/google/seesaw/ipvs"
+)
+
+// versionFile starts with the IPVS version line printed by ipvsadm.
+const versionFile = "/proc/net/ip_vs"
+
+// Dump renders the IPVS table like `ipvsadm -L -n` does.
+func (ipvs *Ipvs) Dump() (string, error) {
+	svcs, err := ipvs.GetServices()
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if version, err := readVersion(); err == nil {
+		fmt.Fprintln(&buf, version)
+	}
+	WriteTable(&buf, svcs)
+	return buf.String(), nil
+}
+
+// readVersion reads the IPVS version line, with the size of the connection
+// table.
+func readVersion() (string, error) {
+	f, err := os.Open(versionFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// WriteTable writes svcs in the columns of `ipvsadm -L -n`, sorted the same
+// way: services by firewall mark, protocol, address and port, their
+// destinations by address and port.
+func WriteTable(w io.Writer, svcs []*gipvs.Service) {
+	fmt.Fprintln(w, "Prot LocalAddress:Port Scheduler Flags")
+	fmt.Fprintln(w, "  -> RemoteAddress:Port           Forward Weight ActiveConn InActConn")
+
+	svcs = append([]*gipvs.Service{}, svcs...)
+	sort.Slice(svcs, func(i, j int) bool {
+		a, b := svcs[i], svcs[j]
+		if a.FirewallMark != b.FirewallMark {
+			return a.FirewallMark < b.FirewallMark
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		if c := bytes.Compare(a.Address.To16(), b.Address.To16()); c != 0 {
+			return c < 0
+		}
+		return a.Port < b.Port
+	})
+
+	for _, s := range svcs {
+		if s.FirewallMark != 0 {
+			fmt.Fprintf(w, "FWM  %d %s", s.FirewallMark, s.Scheduler)
+		} else {
+			fmt.Fprintf(w, "%s  %s %s", protocolName(s.Protocol), hostPort(s.Address, s.Port), s.Scheduler)
+		}
+		if names := schedulerFlagNames(Scheduler(s.Scheduler), s.Flags); len(names) > 0 {
+			fmt.Fprintf(w, " (%s)", strings.Join(names, ","))
+		}
+		if s.Flags&gipvs.SFPersistent != 0 {
+			fmt.Fprintf(w, " persistent %d", s.Timeout)
+		}
+		if s.Flags&gipvs.SFOnePacket != 0 {
+			fmt.Fprint(w, " ops")
+		}
+		fmt.Fprintln(w)
+
+		dsts := append([]*gipvs.Destination{}, s.Destinations...)
+		sort.Slice(dsts, func(i, j int) bool {
+			if c := bytes.Compare(dsts[i].Address.To16(), dsts[j].Address.To16()); c != 0 {
+				return c < 0
+			}
+			return dsts[i].Port < dsts[j].Port
+		})
+		for _, d := range dsts {
+			var active, inactive uint32
+			if d.Statistics != nil {
+				active, inactive = d.Statistics.ActiveConns, d.Statistics.InactiveConns
+			}
+			fmt.Fprintf(w, "  -> %-28s %-7s %-6d %-10d %-10d\n",
+				hostPort(d.Address, d.Port), forwardName(d.Flags), d.Weight, active, inactive)
+		}
+	}
+}
+
+func hostPort(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+func protocolName(proto gipvs.IPProto) string {
+	switch proto {
+	case syscall.IPPROTO_TCP:
+		return "TCP"
+	case syscall.IPPROTO_UDP:
+		return "UDP"
+	case syscall.IPPROTO_SCTP:
+		return "SCTP"
+	}
+	return "IP"
+}
+
+func forwardName(flags gipvs.DestinationFlags) string {
+	switch flags & gipvs.DFForwardMask {
+	case gipvs.DFForwardMasq:
+		return "Masq"
+	case gipvs.DFForwardLocal:
+		return "Local"
+	case gipvs.DFForwardTunnel:
+		return "Tunnel"
+	case gipvs.DFForwardRoute:
+		return "Route"
+	}
+	return "Unknown"
+}
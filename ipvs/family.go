@@ -0,0 +1,86 @@
+package ipvs
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// AddressFamily is the IP version of a service or destination address.
+type AddressFamily int
+
+const (
+	UnknownFamily AddressFamily = iota
+	IPv4
+	IPv6
+)
+
+func (f AddressFamily) String() string {
+	switch f {
+	case IPv4:
+		return "IPv4"
+	case IPv6:
+		return "IPv6"
+	}
+	return "unknown"
+}
+
+// PrefixLen returns the prefix length of a single host address of the family.
+func (f AddressFamily) PrefixLen() int {
+	if f == IPv6 {
+		return 128
+	}
+	return 32
+}
+
+// parseIP parses host, which may be an IPv6 literal surrounded by brackets.
+func parseIP(host string) net.IP {
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+}
+
+func familyOf(ip net.IP) AddressFamily {
+	switch {
+	case ip == nil:
+		return UnknownFamily
+	case ip.To4() != nil:
+		return IPv4
+	}
+	return IPv6
+}
+
+// IP returns the parsed service address, or nil when Host isn't an IP.
+func (svc Service) IP() net.IP {
+	return parseIP(svc.Host)
+}
+
+// AddressFamily returns the IP version of the service address.
+func (svc Service) AddressFamily() AddressFamily {
+	return familyOf(svc.IP())
+}
+
+// Address returns the service host and port, with IPv6 hosts bracketed.
+func (svc Service) Address() string {
+	return joinHostPort(svc.IP(), svc.Host, svc.Port)
+}
+
+// IP returns the parsed destination address, or nil when Host isn't an IP.
+func (dst Destination) IP() net.IP {
+	return parseIP(dst.Host)
+}
+
+// AddressFamily returns the IP version of the destination address.
+func (dst Destination) AddressFamily() AddressFamily {
+	return familyOf(dst.IP())
+}
+
+// Address returns the destination host and port, with IPv6 hosts bracketed.
+func (dst Destination) Address() string {
+	return joinHostPort(dst.IP(), dst.Host, dst.Port)
+}
+
+func joinHostPort(ip net.IP, host string, port uint16) string {
+	if ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
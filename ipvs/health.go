@@ -0,0 +1,291 @@
+package ipvs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Health check types.
+const (
+	TCPCheck  = "tcp"
+	HTTPCheck = "http"
+	PingCheck = "ping"
+	GRPCCheck = "grpc"
+)
+
+// maxExpect bounds the Expect of a HealthCheck, and so how much of the answer
+// of the destination is read.
+const maxExpect = 4096
+
+// Defaults used for the zero values of a HealthCheck.
+const (
+	DefaultHealthyThreshold   = 2
+	DefaultUnhealthyThreshold = 3
+)
+
+// Defaults used for the zero values of a CircuitBreaker. The window defaults
+// to DefaultBreakerWindowChecks intervals of the check.
+const (
+	DefaultBreakerFailureThreshold = 5
+	DefaultBreakerWindowChecks     = 10
+	DefaultBreakerOpenDuration     = 30 * time.Second
+	DefaultBreakerHalfOpenProbes   = 1
+)
+
+// HealthCheck describes how a destination is actively checked. A destination
+// failing UnhealthyThreshold checks in a row is withdrawn until it passes
+// HealthyThreshold checks in a row: it's removed from IPVS, or only given
+// weight 0 with InhibitOnFailure.
+type HealthCheck struct {
+	// Type is either "tcp", which only connects, "http", "ping", which
+	// sends an ICMP echo request to the destination host, or "grpc", which
+	// calls the standard grpc.health.v1.Health/Check method.
+	Type     string
+	Interval Duration
+	// Timeout bounds a single check. It defaults to Interval.
+	Timeout            Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+
+	// Send is written by "tcp" checks once connected, and Expect must then
+	// be found in what the destination answers, like "PING\r\n" and "+PONG"
+	// for Redis. The whole exchange must complete within Timeout.
+	Send   string `json:",omitempty"`
+	Expect string `json:",omitempty"`
+
+	// Path is the HTTP path requested by "http" checks.
+	Path string
+	// ExpectedStatus is the HTTP status of a successful "http" check. When
+	// 0, any 2xx status is a success.
+	ExpectedStatus int
+	// Headers are sent with "http" checks. A "Host" header replaces the
+	// destination address as the requested host.
+	Headers map[string]string `json:",omitempty"`
+	// TLS makes "http" checks use HTTPS, and "grpc" checks use TLS.
+	// InsecureSkipVerify accepts any certificate, like self-signed ones.
+	TLS                bool
+	InsecureSkipVerify bool
+	// FollowRedirects makes "http" checks follow redirects instead of
+	// judging the redirect status itself.
+	FollowRedirects bool
+
+	// GRPCService is the service name sent with "grpc" checks. When empty,
+	// the check is about the server as a whole.
+	GRPCService string `json:",omitempty"`
+
+	// PassiveCheck, when set, also judges the destination from its IPVS
+	// counters. Type may be left empty to only check passively.
+	PassiveCheck *PassiveCheck `json:",omitempty"`
+
+	// CircuitBreaker, when set, also withdraws the destination when its
+	// active checks fail too often, even if not in a row.
+	CircuitBreaker *CircuitBreaker `json:",omitempty"`
+
+	// InhibitOnFailure keeps a failing destination in IPVS with weight 0
+	// instead of removing it, so its counters and the connections it has
+	// survive until it recovers. Passive checks and circuit breakers
+	// always inhibit: the first need the counters to see the recovery, and
+	// a breaker quiesces the destination while it is open.
+	InhibitOnFailure bool
+}
+
+// Inhibits tells if the destinations failing hc are kept in IPVS with weight
+// 0 rather than removed.
+func (hc HealthCheck) Inhibits() bool {
+	return hc.InhibitOnFailure || hc.PassiveCheck != nil || hc.CircuitBreaker != nil
+}
+
+// CircuitBreaker trips when FailureThreshold active checks failed within
+// Window, quiescing the destination. It stays open for OpenDuration, then
+// half-opens: the destination is closed again, and given its weight back,
+// after HalfOpenProbes successful checks in a row, while a failure opens it
+// again. The HealthCheck thresholds still apply on their own.
+type CircuitBreaker struct {
+	FailureThreshold int
+	// Window defaults to 10 intervals of the check.
+	Window         Duration
+	OpenDuration   Duration
+	HalfOpenProbes int
+}
+
+func (cb CircuitBreaker) validate(hc HealthCheck) error {
+	if cb.FailureThreshold < 0 {
+		return &ValidationError{"HealthCheck.CircuitBreaker.FailureThreshold", "must not be negative"}
+	}
+	if cb.Window < 0 || (cb.Window > 0 && cb.Window < hc.Interval) {
+		return &ValidationError{"HealthCheck.CircuitBreaker.Window", "must be at least the check Interval"}
+	}
+	if cb.OpenDuration < 0 {
+		return &ValidationError{"HealthCheck.CircuitBreaker.OpenDuration", "must not be negative"}
+	}
+	if cb.HalfOpenProbes < 0 {
+		return &ValidationError{"HealthCheck.CircuitBreaker.HalfOpenProbes", "must not be negative"}
+	}
+	return nil
+}
+
+// PassiveCheck judges a destination from the IPVS counters of its traffic.
+// A sample fails when any of the set thresholds is crossed, and the
+// HealthyThreshold and UnhealthyThreshold of the HealthCheck apply to
+// samples as they do to active checks.
+type PassiveCheck struct {
+	// Interval between samples. It defaults to the HealthCheck Interval.
+	Interval Duration
+	// MaxInactiveIncrease fails a sample when the inactive connections of
+	// the destination grew by more than it since the previous sample.
+	MaxInactiveIncrease uint32
+	// LoadThreshold fails a sample when the destination has no active
+	// connection while its service has at least LoadThreshold.
+	LoadThreshold uint32
+}
+
+// Clone returns a copy of hc sharing nothing with it.
+func (hc HealthCheck) Clone() *HealthCheck {
+	if hc.PassiveCheck != nil {
+		pc := *hc.PassiveCheck
+		hc.PassiveCheck = &pc
+	}
+	if hc.CircuitBreaker != nil {
+		cb := *hc.CircuitBreaker
+		hc.CircuitBreaker = &cb
+	}
+	if hc.Headers != nil {
+		headers := make(map[string]string, len(hc.Headers))
+		for name, value := range hc.Headers {
+			headers[name] = value
+		}
+		hc.Headers = headers
+	}
+	return &hc
+}
+
+// WithDefaults returns hc with its zero values replaced by the defaults.
+func (hc HealthCheck) WithDefaults() HealthCheck {
+	if hc.Timeout == 0 {
+		hc.Timeout = hc.Interval
+	}
+	if hc.PassiveCheck != nil && hc.PassiveCheck.Interval == 0 {
+		pc := *hc.PassiveCheck
+		pc.Interval = hc.Interval
+		hc.PassiveCheck = &pc
+	}
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = DefaultHealthyThreshold
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	if hc.CircuitBreaker != nil {
+		cb := *hc.CircuitBreaker
+		if cb.FailureThreshold == 0 {
+			cb.FailureThreshold = DefaultBreakerFailureThreshold
+		}
+		if cb.Window == 0 {
+			cb.Window = DefaultBreakerWindowChecks * hc.Interval
+		}
+		if cb.OpenDuration == 0 {
+			cb.OpenDuration = Duration(DefaultBreakerOpenDuration)
+		}
+		if cb.HalfOpenProbes == 0 {
+			cb.HalfOpenProbes = DefaultBreakerHalfOpenProbes
+		}
+		hc.CircuitBreaker = &cb
+	}
+	return hc
+}
+
+// Validate checks that hc describes a check that can run.
+func (hc HealthCheck) Validate() error {
+	if hc.CircuitBreaker != nil && hc.Type == "" {
+		return &ValidationError{"HealthCheck.CircuitBreaker", "requires an active check Type"}
+	}
+	if hc.PassiveCheck != nil {
+		if err := hc.PassiveCheck.validate(hc); err != nil {
+			return err
+		}
+		if hc.Type == "" {
+			return nil
+		}
+	}
+	if hc.Type != TCPCheck && hc.Type != HTTPCheck && hc.Type != PingCheck && hc.Type != GRPCCheck {
+		return &ValidationError{"HealthCheck.Type", fmt.Sprintf("%q is not one of [%s %s %s %s]", hc.Type, TCPCheck, HTTPCheck, PingCheck, GRPCCheck)}
+	}
+	if hc.Interval <= 0 {
+		return &ValidationError{"HealthCheck.Interval", "must be positive"}
+	}
+	if hc.Timeout < 0 {
+		return &ValidationError{"HealthCheck.Timeout", "must not be negative"}
+	}
+	if hc.HealthyThreshold < 0 {
+		return &ValidationError{"HealthCheck.HealthyThreshold", "must not be negative"}
+	}
+	if hc.UnhealthyThreshold < 0 {
+		return &ValidationError{"HealthCheck.UnhealthyThreshold", "must not be negative"}
+	}
+	if hc.Send != "" && hc.Type != TCPCheck {
+		return &ValidationError{"HealthCheck.Send", fmt.Sprintf("only applies to %s checks", TCPCheck)}
+	}
+	if hc.Expect != "" && hc.Type != TCPCheck {
+		return &ValidationError{"HealthCheck.Expect", fmt.Sprintf("only applies to %s checks", TCPCheck)}
+	}
+	if len(hc.Expect) > maxExpect {
+		return &ValidationError{"HealthCheck.Expect", fmt.Sprintf("must not be longer than %d bytes", maxExpect)}
+	}
+	if hc.CircuitBreaker != nil {
+		if err := hc.CircuitBreaker.validate(hc); err != nil {
+			return err
+		}
+	}
+	if hc.Type != HTTPCheck {
+		return nil
+	}
+	if u, err := url.ParseRequestURI(hc.Path); err != nil || !strings.HasPrefix(hc.Path, "/") || u.Host != "" {
+		return &ValidationError{"HealthCheck.Path", fmt.Sprintf("%q is not an absolute HTTP path", hc.Path)}
+	}
+	if hc.ExpectedStatus != 0 && (hc.ExpectedStatus < 100 || hc.ExpectedStatus > 599) {
+		return &ValidationError{"HealthCheck.ExpectedStatus", fmt.Sprintf("%d is not an HTTP status", hc.ExpectedStatus)}
+	}
+	return nil
+}
+
+func (pc PassiveCheck) validate(hc HealthCheck) error {
+	if pc.Interval < 0 || (pc.Interval == 0 && hc.Interval <= 0) {
+		return &ValidationError{"HealthCheck.PassiveCheck.Interval", "must be positive"}
+	}
+	if pc.MaxInactiveIncrease == 0 && pc.LoadThreshold == 0 {
+		return &ValidationError{"HealthCheck.PassiveCheck", "needs MaxInactiveIncrease or LoadThreshold"}
+	}
+	if hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+		return &ValidationError{"HealthCheck", "thresholds must not be negative"}
+	}
+	return nil
+}
+
+// Duration is a time.Duration encoded in JSON as a string like "1.5s". Plain
+// numbers are decoded as nanoseconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var ns int64
+		if err := json.Unmarshal(b, &ns); err != nil {
+			return fmt.Errorf("invalid duration %s", b)
+		}
+		*d = Duration(ns)
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
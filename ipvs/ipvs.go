@@ -48,7 +48,14 @@ func (ipvs *Ipvs) GetService(svc *ip_vs.Service) (*ip_vs.Service, error) {
 func (ipvs *Ipvs) AddService(svc *ip_vs.Service) error {
 	ipvs.Lock()
 	defer ipvs.Unlock()
-	return ip_vs.AddService(*svc)
+	return schedulerError(svc, ip_vs.AddService(*svc))
+}
+
+// UpdateService updates given service in the IPVS table.
+func (ipvs *Ipvs) UpdateService(svc *ip_vs.Service) error {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+	return schedulerError(svc, ip_vs.UpdateService(*svc))
 }
 
 // DeleteService deletes given service from IPVS table.
@@ -65,6 +72,13 @@ func (ipvs *Ipvs) AddDestination(svc ip_vs.Service, dst ip_vs.Destination) error
 	return ip_vs.AddDestination(svc, dst)
 }
 
+// UpdateDestination updates given destination in the IPVS table.
+func (ipvs *Ipvs) UpdateDestination(svc ip_vs.Service, dst ip_vs.Destination) error {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+	return ip_vs.UpdateDestination(svc, dst)
+}
+
 // GetDestinations gets all destination from a service
 func (ipvs *Ipvs) GetDestinations(svc *ip_vs.Service) ([]*ip_vs.Destination, error) {
 	ipvs.Lock()
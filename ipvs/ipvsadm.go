@@ -0,0 +1,64 @@
+package ipvs
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// SetPersistenceNetmask applies the persistence netmask, or the IPv6 prefix,
+// of svc. The netlink bindings always persist single clients, so the service
+// is edited with ipvsadm instead.
+func (ipvs *Ipvs) SetPersistenceNetmask(svc Service) error {
+	mask := svc.PersistenceNetmask
+	if svc.PersistencePrefix != 0 {
+		mask = strconv.Itoa(svc.PersistencePrefix)
+	}
+	if mask == "" {
+		return nil
+	}
+
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	args := append([]string{"-E"}, svc.ipvsadmAddress()...)
+	args = append(args,
+		"-s", string(svc.Scheduler),
+		"-p", strconv.Itoa(svc.PersistenceTimeout),
+		"-M", mask,
+	)
+	// Editing replaces the flags of the service
+	if svc.OnePacket {
+		args = append(args, "-o")
+	}
+	return ipvsadm(args...)
+}
+
+// ipvsadmAddress returns the ipvsadm flags identifying svc.
+func (svc Service) ipvsadmAddress() []string {
+	if svc.IsFwmark() {
+		return []string{"-f", strconv.FormatUint(uint64(svc.Fwmark), 10)}
+	}
+	switch svc.Protocol {
+	case "udp":
+		return []string{"-u", svc.Address()}
+	case "sctp":
+		return []string{"--sctp-service", svc.Address()}
+	}
+	return []string{"-t", svc.Address()}
+}
+
+func ipvsadm(args ...string) error {
+	_, err := ipvsadmOutput(args...)
+	return err
+}
+
+func ipvsadmOutput(args ...string) ([]byte, error) {
+	out, err := exec.Command("ipvsadm", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ipvsadm %s failed: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
@@ -0,0 +1,61 @@
+package ipvs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidateLabels checks that the label keys of dst can be selected on.
+func (dst Destination) ValidateLabels() error {
+	return validateSelectable("Labels", dst.Labels)
+}
+
+// ValidateTags checks that the tag keys of svc can be selected on.
+func (svc Service) ValidateTags() error {
+	return validateSelectable("Tags", svc.Tags)
+}
+
+func validateSelectable(field string, labels map[string]string) error {
+	for key := range labels {
+		if key == "" || strings.ContainsAny(key, "=,") {
+			return &ValidationError{field, fmt.Sprintf("key %q must be non empty and can't contain = or ,", key)}
+		}
+	}
+	return nil
+}
+
+// HasLabels tells if dst has every label of selector.
+func (dst Destination) HasLabels(selector map[string]string) bool {
+	return matchesSelector(dst.Labels, selector)
+}
+
+// HasTags tells if svc has every tag of selector.
+func (svc Service) HasTags(selector map[string]string) bool {
+	return matchesSelector(svc.Tags, selector)
+}
+
+func matchesSelector(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseLabelSelector reads a selector made of key=value requirements, as
+// given in the label and tag query parameters, each of which may hold
+// several separated by commas. Matches must meet all of them.
+func ParseLabelSelector(requirements []string) (map[string]string, error) {
+	selector := make(map[string]string, len(requirements))
+	for _, r := range requirements {
+		for _, req := range strings.Split(r, ",") {
+			kv := strings.SplitN(req, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("invalid label selector %q, expected key=value", req)
+			}
+			selector[kv[0]] = kv[1]
+		}
+	}
+	return selector, nil
+}
@@ -0,0 +1,60 @@
+package ipvs
+
+import (
+	"fmt"
+	"time"
+)
+
+// Defaults used for the zero values of an OutlierDetection.
+const (
+	DefaultMaxEjectionPercent = 10
+	DefaultBaseEjectionTime   = 30 * time.Second
+)
+
+// OutlierDetection ejects the destinations of a service whose health check
+// latency or error rate stands out from the ones of the other destinations,
+// even while their checks pass. Ejected destinations are quiesced with
+// weight 0 by the balancer seeing them stand out, like unhealthy ones, and
+// readmitted after an ejection time. Only destinations with an active health
+// check are compared.
+type OutlierDetection struct {
+	// MaxEjectionPercent caps the share of the destinations of the service
+	// ejected at once. A single destination can always be ejected, whatever
+	// the share it makes. It defaults to DefaultMaxEjectionPercent.
+	MaxEjectionPercent int `json:",omitempty"`
+	// BaseEjectionTime is how long a destination is ejected the first time.
+	// Each ejection following closely the previous one lasts one
+	// BaseEjectionTime more. It defaults to DefaultBaseEjectionTime.
+	BaseEjectionTime Duration `json:",omitempty"`
+}
+
+// Validate checks that od ejects destinations for a while.
+func (od OutlierDetection) Validate() error {
+	if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+		return &ValidationError{"OutlierDetection.MaxEjectionPercent", "must be between 0 and 100"}
+	}
+	if od.BaseEjectionTime != 0 && time.Duration(od.BaseEjectionTime) < time.Second {
+		return &ValidationError{"OutlierDetection.BaseEjectionTime", fmt.Sprintf("must be at least %s", time.Second)}
+	}
+	return nil
+}
+
+// WithDefaults returns od with the defaults of the fields it leaves 0.
+func (od OutlierDetection) WithDefaults() OutlierDetection {
+	if od.MaxEjectionPercent == 0 {
+		od.MaxEjectionPercent = DefaultMaxEjectionPercent
+	}
+	if od.BaseEjectionTime == 0 {
+		od.BaseEjectionTime = Duration(DefaultBaseEjectionTime)
+	}
+	return od
+}
+
+// MaxEjections returns how many of n destinations can be ejected at once.
+func (od OutlierDetection) MaxEjections(n int) int {
+	max := n * od.WithDefaults().MaxEjectionPercent / 100
+	if max < 1 {
+		return 1
+	}
+	return max
+}
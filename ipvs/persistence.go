@@ -0,0 +1,127 @@
+package ipvs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// connectionsFile lists the connections and persistence templates of the
+// IPVS table.
+const connectionsFile = "/proc/net/ip_vs_conn"
+
+// PersistenceEntry is a persistence template of a service: the client pinned
+// to one of its destinations until the template expires.
+type PersistenceEntry struct {
+	ClientIP string `json:"client_ip"`
+	// Destination is the id of the destination the client is pinned to, it
+	// is empty when the destination isn't one of the service anymore.
+	Destination        string `json:"destination,omitempty"`
+	DestinationAddress string `json:"destination_address"`
+	// Expires is how many seconds are left before the template expires.
+	Expires int `json:"expires"`
+}
+
+// GetPersistenceEntries reads the persistence templates of svc from the IPVS
+// connection table.
+func (ipvs *Ipvs) GetPersistenceEntries(svc Service) ([]PersistenceEntry, error) {
+	f, err := os.Open(connectionsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parsePersistenceEntries(f, svc)
+}
+
+// parsePersistenceEntries filters the persistence templates of svc out of
+// the connections listed in r, formatted like connectionsFile. Templates are
+// told from connections by their client port, always 0.
+func parsePersistenceEntries(r io.Reader, svc Service) ([]PersistenceEntry, error) {
+	vip, vport, protocol := net.ParseIP(svc.Host), svc.Port, strings.ToUpper(svc.Protocol)
+	if svc.IsFwmark() {
+		// Templates of fwmark services hold the mark in place of the VIP
+		vip, vport, protocol = make(net.IP, 4), 0, "IP"
+		binary.BigEndian.PutUint32(vip, svc.Fwmark)
+	}
+
+	entries := []PersistenceEntry{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Pro FromIP FPrt ToIP TPrt DestIP DPrt State Expires ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 || fields[0] == "Pro" {
+			continue
+		}
+		if fields[0] != protocol || fields[2] != "0000" {
+			continue
+		}
+
+		toIP, err := parseConnAddr(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		toPort, err := strconv.ParseUint(fields[4], 16, 16)
+		if err != nil {
+			return nil, err
+		}
+		if !toIP.Equal(vip) || uint16(toPort) != vport {
+			continue
+		}
+
+		fromIP, err := parseConnAddr(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		dstIP, err := parseConnAddr(fields[5])
+		if err != nil {
+			return nil, err
+		}
+		dstPort, err := strconv.ParseUint(fields[6], 16, 16)
+		if err != nil {
+			return nil, err
+		}
+		expires, err := strconv.Atoi(fields[8])
+		if err != nil {
+			return nil, err
+		}
+
+		entry := PersistenceEntry{
+			ClientIP:           fromIP.String(),
+			DestinationAddress: net.JoinHostPort(dstIP.String(), strconv.FormatUint(dstPort, 10)),
+			Expires:            expires,
+		}
+		for _, d := range svc.Destinations {
+			if dstIP.Equal(net.ParseIP(d.Host)) && uint16(dstPort) == d.Port {
+				entry.Destination = d.GetId()
+				break
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// parseConnAddr parses an address of connectionsFile. IPv4 addresses are
+// written in hex, IPv6 ones in their usual form.
+func parseConnAddr(s string) (net.IP, error) {
+	if strings.Contains(s, ":") {
+		if ip := net.ParseIP(s); ip != nil {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != net.IPv4len {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	return net.IP(b), nil
+}
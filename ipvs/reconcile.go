@@ -0,0 +1,24 @@
+package ipvs
+
+// Actions of the corrections made by a reconciliation.
+const (
+	CorrectionAdd    = "add"
+	CorrectionUpdate = "update"
+	CorrectionDelete = "delete"
+)
+
+// Correction is a change made to the IPVS table of a balancer so that it
+// matches the services balanced. Service is the service id, or its address
+// in the kernel when fusis doesn't know it. Destination is set when the
+// change was made to a destination.
+type Correction struct {
+	Action      string `json:"action"`
+	Service     string `json:"service"`
+	Destination string `json:"destination,omitempty"`
+}
+
+// ReconcileReport lists the corrections made by a reconciliation, none when
+// IPVS had not drifted.
+type ReconcileReport struct {
+	Corrections []Correction `json:"corrections"`
+}
@@ -0,0 +1,102 @@
+package ipvs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	ip_vs "github.com/google/seesaw/ipvs"
+)
+
+// Scheduler is an IPVS scheduling algorithm. Decoding a Scheduler from JSON
+// fails unless it is one of Schedulers, or empty when it isn't set.
+type Scheduler string
+
+// The IPVS scheduling algorithms a service may use
+const (
+	SchedulerRR    Scheduler = "rr"    // round robin
+	SchedulerWRR   Scheduler = "wrr"   // weighted round robin
+	SchedulerLC    Scheduler = "lc"    // least connection
+	SchedulerWLC   Scheduler = "wlc"   // weighted least connection
+	SchedulerLBLC  Scheduler = "lblc"  // locality-based least connection
+	SchedulerLBLCR Scheduler = "lblcr" // locality-based least connection with replication
+	SchedulerDH    Scheduler = "dh"    // destination hashing
+	SchedulerSH    Scheduler = "sh"    // source hashing
+	SchedulerSED   Scheduler = "sed"   // shortest expected delay
+	SchedulerNQ    Scheduler = "nq"    // never queue
+	// SchedulerMH is Maglev consistent hashing of the source address, which
+	// moves few connections when destinations come and go. It needs Linux
+	// 4.18 or later, with the ip_vs_mh module.
+	SchedulerMH Scheduler = "mh"
+)
+
+// Schedulers lists the IPVS scheduling algorithms a service may use.
+var Schedulers = []Scheduler{
+	SchedulerRR, SchedulerWRR, SchedulerLC, SchedulerWLC, SchedulerLBLC,
+	SchedulerLBLCR, SchedulerDH, SchedulerSH, SchedulerSED, SchedulerNQ,
+	SchedulerMH,
+}
+
+// ErrSchedulerUnsupported is returned when the running kernel doesn't have
+// the scheduler of a service.
+var ErrSchedulerUnsupported = errors.New("scheduler not supported by the kernel")
+
+// minKernel tells the first Linux version of the schedulers added after the
+// others.
+var minKernel = map[Scheduler]string{
+	SchedulerMH: "4.18",
+}
+
+// schedulerError explains err, returned by IPVS for svc, when it means that
+// the kernel doesn't have the scheduler: IPVS fails with ENOENT when it can't
+// load the module of a scheduler.
+func schedulerError(svc *ip_vs.Service, err error) error {
+	if err == nil || !(errors.Is(err, syscall.ENOENT) || strings.Contains(err.Error(), syscall.ENOENT.Error())) {
+		return err
+	}
+	requirement := ""
+	if version, ok := minKernel[Scheduler(svc.Scheduler)]; ok {
+		requirement = ", it needs Linux " + version + " or later"
+	}
+	return fmt.Errorf("%w: the kernel can't load the ip_vs_%s module of the %s scheduler%s", ErrSchedulerUnsupported, svc.Scheduler, svc.Scheduler, requirement)
+}
+
+// ParseScheduler returns the scheduler named s, failing when it isn't one of
+// Schedulers.
+func ParseScheduler(s string) (Scheduler, error) {
+	scheduler := Scheduler(s)
+	if !scheduler.known() {
+		return "", fmt.Errorf("unknown scheduler %q, must be one of %v", s, Schedulers)
+	}
+	return scheduler, nil
+}
+
+func (s Scheduler) known() bool {
+	for _, scheduler := range Schedulers {
+		if s == scheduler {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalJSON decodes a scheduler, failing when it isn't one of Schedulers.
+// An empty one is left for Validate to require.
+func (s *Scheduler) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	if name == "" {
+		*s = ""
+		return nil
+	}
+	scheduler, err := ParseScheduler(name)
+	if err != nil {
+		return err
+	}
+	*s = scheduler
+	return nil
+}
@@ -0,0 +1,115 @@
+package ipvs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// snatChain is the nat table chain, jumped to from POSTROUTING, holding the
+// masquerade rules of the SNAT services.
+const snatChain = "FUSIS-SNAT"
+
+// AddSNAT masquerades the traffic IPVS forwards to the destinations of svc,
+// so their replies come back through the balancer whatever their routes are.
+func (ipvs *Ipvs) AddSNAT(svc Service) error {
+	if !svc.SNAT {
+		return nil
+	}
+
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	// Masquerading IPVS traffic needs the connections tracked
+	if err := ioutil.WriteFile("/proc/sys/net/ipv4/vs/conntrack", []byte("1"), 0644); err != nil {
+		return err
+	}
+
+	cmd := svc.iptablesCommand()
+	if err := ensureSNATChain(cmd); err != nil {
+		return err
+	}
+	if iptables(cmd, append([]string{"-t", "nat", "-C", snatChain}, svc.snatRule()...)...) == nil {
+		return nil
+	}
+	return iptables(cmd, append([]string{"-t", "nat", "-A", snatChain}, svc.snatRule()...)...)
+}
+
+// DelSNAT removes the masquerade rule of svc, if it has one.
+func (ipvs *Ipvs) DelSNAT(svc Service) error {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	cmd := svc.iptablesCommand()
+	if iptables(cmd, append([]string{"-t", "nat", "-C", snatChain}, svc.snatRule()...)...) != nil {
+		return nil
+	}
+	return iptables(cmd, append([]string{"-t", "nat", "-D", snatChain}, svc.snatRule()...)...)
+}
+
+// FlushSNAT removes the masquerade rules of every service.
+func (ipvs *Ipvs) FlushSNAT() error {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		if iptables(cmd, "-t", "nat", "-n", "-L", snatChain) != nil {
+			// The chain was never created
+			continue
+		}
+		if err := iptables(cmd, "-t", "nat", "-F", snatChain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ensureSNATChain(cmd string) error {
+	if iptables(cmd, "-t", "nat", "-n", "-L", snatChain) != nil {
+		if err := iptables(cmd, "-t", "nat", "-N", snatChain); err != nil {
+			return err
+		}
+	}
+	if iptables(cmd, "-t", "nat", "-C", "POSTROUTING", "-j", snatChain) != nil {
+		return iptables(cmd, "-t", "nat", "-A", "POSTROUTING", "-j", snatChain)
+	}
+	return nil
+}
+
+// snatRule returns the iptables rule masquerading IPVS traffic of svc.
+func (svc Service) snatRule() []string {
+	rule := []string{"-m", "ipvs", "--ipvs", "--vdir", "ORIGINAL"}
+	if svc.IsFwmark() {
+		rule = append(rule, "--vmark", strconv.FormatUint(uint64(svc.Fwmark), 10))
+	} else {
+		rule = append(rule,
+			"--vaddr", fmt.Sprintf("%s/%d", svc.IP(), svc.AddressFamily().PrefixLen()),
+			"--vport", strconv.Itoa(int(svc.Port)),
+			"--vproto", svc.Protocol,
+		)
+	}
+	return append(rule, "-m", "comment", "--comment", "fusis:"+svc.GetId(), "-j", "MASQUERADE")
+}
+
+func (svc Service) iptablesCommand() string {
+	if svc.AddressFamily() == IPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func iptables(cmd string, args ...string) error {
+	_, err := iptablesOutput(cmd, args...)
+	return err
+}
+
+func iptablesOutput(cmd string, args ...string) ([]byte, error) {
+	out, err := exec.Command(cmd, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %v: %s", cmd, strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
@@ -9,6 +9,7 @@ var ErrNotFound = errors.New("Not found")
 
 type State interface {
 	GetServices() *[]Service
+	GetServicesByTags(selector map[string]string) *[]Service
 	GetService(name string) (*Service, error)
 	AddService(svc *Service)
 	DeleteService(svc *Service)
@@ -19,19 +20,26 @@ type State interface {
 }
 
 type FusisState struct {
-	sync.Mutex
+	sync.RWMutex
 	Services     map[string]Service
 	Destinations map[string]Destination
+
+	// tagged indexes the ids of the services by their key=value tags.
+	tagged map[string]map[string]bool
 }
 
 func NewFusisState() *FusisState {
 	return &FusisState{
 		Services:     make(map[string]Service),
 		Destinations: make(map[string]Destination),
+		tagged:       make(map[string]map[string]bool),
 	}
 }
 
 func (s *FusisState) GetServices() *[]Service {
+	s.RLock()
+	defer s.RUnlock()
+
 	services := []Service{}
 	for _, v := range s.Services {
 		s.getDestinations(&v)
@@ -41,8 +49,52 @@ func (s *FusisState) GetServices() *[]Service {
 	return &services
 }
 
+// GetServicesByTags returns the services having every tag of selector,
+// looking them up in the tag index.
+func (s *FusisState) GetServicesByTags(selector map[string]string) *[]Service {
+	if len(selector) == 0 {
+		return s.GetServices()
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	// Only the services of the smallest tag set need to be checked
+	var candidates map[string]bool
+	for key, value := range selector {
+		ids := s.tagged[key+"="+value]
+		if candidates == nil || len(ids) < len(candidates) {
+			candidates = ids
+		}
+	}
+
+	services := []Service{}
+	for id := range candidates {
+		svc := s.Services[id]
+		if svc.HasTags(selector) {
+			s.getDestinations(&svc)
+			services = append(services, svc)
+		}
+	}
+
+	return &services
+}
+
+// GetService returns the service named name or, when there is none, the
+// service whose Id is name.
 func (s *FusisState) GetService(name string) (*Service, error) {
-	svc := s.Services[name]
+	s.RLock()
+	defer s.RUnlock()
+
+	svc, ok := s.Services[name]
+	if !ok {
+		for _, v := range s.Services {
+			if v.Id == name {
+				svc = v
+				break
+			}
+		}
+	}
 
 	if svc.Name == "" {
 		return nil, ErrNotFound
@@ -69,17 +121,40 @@ func (s *FusisState) AddService(svc *Service) {
 	s.Lock()
 	defer s.Unlock()
 
+	s.untag(svc.GetId())
 	s.Services[svc.GetId()] = *svc
+	for key, value := range svc.Tags {
+		tag := key + "=" + value
+		if s.tagged[tag] == nil {
+			s.tagged[tag] = make(map[string]bool)
+		}
+		s.tagged[tag][svc.GetId()] = true
+	}
 }
 
 func (s *FusisState) DeleteService(svc *Service) {
 	s.Lock()
 	defer s.Unlock()
 
+	s.untag(svc.GetId())
 	delete(s.Services, svc.GetId())
 }
 
+// untag removes the service id from the tag index.
+func (s *FusisState) untag(id string) {
+	for key, value := range s.Services[id].Tags {
+		tag := key + "=" + value
+		delete(s.tagged[tag], id)
+		if len(s.tagged[tag]) == 0 {
+			delete(s.tagged, tag)
+		}
+	}
+}
+
 func (s *FusisState) GetDestination(name string) (*Destination, error) {
+	s.RLock()
+	defer s.RUnlock()
+
 	dst := s.Destinations[name]
 
 	if dst.Name == "" {
@@ -0,0 +1,70 @@
+package ipvs
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+type StateSuite struct{}
+
+var _ = Suite(&StateSuite{})
+
+func (s *StateSuite) TestGetServicesByTags(c *C) {
+	state := NewFusisState()
+	state.AddService(&Service{Name: "web", Tags: map[string]string{"env": "prod", "team": "web"}})
+	state.AddService(&Service{Name: "pay", Tags: map[string]string{"env": "prod", "team": "payments"}})
+	state.AddService(&Service{Name: "dev", Tags: map[string]string{"env": "dev", "team": "payments"}})
+
+	names := func(selector map[string]string) []string {
+		var names []string
+		for _, svc := range *state.GetServicesByTags(selector) {
+			names = append(names, svc.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	c.Assert(names(map[string]string{"env": "prod"}), DeepEquals, []string{"pay", "web"})
+	c.Assert(names(map[string]string{"env": "prod", "team": "payments"}), DeepEquals, []string{"pay"})
+	c.Assert(names(map[string]string{"env": "staging"}), IsNil)
+	c.Assert(names(nil), DeepEquals, []string{"dev", "pay", "web"})
+
+	// Updates and deletes are reflected in the index
+	state.AddService(&Service{Name: "web", Tags: map[string]string{"env": "dev"}})
+	state.DeleteService(&Service{Name: "pay"})
+	c.Assert(names(map[string]string{"env": "prod"}), IsNil)
+	c.Assert(names(map[string]string{"env": "dev"}), DeepEquals, []string{"dev", "web"})
+}
+
+func (s *StateSuite) TestConcurrentAccess(c *C) {
+	state := NewFusisState()
+	state.AddService(&Service{Name: "web", Tags: map[string]string{"env": "prod"}})
+
+	// Readers go along with the writers, which go test -race checks
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			dst := &Destination{Name: strconv.Itoa(i), ServiceId: "web"}
+			state.AddDestination(dst)
+			state.DeleteDestination(dst)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			state.GetServices()
+			state.GetServicesByTags(map[string]string{"env": "prod"})
+			state.GetService("web")
+			state.GetDestination(strconv.Itoa(i))
+		}
+	}()
+	wg.Wait()
+
+	svc, err := state.GetService("web")
+	c.Assert(err, IsNil)
+	c.Assert(svc.Destinations, HasLen, 0)
+}
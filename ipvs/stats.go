@@ -0,0 +1,70 @@
+package ipvs
+
+import gipvs "github.com/google/seesaw/ipvs"
+
+// ServiceStats holds the IPVS counters of a service. Active and inactive
+// connections are the sum of the ones of its destinations.
+type ServiceStats struct {
+	ActiveConns   uint32 `json:"active_conns"`
+	InactiveConns uint32 `json:"inactive_conns"`
+	Connections   uint32 `json:"connections"`
+	PacketsIn     uint32 `json:"packets_in"`
+	PacketsOut    uint32 `json:"packets_out"`
+	BytesIn       uint64 `json:"bytes_in"`
+	BytesOut      uint64 `json:"bytes_out"`
+	// ConnLimitDrops counts the new connections dropped by the ConnLimit
+	// of the service, which isn't an IPVS counter.
+	ConnLimitDrops uint64 `json:"conn_limit_drops,omitempty"`
+}
+
+// NewServiceStats builds the stats of a service read from the IPVS table.
+func NewServiceStats(s *gipvs.Service) *ServiceStats {
+	stats := &ServiceStats{}
+	if s.Statistics != nil {
+		stats.Connections = s.Statistics.Connections
+		stats.PacketsIn = s.Statistics.PacketsIn
+		stats.PacketsOut = s.Statistics.PacketsOut
+		stats.BytesIn = s.Statistics.BytesIn
+		stats.BytesOut = s.Statistics.BytesOut
+	}
+
+	for _, d := range s.Destinations {
+		if d.Statistics != nil {
+			stats.ActiveConns += d.Statistics.ActiveConns
+			stats.InactiveConns += d.Statistics.InactiveConns
+		}
+	}
+
+	return stats
+}
+
+// DestinationStats holds the IPVS counters of a single destination. Its
+// fields are named and tagged like the ones of ServiceStats.
+type DestinationStats struct {
+	ActiveConns   uint32 `json:"active_conns"`
+	InactiveConns uint32 `json:"inactive_conns"`
+	PersistConns  uint32 `json:"persist_conns"`
+	Connections   uint32 `json:"connections"`
+	PacketsIn     uint32 `json:"packets_in"`
+	PacketsOut    uint32 `json:"packets_out"`
+	BytesIn       uint64 `json:"bytes_in"`
+	BytesOut      uint64 `json:"bytes_out"`
+}
+
+// NewDestinationStats builds the stats of a destination read from the IPVS
+// table.
+func NewDestinationStats(d *gipvs.Destination) *DestinationStats {
+	stats := &DestinationStats{}
+	if d.Statistics != nil {
+		stats.ActiveConns = d.Statistics.ActiveConns
+		stats.InactiveConns = d.Statistics.InactiveConns
+		stats.PersistConns = d.Statistics.PersistConns
+		stats.Connections = d.Statistics.Connections
+		stats.PacketsIn = d.Statistics.PacketsIn
+		stats.PacketsOut = d.Statistics.PacketsOut
+		stats.BytesIn = d.Statistics.BytesIn
+		stats.BytesOut = d.Statistics.BytesOut
+	}
+
+	return stats
+}
@@ -3,7 +3,8 @@ package ipvs
 import (
 	"encoding/json"
 	"errors"
-	"net"
+	"fmt"
+	"reflect"
 	"syscall"
 
 	gipvs "github.com/google/seesaw/ipvs"
@@ -16,13 +17,71 @@ const (
 )
 
 type Service struct {
-	Id           string `storm:"id"`
-	Name         string `storm:"unique" valid:"required"`
-	Host         string
-	Port         uint16 `valid:"required"`
-	Protocol     string `valid:"required"`
-	Scheduler    string `valid:"required"`
-	Destinations []Destination
+	Id        string `storm:"id"`
+	Name      string `storm:"unique" valid:"required"`
+	Host      string
+	Port      uint16
+	Protocol  string
+	Fwmark    uint32
+	Scheduler Scheduler `valid:"required"`
+	// SchedulerFlags tune the scheduler, see SchedulerFlags for the ones
+	// each scheduler accepts.
+	SchedulerFlags []string
+	Destinations   []Destination
+
+	// PersistenceTimeout is how long, in seconds, a client keeps being sent
+	// to the same destination. 0 disables persistence.
+	PersistenceTimeout int
+	// PersistenceNetmask, as a dotted IPv4 mask, groups the clients of an
+	// IPv4 service that share a persistent destination. It defaults to a
+	// single client.
+	PersistenceNetmask string
+	// PersistencePrefix is the prefix length grouping the clients of an IPv6
+	// service, 64 pinning every /64 to the same destination. It defaults to
+	// a single client.
+	//
+	// Both require a PersistenceTimeout, which applies to the whole group: it
+	// keeps its destination until none of its clients connected for the
+	// timeout, so wider groups hold on to destinations longer.
+	PersistencePrefix int `json:",omitempty"`
+
+	// OnePacket schedules every packet of a UDP service on its own, without
+	// tracking connections, as suits stateless protocols like DNS.
+	OnePacket bool `json:",omitempty"`
+
+	// SNAT masquerades the traffic forwarded to the NAT destinations, so
+	// their replies go back through the balancer even in asymmetric networks.
+	SNAT bool `json:",omitempty"`
+
+	// AccessControl, when set, restricts the clients that can reach the
+	// service by their source network.
+	AccessControl *AccessControl `json:",omitempty"`
+
+	// ConnLimit, when set, drops the new connections to the service above
+	// a rate.
+	ConnLimit *ConnLimit `json:",omitempty"`
+
+	// AdaptiveWeight, when set, makes the balancers weight destinations by
+	// the latency of their health checks.
+	AdaptiveWeight *AdaptiveWeight `json:",omitempty"`
+
+	// OutlierDetection, when set, makes the balancers eject the destinations
+	// whose health checks stand out from the others for a while.
+	OutlierDetection *OutlierDetection `json:",omitempty"`
+
+	// Maintenance stops the balancers sending new connections to the
+	// destinations, which are quiesced with weight 0 in IPVS while keeping
+	// their configured weights, given back when it's turned off.
+	Maintenance bool
+
+	// Tags are arbitrary metadata, for instance the team owning the service,
+	// services can be listed by. Like destination labels they are never
+	// programmed in IPVS.
+	Tags map[string]string `json:",omitempty"`
+
+	// Version counts the changes of the service configuration, from 1 when
+	// it is created. It can't be set by clients.
+	Version uint64
 }
 
 type Destination struct {
@@ -33,34 +92,116 @@ type Destination struct {
 	Weight    int32
 	Mode      string `valid:"required"`
 	ServiceId string `storm:"index" valid:"required"`
+
+	// HealthCheck, when set, makes the balancers check the destination and
+	// withdraw it while it fails.
+	HealthCheck *HealthCheck `json:",omitempty"`
+
+	// Labels are arbitrary metadata, for instance to relate the destination
+	// to an inventory. They are stored and returned as given, and never
+	// programmed in IPVS.
+	Labels map[string]string `json:",omitempty"`
+
+	// EffectiveWeight is the weight programmed in IPVS by the balancer
+	// answering, which differs from Weight while the destination is
+	// unhealthy or weighted adaptively. It is ignored on writes.
+	EffectiveWeight int32
+
+	// TTL, when set, makes the destination registered for that long only:
+	// it must send heartbeats, and once none came for TTL the leader
+	// quiesces it, then removes it when none came for another TTL.
+	TTL Duration `json:",omitempty"`
+	// Expired is set by the leader while the destination is quiesced for
+	// missing its heartbeats. It is ignored on writes.
+	Expired bool `json:",omitempty"`
 }
 
 func (svc Service) GetId() string {
 	return svc.Name
 }
 
+// Matches tells if svc and other have the same configuration, regardless of
+// their ids, versions and destinations. Empty collections match missing ones,
+// as the state gives them back nil.
+func (svc Service) Matches(other Service) bool {
+	return reflect.DeepEqual(svc.comparable(), other.comparable())
+}
+
+// comparable returns the configuration of svc as Matches compares it.
+func (svc Service) comparable() Service {
+	svc.Id = ""
+	svc.Version = 0
+	svc.Destinations = nil
+	if len(svc.SchedulerFlags) == 0 {
+		svc.SchedulerFlags = nil
+	}
+	if len(svc.Tags) == 0 {
+		svc.Tags = nil
+	}
+	if svc.AccessControl != nil {
+		// Cloned lists are nil when empty
+		svc.AccessControl = svc.AccessControl.Clone()
+	}
+	return svc
+}
+
+// IsFwmark tells if svc matches packets by firewall mark rather than by
+// host, port and protocol.
+func (svc Service) IsFwmark() bool {
+	return svc.Fwmark != 0
+}
+
 func (dst Destination) GetId() string {
 	return dst.Name
 }
 
+// Matches tells if dst and other have the same configuration, regardless of
+// their ids, effective weights and expiration. Like for services, empty
+// collections match missing ones.
+func (dst Destination) Matches(other Destination) bool {
+	return reflect.DeepEqual(dst.comparable(), other.comparable())
+}
+
+// comparable returns the configuration of dst as Matches compares it.
+func (dst Destination) comparable() Destination {
+	dst.Id = ""
+	dst.EffectiveWeight = 0
+	dst.Expired = false
+	if len(dst.Labels) == 0 {
+		dst.Labels = nil
+	}
+	if dst.HealthCheck != nil && len(dst.HealthCheck.Headers) == 0 {
+		hc := *dst.HealthCheck
+		hc.Headers = nil
+		dst.HealthCheck = &hc
+	}
+	return dst
+}
+
 func stringToIPProto(s string) gipvs.IPProto {
 	var value gipvs.IPProto
-	if s == "udp" {
+	switch s {
+	case "udp":
 		value = syscall.IPPROTO_UDP
-	} else {
+	case "sctp":
+		value = syscall.IPPROTO_SCTP
+	default:
 		value = syscall.IPPROTO_TCP
 	}
 
 	return value
 }
 
-//MarshalJSON ...
+// MarshalJSON ...
 func ipProtoToString(proto gipvs.IPProto) string {
 	var value string
 
-	if proto == syscall.IPPROTO_UDP {
+	switch proto {
+	case syscall.IPPROTO_UDP:
 		value = "udp"
-	} else {
+	case syscall.IPPROTO_SCTP:
+		value = "sctp"
+	default:
 		value = "tcp"
 	}
 
@@ -75,6 +216,8 @@ func stringToDestinationFlags(s string) gipvs.DestinationFlags {
 		flag = NatMode
 	case "tunnel":
 		flag = TunnelMode
+	case "route":
+		flag = RouteMode
 	default:
 		// Default is Direct Routing
 		flag = RouteMode
@@ -83,16 +226,18 @@ func stringToDestinationFlags(s string) gipvs.DestinationFlags {
 	return flag
 }
 
-//MarshalJSON ...
+// MarshalJSON ...
 func destinationFlagsToString(flags gipvs.DestinationFlags) string {
 	var value string
 
-	switch flags {
+	switch flags & gipvs.DFForwardMask {
 	case NatMode:
 		value = "nat"
 		// *flags =
 	case TunnelMode:
 		value = "tunnel"
+	case RouteMode:
+		value = "route"
 	default:
 		// Default is Direct Routing
 		value = "route"
@@ -104,15 +249,41 @@ func destinationFlagsToString(flags gipvs.DestinationFlags) string {
 func (s Service) ToIpvsService() *gipvs.Service {
 	destinations := []*gipvs.Destination{}
 
+	if s.IsFwmark() {
+		return &gipvs.Service{
+			FirewallMark: s.Fwmark,
+			Scheduler:    string(s.Scheduler),
+			Flags:        s.flags(),
+			Timeout:      uint32(s.PersistenceTimeout),
+			Destinations: destinations,
+		}
+	}
+
 	return &gipvs.Service{
-		Address:      net.ParseIP(s.Host),
+		Address:      s.IP(),
 		Port:         s.Port,
 		Protocol:     stringToIPProto(s.Protocol),
-		Scheduler:    s.Scheduler,
+		Scheduler:    string(s.Scheduler),
+		Flags:        s.flags(),
+		Timeout:      uint32(s.PersistenceTimeout),
 		Destinations: destinations,
 	}
 }
 
+func (s Service) flags() gipvs.ServiceFlags {
+	var flags gipvs.ServiceFlags
+	if s.PersistenceTimeout > 0 {
+		flags |= gipvs.SFPersistent
+	}
+	if s.OnePacket {
+		flags |= gipvs.SFOnePacket
+	}
+	for _, name := range s.SchedulerFlags {
+		flags |= SchedulerFlags[s.Scheduler][name]
+	}
+	return flags
+}
+
 func (s Service) ValidateUniqueness() (bool, error) {
 	if s.presentInStore() {
 		return false, errors.New("Service found in store")
@@ -143,9 +314,15 @@ func (s Service) presentInKernel() bool {
 	return false
 }
 
+// ErrDestinationExists is returned when adding a destination at the address
+// of another destination of the same service.
+var ErrDestinationExists = errors.New("destination already exists")
+
+// ValidateUniqueness checks that no destination of svc is at the address of
+// d, since IPVS holds a single destination per address and service.
 func (d Destination) ValidateUniqueness(svc *Service) (bool, error) {
-	if d.presentInStore() {
-		return false, errors.New("Destination found in store")
+	if existing := svc.DestinationAt(d); existing != nil {
+		return false, fmt.Errorf("%w: %s is destination %q of service %q", ErrDestinationExists, d.Address(), existing.GetId(), svc.GetId())
 	}
 
 	if d.presentInKernel(svc) {
@@ -155,13 +332,15 @@ func (d Destination) ValidateUniqueness(svc *Service) (bool, error) {
 	return true, nil
 }
 
-func (d Destination) presentInStore() bool {
-	// dst, _ := Store.GetDestination(d.Name)
-	// if dst != nil {
-	// 	return true
-	// }
-
-	return false
+// DestinationAt returns the destination of svc at the host and port of dst,
+// nil when there is none.
+func (svc Service) DestinationAt(dst Destination) *Destination {
+	for i := range svc.Destinations {
+		if svc.Destinations[i].Address() == dst.Address() {
+			return &svc.Destinations[i]
+		}
+	}
+	return nil
 }
 
 func (d Destination) presentInKernel(svc *Service) bool {
@@ -177,7 +356,7 @@ func (d Destination) presentInKernel(svc *Service) bool {
 
 func (d Destination) ToIpvsDestination() *gipvs.Destination {
 	return &gipvs.Destination{
-		Address: net.ParseIP(d.Host),
+		Address: d.IP(),
 		Port:    d.Port,
 		Weight:  d.Weight,
 		Flags:   stringToDestinationFlags(d.Mode),
@@ -199,13 +378,27 @@ func NewService(s *gipvs.Service) Service {
 		destinations = append(destinations, newDestinationRequest(dst))
 	}
 
-	return Service{
+	svc := Service{
 		Host:         s.Address.String(),
 		Port:         s.Port,
 		Protocol:     ipProtoToString(s.Protocol),
-		Scheduler:    s.Scheduler,
+		Scheduler:    Scheduler(s.Scheduler),
 		Destinations: destinations,
 	}
+	if s.FirewallMark != 0 {
+		svc = Service{
+			Fwmark:       s.FirewallMark,
+			Scheduler:    Scheduler(s.Scheduler),
+			Destinations: destinations,
+		}
+	}
+	if s.Flags&gipvs.SFPersistent != 0 {
+		svc.PersistenceTimeout = int(s.Timeout)
+	}
+	svc.OnePacket = s.Flags&gipvs.SFOnePacket != 0
+	svc.SchedulerFlags = schedulerFlagNames(svc.Scheduler, s.Flags)
+
+	return svc
 }
 
 func newDestinationRequest(d *gipvs.Destination) Destination {
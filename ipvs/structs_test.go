@@ -0,0 +1,74 @@
+package ipvs
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type StructsSuite struct{}
+
+var _ = Suite(&StructsSuite{})
+
+func (s *StructsSuite) TestMatchesEmptyCollections(c *C) {
+	svc := Service{
+		Name: "web", Host: "10.0.0.1", Port: 80, Protocol: "tcp", Scheduler: "rr",
+		SchedulerFlags: []string{},
+		Tags:           map[string]string{},
+		AccessControl:  &AccessControl{Allow: []string{"10.0.0.0/8"}, Deny: []string{}},
+	}
+	// As stored after a JSON round trip
+	b, err := json.Marshal(svc)
+	c.Assert(err, IsNil)
+	var stored Service
+	c.Assert(json.Unmarshal(b, &stored), IsNil)
+	stored.Version = 3
+	c.Assert(stored.Tags, IsNil)
+	c.Assert(stored.Matches(svc), Equals, true)
+	c.Assert(svc.Matches(stored), Equals, true)
+	c.Assert(svc.AccessControl.Deny, NotNil)
+
+	svc.Tags = map[string]string{"team": "web"}
+	c.Assert(stored.Matches(svc), Equals, false)
+
+	dst := Destination{
+		Name: "web1", Host: "192.168.0.1", Port: 80, Weight: 1, Mode: "nat", ServiceId: "web",
+		Labels:      map[string]string{},
+		HealthCheck: &HealthCheck{Type: "http", Path: "/", Headers: map[string]string{}},
+	}
+	b, err = json.Marshal(dst)
+	c.Assert(err, IsNil)
+	var storedDst Destination
+	c.Assert(json.Unmarshal(b, &storedDst), IsNil)
+	c.Assert(storedDst.Labels, IsNil)
+	c.Assert(storedDst.Matches(dst), Equals, true)
+	c.Assert(dst.HealthCheck.Headers, NotNil)
+
+	dst.Labels = map[string]string{"rack": "r1"}
+	c.Assert(storedDst.Matches(dst), Equals, false)
+}
+
+func (s *StructsSuite) TestDestinationHasLabels(c *C) {
+	dst := Destination{Labels: map[string]string{"zone": "a", "rack": "r1"}}
+	for _, t := range []struct {
+		requirements []string
+		matches      bool
+	}{
+		{nil, true},
+		{[]string{"zone=a"}, true},
+		{[]string{"zone=a", "rack=r1"}, true},
+		{[]string{"zone=b"}, false},
+		{[]string{"zone=a", "env=prod"}, false},
+		{[]string{"rack="}, false},
+	} {
+		selector, err := ParseLabelSelector(t.requirements)
+		c.Assert(err, IsNil)
+		c.Assert(dst.HasLabels(selector), Equals, t.matches, Commentf("%v", t.requirements))
+	}
+
+	_, err := ParseLabelSelector([]string{"zone"})
+	c.Assert(err, ErrorMatches, `invalid label selector "zone", expected key=value`)
+}
@@ -0,0 +1,139 @@
+package ipvs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// SyncState is the role of an IPVS connection synchronization daemon.
+type SyncState string
+
+const (
+	// SyncMaster daemons multicast the connections balanced locally.
+	SyncMaster SyncState = "master"
+	// SyncBackup daemons receive the connections of the masters, so the
+	// balancer keeps them when taking over.
+	SyncBackup SyncState = "backup"
+)
+
+// MaxSyncID is the highest sync ID, which tells apart the daemons sharing a
+// network.
+const MaxSyncID = 255
+
+// ErrSyncDaemonNotRunning is returned when stopping a sync daemon that
+// isn't running.
+var ErrSyncDaemonNotRunning = errors.New("sync daemon not running")
+
+// SyncDaemon is an IPVS connection synchronization daemon. A balancer can
+// run a master and a backup at the same time.
+type SyncDaemon struct {
+	State SyncState `json:"state"`
+	// Interface is where the connections are multicast.
+	Interface string `json:"interface"`
+	// SyncID must be the same on the masters and backups synchronizing.
+	SyncID int `json:"sync_id"`
+}
+
+// Validate checks that d can be started.
+func (d SyncDaemon) Validate() error {
+	if err := d.State.Validate(); err != nil {
+		return err
+	}
+	if d.Interface == "" {
+		return &ValidationError{"Interface", "is required"}
+	}
+	if d.SyncID < 0 || d.SyncID > MaxSyncID {
+		return &ValidationError{"SyncID", fmt.Sprintf("must be between 0 and %d", MaxSyncID)}
+	}
+	return nil
+}
+
+// Validate checks that s is a known state.
+func (s SyncState) Validate() error {
+	if s != SyncMaster && s != SyncBackup {
+		return &ValidationError{"State", fmt.Sprintf("%q is not one of [%s %s]", s, SyncMaster, SyncBackup)}
+	}
+	return nil
+}
+
+// StartSyncDaemon starts d, replacing the running daemon of the same state
+// if it differs.
+func (ipvs *Ipvs) StartSyncDaemon(d SyncDaemon) error {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	running, err := syncDaemons()
+	if err != nil {
+		return err
+	}
+	for _, r := range running {
+		if r.State != d.State {
+			continue
+		}
+		if r == d {
+			return nil
+		}
+		if err := ipvsadm("--stop-daemon", string(r.State)); err != nil {
+			return err
+		}
+	}
+	return ipvsadm("--start-daemon", string(d.State), "--mcast-interface", d.Interface, "--syncid", strconv.Itoa(d.SyncID))
+}
+
+// StopSyncDaemon stops the daemon of the given state.
+func (ipvs *Ipvs) StopSyncDaemon(state SyncState) error {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	running, err := syncDaemons()
+	if err != nil {
+		return err
+	}
+	for _, r := range running {
+		if r.State == state {
+			return ipvsadm("--stop-daemon", string(state))
+		}
+	}
+	return ErrSyncDaemonNotRunning
+}
+
+// SyncDaemons returns the sync daemons running.
+func (ipvs *Ipvs) SyncDaemons() ([]SyncDaemon, error) {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	return syncDaemons()
+}
+
+func syncDaemons() ([]SyncDaemon, error) {
+	out, err := ipvsadmOutput("-L", "--daemon")
+	if err != nil {
+		return nil, err
+	}
+	return parseSyncDaemons(out), nil
+}
+
+var syncDaemonLine = regexp.MustCompile(`^(master|backup) sync daemon \(mcast=([^,)]+), syncid=(\d+)`)
+
+// parseSyncDaemons reads the daemons listed by ipvsadm, whose lines look
+// like:
+//
+//	master sync daemon (mcast=eth0, syncid=1)
+//	backup sync daemon (mcast=eth1, syncid=2, maxlen=1472, group=224.0.0.81, port=8848, ttl=1)
+func parseSyncDaemons(out []byte) []SyncDaemon {
+	daemons := []SyncDaemon{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		m := syncDaemonLine.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		id, _ := strconv.Atoi(m[3])
+		daemons = append(daemons, SyncDaemon{State: SyncState(m[1]), Interface: m[2], SyncID: id})
+	}
+	return daemons
+}
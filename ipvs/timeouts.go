@@ -0,0 +1,64 @@
+package ipvs
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Timeouts are how long, in seconds, IPVS keeps idle connections: the TCP
+// established ones, the TCP ones closing after a FIN, and the UDP ones. They
+// apply to every service of a balancer.
+type Timeouts struct {
+	TCP    int `json:"tcp"`
+	TCPFin int `json:"tcpfin"`
+	UDP    int `json:"udp"`
+}
+
+// Validate checks that the timeouts can be set. 0 leaves a timeout
+// unchanged.
+func (t Timeouts) Validate() error {
+	for field, timeout := range map[string]int{"TCP": t.TCP, "TCPFin": t.TCPFin, "UDP": t.UDP} {
+		if timeout < 0 {
+			return &ValidationError{field, "must not be negative"}
+		}
+	}
+	return nil
+}
+
+// SetTimeouts sets the timeouts of IPVS, leaving the ones that are 0
+// unchanged.
+func (ipvs *Ipvs) SetTimeouts(t Timeouts) error {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	return ipvsadm("--set", strconv.Itoa(t.TCP), strconv.Itoa(t.TCPFin), strconv.Itoa(t.UDP))
+}
+
+// Timeouts returns the timeouts of IPVS.
+func (ipvs *Ipvs) Timeouts() (Timeouts, error) {
+	ipvs.Lock()
+	defer ipvs.Unlock()
+
+	out, err := ipvsadmOutput("-L", "--timeout")
+	if err != nil {
+		return Timeouts{}, err
+	}
+	return parseTimeouts(out)
+}
+
+var timeoutsLine = regexp.MustCompile(`Timeout \(tcp tcpfin udp\): (\d+) (\d+) (\d+)`)
+
+// parseTimeouts reads the timeouts listed by ipvsadm, like:
+//
+//	Timeout (tcp tcpfin udp): 900 120 300
+func parseTimeouts(out []byte) (Timeouts, error) {
+	m := timeoutsLine.FindSubmatch(out)
+	if m == nil {
+		return Timeouts{}, fmt.Errorf("unexpected ipvsadm timeouts %q", out)
+	}
+	tcp, _ := strconv.Atoi(string(m[1]))
+	tcpFin, _ := strconv.Atoi(string(m[2]))
+	udp, _ := strconv.Atoi(string(m[3]))
+	return Timeouts{TCP: tcp, TCPFin: tcpFin, UDP: udp}, nil
+}
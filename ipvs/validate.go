@@ -0,0 +1,285 @@
+package ipvs
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	gipvs "github.com/google/seesaw/ipvs"
+)
+
+// MinTTL is the shortest TTL of a destination.
+const MinTTL = time.Second
+
+// IPVS scheduler flags, whose meaning depends on the scheduler.
+const (
+	schedFlag1 gipvs.ServiceFlags = 0x0008
+	schedFlag2 gipvs.ServiceFlags = 0x0010
+)
+
+// SchedulerFlags maps each scheduler taking flags to the ones it accepts:
+//
+//	sh-fallback  sh: pick another destination when the hashed one is unavailable
+//	sh-port      sh: hash the source port along with the source address
+//	mh-fallback  mh: pick another destination when the hashed one is unavailable
+//	mh-port      mh: hash the source port along with the source address
+var SchedulerFlags = map[Scheduler]map[string]gipvs.ServiceFlags{
+	SchedulerSH: {
+		"sh-fallback": schedFlag1,
+		"sh-port":     schedFlag2,
+	},
+	SchedulerMH: {
+		"mh-fallback": schedFlag1,
+		"mh-port":     schedFlag2,
+	},
+}
+
+// schedulerFlagNames returns the names of the scheduler flags set in flags,
+// sorted.
+func schedulerFlagNames(scheduler Scheduler, flags gipvs.ServiceFlags) []string {
+	var names []string
+	for name, flag := range SchedulerFlags[scheduler] {
+		if flags&flag != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Protocols lists the protocols a service may balance.
+var Protocols = []string{"tcp", "udp", "sctp"}
+
+// Modes lists the forwarding modes a destination may use: "nat" for
+// masquerading, "route" for direct routing and "tunnel" for IP-in-IP.
+//
+// With "route" (DSR, direct server return) the balancer only rewrites the MAC
+// address of requests and the destinations answer clients directly. They must
+// share a network segment with the balancer and have the service VIP on their
+// loopback interface, without answering ARP for it.
+//
+// With "tunnel" the balancer encapsulates requests in IPIP packets, so the
+// destinations may be in other subnets. They must decapsulate them, have the
+// VIP on a tunnel interface and answer clients directly. Encapsulation adds 20
+// bytes to each packet: the path MTU towards the destinations, or the MSS the
+// clients are given, must leave room for it.
+var Modes = []string{"nat", "route", "tunnel"}
+
+// ValidationError describes why a service or destination is invalid.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+// Validate checks that svc can be created in IPVS. A service is matched
+// either by Host, Port and Protocol or by Fwmark alone.
+func (svc Service) Validate() error {
+	if svc.Name == "" {
+		return &ValidationError{"Name", "is required"}
+	}
+	if svc.IsFwmark() {
+		if svc.Host != "" || svc.Port != 0 || svc.Protocol != "" {
+			return &ValidationError{"Fwmark", "can't be set together with Host, Port or Protocol"}
+		}
+	} else if err := svc.validateAddress(); err != nil {
+		return err
+	}
+	if svc.Scheduler == "" {
+		return &ValidationError{"Scheduler", "is required"}
+	}
+	if !svc.Scheduler.known() {
+		// Only possible when set from Go, decoding rejects unknown schedulers
+		return &ValidationError{"Scheduler", fmt.Sprintf("%q is not one of %v", svc.Scheduler, Schedulers)}
+	}
+	for _, name := range svc.SchedulerFlags {
+		if _, ok := SchedulerFlags[svc.Scheduler][name]; !ok {
+			return &ValidationError{"SchedulerFlags", fmt.Sprintf("%q doesn't apply to the %s scheduler", name, svc.Scheduler)}
+		}
+	}
+	if err := svc.validatePersistence(); err != nil {
+		return err
+	}
+	if err := svc.ValidateOnePacket(); err != nil {
+		return err
+	}
+	if svc.AdaptiveWeight != nil {
+		if err := svc.AdaptiveWeight.Validate(); err != nil {
+			return err
+		}
+	}
+	if svc.OutlierDetection != nil {
+		if err := svc.OutlierDetection.Validate(); err != nil {
+			return err
+		}
+	}
+	if svc.AccessControl != nil {
+		if err := svc.AccessControl.Validate(svc.AddressFamily()); err != nil {
+			return err
+		}
+	}
+	if svc.ConnLimit != nil {
+		if err := svc.ConnLimit.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := svc.ValidateTags(); err != nil {
+		return err
+	}
+	for _, dst := range svc.Destinations {
+		if err := dst.ValidateFamily(svc); err != nil {
+			return err
+		}
+		if err := dst.ValidateMode(svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svc Service) validateAddress() error {
+	// Without a Host, the VIP is allocated from the pool of the balancers
+	if svc.Host != "" && svc.IP() == nil {
+		return &ValidationError{"Host", fmt.Sprintf("%q is not an IP address", svc.Host)}
+	}
+	if svc.Port == 0 {
+		return &ValidationError{"Port", "must be between 1 and 65535"}
+	}
+	if !contains(Protocols, svc.Protocol) {
+		return &ValidationError{"Protocol", fmt.Sprintf("%q is not one of %v", svc.Protocol, Protocols)}
+	}
+	return nil
+}
+
+// ValidateOnePacket checks that OnePacket is only set on UDP services, the
+// only ones IPVS schedules packet by packet.
+func (svc Service) ValidateOnePacket() error {
+	if svc.OnePacket && svc.Protocol != "udp" {
+		return &ValidationError{"OnePacket", "is only supported by udp services"}
+	}
+	return nil
+}
+
+func (svc Service) validatePersistence() error {
+	if svc.PersistenceTimeout < 0 {
+		return &ValidationError{"PersistenceTimeout", "must not be negative"}
+	}
+	if svc.PersistenceNetmask != "" {
+		if svc.PersistenceTimeout == 0 {
+			return &ValidationError{"PersistenceNetmask", "requires a PersistenceTimeout"}
+		}
+		if svc.AddressFamily() == IPv6 {
+			return &ValidationError{"PersistenceNetmask", "only applies to IPv4 services, use PersistencePrefix"}
+		}
+		if !isNetmask(svc.PersistenceNetmask) {
+			return &ValidationError{"PersistenceNetmask", fmt.Sprintf("%q is not an IPv4 netmask", svc.PersistenceNetmask)}
+		}
+	}
+	if svc.PersistencePrefix != 0 {
+		if svc.PersistenceTimeout == 0 {
+			return &ValidationError{"PersistencePrefix", "requires a PersistenceTimeout"}
+		}
+		if svc.AddressFamily() != IPv6 {
+			return &ValidationError{"PersistencePrefix", "only applies to IPv6 services, use PersistenceNetmask"}
+		}
+		if svc.PersistencePrefix < 1 || svc.PersistencePrefix > IPv6.PrefixLen() {
+			return &ValidationError{"PersistencePrefix", fmt.Sprintf("must be between 1 and %d", IPv6.PrefixLen())}
+		}
+	}
+	return nil
+}
+
+// isNetmask tells if s is a dotted IPv4 mask, like 255.255.255.0.
+func isNetmask(s string) bool {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return false
+	}
+	_, bits := net.IPMask(ip).Size()
+	return bits == 32
+}
+
+// Validate checks that dst can be added to an IPVS service. A weight of 0 is
+// valid and quiesces the destination.
+func (dst Destination) Validate() error {
+	if dst.IP() == nil {
+		return &ValidationError{"Host", fmt.Sprintf("%q is not an IP address", dst.Host)}
+	}
+	if dst.Port == 0 {
+		return &ValidationError{"Port", "must be between 1 and 65535"}
+	}
+	if dst.Weight < 0 {
+		return &ValidationError{"Weight", "must not be negative"}
+	}
+	if !contains(Modes, dst.Mode) {
+		return &ValidationError{"Mode", fmt.Sprintf("%q is not one of %v", dst.Mode, Modes)}
+	}
+	if err := dst.ValidateLabels(); err != nil {
+		return err
+	}
+	if err := dst.ValidateTTL(); err != nil {
+		return err
+	}
+	if dst.HealthCheck != nil {
+		return dst.HealthCheck.Validate()
+	}
+	return nil
+}
+
+// ValidateTTL checks that the TTL of dst, when set, leaves time for
+// heartbeats.
+func (dst Destination) ValidateTTL() error {
+	if dst.TTL < 0 {
+		return &ValidationError{"TTL", "must not be negative"}
+	}
+	if dst.TTL > 0 && time.Duration(dst.TTL) < MinTTL {
+		return &ValidationError{"TTL", fmt.Sprintf("must be at least %v", MinTTL)}
+	}
+	return nil
+}
+
+// ValidateFamily checks that dst has the same address family as svc, since
+// IPVS can't forward between IPv4 and IPv6. Fwmark services have no address,
+// so their destinations are checked against the other ones instead.
+func (dst Destination) ValidateFamily(svc Service) error {
+	if svc.IsFwmark() {
+		for _, other := range svc.Destinations {
+			if other.GetId() != dst.GetId() && other.AddressFamily() != dst.AddressFamily() {
+				return &ValidationError{"Host", fmt.Sprintf("%s destination %q can't be added to fwmark service %q with %s destinations",
+					dst.AddressFamily(), dst.Host, svc.GetId(), other.AddressFamily())}
+			}
+		}
+		return nil
+	}
+	if dst.AddressFamily() != svc.AddressFamily() {
+		return &ValidationError{"Host", fmt.Sprintf("%s destination %q can't be added to %s service %q",
+			dst.AddressFamily(), dst.Host, svc.AddressFamily(), svc.GetId())}
+	}
+	return nil
+}
+
+// ValidateMode checks that dst can forward svc traffic in its mode. Direct
+// routing and tunneling leave packets untouched, so their destinations must
+// listen on the service port, and only NAT destinations can be masqueraded.
+func (dst Destination) ValidateMode(svc Service) error {
+	if svc.SNAT && dst.Mode != "nat" {
+		return &ValidationError{"Mode", fmt.Sprintf("%s destinations can't be added to SNAT service %q", dst.Mode, svc.GetId())}
+	}
+	if dst.Mode == "nat" || svc.IsFwmark() || dst.Port == svc.Port {
+		return nil
+	}
+	return &ValidationError{"Port", fmt.Sprintf("%s destinations must use the service port %d", dst.Mode, svc.Port)}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
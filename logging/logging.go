@@ -0,0 +1,50 @@
+// Package logging configures the logger shared by every fusis component,
+// the standard logrus one, so that its level and format apply everywhere.
+package logging
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Formats lists the output formats a logger may use.
+var Formats = []string{"text", "json"}
+
+// Logger returns the logger shared by every fusis component.
+func Logger() *logrus.Logger {
+	return logrus.StandardLogger()
+}
+
+// Configure sets the level, like "info" or "debug", and the format, one of
+// Formats, of the shared logger.
+func Configure(level, format string) error {
+	if err := SetLevel(level); err != nil {
+		return err
+	}
+
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %q, expected one of %v", format, Formats)
+	}
+	return nil
+}
+
+// SetLevel changes the level of the shared logger, at any time.
+func SetLevel(level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
+	return nil
+}
+
+// Level returns the level of the shared logger.
+func Level() string {
+	return logrus.GetLevel().String()
+}
@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/check.v1"
+)
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+func (s *S) TearDownTest(c *check.C) {
+	logrus.SetOutput(os.Stderr)
+	Configure("info", "text")
+}
+
+func (s *S) TestConfigureJSON(c *check.C) {
+	var out bytes.Buffer
+	logrus.SetOutput(&out)
+	c.Assert(Configure("debug", "json"), check.IsNil)
+	c.Assert(Level(), check.Equals, "debug")
+
+	Logger().WithField("service", "svc1").Debug("applied")
+	var entry map[string]interface{}
+	c.Assert(json.Unmarshal(out.Bytes(), &entry), check.IsNil)
+	c.Assert(entry["level"], check.Equals, "debug")
+	c.Assert(entry["msg"], check.Equals, "applied")
+	c.Assert(entry["service"], check.Equals, "svc1")
+}
+
+func (s *S) TestSetLevel(c *check.C) {
+	var out bytes.Buffer
+	logrus.SetOutput(&out)
+	c.Assert(SetLevel("warning"), check.IsNil)
+	Logger().Info("dropped")
+	c.Assert(out.Len(), check.Equals, 0)
+
+	c.Assert(SetLevel("loud"), check.NotNil)
+	c.Assert(Level(), check.Equals, "warning")
+}
+
+func (s *S) TestConfigureInvalidFormat(c *check.C) {
+	c.Assert(Configure("info", "xml"), check.ErrorMatches, `invalid log format "xml", expected one of \[text json\]`)
+}
@@ -0,0 +1,268 @@
+// Package metrics publishes the balancer metrics in the Prometheus text
+// exposition format. IPVS counters are read live on every scrape, while API
+// requests and health checks are counted as they happen.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+// contentType is the content type of the text exposition format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DurationBuckets are the upper bounds, in seconds, of the API request
+// duration histogram.
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Source reads the services and their IPVS counters, like *fusis.Balancer.
+type Source interface {
+	GetServices() *[]ipvs.Service
+	GetServiceStats(name string) (*ipvs.ServiceStats, error)
+	GetDestinationStats(dst *ipvs.Destination) (*ipvs.DestinationStats, error)
+}
+
+type requestKey struct {
+	method, route string
+	status        int
+}
+
+type durationKey struct {
+	method, route string
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type checkKey struct {
+	service, destination, result string
+}
+
+var (
+	lock      sync.Mutex
+	requests  = make(map[requestKey]uint64)
+	durations = make(map[durationKey]*histogram)
+	checks    = make(map[checkKey]uint64)
+)
+
+// ObserveRequest counts an API request to route, the pattern of the path
+// served, so that paths with ids don't explode the number of series.
+func ObserveRequest(method, route string, status int, duration time.Duration) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	requests[requestKey{method, route, status}]++
+
+	key := durationKey{method, route}
+	h, ok := durations[key]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(DurationBuckets))}
+		durations[key] = h
+	}
+	seconds := duration.Seconds()
+	for i, le := range DurationBuckets {
+		if seconds <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// ObserveHealthCheck counts the outcome of a health check of dst.
+func ObserveHealthCheck(dst ipvs.Destination, healthy bool) {
+	result := "failure"
+	if healthy {
+		result = "success"
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	checks[checkKey{dst.ServiceId, dst.Address(), result}]++
+}
+
+// Handler serves the metrics, reading the IPVS counters from source.
+func Handler(source Source) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		Write(w, source)
+	})
+}
+
+// Write writes the metrics to w, reading the IPVS counters from source.
+func Write(w io.Writer, source Source) {
+	p := &printer{w: w}
+	writeIPVS(p, source)
+	writeRequests(p)
+	writeChecks(p)
+}
+
+func writeIPVS(p *printer, source Source) {
+	services := *source.GetServices()
+	sort.Slice(services, func(i, j int) bool { return services[i].GetId() < services[j].GetId() })
+
+	svcFamilies := newFamilies("fusis_service", "service")
+	dstFamilies := newFamilies("fusis_destination", "destination")
+	for _, svc := range services {
+		if stats, err := source.GetServiceStats(svc.GetId()); err == nil {
+			svcFamilies.add(labels{"service", svc.GetId()}, uint64(stats.ActiveConns), uint64(stats.InactiveConns),
+				uint64(stats.Connections), uint64(stats.PacketsIn), uint64(stats.PacketsOut), stats.BytesIn, stats.BytesOut)
+		}
+
+		sort.Slice(svc.Destinations, func(i, j int) bool { return svc.Destinations[i].Address() < svc.Destinations[j].Address() })
+		for i := range svc.Destinations {
+			dst := &svc.Destinations[i]
+			if stats, err := source.GetDestinationStats(dst); err == nil {
+				dstFamilies.add(labels{"service", svc.GetId(), "destination", dst.Address()}, uint64(stats.ActiveConns), uint64(stats.InactiveConns),
+					uint64(stats.Connections), uint64(stats.PacketsIn), uint64(stats.PacketsOut), stats.BytesIn, stats.BytesOut)
+			}
+		}
+	}
+	svcFamilies.write(p)
+	dstFamilies.write(p)
+}
+
+func writeRequests(p *printer) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	keys := make([]requestKey, 0, len(requests))
+	for k := range requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	p.header("fusis_api_requests_total", "API requests served.", "counter")
+	for _, k := range keys {
+		p.sample("fusis_api_requests_total", labels{"method", k.method, "route", k.route, "status", strconv.Itoa(k.status)}, float64(requests[k]))
+	}
+
+	dkeys := make([]durationKey, 0, len(durations))
+	for k := range durations {
+		dkeys = append(dkeys, k)
+	}
+	sort.Slice(dkeys, func(i, j int) bool {
+		if dkeys[i].route != dkeys[j].route {
+			return dkeys[i].route < dkeys[j].route
+		}
+		return dkeys[i].method < dkeys[j].method
+	})
+	p.header("fusis_api_request_duration_seconds", "API request durations.", "histogram")
+	for _, k := range dkeys {
+		h := durations[k]
+		for i, le := range DurationBuckets {
+			p.sample("fusis_api_request_duration_seconds_bucket",
+				labels{"method", k.method, "route", k.route, "le", strconv.FormatFloat(le, 'g', -1, 64)}, float64(h.buckets[i]))
+		}
+		p.sample("fusis_api_request_duration_seconds_bucket", labels{"method", k.method, "route", k.route, "le", "+Inf"}, float64(h.count))
+		p.sample("fusis_api_request_duration_seconds_sum", labels{"method", k.method, "route", k.route}, h.sum)
+		p.sample("fusis_api_request_duration_seconds_count", labels{"method", k.method, "route", k.route}, float64(h.count))
+	}
+}
+
+func writeChecks(p *printer) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	keys := make([]checkKey, 0, len(checks))
+	for k := range checks {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		if a.destination != b.destination {
+			return a.destination < b.destination
+		}
+		return a.result < b.result
+	})
+	p.header("fusis_health_checks_total", "Active health checks run, by result.", "counter")
+	for _, k := range keys {
+		p.sample("fusis_health_checks_total", labels{"service", k.service, "destination", k.destination, "result", k.result}, float64(checks[k]))
+	}
+}
+
+// families collects the IPVS counters of services or destinations, which are
+// written grouped by metric.
+type families struct {
+	prefix, kind string
+	samples      [7][]sample
+}
+
+type sample struct {
+	labels labels
+	value  uint64
+}
+
+var ipvsMetrics = [7]struct{ name, help, typ string }{
+	{"active_connections", "Active connections of the %s.", "gauge"},
+	{"inactive_connections", "Inactive connections of the %s.", "gauge"},
+	{"connections_total", "Connections forwarded to the %s.", "counter"},
+	{"packets_in_total", "Incoming packets of the %s.", "counter"},
+	{"packets_out_total", "Outgoing packets of the %s.", "counter"},
+	{"bytes_in_total", "Incoming bytes of the %s.", "counter"},
+	{"bytes_out_total", "Outgoing bytes of the %s.", "counter"},
+}
+
+func newFamilies(prefix, kind string) *families {
+	return &families{prefix: prefix, kind: kind}
+}
+
+func (f *families) add(l labels, values ...uint64) {
+	for i, v := range values {
+		f.samples[i] = append(f.samples[i], sample{l, v})
+	}
+}
+
+func (f *families) write(p *printer) {
+	for i, m := range ipvsMetrics {
+		name := f.prefix + "_" + m.name
+		p.header(name, fmt.Sprintf(m.help, f.kind), m.typ)
+		for _, s := range f.samples[i] {
+			p.sample(name, s.labels, float64(s.value))
+		}
+	}
+}
+
+// labels alternates label names and values.
+type labels []string
+
+type printer struct {
+	w io.Writer
+}
+
+func (p *printer) header(name, help, typ string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *printer) sample(name string, l labels, value float64) {
+	pairs := make([]string, 0, len(l)/2)
+	for i := 0; i+1 < len(l); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l[i], labelEscaper.Replace(l[i+1])))
+	}
+	fmt.Fprintf(p.w, "%s{%s} %s\n", name, strings.Join(pairs, ","), strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// labelEscaper escapes label values as the exposition format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/luizbafilho/fusis/ipvs"
+	"gopkg.in/check.v1"
+)
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+// fakeSource serves fixed counters, counting how often they are read.
+type fakeSource struct {
+	services []ipvs.Service
+	reads    int
+}
+
+func (f *fakeSource) GetServices() *[]ipvs.Service {
+	services := append([]ipvs.Service{}, f.services...)
+	return &services
+}
+
+func (f *fakeSource) GetServiceStats(name string) (*ipvs.ServiceStats, error) {
+	f.reads++
+	if name != "svc1" {
+		return nil, ipvs.ErrNotFound
+	}
+	return &ipvs.ServiceStats{ActiveConns: uint32(f.reads), Connections: 10, BytesIn: 1 << 40}, nil
+}
+
+func (f *fakeSource) GetDestinationStats(dst *ipvs.Destination) (*ipvs.DestinationStats, error) {
+	return &ipvs.DestinationStats{ActiveConns: 2, InactiveConns: 1, PacketsOut: 7}, nil
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{services: []ipvs.Service{{
+		Name: "svc1",
+		Destinations: []ipvs.Destination{
+			{Name: "dst1", Host: "10.0.1.1", Port: 8080, ServiceId: "svc1"},
+			{Name: "dst2", Host: "2001:db8::1", Port: 8080, ServiceId: "svc1"},
+		},
+	}}}
+}
+
+func (s *S) TestHandlerReadsIPVSLive(c *check.C) {
+	source := newFakeSource()
+	srv := httptest.NewServer(Handler(source))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.Header.Get("Content-Type"), check.Equals, contentType)
+
+	var out bytes.Buffer
+	Write(&out, source)
+	c.Assert(out.String(), check.Matches, `(?s).*# TYPE fusis_service_active_connections gauge\nfusis_service_active_connections\{service="svc1"\} 2\n.*`)
+	c.Assert(out.String(), check.Matches, `(?s).*fusis_service_bytes_in_total\{service="svc1"\} 1099511627776\n.*`)
+	c.Assert(out.String(), check.Matches, `(?s).*fusis_destination_active_connections\{service="svc1",destination="10.0.1.1:8080"\} 2\n.*`)
+	c.Assert(out.String(), check.Matches, `(?s).*fusis_destination_packets_out_total\{service="svc1",destination="\[2001:db8::1\]:8080"\} 7\n.*`)
+}
+
+func (s *S) TestObserveRequest(c *check.C) {
+	ObserveRequest("GET", "/services/:service_id", 200, 20*time.Millisecond)
+	ObserveRequest("GET", "/services/:service_id", 200, 3*time.Second)
+	ObserveRequest("GET", "/services/:service_id", 404, time.Millisecond)
+
+	var out bytes.Buffer
+	Write(&out, &fakeSource{})
+	c.Assert(out.String(), check.Matches, `(?s).*fusis_api_requests_total\{method="GET",route="/services/:service_id",status="200"\} 2\n.*`)
+	c.Assert(out.String(), check.Matches, `(?s).*fusis_api_request_duration_seconds_bucket\{method="GET",route="/services/:service_id",le="0.025"\} 2\n.*`)
+	c.Assert(out.String(), check.Matches, `(?s).*fusis_api_request_duration_seconds_bucket\{method="GET",route="/services/:service_id",le="\+Inf"\} 3\n.*`)
+	c.Assert(out.String(), check.Matches, `(?s).*fusis_api_request_duration_seconds_count\{method="GET",route="/services/:service_id"\} 3\n.*`)
+}
+
+func (s *S) TestObserveHealthCheck(c *check.C) {
+	dst := ipvs.Destination{Name: "dst1", Host: "10.0.1.1", Port: 8080, ServiceId: "svc\"2"}
+	ObserveHealthCheck(dst, true)
+	ObserveHealthCheck(dst, false)
+	ObserveHealthCheck(dst, false)
+
+	var out bytes.Buffer
+	Write(&out, &fakeSource{})
+	c.Assert(out.String(), check.Matches, `(?s).*fusis_health_checks_total\{service="svc\\"2",destination="10.0.1.1:8080",result="failure"\} 2\n.*`)
+	c.Assert(out.String(), check.Matches, `(?s).*fusis_health_checks_total\{service="svc\\"2",destination="10.0.1.1:8080",result="success"\} 1\n.*`)
+}
@@ -1,54 +1,103 @@
 package none
 
 import (
+	"net"
+	"sync"
+
 	"github.com/luizbafilho/fusis/ipvs"
-	"github.com/mikioh/ipaddr"
+	"github.com/luizbafilho/fusis/provider"
 )
 
+// Ipam allocates VIPs from a pool. The VIPs of the services in the state
+// are never allocated, so the allocations survive restarts along with the
+// state they are restored from.
 type Ipam struct {
-	rangeCursor *ipaddr.Cursor
-	state       ipvs.State
+	sync.Mutex
+	pool  *net.IPNet
+	state ipvs.State
+	// reserved holds the VIPs allocated and not released yet, including
+	// the ones of services not applied to the state yet.
+	reserved map[string]bool
 }
 
 //Init initilizes ipam module
 func NewIpam(iprange string, state ipvs.State) (*Ipam, error) {
-	// var err error
-	rangeCursor, err := ipaddr.Parse(iprange)
+	_, pool, err := net.ParseCIDR(iprange)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Ipam{rangeCursor, state}, nil
+	return &Ipam{pool: pool, state: state, reserved: make(map[string]bool)}, nil
 }
 
 //Allocate allocates a new avaliable ip
 func (i *Ipam) Allocate() (string, error) {
-	for pos := i.rangeCursor.Next(); pos != nil; pos = i.rangeCursor.Next() {
-		assigned, err := i.ipIsAssigned(pos.IP.String())
-		if err != nil {
-			return "", err
+	i.Lock()
+	defer i.Unlock()
+
+	used := make(map[string]bool)
+	for _, svc := range *i.state.GetServices() {
+		if ip := svc.IP(); ip != nil {
+			used[ip.String()] = true
 		}
+	}
 
-		if !assigned {
-			i.rangeCursor.Set(i.rangeCursor.First())
-			return pos.IP.String(), nil
+	first := i.pool.IP
+	if ones, bits := i.pool.Mask.Size(); bits-ones >= 2 {
+		// The network address is never allocated
+		first = next(first)
+	}
+	for ip := first; i.pool.Contains(ip); ip = next(ip) {
+		if i.isBroadcast(ip) {
+			break
+		}
+		if vip := ip.String(); !used[vip] && !i.reserved[vip] {
+			i.reserved[vip] = true
+			return vip, nil
 		}
 	}
 
-	return "", nil
+	return "", provider.ErrPoolExhausted
 }
 
 //Release releases a allocated IP
-func (i *Ipam) Release(allocIP string) {}
+func (i *Ipam) Release(allocIP string) {
+	i.Lock()
+	defer i.Unlock()
 
-func (i *Ipam) ipIsAssigned(e string) (bool, error) {
-	services := i.state.GetServices()
+	if ip := net.ParseIP(allocIP); ip != nil {
+		delete(i.reserved, ip.String())
+	}
+}
 
-	for _, a := range *services {
-		if a.Host == e {
-			return true, nil
+// isBroadcast tells if ip is the broadcast address of an IPv4 pool, which
+// is never allocated like the network address.
+func (i *Ipam) isBroadcast(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	ones, bits := i.pool.Mask.Size()
+	if bits-ones < 2 {
+		return false
+	}
+	for b := range ip4 {
+		if ip4[b]|i.pool.Mask[len(i.pool.Mask)-4+b] != 0xff {
+			return false
 		}
+	}
+	return true
+}
 
+// next returns the address following ip.
+func next(ip net.IP) net.IP {
+	n := make(net.IP, len(ip))
+	copy(n, ip)
+	for b := len(n) - 1; b >= 0; b-- {
+		n[b]++
+		if n[b] != 0 {
+			break
+		}
 	}
-	return false, nil
+	return n
 }
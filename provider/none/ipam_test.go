@@ -1,11 +1,10 @@
 package none
 
 import (
-	"os"
 	"testing"
 
-	"github.com/asdine/storm"
 	"github.com/luizbafilho/fusis/ipvs"
+	"github.com/luizbafilho/fusis/provider"
 
 	. "gopkg.in/check.v1"
 )
@@ -13,49 +12,83 @@ import (
 func Test(t *testing.T) { TestingT(t) }
 
 type IpamSuite struct {
-	db *storm.DB
+	state *ipvs.FusisState
+	ipam  *Ipam
 }
 
 var _ = Suite(&IpamSuite{})
 
-func (s *IpamSuite) SetUpSuite(c *C) {
-	s.db, _ = db.New("fusis_test.db")
-
-	ipvs.InitStore(s.db)
-
-	if err := Init("192.168.0.0/28"); err != nil {
-		panic(err)
-	}
-}
-
-func (s *IpamSuite) TearDownSuite(c *C) {
-	os.Remove("fusis_test.db")
+func (s *IpamSuite) SetUpTest(c *C) {
+	var err error
+	s.state = ipvs.NewFusisState()
+	s.ipam, err = NewIpam("192.168.0.0/29", s.state)
+	c.Assert(err, IsNil)
 }
 
 func (s *IpamSuite) TestIpAllocation(c *C) {
 	service := &ipvs.Service{
-		Id:   "test",
+		Name: "test",
 		Host: "192.168.0.1",
 	}
-	s.db.Save(service)
+	s.state.AddService(service)
 
-	ip, err := Allocate()
+	ip, err := s.ipam.Allocate()
 	c.Assert(err, IsNil)
 	c.Assert(ip, DeepEquals, "192.168.0.2")
 
 	service = &ipvs.Service{
-		Id:   "test2",
-		Host: "192.168.0.2",
+		Name: "test2",
+		Host: ip,
 	}
-	s.db.Save(service)
+	s.state.AddService(service)
 
-	ip, err = Allocate()
+	ip, err = s.ipam.Allocate()
 	c.Assert(err, IsNil)
 	c.Assert(ip, DeepEquals, "192.168.0.3")
 
-	s.db.Remove(service)
+	s.state.DeleteService(service)
+	s.ipam.Release(service.Host)
 
-	ip, err = Allocate()
+	ip, err = s.ipam.Allocate()
 	c.Assert(err, IsNil)
 	c.Assert(ip, DeepEquals, "192.168.0.2")
 }
+
+func (s *IpamSuite) TestIpAllocationReservesUnappliedVips(c *C) {
+	// VIPs allocated together, before any service is applied, differ
+	first, err := s.ipam.Allocate()
+	c.Assert(err, IsNil)
+	second, err := s.ipam.Allocate()
+	c.Assert(err, IsNil)
+	c.Assert(first, Not(Equals), second)
+}
+
+func (s *IpamSuite) TestIpAllocationExhausted(c *C) {
+	// The network and broadcast addresses are never allocated
+	for _, want := range []string{"192.168.0.1", "192.168.0.2", "192.168.0.3", "192.168.0.4", "192.168.0.5", "192.168.0.6"} {
+		ip, err := s.ipam.Allocate()
+		c.Assert(err, IsNil)
+		c.Assert(ip, Equals, want)
+	}
+	_, err := s.ipam.Allocate()
+	c.Assert(err, Equals, provider.ErrPoolExhausted)
+}
+
+func (s *IpamSuite) TestIpAllocationSurvivesRestart(c *C) {
+	s.state.AddService(&ipvs.Service{Name: "test", Host: "192.168.0.1"})
+
+	// A new allocator, as after a restart, skips the VIPs of the state
+	ipam, err := NewIpam("192.168.0.0/29", s.state)
+	c.Assert(err, IsNil)
+	ip, err := ipam.Allocate()
+	c.Assert(err, IsNil)
+	c.Assert(ip, Equals, "192.168.0.2")
+}
+
+func (s *IpamSuite) TestIpAllocationIPv6(c *C) {
+	ipam, err := NewIpam("2001:db8::/126", s.state)
+	c.Assert(err, IsNil)
+	ip, err := ipam.Allocate()
+	c.Assert(err, IsNil)
+	c.Assert(ip, Equals, "2001:db8::1")
+}
@@ -1,6 +1,8 @@
 package none
 
 import (
+	"fmt"
+
 	"github.com/luizbafilho/fusis/config"
 	"github.com/luizbafilho/fusis/ipvs"
 	"github.com/luizbafilho/fusis/net"
@@ -25,7 +27,12 @@ func new() provider.Provider {
 	}
 }
 
+// Initialize sets up the VIP pool when a vipRange is configured. Without it,
+// every service must be created with a Host.
 func (n *None) Initialize(state ipvs.State) error {
+	if n.VipRange == "" {
+		return nil
+	}
 	i, err := NewIpam(n.VipRange, state)
 	if err != nil {
 		return err
@@ -37,6 +44,9 @@ func (n *None) Initialize(state ipvs.State) error {
 }
 
 func (n None) AllocateVIP(s *ipvs.Service) error {
+	if n.ipam == nil {
+		return provider.ErrNoVIPPool
+	}
 	ip, err := n.ipam.Allocate()
 	if err != nil {
 		return err
@@ -47,14 +57,22 @@ func (n None) AllocateVIP(s *ipvs.Service) error {
 }
 
 func (n None) ReleaseVIP(s ipvs.Service) error {
+	if n.ipam == nil {
+		return nil
+	}
 	n.ipam.Release(s.Host)
 	return nil
 }
 
 func (n None) AssignVIP(s ipvs.Service) error {
-	return net.AddIp(s.Host+"/32", config.Balancer.Provider.Params["interface"])
+	return net.AddIp(hostAddr(s), config.Balancer.Provider.Params["interface"])
 }
 
 func (n None) UnassignVIP(s ipvs.Service) error {
-	return net.DelIp(s.Host+"/32", config.Balancer.Provider.Params["interface"])
+	return net.DelIp(hostAddr(s), config.Balancer.Provider.Params["interface"])
+}
+
+// hostAddr returns the VIP of s as a single host CIDR of its address family.
+func hostAddr(s ipvs.Service) string {
+	return fmt.Sprintf("%s/%d", s.IP(), s.AddressFamily().PrefixLen())
 }
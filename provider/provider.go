@@ -20,6 +20,12 @@ type InitializableProvider interface {
 
 var ErrProviderNotRegistered = errors.New("Provider not registered")
 
+// ErrNoVIPPool is returned when allocating a VIP without a pool configured.
+var ErrNoVIPPool = errors.New("Host is required, no VIP pool is configured")
+
+// ErrPoolExhausted is returned when every VIP of the pool is allocated.
+var ErrPoolExhausted = errors.New("VIP pool exhausted")
+
 type providerFactory func() Provider
 
 var providerFactories = make(map[string]providerFactory)
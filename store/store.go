@@ -0,0 +1,83 @@
+// Package store keeps a durable local copy of the services a balancer
+// programs, so a restarting balancer can restore IPVS before it rejoins the
+// cluster.
+package store
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+	"github.com/luizbafilho/fusis/ipvs"
+)
+
+var servicesBucket = []byte("services")
+
+// Store saves services, with their destinations, in a BoltDB file.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens the store at path, creating it if needed.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(servicesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the store file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// SaveService saves svc and its destinations, replacing what was saved
+// before for it.
+func (s *Store) SaveService(svc ipvs.Service) error {
+	data, err := json.Marshal(svc)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(servicesBucket).Put([]byte(svc.GetId()), data)
+	})
+}
+
+// DeleteService removes the service id. Removing a service that was never
+// saved isn't an error.
+func (s *Store) DeleteService(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(servicesBucket).Delete([]byte(id))
+	})
+}
+
+// Load returns every saved service.
+func (s *Store) Load() ([]ipvs.Service, error) {
+	services := []ipvs.Service{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(servicesBucket).ForEach(func(k, v []byte) error {
+			var svc ipvs.Service
+			if err := json.Unmarshal(v, &svc); err != nil {
+				return err
+			}
+			services = append(services, svc)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
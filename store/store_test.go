@@ -0,0 +1,73 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/luizbafilho/fusis/ipvs"
+	"gopkg.in/check.v1"
+)
+
+type S struct {
+	dir string
+}
+
+var _ = check.Suite(&S{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+func (s *S) SetUpTest(c *check.C) {
+	dir, err := ioutil.TempDir("", "fusis-store")
+	c.Assert(err, check.IsNil)
+	s.dir = dir
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	os.RemoveAll(s.dir)
+}
+
+func testService(name string) ipvs.Service {
+	return ipvs.Service{
+		Name:      name,
+		Host:      "10.0.0.1",
+		Port:      80,
+		Protocol:  "tcp",
+		Scheduler: "rr",
+		Destinations: []ipvs.Destination{
+			{Name: "dst1", Host: "10.0.1.1", Port: 8080, Weight: 1, Mode: "nat", ServiceId: name},
+		},
+	}
+}
+
+func (s *S) TestSaveAndLoad(c *check.C) {
+	path := filepath.Join(s.dir, "services.db")
+	st, err := Open(path)
+	c.Assert(err, check.IsNil)
+	svc1, svc2 := testService("svc1"), testService("svc2")
+	c.Assert(st.SaveService(svc1), check.IsNil)
+	c.Assert(st.SaveService(svc2), check.IsNil)
+	svc1.Scheduler = "lc"
+	c.Assert(st.SaveService(svc1), check.IsNil)
+	c.Assert(st.Close(), check.IsNil)
+
+	st, err = Open(path)
+	c.Assert(err, check.IsNil)
+	defer st.Close()
+	services, err := st.Load()
+	c.Assert(err, check.IsNil)
+	c.Assert(services, check.DeepEquals, []ipvs.Service{svc1, svc2})
+}
+
+func (s *S) TestDeleteService(c *check.C) {
+	st, err := Open(filepath.Join(s.dir, "services.db"))
+	c.Assert(err, check.IsNil)
+	defer st.Close()
+	c.Assert(st.SaveService(testService("svc1")), check.IsNil)
+	c.Assert(st.DeleteService("svc1"), check.IsNil)
+	c.Assert(st.DeleteService("unknown"), check.IsNil)
+	services, err := st.Load()
+	c.Assert(err, check.IsNil)
+	c.Assert(services, check.DeepEquals, []ipvs.Service{})
+}